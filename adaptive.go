@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// with --adaptive-ttl the TTL of a key follows how much its last copy was
+// used. a copy served adaptiveHighRatio of the time from the cache or more
+// is kept adaptiveMaxFactor times as long, one served less than
+// adaptiveLowRatio of the time adaptiveMinFactor times as long, where 0
+// stops caching it
+var (
+	adaptiveTTL       bool
+	adaptiveHighRatio float64
+	adaptiveLowRatio  float64
+	adaptiveMaxFactor float64
+	adaptiveMinFactor float64
+)
+
+// usesKey returns the key counting the hits of the copy stored under key.
+// it lives next to the entry's key, so purging the URL resets it
+func usesKey(key string) string {
+	return key + "|uses"
+}
+
+// countUse records a hit on the copy stored under key
+func countUse(ctx context.Context, key string, entry *cache.Entry) {
+	if !adaptiveTTL || !cache.Available() {
+		return
+	}
+	_, err := cache.Backend().Incr(ctx, usesKey(key), time.Until(entry.Expires)+time.Minute)
+	cache.ReportError(ctx, err)
+}
+
+// adaptTTL returns the TTL for a new copy of key, ttl being what it gets
+// otherwise. the hit ratio of the previous copy is its hits over those hits
+// and the miss that stored it. a key stored for the first time gets ttl,
+// and whatever comes out stays within --max-ttl
+func adaptTTL(ctx context.Context, key string, ttl time.Duration) time.Duration {
+	if !adaptiveTTL || ttl <= 0 || !cache.Available() {
+		return ttl
+	}
+	data, err := cache.Backend().Get(ctx, usesKey(key))
+	if err != nil && !errors.Is(err, cache.ErrMiss) {
+		cache.ReportError(ctx, err)
+		return ttl
+	}
+	adapted := ttl
+	if err == nil {
+		uses, _ := strconv.ParseInt(string(data), 10, 64)
+		switch ratio := float64(uses) / float64(uses+1); {
+		case ratio >= adaptiveHighRatio:
+			adapted = time.Duration(float64(ttl) * adaptiveMaxFactor)
+		case ratio < adaptiveLowRatio:
+			adapted = time.Duration(float64(ttl) * adaptiveMinFactor)
+		}
+		if maxTTL > 0 && adapted > maxTTL {
+			adapted = maxTTL
+		}
+	}
+	// the new copy starts counting from zero, even one that isn't cached,
+	// so it gets measured again next time
+	cache.ReportError(ctx, cache.Backend().Set(ctx, usesKey(key), []byte("0"), max(adapted, ttl)+time.Minute))
+	return adapted
+}
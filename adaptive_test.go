@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// useAdaptiveTTL turns on --adaptive-ttl with the default bounds
+func useAdaptiveTTL(t *testing.T) {
+	on, high, low, most, least := adaptiveTTL, adaptiveHighRatio, adaptiveLowRatio, adaptiveMaxFactor, adaptiveMinFactor
+	t.Cleanup(func() {
+		adaptiveTTL, adaptiveHighRatio, adaptiveLowRatio, adaptiveMaxFactor, adaptiveMinFactor = on, high, low, most, least
+	})
+	adaptiveTTL, adaptiveHighRatio, adaptiveLowRatio, adaptiveMaxFactor, adaptiveMinFactor = true, 0.9, 0.5, 4, 0.25
+}
+
+// expireCopy drops the cached copy of path, as its TTL running out would,
+// so the next request stores a new one
+func expireCopy(mr *miniredis.Miniredis, path string) {
+	memCache.Remove(keyFor(path))
+	mr.Del(keyFor(path))
+}
+
+func TestAdaptiveTTLFollowsTheHitRatio(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=100")
+		w.Write([]byte("ok"))
+	})
+	useAdaptiveTTL(t)
+	base := 100 * time.Second
+
+	// nothing is known about a first copy
+	doRequest("GET", "/hot")
+	doRequest("GET", "/cold")
+	if hot, cold := mr.TTL(keyFor("/hot")), mr.TTL(keyFor("/cold")); hot != base || cold != base {
+		t.Fatalf("first copies stored for %v and %v, want %v", hot, cold, base)
+	}
+
+	// /hot is hit 20 times, /cold never
+	for i := 0; i < 20; i++ {
+		if rec := doRequest("GET", "/hot"); rec.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("request %d: X-Cache %q, want HIT", i, rec.Header().Get("X-Cache"))
+		}
+	}
+	expireCopy(mr, "/hot")
+	expireCopy(mr, "/cold")
+	doRequest("GET", "/hot")
+	doRequest("GET", "/cold")
+	if ttl := mr.TTL(keyFor("/hot")); ttl != 4*base {
+		t.Fatalf("often hit key stored for %v, want %v", ttl, 4*base)
+	}
+	if ttl := mr.TTL(keyFor("/cold")); ttl != base/4 {
+		t.Fatalf("never hit key stored for %v, want %v", ttl, base/4)
+	}
+
+	// two hits of three requests is between the bounds
+	doRequest("GET", "/cold")
+	doRequest("GET", "/cold")
+	expireCopy(mr, "/cold")
+	doRequest("GET", "/cold")
+	if ttl := mr.TTL(keyFor("/cold")); ttl != base {
+		t.Fatalf("middling key stored for %v, want %v", ttl, base)
+	}
+}
+
+func TestAdaptiveTTLOfZeroStopsCachingRarelyReusedKeys(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=100")
+		w.Write([]byte("ok"))
+	})
+	useAdaptiveTTL(t)
+	adaptiveMinFactor = 0
+
+	doRequest("GET", "/never")
+	expireCopy(mr, "/never")
+	n := hits.Load()
+	doRequest("GET", "/never")
+	if mr.Exists(keyFor("/never")) {
+		t.Fatal("a key whose last copy was never hit was stored again")
+	}
+	doRequest("GET", "/never")
+	if hits.Load() != n+2 {
+		t.Fatalf("origin hit %d times, want %d", hits.Load()-n, 2)
+	}
+}
+
+func TestAdaptiveTTLBoundsAreChecked(t *testing.T) {
+	for _, tc := range []struct{ flag, want string }{
+		{"--adaptive-ttl-low=0.95", "Error: --adaptive-ttl-low and --adaptive-ttl-high must be ratios from 0 to 1"},
+		{"--adaptive-ttl-high=1.5", "Error: --adaptive-ttl-low and --adaptive-ttl-high must be ratios from 0 to 1"},
+		{"--adaptive-ttl-max=0.5", "Error: --adaptive-ttl-max must be at least 1"},
+		{"--adaptive-ttl-min=2", "Error: --adaptive-ttl-max must be at least 1 and --adaptive-ttl-min from 0 to 1"},
+	} {
+		if out := startupError(t, "--origin=http://origin.test", "--adaptive-ttl", tc.flag); !strings.Contains(out, tc.want) {
+			t.Fatalf("%s: %s", tc.flag, out)
+		}
+	}
+}
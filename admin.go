@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// adminSecretHeader carries the shared secret that unlocks /_admin endpoints
+const adminSecretHeader = "X-Admin-Secret"
+
+// adminAuthorized reports whether r presents the configured admin secret
+// or Basic Auth credentials. the admin endpoints stay locked when neither
+// is configured
+func adminAuthorized(r *http.Request) bool {
+	if adminSecret != "" && secureEqual(r.Header.Get(adminSecretHeader), adminSecret) {
+		return true
+	}
+	if adminUser == "" || adminPass == "" {
+		return false
+	}
+	user, pass, ok := r.BasicAuth()
+	// both are compared so a wrong user takes as long as a wrong password
+	userOK := secureEqual(user, adminUser)
+	passOK := secureEqual(pass, adminPass)
+	return ok && userOK && passOK
+}
+
+// secureEqual compares secrets in constant time
+func secureEqual(given, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(want)) == 1
+}
+
+// requireAdmin lets an authorized admin request through and answers any
+// other one, with a Basic Auth challenge when credentials are configured
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminAuthorized(r) {
+		return true
+	}
+	if adminUser != "" && adminPass != "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// writeJSON sends v as a JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handlePurge evicts cached entries. ?url=<path> removes the entry for one
+// path, ?prefix=<path> removes everything under it and ?tag=<tag> every
+// entry the origin tagged with it in its Surrogate-Key header
+//
+//	DELETE /_admin/cache?url=/users/1
+//	DELETE /_admin/cache?prefix=/users/
+//	DELETE /_admin/cache?tag=product-42
+func handlePurge(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var deleted int64
+	query := r.URL.Query()
+	switch {
+	case query.Get("url") != "":
+		u, err := url.Parse(query.Get("url"))
+		if err != nil {
+			http.Error(w, "invalid url parameter", http.StatusBadRequest)
+			return
+		}
+		deleted, err = purgeURL(r.Context(), u)
+		if err != nil {
+			http.Error(w, "Error purging cache", http.StatusInternalServerError)
+			return
+		}
+	case query.Get("prefix") != "":
+		// hashed keys no longer contain the URL to match against
+		if cache.HashKeys {
+			http.Error(w, "prefix purges are not available with --key-strategy hash", http.StatusBadRequest)
+			return
+		}
+		u := rewriteURL(&url.URL{Path: query.Get("prefix")})
+		prefix := u.EscapedPath()
+		origin, _ := resolveOrigin(prefix)
+		for _, method := range purgedMethods(prefix, true) {
+			key := cacheKey(method, origin, u)
+			memCache.RemovePrefix(key)
+			n, err := cache.Backend().DeletePrefix(r.Context(), key)
+			deleted += n
+			if err != nil {
+				http.Error(w, "Error purging cache", http.StatusInternalServerError)
+				return
+			}
+		}
+	case query.Get("tag") != "":
+		keys, n, err := cache.PurgeTag(r.Context(), query.Get("tag"))
+		deleted = n
+		if err != nil {
+			http.Error(w, "Error purging cache", http.StatusInternalServerError)
+			return
+		}
+		for _, key := range keys {
+			memCache.Remove(key)
+		}
+	default:
+		http.Error(w, "url, prefix or tag parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int64{"deleted": deleted})
+}
+
+// handlePurgeMethod answers PURGE /some/path, the way CDNs are purged, by
+// evicting the entry for that path like DELETE /_admin/cache?url= does
+func handlePurgeMethod(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	deleted, err := purgeURL(r.Context(), r.URL)
+	if err != nil {
+		http.Error(w, "Error purging cache", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"deleted": deleted})
+}
+
+// purgeURL evicts the entries for the client URL u, one per cached
+// method. a varied entry leaves per-variant keys next to the plain key,
+// they have to go too or they become reachable again later
+func purgeURL(ctx context.Context, u *url.URL) (int64, error) {
+	u = rewriteURL(u)
+	origin, _ := resolveOrigin(u.Path)
+	var deleted int64
+	for _, method := range purgedMethods(u.Path, false) {
+		key := cacheKey(method, origin, u)
+		memCache.Remove(key)
+		memCache.RemovePrefix(key + "|")
+		n, err := cache.Backend().Delete(ctx, key)
+		if err != nil {
+			return deleted, err
+		}
+		m, err := cache.Backend().DeletePrefix(ctx, key+"|")
+		deleted += n + m
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// entryInfo is the body of GET /_admin/entry. Body is only filled in on
+// request, base64 encoded like any []byte in JSON since it may be binary
+type entryInfo struct {
+	Key         string      `json:"key"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"headers"`
+	Vary        []string    `json:"vary,omitempty"`
+	StoredAt    time.Time   `json:"stored_at"`
+	Expires     time.Time   `json:"expires"`
+	TTLSeconds  int64       `json:"ttl_seconds"`
+	Size        int         `json:"size"`
+	StoredBytes int         `json:"stored_bytes"`
+	Checksum    string      `json:"checksum"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// handleEntry describes what is cached for a URL without sending the body,
+// unless ?body=true. a varied response is looked up with the headers of
+// the admin request, like a client sending them would get it. ttl_seconds
+// is how long the entry is kept, expires when it goes stale
+//
+//	GET /_admin/entry?url=/users/1
+func handleEntry(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("url") == "" {
+		http.Error(w, "url parameter is required", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil {
+		http.Error(w, "invalid url parameter", http.StatusBadRequest)
+		return
+	}
+	u = rewriteURL(u)
+	origin, _ := resolveOrigin(u.Path)
+	key := cacheKey(http.MethodGet, origin, u)
+
+	data, entry, err := readEntry(r.Context(), key)
+	if err == nil && entry.IsVaryMarker() {
+		key = cache.VariantKey(key, entry.Vary, r.Header)
+		data, entry, err = readEntry(r.Context(), key)
+	}
+	if errors.Is(err, cache.ErrMiss) || (err == nil && entry.IsVaryMarker()) {
+		http.Error(w, "Not cached", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading cache", http.StatusInternalServerError)
+		return
+	}
+
+	info := entryInfo{
+		Key:         key,
+		Status:      entry.Status,
+		Header:      entry.Header,
+		Vary:        entry.Vary,
+		StoredAt:    entry.Stored,
+		Expires:     entry.Expires,
+		Size:        len(entry.Body),
+		StoredBytes: len(data),
+		Checksum:    entry.Checksum,
+	}
+	if ttl, ok := storedTTL(r.Context(), key); ok {
+		info.TTLSeconds = int64(ttl.Seconds())
+	}
+	if r.URL.Query().Get("body") == "true" {
+		info.Body = entry.Body
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// readEntry fetches and decodes key straight from the cache backend, so
+// looking at an entry neither counts as a use nor fills the in-memory tier
+func readEntry(ctx context.Context, key string) ([]byte, *cache.Entry, error) {
+	data, err := cache.Backend().Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, err := cache.UnmarshalEntry(data)
+	return data, entry, err
+}
+
+// warmConcurrency bounds how many origin fetches one warm-up runs at once
+const warmConcurrency = 4
+
+// warmResult reports what happened to one path of a warm-up
+type warmResult struct {
+	Path   string `json:"path"`
+	Status int    `json:"status,omitempty"`
+	Cached bool   `json:"cached"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleWarm fetches a JSON array of paths from the origin and caches them,
+// e.g. after a deploy so the first users don't all find the cache cold
+//
+//	POST /_admin/warm ["/users/1", "/products?page=1"]
+func handleWarm(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var paths []string
+	if err := json.NewDecoder(r.Body).Decode(&paths); err != nil {
+		http.Error(w, "body must be a JSON array of paths", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]warmResult, len(paths))
+	sem := make(chan struct{}, warmConcurrency)
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = warmPath(r, path)
+		}()
+	}
+	wg.Wait()
+	writeJSON(w, http.StatusOK, results)
+}
+
+// warmPath fetches path from its origin and stores it like a GET miss would
+func warmPath(r *http.Request, path string) warmResult {
+	result := warmResult{Path: path}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, path, nil)
+	if err != nil || !strings.HasPrefix(req.URL.Path, "/") {
+		result.Error = "invalid path"
+		return result
+	}
+	u, err := checkPath(req.URL)
+	if err != nil {
+		result.Error = "invalid path"
+		return result
+	}
+	req.URL = rewriteURL(u)
+	if matchAny(noCachePaths, req.URL.Path) {
+		result.Error = "path bypasses the cache"
+		return result
+	}
+	origin, ok := resolveOrigin(req.URL.Path)
+	if !ok {
+		result.Error = "no origin configured for this path"
+		return result
+	}
+
+	targetURL := joinOrigin(origin, requestTarget(req))
+	key := requestKey(req, origin, nil)
+	shared, err, _ := coalesce(req.Context(), key, func(ctx context.Context) (interface{}, error) {
+		return fetchAndStore(ctx, discardResponse{}, req, targetURL, key, nil)
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if res := shared.(*originResult); res.entry != nil {
+		result.Status = res.entry.Status
+		result.Cached = res.stored
+	} else {
+		result.Error = "response too large to cache"
+	}
+	return result
+}
+
+// handleVersion returns the --cache-version embedded in cache keys
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"version": cache.Version})
+}
+
+// statsResponse is the body of GET /_admin/stats
+type statsResponse struct {
+	Hits          uint64  `json:"hits"`
+	Misses        uint64  `json:"misses"`
+	Errors        uint64  `json:"errors"`
+	HitRatio      float64 `json:"hit_ratio"`
+	RedisKeys     int64   `json:"redis_keys"`
+	UptimeSeconds int64   `json:"uptime_seconds"`
+
+	// with --compress-cache, how well the bodies stored since startup
+	// compressed
+	CompressionRatio      float64 `json:"compression_ratio"`
+	CompressionSavedBytes int64   `json:"compression_saved_bytes"`
+}
+
+// handleStats returns a JSON snapshot of the cache counters. redis_keys is
+// -1 when Redis can't be asked
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	counts := stats.Snapshot()
+	resp := statsResponse{
+		Hits:          counts.Hits,
+		Misses:        counts.Misses,
+		Errors:        counts.Errors,
+		HitRatio:      counts.HitRatio(),
+		RedisKeys:     -1,
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+	}
+	compression := cache.Compression()
+	resp.CompressionRatio = compression.Ratio()
+	resp.CompressionSavedBytes = compression.SavedBytes()
+	if n, err := cache.Backend().Len(r.Context()); err == nil {
+		resp.RedisKeys = n
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// topKey is one entry of GET /_admin/top. ttl_seconds is how long the
+// entry under key is kept, 0 when nothing is cached under it right now
+type topKey struct {
+	Key        string `json:"key"`
+	Hits       int64  `json:"hits"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+}
+
+// defaultTopKeys is how many keys GET /_admin/top lists without ?n=
+const defaultTopKeys = 20
+
+// handleTop lists the most requested keys with --top-keys, busiest first.
+// DELETE starts the counts over
+//
+//	GET /_admin/top?n=20
+//	DELETE /_admin/top
+func handleTop(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		if err := cache.ResetTopKeys(r.Context()); err != nil {
+			http.Error(w, "Error resetting top keys", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := int64(defaultTopKeys)
+	if value := r.URL.Query().Get("n"); value != "" {
+		var err error
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil || n < 1 {
+			http.Error(w, "n must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	counts, err := cache.TopKeys(r.Context(), n)
+	if err != nil {
+		http.Error(w, "Error reading top keys", http.StatusInternalServerError)
+		return
+	}
+	keys := make([]topKey, len(counts))
+	for i, c := range counts {
+		keys[i] = topKey{Key: c.Key, Hits: c.Count}
+		if ttl, ok := storedTTL(r.Context(), c.Key); ok {
+			keys[i].TTLSeconds = int64(ttl.Seconds())
+		}
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// testAdminSecret is the --admin-secret the admin tests run with
+const testAdminSecret = "test-secret"
+
+// adminRequest sends an admin request to handler with the admin secret
+func adminRequest(t *testing.T, handler http.HandlerFunc, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	return adminRequestBody(t, handler, method, target, "")
+}
+
+// adminRequestBody is adminRequest with a request body
+func adminRequestBody(t *testing.T, handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	adminSecret = testAdminSecret
+	t.Cleanup(func() { adminSecret = "" })
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set(adminSecretHeader, testAdminSecret)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// deletedCount returns the count of a purge response
+func deletedCount(t *testing.T, rec *httptest.ResponseRecorder) int64 {
+	t.Helper()
+	var body struct {
+		Deleted int64 `json:"deleted"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &body) != nil {
+		t.Fatalf("purge answered %d %q", rec.Code, rec.Body.String())
+	}
+	return body.Deleted
+}
+
+func TestPurgeURL(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("x")) })
+	doRequest("GET", "/users/1")
+	doRequest("GET", "/users/2")
+	rec := adminRequest(t, handlePurge, "DELETE", "/_admin/cache?url=/users/1")
+	if n := deletedCount(t, rec); n != 1 {
+		t.Fatalf("deleted %d", n)
+	}
+	if mr.Exists(keyFor("/users/1")) || !mr.Exists(keyFor("/users/2")) {
+		t.Fatalf("keys left %v", mr.Keys())
+	}
+	if doRequest("GET", "/users/1").Header().Get("X-Cache") != "MISS" {
+		t.Fatal("purged entry still served")
+	}
+}
+
+func TestPurgePrefix(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("x")) })
+	doRequest("GET", "/users/1")
+	doRequest("GET", "/users/2?tab=posts")
+	doRequest("GET", "/teams/1")
+	rec := adminRequest(t, handlePurge, "DELETE", "/_admin/cache?prefix=/users/")
+	if n := deletedCount(t, rec); n != 2 {
+		t.Fatalf("deleted %d", n)
+	}
+	if len(mr.Keys()) != 1 || !mr.Exists(keyFor("/teams/1")) {
+		t.Fatalf("keys left %v", mr.Keys())
+	}
+}
+
+func TestPurgeNeedsTheSecret(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("x")) })
+	doRequest("GET", "/users/1")
+	adminSecret = testAdminSecret
+	defer func() { adminSecret = "" }()
+	for _, secret := range []string{"", "wrong"} {
+		r := httptest.NewRequest("DELETE", "/_admin/cache?url=/users/1", nil)
+		if secret != "" {
+			r.Header.Set(adminSecretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		handlePurge(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("secret %q: %d", secret, w.Code)
+		}
+	}
+	if !mr.Exists(keyFor("/users/1")) {
+		t.Fatal("purged without the secret")
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+	before := stats.Snapshot()
+	doRequest("GET", "/s")
+	doRequest("GET", "/s")
+	doRequest("GET", "/s")
+
+	rec := adminRequest(t, handleStats, "GET", "/_admin/stats")
+	var body map[string]any
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &body) != nil {
+		t.Fatalf("stats answered %d %q", rec.Code, rec.Body.String())
+	}
+	for _, field := range []string{"hits", "misses", "errors", "hit_ratio", "redis_keys", "uptime_seconds"} {
+		if _, ok := body[field]; !ok {
+			t.Errorf("no %s in %s", field, rec.Body.String())
+		}
+	}
+	var resp statsResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Hits-before.Hits != 2 || resp.Misses-before.Misses != 1 {
+		t.Fatalf("counted %d hits and %d misses since %+v", resp.Hits, resp.Misses, before)
+	}
+	if want := float64(resp.Hits) / float64(resp.Hits+resp.Misses); resp.HitRatio != want {
+		t.Fatalf("hit ratio %v, want %v", resp.HitRatio, want)
+	}
+	if resp.RedisKeys != 1 {
+		t.Fatalf("redis_keys %d", resp.RedisKeys)
+	}
+}
+
+func TestStatsAndMetricsAgree(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+	doRequest("GET", "/agree")
+	doRequest("GET", "/agree")
+
+	var resp statsResponse
+	json.Unmarshal(adminRequest(t, handleStats, "GET", "/_admin/stats").Body.Bytes(), &resp)
+	samples := scrape(t)
+	if samples["cache_hits_total"] != float64(resp.Hits) || samples["cache_misses_total"] != float64(resp.Misses) {
+		t.Fatalf("/metrics has %v hits and %v misses, /_admin/stats %d and %d",
+			samples["cache_hits_total"], samples["cache_misses_total"], resp.Hits, resp.Misses)
+	}
+}
+
+func TestStatsNeedsTheSecret(t *testing.T) {
+	adminSecret = testAdminSecret
+	defer func() { adminSecret = "" }()
+	rec := httptest.NewRecorder()
+	handleStats(rec, httptest.NewRequest("GET", "/_admin/stats", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("stats without the secret got %d", rec.Code)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	})
+	rec := adminRequestBody(t, handleWarm, "POST", "/_admin/warm", `["/a", "/b?x=1", "/broken", "no-slash"]`)
+	var results []warmResult
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &results) != nil {
+		t.Fatalf("warm answered %d %q", rec.Code, rec.Body.String())
+	}
+	want := []warmResult{
+		{Path: "/a", Status: 200, Cached: true},
+		{Path: "/b?x=1", Status: 200, Cached: true},
+		{Path: "/broken", Status: 500},
+		{Path: "no-slash", Error: "invalid path"},
+	}
+	for i := range want {
+		if i >= len(results) || results[i] != want[i] {
+			t.Fatalf("report %+v, want %+v", results, want)
+		}
+	}
+	if !mr.Exists(keyFor("/a")) || !mr.Exists(keyFor("/b?x=1")) || len(mr.Keys()) != 2 {
+		t.Fatalf("keys %v", mr.Keys())
+	}
+	if rec := doRequest("GET", "/b?x=1"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatal("warmed path not served from the cache")
+	}
+}
+
+func TestWarmConcurrencyIsBounded(t *testing.T) {
+	var running, most atomic.Int64
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("x"))
+	})
+	paths, _ := json.Marshal([]string{"/1", "/2", "/3", "/4", "/5", "/6", "/7", "/8", "/9", "/10"})
+	if rec := adminRequestBody(t, handleWarm, "POST", "/_admin/warm", string(paths)); rec.Code != http.StatusOK {
+		t.Fatalf("warm answered %d", rec.Code)
+	}
+	if most.Load() > warmConcurrency {
+		t.Fatalf("%d fetches at once, want at most %d", most.Load(), warmConcurrency)
+	}
+}
+
+func TestWarmNeedsTheSecret(t *testing.T) {
+	adminSecret = testAdminSecret
+	defer func() { adminSecret = "" }()
+	rec := httptest.NewRecorder()
+	handleWarm(rec, httptest.NewRequest("POST", "/_admin/warm", strings.NewReader(`["/a"]`)))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("warm without the secret got %d", rec.Code)
+	}
+}
+
+func TestAdminBasicAuth(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	adminUser, adminPass = "ops", "pw"
+	defer func() { adminUser, adminPass = "", "" }()
+	for _, tc := range []struct {
+		name       string
+		user, pass string
+		set        bool
+		want       int
+	}{
+		{"right credentials", "ops", "pw", true, http.StatusOK},
+		{"wrong password", "ops", "bad", true, http.StatusUnauthorized},
+		{"wrong user", "dev", "pw", true, http.StatusUnauthorized},
+		{"no credentials", "", "", false, http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", "/_admin/stats", nil)
+		if tc.set {
+			r.SetBasicAuth(tc.user, tc.pass)
+		}
+		rec := httptest.NewRecorder()
+		handleStats(rec, r)
+		if rec.Code != tc.want {
+			t.Errorf("%s: %d, want %d", tc.name, rec.Code, tc.want)
+		}
+		if tc.want == http.StatusUnauthorized && !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("%s: challenge %q", tc.name, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestEveryAdminRouteNeedsCredentials(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	adminUser, adminPass = "ops", "pw"
+	defer func() { adminUser, adminPass = "", "" }()
+	for name, handler := range map[string]http.HandlerFunc{
+		"cache":    handlePurge,
+		"stats":    handleStats,
+		"warm":     handleWarm,
+		"version":  handleVersion,
+		"inflight": handleInflight,
+		"entry":    handleEntry,
+		"top":      handleTop,
+		"offline":  handleOffline,
+		"loglevel": handleLogLevel,
+		"routes":   handleRoutes,
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/_admin/"+name, nil))
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("/_admin/%s without credentials: %d %q", name, rec.Code, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestPurgeTagEvictsTheTaggedEntries(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/p/1":
+			w.Header().Set("Surrogate-Key", "product-1 all")
+		case "/p/2":
+			w.Header().Set("Surrogate-Key", "product-2 all")
+		case "/list":
+			w.Header().Set("Surrogate-Key", "product-1  product-2")
+		}
+		w.Write([]byte("x"))
+	})
+	paths := []string{"/p/1", "/p/2", "/list", "/plain"}
+	for _, p := range paths {
+		doRequest("GET", p)
+	}
+	if members, err := mr.Members(cache.TagKey("product-1")); err != nil || len(members) != 2 {
+		t.Fatalf("product-1 tags %q: %v", members, err)
+	}
+
+	rec := adminRequest(t, handlePurge, "DELETE", "/_admin/cache?tag=product-1")
+	if n := deletedCount(t, rec); n != 2 {
+		t.Fatalf("deleted %d, want 2", n)
+	}
+	if mr.Exists(cache.TagKey("product-1")) {
+		t.Fatal("the purged tag's set was kept")
+	}
+	want := map[string]string{"/p/1": "MISS", "/p/2": "HIT", "/list": "MISS", "/plain": "HIT"}
+	for _, p := range paths {
+		if got := doRequest("GET", p).Header().Get("X-Cache"); got != want[p] {
+			t.Errorf("%s after the purge: X-Cache %q, want %q", p, got, want[p])
+		}
+	}
+
+	// PURGE on a path takes just that entry
+	if rec := doRequest("PURGE", "/p/2"); rec.Code != http.StatusForbidden {
+		t.Fatalf("PURGE without the secret: status %d", rec.Code)
+	}
+	rec = adminRequest(t, handlePurgeMethod, "PURGE", "/p/2")
+	if n := deletedCount(t, rec); n != 1 {
+		t.Fatalf("PURGE deleted %d, want 1", n)
+	}
+	if got := doRequest("GET", "/p/2").Header().Get("X-Cache"); got != "MISS" {
+		t.Fatalf("after PURGE: X-Cache %q", got)
+	}
+}
+
+// entryInfoFor asks /_admin/entry about target, decoding the answer when
+// there is one
+func entryInfoFor(t *testing.T, target string) (*httptest.ResponseRecorder, entryInfo) {
+	t.Helper()
+	rec := adminRequest(t, handleEntry, "GET", target)
+	var info entryInfo
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec, info
+}
+
+func TestEntryDescribesTheCachedResponse(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello entry"))
+	})
+	if rec, _ := entryInfoFor(t, "/_admin/entry?url=/e"); rec.Code != http.StatusNotFound {
+		t.Fatalf("uncached URL: status %d, want 404", rec.Code)
+	}
+	if rec, _ := entryInfoFor(t, "/_admin/entry"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("without url: status %d, want 400", rec.Code)
+	}
+
+	doRequest("GET", "/e")
+	rec, info := entryInfoFor(t, "/_admin/entry?url=/e")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if info.Key != keyFor("/e") || info.Status != http.StatusOK || info.Size != 11 || info.StoredBytes <= info.Size ||
+		info.Header.Get("Content-Type") != "text/plain" || len(info.Checksum) != 64 {
+		t.Fatalf("%+v", info)
+	}
+	if info.TTLSeconds <= 0 || time.Since(info.StoredAt) > time.Minute || time.Until(info.Expires) > time.Minute {
+		t.Fatalf("ttl %d, stored %v, expires %v", info.TTLSeconds, info.StoredAt, info.Expires)
+	}
+	if info.Body != nil || strings.Contains(rec.Body.String(), `"body"`) {
+		t.Fatalf("body sent without ?body=true: %s", rec.Body.String())
+	}
+	if _, info := entryInfoFor(t, "/_admin/entry?url=/e&body=true"); string(info.Body) != "hello entry" {
+		t.Fatalf("body %q", info.Body)
+	}
+}
+
+func TestEntryFindsHashedKeys(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	defer func(v bool) { cache.HashKeys = v }(cache.HashKeys)
+	cache.HashKeys = true
+
+	target := "/search?q=" + strings.Repeat("z", 3000)
+	doRequest("GET", target)
+	rec, info := entryInfoFor(t, "/_admin/entry?url="+url.QueryEscape(target))
+	if rec.Code != http.StatusOK || info.Key != keyFor(target) {
+		t.Fatalf("status %d, key %q: %s", rec.Code, info.Key, rec.Body.String())
+	}
+}
+
+func TestTopListsKeysByRequests(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+	defer cache.EnableTopKeys("", 0)
+	cache.EnableTopKeys(cache.KeyPrefix+"__top", time.Hour)
+	for path, n := range map[string]int{"/a": 2, "/b": 5, "/c": 1, "/d": 3} {
+		for i := 0; i < n; i++ {
+			doRequest("GET", path)
+		}
+	}
+	top := func(target string) ([]topKey, int) {
+		rec := adminRequest(t, handleTop, "GET", target)
+		var keys []topKey
+		json.Unmarshal(rec.Body.Bytes(), &keys)
+		return keys, rec.Code
+	}
+
+	keys, code := top("/_admin/top?n=3")
+	if code != http.StatusOK || len(keys) != 3 {
+		t.Fatalf("%d %+v", code, keys)
+	}
+	for i, want := range []struct {
+		path string
+		hits int64
+	}{{"/b", 5}, {"/d", 3}, {"/a", 2}} {
+		if keys[i].Key != keyFor(want.path) || keys[i].Hits != want.hits || keys[i].TTLSeconds < 50 {
+			t.Errorf("%d: %+v, want %s with %d hits", i, keys[i], want.path, want.hits)
+		}
+	}
+	// the counts last one --top-keys-window
+	if ttl := mr.TTL(cache.KeyPrefix + "__top"); ttl != time.Hour {
+		t.Fatalf("window %v", ttl)
+	}
+	if _, code := top("/_admin/top?n=x"); code != http.StatusBadRequest {
+		t.Fatalf("n=x: status %d", code)
+	}
+	if rec := adminRequest(t, handleTop, "DELETE", "/_admin/top"); rec.Code != http.StatusNoContent {
+		t.Fatalf("reset: status %d", rec.Code)
+	}
+	if keys, _ := top("/_admin/top"); len(keys) != 0 {
+		t.Fatalf("after a reset %+v", keys)
+	}
+}
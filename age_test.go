@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAgeHeader(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	age := func() int {
+		rec := doRequest("GET", "/age")
+		if rec.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("X-Cache %q", rec.Header().Get("X-Cache"))
+		}
+		n, err := strconv.Atoi(rec.Header().Get("Age"))
+		if err != nil {
+			t.Fatalf("Age %q", rec.Header().Get("Age"))
+		}
+		return n
+	}
+	doRequest("GET", "/age")
+	time.Sleep(1100 * time.Millisecond)
+	first := age()
+	time.Sleep(1100 * time.Millisecond)
+	second := age()
+	if first < 1 || second <= first {
+		t.Fatalf("ages %d then %d, want nonzero and increasing", first, second)
+	}
+}
+
+func TestOriginAgeIsAddedTo(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Age", "10")
+		w.Write([]byte("x"))
+	})
+	doRequest("GET", "/aged")
+	time.Sleep(1100 * time.Millisecond)
+	if got := doRequest("GET", "/aged").Header().Get("Age"); got != "11" {
+		t.Fatalf("Age %q, want the origin's 10 plus 1", got)
+	}
+	// the origin's Age counts against max-age
+	if ttl := mr.TTL(keyFor("/aged")); ttl != 50*time.Second {
+		t.Fatalf("TTL %v, want 50s", ttl)
+	}
+}
+
+func TestOriginAgeSurvivesTheDefaultStripList(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Age", "10")
+		w.Write([]byte("x"))
+	})
+	useStoredHeaders(t, defaultStripStoredHeaders, false)
+
+	doRequest("GET", "/aged")
+	time.Sleep(1100 * time.Millisecond)
+	if got := doRequest("GET", "/aged").Header().Get("Age"); got != "11" {
+		t.Fatalf("Age %q, want the origin's 10 plus 1", got)
+	}
+}
+
+func TestCacheTTLHeaderCountsDown(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=100")
+		w.Write([]byte("x"))
+	})
+	if rec := doRequest("GET", "/t"); rec.Header().Get("X-Cache-TTL") != "" {
+		t.Fatalf("X-Cache-TTL %q on a miss", rec.Header().Get("X-Cache-TTL"))
+	}
+	first, err := strconv.Atoi(doRequest("GET", "/t").Header().Get("X-Cache-TTL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(30 * time.Second)
+	second, err := strconv.Atoi(doRequest("GET", "/t").Header().Get("X-Cache-TTL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first-second != 30 {
+		t.Fatalf("X-Cache-TTL went from %d to %d in 30s", first, second)
+	}
+
+	// a key without an expiry has nothing to report
+	mr.SetTTL(keyFor("/t"), 0)
+	if rec := doRequest("GET", "/t"); rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("X-Cache-TTL") != "" {
+		t.Fatalf("X-Cache %q, X-Cache-TTL %q", rec.Header().Get("X-Cache"), rec.Header().Get("X-Cache-TTL"))
+	}
+}
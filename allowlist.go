@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// errOriginForbidden is returned for origin requests to hosts outside
+// --allowed-origin-hosts or to private addresses
+var errOriginForbidden = errors.New("origin host not allowed")
+
+// originHostAllowed reports whether requests may be sent to host at all.
+// without --allowed-origin-hosts every host is
+func originHostAllowed(host string) bool {
+	return allowedOriginHosts == nil || allowedOriginHosts[strings.ToLower(host)]
+}
+
+// blockedIP reports whether ip is in a private or link-local range, which
+// is where cloud metadata services and internal backends live. loopback
+// stays reachable for an origin running next to the proxy
+func blockedIP(ip net.IP) bool {
+	if allowPrivateOrigins {
+		return false
+	}
+	return ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// guardedDial wraps dialer so that connections to blocked addresses are
+// refused. the check runs on the address actually dialed, after name
+// resolution, so a host name can't sneak a private address past it. hosts
+// listed in --allowed-origin-hosts are trusted wherever they resolve to
+func guardedDial(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil && allowedOriginHosts[strings.ToLower(host)] {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		guarded := *dialer
+		guarded.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, _ := net.SplitHostPort(address)
+			if ip := net.ParseIP(host); ip != nil && blockedIP(ip) {
+				return fmt.Errorf("%w: %s resolves to %s", errOriginForbidden, addr, ip)
+			}
+			return nil
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+}
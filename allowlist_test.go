@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestBlockedIP(t *testing.T) {
+	defer func() { allowPrivateOrigins = false }()
+	for ip, want := range map[string]bool{
+		"169.254.169.254": true,
+		"10.1.2.3":        true,
+		"192.168.0.1":     true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"0.0.0.0":         true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"93.184.216.34":   false,
+	} {
+		if got := blockedIP(net.ParseIP(ip)); got != want {
+			t.Errorf("%s blocked %v, want %v", ip, got, want)
+		}
+	}
+	allowPrivateOrigins = true
+	if blockedIP(net.ParseIP("169.254.169.254")) {
+		t.Error("blocked with --allow-private-origins")
+	}
+}
+
+func TestOriginAllowlist(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+	})
+	defer func() { allowedOriginHosts = nil }()
+
+	// loopback origins keep working
+	if rec := doRequest("GET", "/ok"); rec.Code != http.StatusOK {
+		t.Fatalf("loopback origin: status %d", rec.Code)
+	}
+	allowedOriginHosts = map[string]bool{"example.com": true}
+	if rec := doRequest("GET", "/listed"); rec.Code != http.StatusForbidden || hits.Load() != 1 {
+		t.Fatalf("unlisted host: status %d, %d origin requests", rec.Code, hits.Load())
+	}
+}
+
+func TestPrivateOriginsAreRefused(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	originServer = "http://169.254.169.254"
+	if rec := doRequest("GET", "/latest/meta-data/"); rec.Code != http.StatusForbidden {
+		t.Fatalf("metadata address: status %d, want 403", rec.Code)
+	}
+	originServer = "http://10.1.2.3:8080"
+	if rec := doRequest("POST", "/x"); rec.Code != http.StatusForbidden {
+		t.Fatalf("private address: status %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestAuthenticatedAndAnonymousGetSeparateEntries(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+			w.Write([]byte("member"))
+			return
+		}
+		w.Write([]byte("guest"))
+	})
+	defer func(v bool, names []string) { segmentAuth, sessionCookies = v, names }(segmentAuth, sessionCookies)
+	segmentAuth = true
+	sessionCookies = []string{"sid"}
+
+	if w := doRequest("GET", "/p"); w.Body.String() != "guest" {
+		t.Fatal(w.Body.String())
+	}
+	// any credentials share the one authenticated entry
+	if w := doRequest("GET", "/p", "Authorization", "Bearer a"); w.Body.String() != "member" || w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("%q, X-Cache %q", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	if w := doRequest("GET", "/p", "Authorization", "Bearer b"); w.Body.String() != "member" || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("%q, X-Cache %q", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	if w := doRequest("GET", "/p", "Cookie", "sid=1"); w.Body.String() != "member" || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("%q, X-Cache %q", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	// other cookies leave a request anonymous
+	if w := doRequest("GET", "/p", "Cookie", "theme=dark"); w.Body.String() != "guest" || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("%q, X-Cache %q", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	if w := doRequest("GET", "/p"); w.Body.String() != "guest" || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("%q, X-Cache %q", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("%d origin requests, want 2", hits.Load())
+	}
+	if !mr.Exists(keyFor("/p")) || !mr.Exists(cache.AuthKey(keyFor("/p"))) {
+		t.Fatalf("keys %v", mr.Keys())
+	}
+	// purging the URL removes both
+	if n, err := purgeURL(t.Context(), &url.URL{Path: "/p"}); err != nil || n != 2 {
+		t.Fatalf("purged %d, %v", n, err)
+	}
+}
+
+func TestAnonymousQueryCantReachTheAuthenticatedEntry(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		if r.Header.Get("Cookie") != "" {
+			w.Write([]byte("member"))
+			return
+		}
+		w.Write([]byte("guest"))
+	})
+	defer func(names []string) { sessionCookies = names }(sessionCookies)
+	sessionCookies = []string{"sid"}
+
+	if w := doRequest("GET", "/search?q=1", "Cookie", "sid=1"); w.Body.String() != "member" {
+		t.Fatal(w.Body.String())
+	}
+	w := doRequest("GET", "/search?q=1|auth")
+	if w.Body.String() != "guest" || w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("anonymous ?q=1|auth got %q, X-Cache %q", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	// and its response left the authenticated entry alone
+	if w := doRequest("GET", "/search?q=1", "Cookie", "sid=2"); w.Body.String() != "member" || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("authenticated %q, X-Cache %q", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRetryAfter caps how long one Retry-After keeps requests for a key away
+// from the origin
+const maxRetryAfter = 10 * time.Minute
+
+var (
+	// retryAfter maps cache keys whose origin answered 503 with a
+	// Retry-After to the time the origin may be asked again
+	retryMu    sync.Mutex
+	retryAfter = map[string]time.Time{}
+)
+
+// parseRetryAfter reads a Retry-After value in either of its forms,
+// delta-seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, secs > 0
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t.Sub(now), t.After(now)
+	}
+	return 0, false
+}
+
+// noteRetryAfter holds back fetches for key when resp is a 503 asking the
+// client to come back later
+func noteRetryAfter(key string, resp *http.Response) {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	now := time.Now()
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		return
+	}
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	// drop windows that passed for keys nobody asked for since
+	for k, until := range retryAfter {
+		if !until.After(now) {
+			delete(retryAfter, k)
+		}
+	}
+	retryAfter[key] = now.Add(min(wait, maxRetryAfter))
+}
+
+// retryWait returns how much longer the origin asked not to be sent
+// requests for key
+func retryWait(key string) (time.Duration, bool) {
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	until, ok := retryAfter[key]
+	if !ok {
+		return 0, false
+	}
+	wait := time.Until(until)
+	if wait <= 0 {
+		delete(retryAfter, key)
+		return 0, false
+	}
+	return wait, true
+}
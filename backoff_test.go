@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 30 ", 30 * time.Second, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, false},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{"later", 0, false},
+		{"", 0, false},
+	} {
+		wait, ok := parseRetryAfter(tc.value, now)
+		if ok != tc.ok || (ok && wait != tc.wait) {
+			t.Errorf("%q: %v %v, want %v %v", tc.value, wait, ok, tc.wait, tc.ok)
+		}
+	}
+}
+
+func TestRetryAfterHoldsBackFetches(t *testing.T) {
+	defer func() { retryAfter = map[string]time.Time{} }()
+	for name, value := range map[string]string{
+		"delta-seconds": "30",
+		"HTTP-date":     time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat),
+	} {
+		_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", value)
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		})
+		if rec := doRequest("GET", "/busy"); rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: %d", name, rec.Code)
+		}
+		rec := doRequest("GET", "/busy")
+		if rec.Code != http.StatusServiceUnavailable || hits.Load() != 1 || rec.Header().Get("Retry-After") == "" {
+			t.Fatalf("%s: %d, Retry-After %q, %d origin requests", name, rec.Code, rec.Header().Get("Retry-After"), hits.Load())
+		}
+		retryAfter = map[string]time.Time{}
+	}
+}
+
+func TestRetryAfterServesStale(t *testing.T) {
+	defer func() { retryAfter = map[string]time.Time{} }()
+	busy := false
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if busy {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("old"))
+	})
+	doRequest("GET", "/page")
+	time.Sleep(1100 * time.Millisecond)
+	busy = true
+	doRequest("GET", "/page")
+	rec := doRequest("GET", "/page")
+	if rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != "old" || hits.Load() != 2 {
+		t.Fatalf("got %q %q, %d origin requests", rec.Header().Get("X-Cache"), rec.Body.String(), hits.Load())
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchReport is what the bench subcommand found out. results counts the
+// responses by their X-Cache, those without one under "-"
+type benchReport struct {
+	requests  int
+	errors    int
+	results   map[string]int
+	latencies []time.Duration
+	elapsed   time.Duration
+}
+
+// runBench is the bench subcommand: it sends requests for a URL of a
+// running proxy from --concurrency clients at once for --duration, as
+// fast as they are answered, and prints the hit ratio, latencies and
+// throughput to out. going through the proxy's listener exercises the
+// configuration it actually runs with
+func runBench(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(out)
+	target := fs.String("url", "", "URL to request through the proxy, e.g. http://localhost:8080/index.html")
+	method := fs.String("method", http.MethodGet, "Request method")
+	concurrency := fs.Int("concurrency", 10, "Requests in flight at once")
+	duration := fs.Duration("duration", 10*time.Second, "How long to keep sending requests")
+	timeout := fs.Duration("timeout", 10*time.Second, "How long one request may take before it counts as an error")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if u, err := url.Parse(*target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("--url must be an http or https URL")
+	}
+	if *concurrency <= 0 || *duration <= 0 {
+		return fmt.Errorf("--concurrency and --duration must be positive")
+	}
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	report := bench(client, *method, *target, *concurrency, *duration)
+	report.print(out)
+	if report.requests == 0 {
+		return errors.New("no request completed")
+	}
+	return nil
+}
+
+// bench sends requests until duration is over and collects the report
+func bench(client *http.Client, method, target string, concurrency int, duration time.Duration) *benchReport {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	report := &benchReport{results: map[string]int{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				began := time.Now()
+				result, err := benchRequest(ctx, client, method, target)
+				took := time.Since(began)
+				// requests cut off by the end of the run aren't counted
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				report.requests++
+				if err != nil {
+					report.errors++
+				} else {
+					report.results[result]++
+					report.latencies = append(report.latencies, took)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	report.elapsed = time.Since(start)
+	sort.Slice(report.latencies, func(i, j int) bool { return report.latencies[i] < report.latencies[j] })
+	return report
+}
+
+// benchRequest sends one request and returns the X-Cache of its answer,
+// the body being read for the latency to cover all of it
+func benchRequest(ctx context.Context, client *http.Client, method, target string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return "", err
+	}
+	// a variant hash of --expose-variant is left out
+	if result, _, _ := strings.Cut(resp.Header.Get("X-Cache"), ";"); result != "" {
+		return result, nil
+	}
+	return "-", nil
+}
+
+// hitRatio is the share of the answered requests that were cache hits
+func (br *benchReport) hitRatio() float64 {
+	if len(br.latencies) == 0 {
+		return 0
+	}
+	return float64(br.results["HIT"]) / float64(len(br.latencies))
+}
+
+// percentile returns the latency that a share p, between 0 and 1, of the
+// answered requests took at most
+func (br *benchReport) percentile(p float64) time.Duration {
+	if len(br.latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(br.latencies)))) - 1
+	return br.latencies[max(i, 0)]
+}
+
+func (br *benchReport) print(out io.Writer) {
+	fmt.Fprintf(out, "requests:   %d in %s, %d errors\n", br.requests, br.elapsed.Round(time.Millisecond), br.errors)
+	fmt.Fprintf(out, "throughput: %.1f requests/s\n", float64(br.requests)/br.elapsed.Seconds())
+	fmt.Fprintf(out, "hit ratio:  %.1f%%\n", 100*br.hitRatio())
+	var results []string
+	for result, n := range br.results {
+		results = append(results, fmt.Sprintf("%s %d", result, n))
+	}
+	sort.Strings(results)
+	fmt.Fprintf(out, "X-Cache:    %s\n", strings.Join(results, ", "))
+	fmt.Fprintf(out, "latency:    p50 %s, p95 %s, p99 %s\n",
+		br.percentile(0.50), br.percentile(0.95), br.percentile(0.99))
+}
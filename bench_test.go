@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchReportsAgainstAStubOrigin(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	})
+	proxy := httptest.NewServer(http.HandlerFunc(handleRequest))
+	defer proxy.Close()
+
+	var out bytes.Buffer
+	if err := runBench([]string{"-url", proxy.URL + "/bench", "-concurrency", "4", "-duration", "300ms"}, &out); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	report := out.String()
+	// only the first few requests miss, so the ratio is in the nineties
+	for _, want := range []string{"requests:", "throughput:", "hit ratio:  9", "HIT ", "p50 ", "p95 ", "p99 "} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report lacks %q:\n%s", want, report)
+		}
+	}
+	if hits.Load() > 4 {
+		t.Errorf("origin hit %d times by 4 clients", hits.Load())
+	}
+}
+
+func TestBenchChecksItsFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"-url", "localhost"},
+		{"-url", "http://localhost:1/", "-concurrency", "0"},
+		{"-url", "http://localhost:1/", "-duration", "0s"},
+	} {
+		if err := runBench(args, &bytes.Buffer{}); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
+
+func TestBenchPercentiles(t *testing.T) {
+	br := &benchReport{latencies: []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}
+	for _, tc := range []struct {
+		p    float64
+		want time.Duration
+	}{{0, 1}, {0.5, 5}, {0.95, 10}, {0.99, 10}} {
+		if got := br.percentile(tc.p); got != tc.want {
+			t.Errorf("p%v = %v, want %v", tc.p*100, got, tc.want)
+		}
+	}
+}
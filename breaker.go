@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of contacting an origin whose breaker
+// is open
+var errCircuitOpen = errors.New("origin circuit breaker is open")
+
+// circuitBreaker stops sending requests to an origin that failed
+// breakerThreshold times in a row within breakerWindow, for
+// breakerCooldown. the first request after the cooldown is a trial, the
+// only one let through until its outcome is recorded: if it fails too the
+// breaker opens again right away. a nil *circuitBreaker never opens
+type circuitBreaker struct {
+	host string
+
+	mu        sync.Mutex
+	failures  int
+	firstFail time.Time
+	openUntil time.Time
+	tripped   bool
+	trial     bool
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*circuitBreaker{}
+)
+
+// breakerFor returns the breaker of the origin at host, nil when breaking
+// is disabled
+func breakerFor(host string) *circuitBreaker {
+	if breakerThreshold <= 0 {
+		return nil
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[host]
+	if !ok {
+		b = &circuitBreaker{host: host}
+		breakers[host] = b
+	}
+	return b
+}
+
+// originBreaker returns the breaker for an origin URL such as --origin
+func originBreaker(origin string) *circuitBreaker {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil
+	}
+	return breakerFor(u.Host)
+}
+
+// Allow reports whether the origin may be contacted. once the cooldown is
+// over the first caller gets the trial and the breaker stays shut to the
+// others for another cooldown, or until the trial's outcome is recorded.
+// a trial that never is, its client having gone away, is followed by
+// another one then
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	if b.tripped {
+		b.openUntil = now.Add(breakerCooldown)
+		b.trial = true
+	}
+	return true
+}
+
+// Open reports whether requests to the origin are turned away right now.
+// unlike Allow it doesn't take the trial, for callers that only look
+func (b *circuitBreaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().Before(b.openUntil)
+}
+
+// Record counts the outcome of a request to the origin
+func (b *circuitBreaker) Record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if b.trial {
+			b.openUntil = time.Time{}
+		}
+		b.failures = 0
+		b.tripped = false
+		b.trial = false
+		return
+	}
+	b.trial = false
+	now := time.Now()
+	if b.failures == 0 || now.Sub(b.firstFail) > breakerWindow {
+		b.failures = 0
+		b.firstFail = now
+	}
+	b.failures++
+	if b.tripped || b.failures >= breakerThreshold {
+		b.failures = 0
+		b.tripped = true
+		b.openUntil = now.Add(breakerCooldown)
+		slog.Warn("origin circuit breaker opened", "origin", b.host, "cooldown", breakerCooldown.String())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpens(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	})
+	breakerThreshold, breakerWindow, breakerCooldown = 3, time.Minute, time.Minute
+	defer func() { breakerThreshold = 0 }()
+	for i := 0; i < 3; i++ {
+		if rec := doRequest("GET", "/b"); rec.Code != http.StatusInternalServerError {
+			t.Fatalf("failure %d answered %d", i, rec.Code)
+		}
+	}
+	if rec := doRequest("GET", "/b"); rec.Code != http.StatusServiceUnavailable || hits.Load() != 3 {
+		t.Fatalf("open breaker answered %d, %d origin requests", rec.Code, hits.Load())
+	}
+	if rec := doRequest("POST", "/b"); rec.Code != http.StatusServiceUnavailable || hits.Load() != 3 {
+		t.Fatalf("open breaker answered POST with %d, %d origin requests", rec.Code, hits.Load())
+	}
+}
+
+func TestBreakerServesStale(t *testing.T) {
+	fail := false
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("old"))
+	})
+	breakerThreshold, breakerWindow, breakerCooldown = 1, time.Minute, time.Minute
+	defer func() { breakerThreshold = 0 }()
+	doRequest("GET", "/s")
+	fail = true
+	doRequest("GET", "/s")
+	rec := doRequest("GET", "/s")
+	if rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != "old" {
+		t.Fatalf("open breaker served %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+// trippedBreaker returns a breaker that opened for cooldown just now
+func trippedBreaker(t *testing.T, cooldown time.Duration) *circuitBreaker {
+	t.Helper()
+	breakerThreshold, breakerWindow, breakerCooldown = 1, time.Minute, cooldown
+	t.Cleanup(func() { breakerThreshold = 0 })
+	b := &circuitBreaker{host: "origin.test"}
+	b.Record(true)
+	if b.Allow() || !b.Open() {
+		t.Fatal("breaker didn't open")
+	}
+	return b
+}
+
+func TestBreakerLetsOneTrialThrough(t *testing.T) {
+	b := trippedBreaker(t, 20*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if b.Open() {
+		t.Fatal("still open after the cooldown")
+	}
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.Allow() {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed.Load() != 1 {
+		t.Fatalf("%d trials let through, want 1", allowed.Load())
+	}
+	if !b.Open() {
+		t.Fatal("breaker not shut to others during the trial")
+	}
+	b.Record(false)
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("successful trial didn't close the breaker")
+	}
+}
+
+func TestBreakerFailedTrialReopens(t *testing.T) {
+	b := trippedBreaker(t, 20*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("no trial after the cooldown")
+	}
+	b.Record(true)
+	if b.Allow() {
+		t.Fatal("failed trial didn't reopen the breaker")
+	}
+}
+
+func TestBreakerLostTrialIsRetried(t *testing.T) {
+	b := trippedBreaker(t, 20*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("no trial after the cooldown")
+	}
+	// the trial's outcome is never recorded
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("no new trial after the first went missing")
+	}
+}
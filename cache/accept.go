@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AcceptsEncoding reports whether the request headers allow a response
+// with the given content coding. identity is always acceptable
+func AcceptsEncoding(h http.Header, coding string) bool {
+	coding = strings.ToLower(strings.TrimSpace(coding))
+	if coding == "" || coding == "identity" {
+		return true
+	}
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, item := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(item, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != coding && name != "*" {
+				continue
+			}
+			// q=0 explicitly refuses the coding
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// encodingClass reduces an Accept-Encoding to the coding a response is
+// served with: br, else gzip, else identity. the order of the codings and
+// their q-values otherwise make no difference, so clients that get the same
+// response share one entry when it varies on Accept-Encoding
+func encodingClass(h http.Header) string {
+	for _, coding := range []string{"br", "gzip"} {
+		if AcceptsEncoding(h, coding) {
+			return coding
+		}
+	}
+	return "identity"
+}
+
+// acceptClass normalizes an Accept header for variant keys: the media
+// types, lowercased and with their parameters but without q, sorted and
+// without duplicates. clients listing the same types in another order or
+// with other preferences share one entry when a response varies on Accept
+func acceptClass(h http.Header) string {
+	seen := map[string]bool{}
+	var types []string
+	for _, value := range h.Values("Accept") {
+		for _, item := range strings.Split(value, ",") {
+			parts := strings.Split(item, ";")
+			kept := parts[:0]
+			for i, part := range parts {
+				part = strings.ToLower(strings.TrimSpace(part))
+				name, _, _ := strings.Cut(part, "=")
+				if part == "" || (i > 0 && strings.TrimSpace(name) == "q") {
+					continue
+				}
+				kept = append(kept, strings.ReplaceAll(part, " ", ""))
+			}
+			if len(kept) == 0 || !strings.Contains(kept[0], "/") {
+				continue
+			}
+			if t := strings.Join(kept, ";"); !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
+		}
+	}
+	sort.Strings(types)
+	return strings.Join(types, ",")
+}
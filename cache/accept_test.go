@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header, coding string
+		want           bool
+	}{
+		{"gzip, deflate", "gzip", true},
+		{"GZIP", "gzip", true},
+		{"deflate", "gzip", false},
+		{"gzip;q=0", "gzip", false},
+		{"gzip; q=0.5", "gzip", true},
+		{"*", "br", true},
+		{"", "identity", true},
+		{"", "gzip", false},
+	} {
+		h := http.Header{"Accept-Encoding": {tc.header}}
+		if got := AcceptsEncoding(h, tc.coding); got != tc.want {
+			t.Errorf("%q accepts %s: %v, want %v", tc.header, tc.coding, got, tc.want)
+		}
+	}
+}
+
+func TestEncodingClass(t *testing.T) {
+	for header, want := range map[string]string{
+		"gzip, deflate":             "gzip",
+		"deflate, gzip":             "gzip",
+		"gzip;q=1.0, deflate;q=0.5": "gzip",
+		"deflate,gzip,":             "gzip",
+		"br, gzip":                  "br",
+		"gzip, br;q=0.9":            "br",
+		"gzip;q=0, deflate":         "identity",
+		"identity":                  "identity",
+		"":                          "identity",
+	} {
+		if got := encodingClass(http.Header{"Accept-Encoding": {header}}); got != want {
+			t.Errorf("%q: %s, want %s", header, got, want)
+		}
+	}
+}
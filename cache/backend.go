@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrMiss is returned by Cache.Get for a key that isn't stored
+var ErrMiss = errors.New("cache miss")
+
+// Cache stores the serialized entries. Redis is the default backend, an in
+// process Memory suits tests and single-node deployments
+type Cache interface {
+	// every call takes the context of the request it serves, so a client
+	// going away aborts the round trip instead of leaving it running
+
+	// Get returns the value stored under key, or ErrMiss
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value under key for ttl
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes keys, returning how many existed
+	Delete(ctx context.Context, keys ...string) (int64, error)
+	// TTL returns how long key has left, 0 or less when it has no expiry
+	// or doesn't exist
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// DeletePrefix removes every key starting with prefix
+	DeletePrefix(ctx context.Context, prefix string) (int64, error)
+	// Len returns the number of keys stored
+	Len(ctx context.Context) (int64, error)
+	// Incr adds one to the counter under key and returns it. a new counter
+	// expires after ttl
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
+
+var backend Cache
+
+// Backend returns the cache set up by InitRedis or Use
+func Backend() Cache {
+	return backend
+}
+
+// Use makes c the cache instead of Redis. c is always considered available
+func Use(c Cache) {
+	if stopMonitor != nil {
+		close(stopMonitor)
+		stopMonitor = nil
+	}
+	backend = c
+	available.Store(true)
+}
+
+// Ready reports whether the cache can serve requests, pinging Redis when
+// that is the backend
+func Ready(ctx context.Context) error {
+	if rc, ok := backend.(redisCache); ok {
+		return rc.client.Ping(ctx).Err()
+	}
+	return nil
+}
+
+// Flush deletes every key under KeyPrefix, leaving whatever else shares
+// the database alone. without a prefix nothing tells our keys apart, so
+// nothing is deleted
+func Flush(ctx context.Context) (int64, error) {
+	if KeyPrefix == "" {
+		return 0, errors.New("refusing to flush without a key prefix")
+	}
+	return backend.DeletePrefix(ctx, KeyPrefix)
+}
+
+// redisClient returns the Redis client when Redis is the backend. eviction
+// and surrogate-key tags need Redis data types and are only available then
+func redisClient() (*redis.Client, bool) {
+	rc, ok := backend.(redisCache)
+	return rc.client, ok
+}
+
+// redisCache is the Cache kept in Redis
+type redisCache struct {
+	client *redis.Client
+}
+
+func (c redisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrMiss
+	}
+	return value, err
+}
+
+func (c redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (c redisCache) Delete(ctx context.Context, keys ...string) (int64, error) {
+	return c.client.Del(ctx, keys...).Result()
+}
+
+func (c redisCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return c.client.TTL(ctx, key).Result()
+}
+
+// DeletePrefix walks the keyspace with SCAN so Redis is never blocked by a
+// KEYS call
+func (c redisCache) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	var deleted int64
+	iter := c.client.Scan(ctx, 0, escapePattern(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		n, err := c.client.Del(ctx, iter.Val()).Result()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, iter.Err()
+}
+
+func (c redisCache) Len(ctx context.Context) (int64, error) {
+	return c.client.DBSize(ctx).Result()
+}
+
+func (c redisCache) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	pipe := c.client.TxPipeline()
+	n := pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return n.Val(), nil
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testBackend checks the behaviour every Cache shares
+func testBackend(t *testing.T, c Cache) {
+	ctx := context.Background()
+	if _, err := c.Get(ctx, "a"); err != ErrMiss {
+		t.Fatalf("Get of a missing key: %v, want ErrMiss", err)
+	}
+	if err := c.Set(ctx, "a", []byte("1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "a"); err != nil || string(v) != "1" {
+		t.Fatalf("Get %q, %v", v, err)
+	}
+	if ttl, err := c.TTL(ctx, "a"); err != nil || ttl <= 59*time.Second || ttl > time.Minute {
+		t.Fatalf("TTL %v, %v", ttl, err)
+	}
+	c.Set(ctx, "forever", []byte("x"), 0)
+	if ttl, err := c.TTL(ctx, "forever"); err != nil || ttl > 0 {
+		t.Fatalf("TTL without an expiry %v, %v", ttl, err)
+	}
+	if ttl, err := c.TTL(ctx, "missing"); err != nil || ttl > 0 {
+		t.Fatalf("TTL of a missing key %v, %v", ttl, err)
+	}
+
+	c.Set(ctx, "p:1", []byte("x"), time.Minute)
+	c.Set(ctx, "p:2", []byte("x"), time.Minute)
+	if n, err := c.Len(ctx); err != nil || n != 4 {
+		t.Fatalf("Len %d, %v", n, err)
+	}
+	if n, err := c.DeletePrefix(ctx, "p:"); err != nil || n != 2 {
+		t.Fatalf("DeletePrefix removed %d, %v", n, err)
+	}
+	if n, err := c.Delete(ctx, "a", "missing"); err != nil || n != 1 {
+		t.Fatalf("Delete removed %d, %v", n, err)
+	}
+	for want := int64(1); want <= 2; want++ {
+		if n, err := c.Incr(ctx, "counter", time.Minute); err != nil || n != want {
+			t.Fatalf("Incr %d, %v, want %d", n, err, want)
+		}
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, NewMemory())
+}
+
+func TestRedisBackend(t *testing.T) {
+	mr := miniredis.RunT(t)
+	if err := InitRedis("redis://"+mr.Addr(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, Backend())
+}
+
+func TestMemoryExpires(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.Set(ctx, "k", []byte("v"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := m.Get(ctx, "k"); err != ErrMiss {
+		t.Fatalf("expired key: %v, want ErrMiss", err)
+	}
+	if n, _ := m.Delete(ctx, "k"); n != 0 {
+		t.Fatal("an expired key counted as deleted")
+	}
+}
+
+func TestFlushNeedsAPrefix(t *testing.T) {
+	defer func(b Cache, prefix string) { backend, KeyPrefix = b, prefix }(backend, KeyPrefix)
+	backend = NewMemory()
+	ctx := context.Background()
+	backend.Set(ctx, "proxy:a", []byte("x"), time.Minute)
+	backend.Set(ctx, "other", []byte("x"), time.Minute)
+
+	KeyPrefix = ""
+	if _, err := Flush(ctx); err == nil {
+		t.Fatal("flushed without a key prefix")
+	}
+	KeyPrefix = "proxy:"
+	if n, err := Flush(ctx); err != nil || n != 1 {
+		t.Fatalf("Flush removed %d, %v", n, err)
+	}
+	if _, err := backend.Get(ctx, "other"); err != nil {
+		t.Fatalf("a key outside the prefix was flushed: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisURL is used when no Redis URL is configured. it matches the
+// service name in redis_docker_compose.yml
+const DefaultRedisURL = "redis://default@redis:6379"
+
+// healthCheckInterval is how often Redis is pinged to notice it going away
+// or coming back
+const healthCheckInterval = 5 * time.Second
+
+var (
+	Ctx    = context.Background()
+	client *redis.Client
+
+	// available is false while Redis can't be reached, the proxy then acts
+	// as a plain pass-through
+	available   atomic.Bool
+	stopMonitor chan struct{}
+)
+
+// Options tunes the Redis client. zero fields keep the go-redis defaults,
+// or whatever the URL sets
+type Options struct {
+	PoolSize     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+func (o Options) apply(opt *redis.Options) {
+	if o.PoolSize > 0 {
+		opt.PoolSize = o.PoolSize
+	}
+	if o.DialTimeout > 0 {
+		opt.DialTimeout = o.DialTimeout
+	}
+	if o.ReadTimeout > 0 {
+		opt.ReadTimeout = o.ReadTimeout
+	}
+	if o.WriteTimeout > 0 {
+		opt.WriteTimeout = o.WriteTimeout
+	}
+}
+
+// InitRedis connects to the Redis server at redisURL. only an invalid URL is
+// an error: when Redis doesn't answer the proxy starts without a cache and
+// a background loop keeps pinging until it does
+func InitRedis(redisURL string, opts Options) error {
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return fmt.Errorf("invalid Redis URL %q: %w", redisURL, err)
+	}
+	opts.apply(opt)
+
+	if stopMonitor != nil {
+		close(stopMonitor)
+	}
+	client = redis.NewClient(opt)
+	backend = redisCache{client}
+	stopMonitor = make(chan struct{})
+
+	err = client.Ping(Ctx).Err()
+	available.Store(err == nil)
+	if err != nil {
+		slog.Warn("Redis ping failed, serving without cache", "error", err)
+	} else {
+		slog.Info("Redis initialized successfully")
+	}
+
+	go monitor(client, stopMonitor)
+	return nil
+}
+
+// Ping checks that the Redis server at redisURL answers, using a client of
+// its own so the one set up by InitRedis is left alone
+func Ping(redisURL string, opts Options) error {
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return fmt.Errorf("invalid Redis URL %q: %w", redisURL, err)
+	}
+	opts.apply(opt)
+	c := redis.NewClient(opt)
+	defer c.Close()
+	return c.Ping(Ctx).Err()
+}
+
+// monitor pings Redis until stop is closed, flipping available whenever
+// the outcome changes
+func monitor(c *redis.Client, stop chan struct{}) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		err := c.Ping(Ctx).Err()
+		if was := available.Swap(err == nil); was != (err == nil) {
+			if err != nil {
+				slog.Warn("Redis unavailable, serving without cache", "error", err)
+			} else {
+				slog.Info("Redis reachable again, cache enabled")
+			}
+		}
+	}
+}
+
+// Available reports whether Redis was reachable at the last check
+func Available() bool {
+	return available.Load()
+}
+
+// ReportError records a failed Redis operation run with ctx. anything
+// other than a missing key marks Redis unavailable until the next
+// successful ping, unless ctx was done: the client that went away or timed
+// out cut the call short, which says nothing of Redis. the Redis client
+// then returns the context's error, or a timeout from the deadline it took
+// for the connection
+func ReportError(ctx context.Context, err error) {
+	if err == nil || errors.Is(err, redis.Nil) || errors.Is(err, ErrMiss) || ctx.Err() != nil {
+		return
+	}
+	if available.Swap(false) {
+		slog.Warn("Redis error, serving without cache", "error", err)
+	}
+}
+
+func GetClient() *redis.Client {
+	return client
+}
+
+// Close stops the health check and closes the Redis client and its
+// connection pool
+func Close() error {
+	if client == nil {
+		return nil
+	}
+	if stopMonitor != nil {
+		close(stopMonitor)
+		stopMonitor = nil
+	}
+	if stopSweep != nil {
+		close(stopSweep)
+		stopSweep = nil
+	}
+	return client.Close()
+}
+
+// escapePattern escapes the glob metacharacters in s so it can be used as a
+// literal prefix in a SCAN MATCH pattern
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestInitRedisRejectsInvalidURL(t *testing.T) {
+	for _, url := range []string{"not a url", "http://localhost:6379", "redis://localhost:6379/notadb"} {
+		err := InitRedis(url, Options{})
+		if err == nil || !strings.Contains(err.Error(), "invalid Redis URL") {
+			t.Errorf("%s: err %v", url, err)
+		}
+	}
+}
+
+func TestInitRedisStartsWithoutRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	addr := mr.Addr()
+	mr.Close()
+	if err := InitRedis("redis://"+addr, Options{}); err != nil {
+		t.Fatalf("unreachable Redis failed startup: %v", err)
+	}
+	if Available() {
+		t.Fatal("unreachable Redis reported available")
+	}
+}
+
+func TestReportError(t *testing.T) {
+	mr := miniredis.RunT(t)
+	if err := InitRedis("redis://"+mr.Addr(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{nil, ErrMiss} {
+		ReportError(t.Context(), err)
+		if !Available() {
+			t.Fatalf("%v marked Redis unavailable", err)
+		}
+	}
+	ReportError(t.Context(), errors.New("connection reset"))
+	if Available() {
+		t.Fatal("Redis still available after an error")
+	}
+}
+
+func TestReportErrorIgnoresCallsTheirContextCutShort(t *testing.T) {
+	mr := miniredis.RunT(t)
+	if err := InitRedis("redis://"+mr.Addr(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	canceled, cancel := context.WithCancel(t.Context())
+	cancel()
+	expired, cancel := context.WithDeadline(t.Context(), time.Now().Add(-time.Second))
+	defer cancel()
+	for name, ctx := range map[string]context.Context{"canceled": canceled, "expired": expired} {
+		// what the Redis client returns for a call made with ctx
+		err := client.Get(ctx, "k").Err()
+		if err == nil {
+			t.Fatalf("%s: the call succeeded", name)
+		}
+		ReportError(ctx, err)
+		// a timeout from the deadline it set on the connection, too
+		ReportError(ctx, errors.New("i/o timeout"))
+		if !Available() {
+			t.Fatalf("%s: %v marked Redis unavailable", name, err)
+		}
+	}
+
+	// a deadline that isn't the caller's is a slow Redis
+	ReportError(t.Context(), context.DeadlineExceeded)
+	if Available() {
+		t.Fatal("Redis still available after a timeout of its own")
+	}
+}
+
+func TestInitRedisAppliesOptions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	opts := Options{
+		PoolSize:     7,
+		DialTimeout:  2 * time.Second,
+		ReadTimeout:  700 * time.Millisecond,
+		WriteTimeout: 900 * time.Millisecond,
+	}
+	if err := InitRedis("redis://"+mr.Addr(), opts); err != nil {
+		t.Fatal(err)
+	}
+	got := GetClient().Options()
+	if got.PoolSize != 7 || got.DialTimeout != 2*time.Second ||
+		got.ReadTimeout != 700*time.Millisecond || got.WriteTimeout != 900*time.Millisecond {
+		t.Fatalf("client options %+v", got)
+	}
+}
+
+func TestInitRedisKeepsDefaults(t *testing.T) {
+	mr := miniredis.RunT(t)
+	if err := InitRedis("redis://"+mr.Addr()+"?dial_timeout=4s", Options{}); err != nil {
+		t.Fatal(err)
+	}
+	got := GetClient().Options()
+	defaults := redis.NewClient(&redis.Options{}).Options()
+	if got.DialTimeout != 4*time.Second || got.PoolSize != defaults.PoolSize ||
+		got.ReadTimeout != defaults.ReadTimeout || got.WriteTimeout != defaults.WriteTimeout {
+		t.Fatalf("client options %+v", got)
+	}
+}
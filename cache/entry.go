@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// Compress gzips entry bodies of at least CompressMinBytes before they
+	// are written to Redis. tiny bodies aren't worth the overhead
+	Compress         bool
+	CompressMinBytes = 1024
+
+	// VerifyChecksum makes UnmarshalEntry check the body against the
+	// checksum Marshal stored with it
+	VerifyChecksum bool
+)
+
+// ErrChecksum is returned by UnmarshalEntry for a body that doesn't match
+// its checksum
+var ErrChecksum = errors.New("entry body does not match its checksum")
+
+// Entry is an origin response as it is stored in Redis. the status code and
+// headers are kept next to the body so a cache hit can be replayed exactly
+type Entry struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+
+	// NoCache is set when the origin sent Cache-Control: no-cache, meaning
+	// the entry may be stored but must not be served without going back to
+	// the origin first
+	NoCache bool `json:"no_cache,omitempty"`
+
+	// MustRevalidate is set when the origin sent must-revalidate or
+	// proxy-revalidate: once stale the entry is never served, not even when
+	// the origin fails, without the origin confirming it first
+	MustRevalidate bool `json:"must_revalidate,omitempty"`
+
+	// Vary lists the request headers named in the response's Vary header.
+	// an entry with Vary set and no Status is a marker stored under the
+	// plain key that says where to find the representation for a request
+	Vary []string `json:"vary,omitempty"`
+
+	// Encoding is the Content-Encoding the origin used before the body was
+	// decoded for storage, empty when it was stored as received
+	Encoding string `json:"encoding,omitempty"`
+
+	// Expires is when the entry stops being fresh. the Redis key may live
+	// longer so that a stale entry can still be revalidated
+	Expires time.Time `json:"expires,omitempty"`
+
+	// Stored is when the entry was written, used to report its Age
+	Stored time.Time `json:"stored,omitempty"`
+
+	// FetchTime is how long the origin took to produce the entry, which
+	// decides how early it is refreshed
+	FetchTime time.Duration `json:"fetch_time,omitempty"`
+
+	// Compressed marks a serialized Body as gzipped by Marshal. entries
+	// stored without it are read as they are
+	Compressed bool `json:"compressed,omitempty"`
+
+	// Checksum is the hex SHA-256 of the uncompressed Body, set by Marshal.
+	// entries stored without one are not verified
+	Checksum string `json:"checksum,omitempty"`
+
+	// graced marks a copy LRU.GetStale served past its expiry
+	graced bool
+}
+
+// Age returns how old the entry is: the Age the origin reported plus the
+// time since it was stored
+func (e *Entry) Age() time.Duration {
+	var age time.Duration
+	if secs, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		age = time.Duration(secs) * time.Second
+	}
+	if !e.Stored.IsZero() {
+		age += time.Since(e.Stored)
+	}
+	return age
+}
+
+// Fresh reports whether the entry may still be served without asking the
+// origin. entries written before Expires was recorded rely on the Redis
+// TTL alone and are always fresh
+func (e *Entry) Fresh() bool {
+	return e.Expires.IsZero() || time.Now().Before(e.Expires)
+}
+
+// Graced reports whether the entry is an expired copy from the in-memory
+// tier's grace window, see LRU.GetStale
+func (e *Entry) Graced() bool {
+	return e.graced
+}
+
+// CanRevalidate reports whether the origin can be asked if the entry is
+// still current with a conditional request
+func (e *Entry) CanRevalidate() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// IsVaryMarker reports whether e only points at per-variant entries
+func (e *Entry) IsVaryMarker() bool {
+	return e.Status == 0 && len(e.Vary) > 0
+}
+
+// Marshal serializes the entry for storage in Format together with a
+// checksum of its body, compressing the body when Compress is set. e
+// itself is left alone
+func (e *Entry) Marshal() ([]byte, error) {
+	stored := *e
+	stored.Checksum = checksum(e.Body)
+	if !Compress || len(e.Body) < CompressMinBytes {
+		return Format.Encode(&stored)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(e.Body)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	stored.Body = buf.Bytes()
+	stored.Compressed = true
+	recordCompression(len(e.Body), len(stored.Body))
+	return Format.Encode(&stored)
+}
+
+// checksum returns the hex SHA-256 of body
+func checksum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// UnmarshalEntry decodes an entry previously produced by Marshal, in
+// whichever format it was written
+func UnmarshalEntry(data []byte) (*Entry, error) {
+	format, err := formatOf(data)
+	if err != nil {
+		return nil, err
+	}
+	var e Entry
+	if err := format.Decode(data, &e); err != nil {
+		return nil, err
+	}
+	if e.Compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(e.Body))
+		if err != nil {
+			return nil, err
+		}
+		if e.Body, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+		e.Compressed = false
+	}
+	if VerifyChecksum && e.Checksum != "" && checksum(e.Body) != e.Checksum {
+		return nil, ErrChecksum
+	}
+	if e.Header == nil {
+		e.Header = http.Header{}
+	}
+	return &e, nil
+}
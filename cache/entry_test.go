@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntryAge(t *testing.T) {
+	stored := time.Now().Add(-5 * time.Second)
+	for _, tc := range []struct {
+		header string
+		stored time.Time
+		want   time.Duration
+	}{
+		{"", stored, 5 * time.Second},
+		{"10", stored, 15 * time.Second},
+		{"10", time.Time{}, 10 * time.Second},
+		{"-3", stored, 5 * time.Second},
+		{"soon", stored, 5 * time.Second},
+	} {
+		e := &Entry{Header: http.Header{}, Stored: tc.stored}
+		if tc.header != "" {
+			e.Header.Set("Age", tc.header)
+		}
+		if got := e.Age().Round(time.Second); got != tc.want {
+			t.Errorf("Age %q: %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestMarshalCompresses(t *testing.T) {
+	defer func(on bool) { Compress = on }(Compress)
+	body := []byte(strings.Repeat("compressible text ", 1000))
+	big := &Entry{Status: 200, Header: http.Header{}, Body: body}
+	small := &Entry{Status: 200, Header: http.Header{}, Body: []byte("tiny")}
+
+	Compress = false
+	plain, err := big.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Compress = true
+	packed, err := big.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packed)*4 > len(plain) {
+		t.Fatalf("compressed entry is %d bytes, uncompressed %d", len(packed), len(plain))
+	}
+	for name, data := range map[string][]byte{"compressed": packed, "uncompressed": plain} {
+		e, err := UnmarshalEntry(data)
+		if err != nil || !bytes.Equal(e.Body, body) || e.Compressed {
+			t.Fatalf("%s entry did not round-trip: %v", name, err)
+		}
+	}
+
+	data, err := small.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw Entry
+	if err := Format.Decode(data, &raw); err != nil || raw.Compressed {
+		t.Fatalf("a body under CompressMinBytes was compressed: %v", err)
+	}
+	if !bytes.Equal(big.Body, body) || big.Compressed {
+		t.Fatal("Marshal changed the entry it was given")
+	}
+}
+
+func TestUnmarshalVerifiesChecksums(t *testing.T) {
+	defer func() { VerifyChecksum = false }()
+	data, err := (&Entry{Status: 200, Body: []byte("body")}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Entry
+	if err := Format.Decode(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	e.Body = []byte("other")
+	tampered, err := Format.Encode(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	VerifyChecksum = true
+	if _, err := UnmarshalEntry(data); err != nil {
+		t.Fatalf("intact entry: %v", err)
+	}
+	if _, err := UnmarshalEntry(tampered); err != ErrChecksum {
+		t.Fatalf("tampered entry: %v, want ErrChecksum", err)
+	}
+	VerifyChecksum = false
+	if _, err := UnmarshalEntry(tampered); err != nil {
+		t.Fatalf("unverified: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sweepInterval is how often the number of keys is brought back under the
+// limit set by EnableEviction
+const sweepInterval = 10 * time.Second
+
+var (
+	// evictIndex is a sorted set of cache keys scored by when they were
+	// last used, evictMax the number of keys it may hold
+	evictIndex string
+	evictMax   int64
+	stopSweep  chan struct{}
+)
+
+// EnableEviction keeps at most max cache keys in Redis. every Touch records
+// when a key was used in the sorted set indexKey, and a background sweeper
+// deletes the least recently used keys once there are more than max. it
+// must be called after InitRedis
+func EnableEviction(indexKey string, max int64) {
+	evictIndex = indexKey
+	evictMax = max
+	if stopSweep != nil {
+		close(stopSweep)
+	}
+	stopSweep = make(chan struct{})
+	go sweep(stopSweep)
+}
+
+// Touch marks key as just used
+func Touch(ctx context.Context, key string) {
+	client, ok := redisClient()
+	if evictMax <= 0 || !ok || !Available() {
+		return
+	}
+	ReportError(ctx, client.ZAdd(ctx, evictIndex, redis.Z{
+		Score:  float64(time.Now().UnixMilli()),
+		Member: key,
+	}).Err())
+}
+
+// Evict deletes the least recently used keys until no more than the limit
+// set by EnableEviction remain, returning how many were evicted. keys that
+// already expired on their own still count until they are swept, but being
+// unused they are the first to go
+func Evict() (int64, error) {
+	client, ok := redisClient()
+	if evictMax <= 0 || !ok {
+		return 0, nil
+	}
+	n, err := client.ZCard(Ctx, evictIndex).Result()
+	if err != nil || n <= evictMax {
+		return 0, err
+	}
+	keys, err := client.ZRange(Ctx, evictIndex, 0, n-evictMax-1).Result()
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	members := make([]interface{}, len(keys))
+	for i, key := range keys {
+		members[i] = key
+	}
+	pipe := client.TxPipeline()
+	deleted := pipe.Del(Ctx, keys...)
+	pipe.ZRem(Ctx, evictIndex, members...)
+	if _, err := pipe.Exec(Ctx); err != nil {
+		return 0, err
+	}
+	return deleted.Val(), nil
+}
+
+// sweep runs Evict every sweepInterval until stop is closed
+func sweep(stop chan struct{}) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !Available() {
+			continue
+		}
+		n, err := Evict()
+		if err != nil {
+			ReportError(Ctx, err)
+		} else if n > 0 {
+			slog.Debug("evicted least recently used keys", "count", n)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestEvictDropsLeastRecentlyUsed(t *testing.T) {
+	mr := miniredis.RunT(t)
+	if err := InitRedis("redis://"+mr.Addr(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	EnableEviction("test:lru", 2)
+	defer EnableEviction("", 0)
+
+	for _, key := range []string{"a", "b", "c"} {
+		mr.Set(key, "x")
+		Touch(Ctx, key)
+		time.Sleep(2 * time.Millisecond)
+	}
+	Touch(Ctx, "a")
+	n, err := Evict()
+	if err != nil || n != 1 {
+		t.Fatalf("evicted %d, %v", n, err)
+	}
+	if mr.Exists("b") || !mr.Exists("a") || !mr.Exists("c") {
+		t.Fatalf("keys left %v", mr.Keys())
+	}
+	if members, _ := mr.ZMembers("test:lru"); len(members) != 2 {
+		t.Fatalf("index holds %v", members)
+	}
+	if n, err := Evict(); err != nil || n != 0 {
+		t.Fatalf("under the limit evicted %d, %v", n, err)
+	}
+}
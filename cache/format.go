@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Serializer turns entries into bytes for storage and back. the first byte
+// of everything a format writes is its Marker, which is how UnmarshalEntry
+// tells the formats apart: entries written in any known format stay
+// readable whatever Format is set to, and an entry in a format this
+// version doesn't know is an error instead of garbage
+type Serializer interface {
+	// Marker is the first byte of every serialized entry
+	Marker() byte
+	// Encode serializes e, starting with Marker
+	Encode(e *Entry) ([]byte, error)
+	// Decode reads an entry produced by Encode, Marker included, into e
+	Decode(data []byte, e *Entry) error
+}
+
+// Format is the Serializer Marshal writes entries with
+var Format Serializer = jsonFormat{}
+
+// formats are the serializers by name, as --cache-format takes them
+var formats = map[string]Serializer{
+	"json":    jsonFormat{},
+	"gob":     gobFormat{},
+	"msgpack": msgpackFormat{},
+}
+
+// FormatNamed returns the serializer called name: json, gob or msgpack
+func FormatNamed(name string) (Serializer, error) {
+	if s, ok := formats[name]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown cache format %q", name)
+}
+
+// formatOf returns the serializer that wrote data
+func formatOf(data []byte) (Serializer, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty entry")
+	}
+	for _, s := range formats {
+		if s.Marker() == data[0] {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown entry format %#x", data[0])
+}
+
+// jsonFormat is the readable format entries were always stored in. the
+// object's opening brace is its marker, so entries written before the
+// marker existed read as they are. binary bodies become base64
+type jsonFormat struct{}
+
+func (jsonFormat) Marker() byte { return '{' }
+
+func (jsonFormat) Encode(e *Entry) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func (jsonFormat) Decode(data []byte, e *Entry) error {
+	return json.Unmarshal(data, e)
+}
+
+// gobFormat stores entries with encoding/gob, the body as raw bytes
+type gobFormat struct{}
+
+func (gobFormat) Marker() byte { return 0x01 }
+
+func (f gobFormat) Encode(e *Entry) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{f.Marker()})
+	if err := gob.NewEncoder(buf).Encode(e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobFormat) Decode(data []byte, e *Entry) error {
+	return gob.NewDecoder(bytes.NewReader(data[1:])).Decode(e)
+}
+
+// msgpackFormat stores entries as a MessagePack map keyed like the JSON
+// object, the body as raw bytes. keys it doesn't know are skipped, so
+// fields added later don't break older readers
+type msgpackFormat struct{}
+
+func (msgpackFormat) Marker() byte { return 0x02 }
+
+func (f msgpackFormat) Encode(e *Entry) ([]byte, error) {
+	return appendMsgpackEntry([]byte{f.Marker()}, e), nil
+}
+
+func (msgpackFormat) Decode(data []byte, e *Entry) error {
+	return decodeMsgpackEntry(data[1:], e)
+}
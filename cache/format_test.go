@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// binaryBody returns n bytes taking every value
+func binaryBody(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+// testEntries are entries using every field, with binary bodies
+func testEntries() []*Entry {
+	now := time.Now()
+	return []*Entry{
+		{Status: 200, Header: http.Header{"Content-Type": {"image/png"}, "X-Many": {"a", "b"}}, Body: binaryBody(70000),
+			NoCache: true, Vary: []string{"Accept", "Accept-Encoding"}, Encoding: "gzip", Expires: now.Add(time.Hour),
+			Stored: now, FetchTime: 1234567 * time.Microsecond},
+		{Status: 404, Header: http.Header{}, Body: []byte("\x00\xff\x80 text")},
+		{Vary: []string{"Accept"}, Header: http.Header{}},
+		{Status: 301, Header: http.Header{"Location": {strings.Repeat("x", 300)}}},
+	}
+}
+
+func TestFormatsRoundTrip(t *testing.T) {
+	defer func(f Serializer, c bool) { Format, Compress = f, c }(Format, Compress)
+	for _, name := range []string{"json", "gob", "msgpack"} {
+		format, err := FormatNamed(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Format = format
+		for _, compress := range []bool{false, true} {
+			Compress = compress
+			for i, e := range testEntries() {
+				data, err := e.Marshal()
+				if err != nil {
+					t.Fatalf("%s %d: %v", name, i, err)
+				}
+				if data[0] != format.Marker() {
+					t.Fatalf("%s: marker %#x, want %#x", name, data[0], format.Marker())
+				}
+				got, err := UnmarshalEntry(data)
+				if err != nil {
+					t.Fatalf("%s %d: %v", name, i, err)
+				}
+				if got.Status != e.Status || !bytes.Equal(got.Body, e.Body) || got.NoCache != e.NoCache ||
+					!reflect.DeepEqual(got.Vary, e.Vary) || got.Encoding != e.Encoding || !got.Expires.Equal(e.Expires) ||
+					!got.Stored.Equal(e.Stored) || got.FetchTime != e.FetchTime || got.Checksum == "" {
+					t.Fatalf("%s %d, compressed %v: %+v", name, i, compress, got)
+				}
+				for k, v := range e.Header {
+					if !reflect.DeepEqual(got.Header[k], v) {
+						t.Fatalf("%s %d: header %s %v, want %v", name, i, k, got.Header[k], v)
+					}
+				}
+			}
+		}
+	}
+	if _, err := FormatNamed("xml"); err == nil {
+		t.Fatal("xml accepted")
+	}
+}
+
+func TestMsgpackKeepsBodiesBinary(t *testing.T) {
+	defer func(f Serializer) { Format = f }(Format)
+	e := &Entry{Status: 200, Header: http.Header{}, Body: binaryBody(1000)}
+	Format = jsonFormat{}
+	asJSON, _ := e.Marshal()
+	Format = msgpackFormat{}
+	asMsgpack, _ := e.Marshal()
+	// no base64: the body's 1000 bytes and little else
+	if len(asMsgpack) > 1200 || len(asMsgpack) >= len(asJSON) {
+		t.Fatalf("msgpack %d bytes, json %d", len(asMsgpack), len(asJSON))
+	}
+}
+
+func TestEntriesInEveryFormatStayReadable(t *testing.T) {
+	defer func(f Serializer) { Format = f }(Format)
+	var stored [][]byte
+	for _, format := range []Serializer{jsonFormat{}, gobFormat{}, msgpackFormat{}} {
+		Format = format
+		data, err := testEntries()[1].Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, data)
+	}
+	// whatever Format is now, entries in the others still read
+	Format = jsonFormat{}
+	for _, data := range stored {
+		if e, err := UnmarshalEntry(data); err != nil || e.Status != 404 {
+			t.Fatalf("marker %#x: %v", data[0], err)
+		}
+	}
+	if _, err := UnmarshalEntry([]byte{0x7e, 1, 2}); err == nil {
+		t.Fatal("an unknown marker was read")
+	}
+	if _, err := UnmarshalEntry(stored[2][:10]); err == nil {
+		t.Fatal("a truncated entry was read")
+	}
+}
+
+func TestMsgpackSkipsUnknownKeys(t *testing.T) {
+	// a map with a key from a later version in front of the status
+	extra := []byte{0x02, 0x82, 0xa3, 'n', 'e', 'w', 0x92, 0x01, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0, 0xa6, 's', 't', 'a', 't', 'u', 's', 0xcc, 200}
+	if e, err := UnmarshalEntry(extra); err != nil || e.Status != 200 {
+		t.Fatalf("%v %+v", err, e)
+	}
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+var (
+	// KeyPrefix starts every key written by the proxy
+	KeyPrefix = "proxy:"
+
+	// Version is part of every key, bumping it makes all existing entries
+	// unreachable at once. they expire from Redis on their own
+	Version string
+
+	// HashKeys replaces the request part of keys by its SHA-256, so very
+	// long URLs still produce short, fixed-length keys. the hash is worked
+	// out again from the URL whenever it is needed, so no mapping back to
+	// the URL is kept
+	HashKeys bool
+)
+
+// BuildKey returns the key of the representation of r selected by the
+// request headers named in vary: the Key of its method and URL followed by
+// what VariantKey adds for vary. r.URL is the absolute origin URL with its
+// path and query already normalized for caching. with no vary this is the
+// plain key of the URL, where a vary marker is kept
+func BuildKey(r *http.Request, vary []string) string {
+	return VariantKey(Key(r.Method, r.URL.String()), vary, r.Header)
+}
+
+// Key returns the plain key for a request: KeyPrefix and Version followed
+// by the method and target URL, or by their hash when HashKeys is set.
+// keys derived from it add parts after a "|", so the URL has its own "|"
+// escaped and no query can make up the key of another URL's variant,
+// lock or counter
+func Key(method, targetURL string) string {
+	key := method + " " + EscapeKeyPart(targetURL)
+	if HashKeys {
+		key = hashString(key)
+	}
+	if Version != "" {
+		return KeyPrefix + "v" + Version + ":" + key
+	}
+	return KeyPrefix + key
+}
+
+// VariantKey returns the key of the representation selected by the request
+// headers named in vary. values are canonicalized so that insignificant
+// whitespace doesn't create a separate entry, Accept-Encoding is cut down
+// to its encodingClass and Accept to its acceptClass. variant keys always
+// start with key followed by "|", which purging relies on, and the values
+// have their "|" escaped like the URL in Key
+func VariantKey(key string, vary []string, reqHeader http.Header) string {
+	if len(vary) == 0 {
+		return key
+	}
+	var b strings.Builder
+	for _, name := range vary {
+		b.WriteString("|")
+		b.WriteString(name)
+		b.WriteString("=")
+		switch {
+		case strings.EqualFold(name, "Accept-Encoding"):
+			b.WriteString(encodingClass(reqHeader))
+		case strings.EqualFold(name, "Accept"):
+			b.WriteString(EscapeKeyPart(acceptClass(reqHeader)))
+		default:
+			b.WriteString(EscapeKeyPart(canonicalValues(reqHeader.Values(name))))
+		}
+	}
+	if HashKeys {
+		return key + "|" + hashString(b.String())
+	}
+	return key + b.String()
+}
+
+// BodyKey returns the key of a request cached by its body, such as a POST
+// query, built from the plain key of its URL and a hash of body. like
+// variant keys it starts with key followed by "|"
+func BodyKey(key string, body []byte) string {
+	return key + "|body=" + checksum(body)
+}
+
+// AuthKey returns the key under which authenticated requests for the plain
+// key are cached, apart from anonymous ones. it starts with key followed by
+// "|" too
+func AuthKey(key string) string {
+	return key + "|auth"
+}
+
+// CookieKey returns the key of the representation selected by the values
+// of the named cookies of r, every other cookie being ignored. a cookie r
+// doesn't send is listed by its name alone, which no cookie that is sent
+// can look like, so requests without it share one entry. like variant keys
+// it starts with key followed by "|"
+func CookieKey(key string, names []string, r *http.Request) string {
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(";")
+		}
+		b.WriteString(name)
+		if c, err := r.Cookie(name); err == nil {
+			b.WriteString("=")
+			b.WriteString(EscapeKeyPart(c.Value))
+		}
+	}
+	if HashKeys {
+		return key + "|cookies=" + hashString(b.String())
+	}
+	return key + "|cookies=" + b.String()
+}
+
+// EscapeKeyPart returns s with every "|" percent-encoded, for anything
+// sent by a client that goes into a key, where "|" separates the parts
+// derived keys add
+func EscapeKeyPart(s string) string {
+	return strings.ReplaceAll(s, "|", "%7C")
+}
+
+// canonicalValues joins the comma-separated items of header values with
+// the whitespace around them and any empty items removed
+func canonicalValues(values []string) string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// hashString returns the hex SHA-256 of s
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
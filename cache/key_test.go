@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	defer func(prefix string) { KeyPrefix = prefix }(KeyPrefix)
+	if got, want := Key("GET", "http://o/a?x=1"), "proxy:GET http://o/a?x=1"; got != want {
+		t.Fatalf("default prefix: %q, want %q", got, want)
+	}
+	KeyPrefix = "shop:"
+	if got, want := Key("HEAD", "http://o/a"), "shop:HEAD http://o/a"; got != want {
+		t.Fatalf("custom prefix: %q, want %q", got, want)
+	}
+}
+
+func TestKeyVersion(t *testing.T) {
+	defer func() { Version = "" }()
+	Version = "7"
+	if got, want := Key("GET", "http://o/a"), KeyPrefix+"v7:GET http://o/a"; got != want {
+		t.Fatalf("versioned key: %q, want %q", got, want)
+	}
+}
+
+func TestHashedKeys(t *testing.T) {
+	HashKeys = true
+	defer func() { HashKeys = false }()
+
+	long := "http://o/search?q=" + strings.Repeat("a", 5000)
+	a := Key("GET", long)
+	if a != Key("GET", long) {
+		t.Fatal("hashing is not deterministic")
+	}
+	if !strings.HasPrefix(a, KeyPrefix) || len(a) != len(KeyPrefix)+64 {
+		t.Fatalf("hashed key %q", a)
+	}
+	if Key("GET", long+"b") == a || Key("HEAD", long) == a {
+		t.Fatal("different requests hashed to one key")
+	}
+	if strings.Contains(a, "search") {
+		t.Fatalf("hashed key %q still holds the URL", a)
+	}
+}
+
+func TestHashedKeysAreDistinctAndFixedLength(t *testing.T) {
+	HashKeys = true
+	defer func() { HashKeys = false }()
+
+	// 20000 URLs differing only in their tail, each mapped the same way
+	// twice and never onto another's key
+	long := "http://o/search?q=" + strings.Repeat("a", 5000)
+	seen := map[string]bool{}
+	for i := 0; i < 20000; i++ {
+		key := Key("GET", long+strconv.Itoa(i))
+		if len(key) != len(KeyPrefix)+64 || key != Key("GET", long+strconv.Itoa(i)) {
+			t.Fatalf("key %d: %q", i, key)
+		}
+		seen[key] = true
+	}
+	if len(seen) != 20000 {
+		t.Fatalf("20000 URLs hashed to %d keys", len(seen))
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	header := func(pairs ...string) http.Header {
+		h := http.Header{}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			h.Add(pairs[i], pairs[i+1])
+		}
+		return h
+	}
+	const key = "proxy:GET http://o/a"
+	for _, tc := range []struct {
+		name   string
+		vary   []string
+		header http.Header
+		want   string
+	}{
+		{"no vary", nil, header("Accept-Language", "de"), key},
+		{"one header", []string{"Accept-Language"}, header("Accept-Language", "de,  en"), key + "|Accept-Language=de,en"},
+		{"repeated header", []string{"Accept-Language"}, header("Accept-Language", "de", "Accept-Language", " en,"), key + "|Accept-Language=de,en"},
+		{"missing headers", []string{"Accept-Language", "X-Foo"}, header(), key + "|Accept-Language=|X-Foo="},
+		{"Accept-Encoding classes", []string{"Accept-Encoding"}, header("Accept-Encoding", "gzip, deflate, br"), key + "|Accept-Encoding=br"},
+		{"no encoding", []string{"Accept-Encoding"}, header(), key + "|Accept-Encoding=identity"},
+		{"Accept sorted without q", []string{"Accept"}, header("Accept", "b/c;level=1;q=0.2, a/b ,b/c; Level=1"), key + "|Accept=a/b,b/c;level=1"},
+		{"Accept preferences", []string{"Accept"}, header("Accept", "TEXT/HTML ; q=1,application/xml"), key + "|Accept=application/xml,text/html"},
+	} {
+		if got := VariantKey(key, tc.vary, tc.header); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	HashKeys = true
+	defer func() { HashKeys = false }()
+	a := VariantKey(key, []string{"Accept-Language"}, header("Accept-Language", "de"))
+	if a != VariantKey(key, []string{"Accept-Language"}, header("Accept-Language", "de")) ||
+		a == VariantKey(key, []string{"Accept-Language"}, header("Accept-Language", "en")) ||
+		!strings.HasPrefix(a, key+"|") || len(a) != len(key)+1+64 {
+		t.Fatalf("hashed variant key %q", a)
+	}
+}
+
+func TestCookieKeyUsesOnlyTheNamedCookies(t *testing.T) {
+	key := func(cookie string) string {
+		r, _ := http.NewRequest("GET", "http://o/", nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		return CookieKey("k", []string{"lang", "theme"}, r)
+	}
+	if a, b := key("lang=en; session=a"), key("session=b; lang=en"); a != b {
+		t.Fatalf("unrelated cookies changed the key: %q and %q", a, b)
+	}
+	if a, b := key("lang=en"), key("lang=de"); a == b {
+		t.Fatalf("lang=en and lang=de share the key %q", a)
+	}
+	// an absent cookie has a stable token of its own, unlike an empty one
+	if a, b := key(""), key("session=c"); a != b {
+		t.Fatalf("requests without the cookies got %q and %q", a, b)
+	}
+	if a, b := key(""), key("lang="); a == b {
+		t.Fatalf("an empty lang shares the key %q of no lang", a)
+	}
+	if got := key("lang=en"); !strings.HasPrefix(got, "k|") {
+		t.Fatalf("key %q does not start with the base key", got)
+	}
+}
+
+func TestClientTextCantMakeUpADerivedKey(t *testing.T) {
+	base := Key("GET", "http://o/a?x")
+	if got := Key("GET", "http://o/a?x|lock"); got == LockKey(base) || strings.Contains(got, "|") {
+		t.Fatalf("query with a separator: %q", got)
+	}
+	if got := Key("GET", "http://o/a?x|auth"); got == AuthKey(base) {
+		t.Fatalf("query made up the authenticated key %q", got)
+	}
+	if got, want := Key("GET", "http://o/a?x|y"), "proxy:GET http://o/a?x%7Cy"; got != want {
+		t.Fatalf("escaped key %q, want %q", got, want)
+	}
+
+	h := http.Header{"Accept-Language": {"de|auth"}}
+	if got := VariantKey(base, []string{"Accept-Language"}, h); got != base+"|Accept-Language=de%7Cauth" {
+		t.Fatalf("header value with a separator: %q", got)
+	}
+	r, _ := http.NewRequest("GET", "http://o/", nil)
+	r.Header.Set("Cookie", "lang=en|auth")
+	if got := CookieKey(base, []string{"lang"}, r); got != base+"|cookies=lang=en%7Cauth" {
+		t.Fatalf("cookie value with a separator: %q", got)
+	}
+}
+
+func TestBuildKey(t *testing.T) {
+	request := func(method, target string, pairs ...string) *http.Request {
+		r, err := http.NewRequest(method, target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			r.Header.Add(pairs[i], pairs[i+1])
+		}
+		return r
+	}
+	for _, tc := range []struct {
+		name    string
+		r       *http.Request
+		vary    []string
+		version string
+		want    string
+	}{
+		{"method and URL", request("GET", "http://o/a?x=1"), nil, "", "proxy:GET http://o/a?x=1"},
+		{"other method", request("POST", "http://o/a"), nil, "", "proxy:POST http://o/a"},
+		{"escaped path", request("GET", "http://o/a%2Fb"), nil, "", "proxy:GET http://o/a%2Fb"},
+		{"separator in the query", request("GET", "http://o/a?q=1|auth"), nil, "", "proxy:GET http://o/a?q=1%7Cauth"},
+		{"headers not varied on", request("GET", "http://o/a", "Accept-Language", "de"), nil, "", "proxy:GET http://o/a"},
+		{"varied header", request("GET", "http://o/a", "Accept-Language", "de, en"),
+			[]string{"Accept-Language"}, "", "proxy:GET http://o/a|Accept-Language=de,en"},
+		{"several varied headers", request("GET", "http://o/a", "Accept-Encoding", "gzip", "X-Tenant", "t1"),
+			[]string{"Accept-Encoding", "X-Tenant"}, "", "proxy:GET http://o/a|Accept-Encoding=gzip|X-Tenant=t1"},
+		{"version", request("GET", "http://o/a"), nil, "3", "proxy:v3:GET http://o/a"},
+	} {
+		Version = tc.version
+		if got := BuildKey(tc.r, tc.vary); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	Version = ""
+
+	HashKeys = true
+	defer func() { HashKeys = false }()
+	r := request("GET", "http://o/a", "Accept-Language", "de")
+	plain := BuildKey(r, nil)
+	varied := BuildKey(r, []string{"Accept-Language"})
+	if plain != Key("GET", "http://o/a") || len(plain) != len(KeyPrefix)+64 ||
+		!strings.HasPrefix(varied, plain+"|") || len(varied) != len(plain)+1+64 {
+		t.Fatalf("hashed keys %q and %q", plain, varied)
+	}
+}
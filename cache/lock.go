@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// unlockScript deletes a lock only while it still holds our token, so a
+// lock that expired and was taken by another instance is left alone
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// LockKey returns the key of the lock guarding the origin fetch for key.
+// like variant keys it starts with key followed by "|"
+func LockKey(key string) string {
+	return key + "|lock"
+}
+
+// Lock takes the lock named key for ttl unless another holder has it,
+// returning a func that gives it back. without Redis there is nobody to
+// share the cache with, and when Redis fails waiting would only make
+// matters worse, so the lock is then always taken
+func Lock(ctx context.Context, key string, ttl time.Duration) (unlock func(), ok bool) {
+	client, isRedis := redisClient()
+	if !isRedis || !Available() {
+		return func() {}, true
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	value := hex.EncodeToString(token)
+	ok, err := client.SetNX(ctx, key, value, ttl).Result()
+	if err != nil {
+		ReportError(ctx, err)
+		return func() {}, true
+	}
+	if !ok {
+		return nil, false
+	}
+	return func() {
+		ReportError(Ctx, unlockScript.Run(Ctx, client, []string{key}, value).Err())
+	}, true
+}
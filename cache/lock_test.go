@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestLockIsHeldByOneInstance(t *testing.T) {
+	mr := miniredis.RunT(t)
+	if err := InitRedis("redis://"+mr.Addr(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	unlock, ok := Lock(Ctx, LockKey("k"), time.Minute)
+	if !ok {
+		t.Fatal("a free lock wasn't taken")
+	}
+	if _, ok := Lock(Ctx, LockKey("k"), time.Minute); ok {
+		t.Fatal("a held lock was taken again")
+	}
+	if ttl := mr.TTL(LockKey("k")); ttl != time.Minute {
+		t.Fatalf("lock TTL %v", ttl)
+	}
+	unlock()
+	if mr.Exists(LockKey("k")) {
+		t.Fatal("lock not released")
+	}
+
+	// a lock that expired and went to someone else is theirs to release
+	unlock, _ = Lock(Ctx, LockKey("k"), time.Minute)
+	mr.Set(LockKey("k"), "theirs")
+	unlock()
+	if v, _ := mr.Get(LockKey("k")); v != "theirs" {
+		t.Fatalf("released another holder's lock, left %q", v)
+	}
+}
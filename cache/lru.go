@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LRU is a bounded in-memory cache of decoded entries that sits in front of
+// Redis so hot keys don't cost a network round trip. once full, the least
+// recently used entry is evicted. a nil *LRU is valid and caches nothing
+type LRU struct {
+	mu    sync.Mutex
+	size  int
+	grace time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key     string
+	entry   *Entry
+	expires time.Time
+}
+
+// NewLRU returns an LRU holding at most size entries
+func NewLRU(size int) *LRU {
+	return &LRU{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// SetGrace keeps expired entries around for grace longer, for GetStale
+func (c *LRU) SetGrace(grace time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.grace = grace
+}
+
+// Get returns the entry stored under key unless it has expired
+func (c *LRU) Get(key string) (*Entry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*lruItem)
+	if now := time.Now(); now.After(item.expires) {
+		if now.After(item.expires.Add(c.grace)) {
+			c.removeElement(el)
+		}
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return item.entry, true
+}
+
+// GetStale returns the entry stored under key once it has expired, for as
+// long as the grace given to SetGrace lasts. it is a copy telling so by
+// Graced, for a key the shared cache no longer has
+func (c *LRU) GetStale(key string) (*Entry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*lruItem)
+	now := time.Now()
+	if !now.After(item.expires) || now.After(item.expires.Add(c.grace)) {
+		return nil, false
+	}
+	graced := *item.entry
+	graced.graced = true
+	return &graced, true
+}
+
+// Add stores entry under key for ttl. entries are shared with callers and
+// must not be modified once added
+func (c *LRU) Add(key string, entry *Entry, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	if el, ok := c.items[key]; ok {
+		item := el.Value.(*lruItem)
+		item.entry = entry
+		item.expires = expires
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruItem{key: key, entry: entry, expires: expires})
+	for c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove drops key from the cache
+func (c *LRU) Remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// RemovePrefix drops every key starting with prefix and returns how many
+// were removed
+func (c *LRU) RemovePrefix(prefix string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, el := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(el)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *LRU) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*lruItem).key)
+}
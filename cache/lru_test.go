@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRU(2)
+	a, b, d := &Entry{}, &Entry{}, &Entry{}
+	c.Add("a", a, time.Minute)
+	c.Add("b", b, time.Minute)
+	c.Get("a")
+	c.Add("d", d, time.Minute)
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b, the least recently used, was kept")
+	}
+	if got, ok := c.Get("a"); !ok || got != a {
+		t.Fatal("a was evicted")
+	}
+	if got, ok := c.Get("d"); !ok || got != d {
+		t.Fatal("d was evicted")
+	}
+}
+
+func TestLRUExpires(t *testing.T) {
+	c := NewLRU(2)
+	c.Add("a", &Entry{}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expired entry served")
+	}
+	c.Add("b", &Entry{}, 0)
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("entry without a ttl was added")
+	}
+}
+
+func TestLRUGraceKeepsExpiredEntriesForGetStale(t *testing.T) {
+	c := NewLRU(2)
+	c.SetGrace(time.Minute)
+	entry := &Entry{Status: 200}
+	c.Add("a", entry, time.Millisecond)
+	if got, ok := c.GetStale("a"); ok || got != nil {
+		t.Fatal("fresh entry returned as stale")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expired entry served by Get")
+	}
+	got, ok := c.GetStale("a")
+	if !ok || !got.Graced() || got.Status != 200 {
+		t.Fatalf("GetStale within the grace: %+v %v", got, ok)
+	}
+	if entry.Graced() {
+		t.Fatal("GetStale marked the shared entry rather than a copy")
+	}
+
+	c.SetGrace(0)
+	if _, ok := c.GetStale("a"); ok {
+		t.Fatal("entry returned past its grace")
+	}
+}
+
+func TestLRURemove(t *testing.T) {
+	c := NewLRU(4)
+	for _, key := range []string{"GET:/a", "GET:/a|br", "GET:/ab", "GET:/b"} {
+		c.Add(key, &Entry{}, time.Minute)
+	}
+	c.Remove("GET:/b")
+	if _, ok := c.Get("GET:/b"); ok {
+		t.Fatal("removed entry served")
+	}
+	if n := c.RemovePrefix("GET:/a"); n != 3 {
+		t.Fatalf("RemovePrefix removed %d, want 3", n)
+	}
+	if _, ok := c.Get("GET:/a|br"); ok {
+		t.Fatal("entry under the prefix served")
+	}
+}
+
+func TestNilLRU(t *testing.T) {
+	var c *LRU
+	c.Add("a", &Entry{}, time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("nil LRU served an entry")
+	}
+	c.Remove("a")
+	c.RemovePrefix("a")
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often Memory drops expired keys nobody asked
+// for again
+const memorySweepInterval = time.Minute
+
+// Memory is a Cache kept in process. it is unbounded apart from expiry and
+// lost on restart. it never blocks, so the contexts it is given go unused
+type Memory struct {
+	mu        sync.Mutex
+	items     map[string]memoryItem
+	lastSweep time.Time
+}
+
+type memoryItem struct {
+	value   []byte
+	expires time.Time
+}
+
+// NewMemory returns an empty Memory
+func NewMemory() *Memory {
+	return &Memory{items: map[string]memoryItem{}, lastSweep: time.Now()}
+}
+
+func (item memoryItem) expired(now time.Time) bool {
+	return !item.expires.IsZero() && !now.Before(item.expires)
+}
+
+func (m *Memory) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[key]
+	if !ok || item.expired(time.Now()) {
+		return nil, ErrMiss
+	}
+	return item.value, nil
+}
+
+func (m *Memory) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.sweep(now)
+	item := memoryItem{value: value}
+	if ttl > 0 {
+		item.expires = now.Add(ttl)
+	}
+	m.items[key] = item
+	return nil
+}
+
+func (m *Memory) Delete(_ context.Context, keys ...string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	now := time.Now()
+	for _, key := range keys {
+		if item, ok := m.items[key]; ok {
+			if !item.expired(now) {
+				deleted++
+			}
+			delete(m.items, key)
+		}
+	}
+	return deleted, nil
+}
+
+func (m *Memory) TTL(_ context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[key]
+	if !ok || item.expires.IsZero() {
+		return 0, nil
+	}
+	return max(time.Until(item.expires), 0), nil
+}
+
+func (m *Memory) DeletePrefix(_ context.Context, prefix string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	now := time.Now()
+	for key, item := range m.items {
+		if strings.HasPrefix(key, prefix) {
+			if !item.expired(now) {
+				deleted++
+			}
+			delete(m.items, key)
+		}
+	}
+	return deleted, nil
+}
+
+func (m *Memory) Len(_ context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(time.Now())
+	return int64(len(m.items)), nil
+}
+
+func (m *Memory) Incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	item, ok := m.items[key]
+	if !ok || item.expired(now) {
+		item = memoryItem{value: []byte("0")}
+		if ttl > 0 {
+			item.expires = now.Add(ttl)
+		}
+	}
+	n, err := strconv.ParseInt(string(item.value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n++
+	item.value = []byte(strconv.FormatInt(n, 10))
+	m.items[key] = item
+	return n, nil
+}
+
+// sweep drops expired keys every memorySweepInterval. m.mu must be held
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < memorySweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, item := range m.items {
+		if item.expired(now) {
+			delete(m.items, key)
+		}
+	}
+}
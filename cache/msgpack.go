@@ -0,0 +1,325 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+)
+
+// the MessagePack encoding of entries, limited to the types an Entry needs
+// to write. reading copes with any type, to skip keys it doesn't know
+
+// errMsgpack is returned for MessagePack data that can't be an entry
+var errMsgpack = errors.New("malformed msgpack entry")
+
+// appendMsgpackEntry appends e to b as a map, leaving out empty fields like
+// the JSON encoding does
+func appendMsgpackEntry(b []byte, e *Entry) []byte {
+	type field struct {
+		name   string
+		append func([]byte) []byte
+	}
+	fields := []field{
+		{"status", func(b []byte) []byte { return appendMsgpackInt(b, int64(e.Status)) }},
+		{"header", func(b []byte) []byte { return appendMsgpackHeader(b, e.Header) }},
+		{"body", func(b []byte) []byte { return appendMsgpackBin(b, e.Body) }},
+	}
+	if e.NoCache {
+		fields = append(fields, field{"no_cache", func(b []byte) []byte { return appendMsgpackBool(b, true) }})
+	}
+	if e.MustRevalidate {
+		fields = append(fields, field{"must_revalidate", func(b []byte) []byte { return appendMsgpackBool(b, true) }})
+	}
+	if len(e.Vary) > 0 {
+		fields = append(fields, field{"vary", func(b []byte) []byte { return appendMsgpackStrings(b, e.Vary) }})
+	}
+	if e.Encoding != "" {
+		fields = append(fields, field{"encoding", func(b []byte) []byte { return appendMsgpackString(b, e.Encoding) }})
+	}
+	if !e.Expires.IsZero() {
+		fields = append(fields, field{"expires", func(b []byte) []byte { return appendMsgpackTime(b, e.Expires) }})
+	}
+	if !e.Stored.IsZero() {
+		fields = append(fields, field{"stored", func(b []byte) []byte { return appendMsgpackTime(b, e.Stored) }})
+	}
+	if e.FetchTime != 0 {
+		fields = append(fields, field{"fetch_time", func(b []byte) []byte { return appendMsgpackInt(b, int64(e.FetchTime)) }})
+	}
+	if e.Compressed {
+		fields = append(fields, field{"compressed", func(b []byte) []byte { return appendMsgpackBool(b, true) }})
+	}
+	if e.Checksum != "" {
+		fields = append(fields, field{"checksum", func(b []byte) []byte { return appendMsgpackString(b, e.Checksum) }})
+	}
+
+	b = appendMsgpackLen(b, len(fields), 0x80, 0xde, 0xdf)
+	for _, f := range fields {
+		b = appendMsgpackString(b, f.name)
+		b = f.append(b)
+	}
+	return b
+}
+
+// appendMsgpackLen appends the header of a map or array of n items, fix
+// being the type byte of the short form and big16 and big32 of the others
+func appendMsgpackLen(b []byte, n int, fix, big16, big32 byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, big16), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, big32), uint32(n))
+	}
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n < 128:
+		return append(b, byte(n))
+	case n >= -32 && n < 0:
+		return append(b, byte(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+	}
+}
+
+func appendMsgpackBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackBin(b []byte, data []byte) []byte {
+	switch n := len(data); {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+	return append(b, data...)
+}
+
+func appendMsgpackStrings(b []byte, items []string) []byte {
+	b = appendMsgpackLen(b, len(items), 0x90, 0xdc, 0xdd)
+	for _, item := range items {
+		b = appendMsgpackString(b, item)
+	}
+	return b
+}
+
+func appendMsgpackHeader(b []byte, h http.Header) []byte {
+	b = appendMsgpackLen(b, len(h), 0x80, 0xde, 0xdf)
+	for name, values := range h {
+		b = appendMsgpackString(b, name)
+		b = appendMsgpackStrings(b, values)
+	}
+	return b
+}
+
+// appendMsgpackTime appends t as the timestamp extension type -1 in its
+// 96-bit form, nanoseconds then seconds
+func appendMsgpackTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xc7, 12, 0xff)
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+	return binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+}
+
+// msgpackReader reads values off data
+type msgpackReader struct {
+	data []byte
+	err  error
+}
+
+// next returns the following n bytes, nil with r.err set when there
+// aren't as many
+func (r *msgpackReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = errMsgpack
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// uint reads a big-endian unsigned integer of n bytes
+func (r *msgpackReader) uint(n int) uint64 {
+	var v uint64
+	for _, c := range r.next(n) {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// header reads the type byte of the next value together with its length,
+// or its value for integers and booleans, whatever the type
+func (r *msgpackReader) header() (byte, int64) {
+	b := r.next(1)
+	if b == nil {
+		return 0, 0
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return 0x00, int64(c)
+	case c >= 0xe0:
+		return 0x00, int64(int8(c))
+	case c&0xf0 == 0x80:
+		return 0x80, int64(c & 0x0f)
+	case c&0xf0 == 0x90:
+		return 0x90, int64(c & 0x0f)
+	case c&0xe0 == 0xa0:
+		return 0xa0, int64(c & 0x1f)
+	}
+	switch c {
+	case 0xc0, 0xc2:
+		return c, 0
+	case 0xc3:
+		return 0xc2, 1
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return 0x00, int64(r.uint(1 << (c - 0xcc)))
+	case 0xd0:
+		return 0x00, int64(int8(r.uint(1)))
+	case 0xd1:
+		return 0x00, int64(int16(r.uint(2)))
+	case 0xd2:
+		return 0x00, int64(int32(r.uint(4)))
+	case 0xd3:
+		return 0x00, int64(r.uint(8))
+	case 0xca:
+		return c, 4
+	case 0xcb:
+		return c, 8
+	case 0xd9, 0xda, 0xdb:
+		return 0xa0, int64(r.uint(1 << (c - 0xd9)))
+	case 0xc4, 0xc5, 0xc6:
+		return 0xc4, int64(r.uint(1 << (c - 0xc4)))
+	case 0xdc, 0xdd:
+		return 0x90, int64(r.uint(2 << (c - 0xdc)))
+	case 0xde, 0xdf:
+		return 0x80, int64(r.uint(2 << (c - 0xde)))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		// fixext, the type byte comes before the data
+		return 0xc7, 1 + int64(1)<<(c-0xd4)
+	case 0xc7, 0xc8, 0xc9:
+		return 0xc7, 1 + int64(r.uint(1<<(c-0xc7)))
+	}
+	r.err = errMsgpack
+	return 0, 0
+}
+
+// skip reads past a value of the type and length header returned
+func (r *msgpackReader) skip(kind byte, n int64) {
+	switch kind {
+	case 0x80:
+		n *= 2
+		fallthrough
+	case 0x90:
+		for i := int64(0); i < n && r.err == nil; i++ {
+			r.skip(r.header())
+		}
+	case 0xa0, 0xc4, 0xc7, 0xca, 0xcb:
+		r.next(int(n))
+	}
+}
+
+// expect reads the header of a value that has to be of kind
+func (r *msgpackReader) expect(kind byte) int64 {
+	got, n := r.header()
+	if got != kind && r.err == nil {
+		r.err = errMsgpack
+	}
+	return n
+}
+
+func (r *msgpackReader) string() string {
+	return string(r.next(int(r.expect(0xa0))))
+}
+
+func (r *msgpackReader) strings() []string {
+	n := r.expect(0x90)
+	var items []string
+	for i := int64(0); i < n && r.err == nil; i++ {
+		items = append(items, r.string())
+	}
+	return items
+}
+
+func (r *msgpackReader) time() time.Time {
+	if n := r.expect(0xc7); n != 13 || r.err != nil {
+		r.err = errMsgpack
+		return time.Time{}
+	}
+	if ext := r.next(1); ext == nil || ext[0] != 0xff {
+		r.err = errMsgpack
+		return time.Time{}
+	}
+	nsec := r.uint(4)
+	sec := r.uint(8)
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+// decodeMsgpackEntry reads an entry written by appendMsgpackEntry into e
+func decodeMsgpackEntry(data []byte, e *Entry) error {
+	r := &msgpackReader{data: data}
+	n := r.expect(0x80)
+	for i := int64(0); i < n && r.err == nil; i++ {
+		switch r.string() {
+		case "status":
+			e.Status = int(r.expect(0x00))
+		case "header":
+			count := r.expect(0x80)
+			e.Header = make(http.Header, count)
+			for j := int64(0); j < count && r.err == nil; j++ {
+				name := r.string()
+				e.Header[name] = r.strings()
+			}
+		case "body":
+			e.Body = append([]byte(nil), r.next(int(r.expect(0xc4)))...)
+		case "no_cache":
+			e.NoCache = r.expect(0xc2) == 1
+		case "must_revalidate":
+			e.MustRevalidate = r.expect(0xc2) == 1
+		case "vary":
+			e.Vary = r.strings()
+		case "encoding":
+			e.Encoding = r.string()
+		case "expires":
+			e.Expires = r.time()
+		case "stored":
+			e.Stored = r.time()
+		case "fetch_time":
+			e.FetchTime = time.Duration(r.expect(0x00))
+		case "compressed":
+			e.Compressed = r.expect(0xc2) == 1
+		case "checksum":
+			e.Checksum = r.string()
+		default:
+			r.skip(r.header())
+		}
+	}
+	if r.err == nil && len(r.data) > 0 {
+		r.err = errMsgpack
+	}
+	return r.err
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats counts how requests were served: from the cache, by the origin, or
+// with an error. it is safe for use by many goroutines, the zero value is
+// ready to use
+type Stats struct {
+	// counting takes mu shared, so counts never wait on each other, and
+	// Snapshot takes it exclusively to read all of them at one instant
+	mu     sync.RWMutex
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	errors atomic.Uint64
+}
+
+// StatsSnapshot is the counts of a Stats at one instant
+type StatsSnapshot struct {
+	Hits   uint64
+	Misses uint64
+	Errors uint64
+}
+
+// Hit counts a request served from the cache
+func (s *Stats) Hit() {
+	s.mu.RLock()
+	s.hits.Add(1)
+	s.mu.RUnlock()
+}
+
+// Miss counts a cacheable request that had to go to the origin
+func (s *Stats) Miss() {
+	s.mu.RLock()
+	s.misses.Add(1)
+	s.mu.RUnlock()
+}
+
+// Error counts a request answered with an error because the origin failed
+func (s *Stats) Error() {
+	s.mu.RLock()
+	s.errors.Add(1)
+	s.mu.RUnlock()
+}
+
+// Snapshot returns the counts, all taken at the same instant so that, say,
+// the hit ratio worked out from them is one that actually was
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StatsSnapshot{Hits: s.hits.Load(), Misses: s.misses.Load(), Errors: s.errors.Load()}
+}
+
+// HitRatio returns the share of hits among hits and misses, 0 before any
+func (s StatsSnapshot) HitRatio() float64 {
+	if total := s.Hits + s.Misses; total > 0 {
+		return float64(s.Hits) / float64(total)
+	}
+	return 0
+}
+
+// compression sums up the bodies Marshal compressed, before and after
+var compression struct {
+	mu              sync.Mutex
+	entries         uint64
+	raw, compressed uint64
+}
+
+// CompressionSnapshot is how much the bodies compressed with Compress
+// took before and after
+type CompressionSnapshot struct {
+	Entries         uint64
+	RawBytes        uint64
+	CompressedBytes uint64
+}
+
+// recordCompression counts one body compressed from raw to compressed bytes
+func recordCompression(raw, compressed int) {
+	compression.mu.Lock()
+	defer compression.mu.Unlock()
+	compression.entries++
+	compression.raw += uint64(raw)
+	compression.compressed += uint64(compressed)
+}
+
+// Compression returns the sizes of every body compressed so far
+func Compression() CompressionSnapshot {
+	compression.mu.Lock()
+	defer compression.mu.Unlock()
+	return CompressionSnapshot{
+		Entries:         compression.entries,
+		RawBytes:        compression.raw,
+		CompressedBytes: compression.compressed,
+	}
+}
+
+// Ratio returns how many times smaller the compressed bodies are, taken
+// together, 0 before any was compressed
+func (c CompressionSnapshot) Ratio() float64 {
+	if c.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(c.RawBytes) / float64(c.CompressedBytes)
+}
+
+// SavedBytes returns how many bytes compression kept out of the cache. a
+// body that grew counts against it
+func (c CompressionSnapshot) SavedBytes() int64 {
+	return int64(c.RawBytes) - int64(c.CompressedBytes)
+}
@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestStatsCountFromManyGoroutines(t *testing.T) {
+	var s Stats
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	// every goroutine counts a hit before its miss, so a snapshot taken at
+	// one instant never has more misses than hits
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if snap := s.Snapshot(); snap.Misses > snap.Hits {
+				t.Errorf("snapshot %+v counted a miss before its hit", snap)
+				return
+			}
+		}
+	}()
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s.Hit()
+				s.Miss()
+				if i%10 == 0 {
+					s.Error()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-done
+
+	snap := s.Snapshot()
+	if snap.Hits != 50000 || snap.Misses != 50000 || snap.Errors != 5000 {
+		t.Fatalf("counted %+v, want 50000 hits and misses and 5000 errors", snap)
+	}
+	if ratio := snap.HitRatio(); ratio != 0.5 {
+		t.Fatalf("hit ratio %v, want 0.5", ratio)
+	}
+}
+
+func TestHitRatioWithoutRequests(t *testing.T) {
+	if ratio := (StatsSnapshot{}).HitRatio(); ratio != 0 {
+		t.Fatalf("hit ratio %v before any request, want 0", ratio)
+	}
+}
+
+func TestCompressionSnapshot(t *testing.T) {
+	if ratio := (CompressionSnapshot{}).Ratio(); ratio != 0 {
+		t.Fatalf("ratio %v before any body was compressed, want 0", ratio)
+	}
+	c := CompressionSnapshot{Entries: 2, RawBytes: 1000, CompressedBytes: 250}
+	if c.Ratio() != 4 || c.SavedBytes() != 750 {
+		t.Fatalf("%+v: ratio %v, %d saved, want 4 and 750", c, c.Ratio(), c.SavedBytes())
+	}
+	// a body that grew counts against the bytes saved
+	if saved := (CompressionSnapshot{RawBytes: 10, CompressedBytes: 30}).SavedBytes(); saved != -20 {
+		t.Fatalf("%d saved, want -20", saved)
+	}
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// TagKey returns the key of the set listing every cache key tagged with
+// tag, as given by an origin's Surrogate-Key header
+func TagKey(tag string) string {
+	return KeyPrefix + "__tag:" + tag
+}
+
+// Tag adds key to the set of each of tags. a set lives as long as the
+// longest lived key in it, ttl being how long key is kept
+func Tag(ctx context.Context, key string, tags []string, ttl time.Duration) {
+	client, ok := redisClient()
+	if len(tags) == 0 || !ok || !Available() {
+		return
+	}
+	pipe := client.Pipeline()
+	for _, tag := range tags {
+		pipe.SAdd(ctx, TagKey(tag), key)
+		// a new set has no expiry, which GT would treat as infinite
+		pipe.ExpireNX(ctx, TagKey(tag), ttl)
+		pipe.ExpireGT(ctx, TagKey(tag), ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	ReportError(ctx, err)
+}
+
+// PurgeTag deletes every key tagged with tag together with the tag's set,
+// returning the keys it held and how many were deleted. keys that already
+// expired are listed too. tags are only kept with the Redis backend
+func PurgeTag(ctx context.Context, tag string) ([]string, int64, error) {
+	client, ok := redisClient()
+	if !ok {
+		return nil, 0, errors.New("tag purges need the redis cache backend")
+	}
+	keys, err := client.SMembers(ctx, TagKey(tag)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	var deleted int64
+	if len(keys) > 0 {
+		if deleted, err = client.Del(ctx, keys...).Result(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return keys, deleted, client.Del(ctx, TagKey(tag)).Err()
+}
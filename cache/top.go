@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// topIndex is a sorted set of cache keys scored by how often they were
+	// requested, topWindow how long it counts before starting over
+	topIndex  string
+	topWindow time.Duration
+)
+
+// KeyCount is a key and how often it was requested
+type KeyCount struct {
+	Key   string
+	Count int64
+}
+
+// EnableTopKeys counts the requests for every key in the sorted set
+// indexKey. with a window the set expires that long after its first count,
+// so the counts cover one window at a time, without one they add up until
+// ResetTopKeys. it must be called after InitRedis
+func EnableTopKeys(indexKey string, window time.Duration) {
+	topIndex = indexKey
+	topWindow = window
+}
+
+// CountRequest adds one to the request count of key
+func CountRequest(ctx context.Context, key string) {
+	client, ok := redisClient()
+	if topIndex == "" || !ok || !Available() {
+		return
+	}
+	pipe := client.Pipeline()
+	pipe.ZIncrBy(ctx, topIndex, 1, key)
+	if topWindow > 0 {
+		pipe.ExpireNX(ctx, topIndex, topWindow)
+	}
+	_, err := pipe.Exec(ctx)
+	ReportError(ctx, err)
+}
+
+// TopKeys returns the n most requested keys, most requested first
+func TopKeys(ctx context.Context, n int64) ([]KeyCount, error) {
+	client, ok := redisClient()
+	if !ok {
+		return nil, errors.New("top keys need the redis cache backend")
+	}
+	if topIndex == "" {
+		return nil, errors.New("top keys are not being counted")
+	}
+	scores, err := client.ZRevRangeWithScores(ctx, topIndex, 0, n-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]KeyCount, len(scores))
+	for i, z := range scores {
+		keys[i] = KeyCount{Key: z.Member.(string), Count: int64(z.Score)}
+	}
+	return keys, nil
+}
+
+// ResetTopKeys sets every request count back to zero
+func ResetTopKeys(ctx context.Context) error {
+	client, ok := redisClient()
+	if topIndex == "" || !ok {
+		return nil
+	}
+	return client.Del(ctx, topIndex).Err()
+}
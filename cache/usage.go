@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StoredBytes returns the size of the values stored under KeyPrefix. in
+// Redis the keys are walked with SCAN and their lengths summed, which is
+// what the entries take up apart from Redis's own per-key overhead. keys
+// that aren't strings, like the eviction index and tag sets, are left out
+func StoredBytes(ctx context.Context) (int64, error) {
+	switch c := backend.(type) {
+	case redisCache:
+		return c.storedBytes(ctx, KeyPrefix)
+	case *Memory:
+		return c.storedBytes(KeyPrefix), nil
+	}
+	return 0, nil
+}
+
+// StoredKeys returns how many keys there are under KeyPrefix. in Redis
+// they are counted with SCAN, DBSIZE counting the keys of every other user
+// of the database too. a backend of another kind is asked its Len
+func StoredKeys(ctx context.Context) (int64, error) {
+	switch c := backend.(type) {
+	case redisCache:
+		return c.storedKeys(ctx, KeyPrefix)
+	case *Memory:
+		return c.storedKeys(KeyPrefix), nil
+	case nil:
+		return 0, nil
+	}
+	return backend.Len(ctx)
+}
+
+func (c redisCache) storedKeys(ctx context.Context, prefix string) (int64, error) {
+	var n int64
+	iter := c.client.Scan(ctx, 0, escapePattern(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		n++
+	}
+	return n, iter.Err()
+}
+
+func (c redisCache) storedBytes(ctx context.Context, prefix string) (int64, error) {
+	var total int64
+	var keys []string
+	iter := c.client.Scan(ctx, 0, escapePattern(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		if keys = append(keys, iter.Val()); len(keys) < 100 {
+			continue
+		}
+		n, err := c.strlen(ctx, keys)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		keys = keys[:0]
+	}
+	if err := iter.Err(); err != nil {
+		return total, err
+	}
+	n, err := c.strlen(ctx, keys)
+	return total + n, err
+}
+
+// strlen sums the lengths of the string values under keys in one round trip
+func (c redisCache) strlen(ctx context.Context, keys []string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	pipe := c.client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.StrLen(ctx, key)
+	}
+	// a WRONGTYPE reply for a key that isn't a string is not a failure
+	if _, err := pipe.Exec(ctx); err != nil && !isRedisReply(err) {
+		return 0, err
+	}
+	var total int64
+	for _, cmd := range cmds {
+		if cmd.Err() == nil {
+			total += cmd.Val()
+		}
+	}
+	return total, nil
+}
+
+// isRedisReply reports whether err is an error reply from Redis rather than
+// a failure to reach it
+func isRedisReply(err error) bool {
+	_, ok := err.(redis.Error)
+	return ok
+}
+
+func (m *Memory) storedBytes(prefix string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	now := time.Now()
+	for key, item := range m.items {
+		if strings.HasPrefix(key, prefix) && !item.expired(now) {
+			total += int64(len(item.value))
+		}
+	}
+	return total
+}
+
+func (m *Memory) storedKeys(prefix string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	now := time.Now()
+	for key, item := range m.items {
+		if strings.HasPrefix(key, prefix) && !item.expired(now) {
+			n++
+		}
+	}
+	return n
+}
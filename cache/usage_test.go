@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestStoredBytesCountsOnlyOurStrings(t *testing.T) {
+	mr := miniredis.RunT(t)
+	if err := InitRedis("redis://"+mr.Addr(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	mr.Set(KeyPrefix+"a", strings.Repeat("a", 100))
+	mr.Set(KeyPrefix+"b", strings.Repeat("b", 50))
+	mr.SAdd(KeyPrefix+"tag:x", "a")
+	mr.Set("other", strings.Repeat("o", 5000))
+	if n, err := StoredBytes(context.Background()); err != nil || n != 150 {
+		t.Fatalf("redis: %d, %v, want 150", n, err)
+	}
+
+	defer Use(backend)
+	m := NewMemory()
+	Use(m)
+	m.Set(context.Background(), KeyPrefix+"a", []byte("12345"), 0)
+	m.Set(context.Background(), "b", []byte("12345"), 0)
+	if n, err := StoredBytes(context.Background()); err != nil || n != 5 {
+		t.Fatalf("memory: %d, %v, want 5", n, err)
+	}
+}
+
+func TestStoredKeysCountsOnlyOurKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	if err := InitRedis("redis://"+mr.Addr(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	mr.Set("other:key", "x")
+	mr.Set(KeyPrefix+"a", "x")
+	mr.Set(KeyPrefix+"b", "x")
+	if n, err := StoredKeys(context.Background()); err != nil || n != 2 {
+		t.Fatalf("redis: %d, %v, want 2", n, err)
+	}
+}
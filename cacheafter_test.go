@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestCacheAfterN(t *testing.T) {
+	defer func() { cacheAfter, cacheAfterWindow = 0, 0 }()
+	for _, backend := range []string{"redis", "memory"} {
+		mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("x"))
+		})
+		if backend == "memory" {
+			cache.Use(cache.NewMemory())
+		}
+		cacheAfter, cacheAfterWindow = 3, time.Minute
+		for i := 1; i <= 2; i++ {
+			if got := doRequest("GET", "/n").Header().Get("X-Cache"); got != "MISS" {
+				t.Fatalf("%s request %d: X-Cache %q", backend, i, got)
+			}
+			if backend == "redis" && mr.Exists(keyFor("/n")) {
+				t.Fatalf("%s stored after %d requests", backend, i)
+			}
+		}
+		doRequest("GET", "/n")
+		if got := doRequest("GET", "/n").Header().Get("X-Cache"); got != "HIT" || hits.Load() != 3 {
+			t.Fatalf("%s past the threshold: X-Cache %q, %d origin requests", backend, got, hits.Load())
+		}
+	}
+}
+
+func TestCacheAfterCountsWithinTheWindow(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+	})
+	cacheAfter, cacheAfterWindow = 2, time.Minute
+	defer func() { cacheAfter, cacheAfterWindow = 0, 0 }()
+
+	doRequest("GET", "/w")
+	mr.FastForward(2 * time.Minute)
+	doRequest("GET", "/w")
+	if mr.Exists(keyFor("/w")) {
+		t.Fatal("requests in different windows added up")
+	}
+	doRequest("GET", "/w")
+	if !mr.Exists(keyFor("/w")) {
+		t.Fatal("not stored after two requests in one window")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// cacheControl holds the directives of a Cache-Control header keyed by their
+// lowercased name. directives without an argument map to an empty string
+type cacheControl map[string]string
+
+// parseCacheControl merges every Cache-Control header in h into one set of
+// directives
+func parseCacheControl(h http.Header) cacheControl {
+	return parseDirectives(h.Values("Cache-Control"))
+}
+
+// parseDirectives parses comma-separated name or name=value directives
+// the way Cache-Control has them
+func parseDirectives(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(part, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return cc
+}
+
+// requestCacheControl returns the directives of a request. with
+// --honor-pragma a request without Cache-Control but with the HTTP/1.0
+// Pragma: no-cache is taken as Cache-Control: no-cache (RFC 7234 5.4)
+func requestCacheControl(h http.Header) cacheControl {
+	cc := parseCacheControl(h)
+	if honorPragma && len(h.Values("Cache-Control")) == 0 && headerHasToken(h, "Pragma", "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+// tooOldForClient reports whether the max-age or min-fresh of a request
+// rule out answering it with entry as it is, though it may be fresh: it
+// is older than max-age, or expires within min-fresh (RFC 7234 5.2.1)
+func tooOldForClient(cc cacheControl, entry *cache.Entry) bool {
+	if maxAge, ok := cc.seconds("max-age"); ok && entry.Age() > maxAge {
+		return true
+	}
+	minFresh, ok := cc.seconds("min-fresh")
+	return ok && !entry.Expires.IsZero() && time.Until(entry.Expires) < minFresh
+}
+
+// withinMaxStale reports whether the max-stale of a request lets entry be
+// served although it expired: for any time past its expiry without an
+// argument, for at most that many seconds with one. must-revalidate
+// still wins
+func withinMaxStale(cc cacheControl, entry *cache.Entry) bool {
+	arg, ok := cc["max-stale"]
+	if !ok || entry.Fresh() || entry.MustRevalidate {
+		return false
+	}
+	if arg == "" {
+		return true
+	}
+	maxStale, ok := cc.seconds("max-stale")
+	return ok && time.Since(entry.Expires) <= maxStale
+}
+
+// bypassHeader and bypassParam let a client skip the cache for one request
+// with --allow-bypass-header, X-Bypass-Cache: 1 or ?nocache=1
+const (
+	bypassHeader = "X-Bypass-Cache"
+	bypassParam  = "nocache"
+)
+
+// takeBypass reports whether r asks to bypass the cache, by header or by
+// query parameter, removing both so they neither reach the origin nor go
+// into the cache key. without --allow-bypass-header r is left alone
+func takeBypass(r *http.Request) bool {
+	if !allowBypassHeader {
+		return false
+	}
+	bypass := isTrue(r.Header.Get(bypassHeader))
+	r.Header.Del(bypassHeader)
+	if query := r.URL.Query(); query.Has(bypassParam) {
+		bypass = bypass || isTrue(query.Get(bypassParam))
+		query.Del(bypassParam)
+		r.URL.RawQuery = query.Encode()
+	}
+	return bypass
+}
+
+// isTrue reports whether a bypass marker is set, as 1 or true
+func isTrue(value string) bool {
+	b, err := strconv.ParseBool(value)
+	return err == nil && b
+}
+
+// proxyCacheHeader lets an origin tell the proxy how to cache a response,
+// X-Proxy-Cache: skip to keep it out of the cache or ttl=120 to store it
+// for that many seconds whatever Cache-Control and the defaults say. it is
+// meant for the proxy alone and never reaches clients
+const proxyCacheHeader = "X-Proxy-Cache"
+
+// takeProxyCache returns the X-Proxy-Cache directives of h, removing the
+// header
+func takeProxyCache(h http.Header) cacheControl {
+	pc := parseDirectives(h.Values(proxyCacheHeader))
+	h.Del(proxyCacheHeader)
+	return pc
+}
+
+// has reports whether the directive is present
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of a directive such as max-age
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// responseTTL works out how long a response for u may be stored. the
+// origin's caching headers decide. when the origin says nothing a
+// --ttl-override for the path is used, else --ttl-with-query or
+// --ttl-no-query depending on whether u has a query, else defaultTTL, or
+// negativeTTL for a 404 or 410 and --redirect-ttl for a redirect. with
+// --ttl-override-wins an override beats the origin. whichever it is, the
+// result is kept within --min-ttl and --max-ttl, except that a zero TTL,
+// which has the entry revalidated on every request, stays zero
+func responseTTL(u *url.URL, status int, h http.Header, cc cacheControl) time.Duration {
+	return clampTTL(chooseTTL(u, status, h, cc))
+}
+
+// clampTTL keeps ttl within --min-ttl and --max-ttl, leaving a zero TTL zero
+func clampTTL(ttl time.Duration) time.Duration {
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl > 0 && ttl < minTTL {
+		ttl = minTTL
+	}
+	return ttl
+}
+
+// jitterTTL moves ttl by a random amount of up to --ttl-jitter percent
+// either way, so entries stored together don't all expire together. it
+// stays above zero, the jitter being under 100%, and within --max-ttl. a
+// zero TTL is left alone
+func jitterTTL(ttl time.Duration) time.Duration {
+	if ttlJitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	ttl += time.Duration(float64(ttl) * ttlJitter / 100 * (2*rand.Float64() - 1))
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return max(ttl, time.Millisecond)
+}
+
+// chooseTTL picks the TTL responseTTL then clamps
+func chooseTTL(u *url.URL, status int, h http.Header, cc cacheControl) time.Duration {
+	override, overridden := ttlOverrides.TTL(u.Path)
+	if overridden && ttlOverrideWins {
+		return override
+	}
+
+	ttl, ok := originTTL(h, cc)
+	switch {
+	case ok:
+		return ttl
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return negativeTTL
+	case status >= 300 && status < 400 && redirectTTL > 0:
+		return redirectTTL
+	case overridden:
+		return override
+	case u.RawQuery != "" && ttlWithQuery > 0:
+		return ttlWithQuery
+	case u.RawQuery == "" && ttlNoQuery > 0:
+		return ttlNoQuery
+	default:
+		return defaultTTL
+	}
+}
+
+// originTTL returns the lifetime the origin gave a response. s-maxage wins
+// over max-age since we are a shared cache, and Expires is only consulted
+// when neither is present. a response that already spent time in an
+// upstream cache, as told by its Age, has that much less left
+func originTTL(h http.Header, cc cacheControl) (time.Duration, bool) {
+	maxAge, ok := cc.seconds("s-maxage")
+	if !ok {
+		maxAge, ok = cc.seconds("max-age")
+	}
+	if ok {
+		if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && age > 0 {
+			maxAge -= time.Duration(age) * time.Second
+		}
+		return max(maxAge, 0), true
+	}
+	expires := h.Get("Expires")
+	if expires == "" {
+		return 0, false
+	}
+	// an Expires value that can't be parsed means already expired
+	t, err := http.ParseTime(expires)
+	if err != nil {
+		return 0, true
+	}
+	now := time.Now()
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		now = date
+	}
+	return t.Sub(now), true
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOriginTTL(t *testing.T) {
+	now := time.Now().UTC()
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, 60 * time.Second, true},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=60, s-maxage=600"}}, 600 * time.Second, true},
+		{"max-age wins over Expires", http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Expires":       {now.Add(time.Hour).Format(http.TimeFormat)},
+		}, 60 * time.Second, true},
+		{"Expires", http.Header{
+			"Date":    {now.Format(http.TimeFormat)},
+			"Expires": {now.Add(2 * time.Minute).Format(http.TimeFormat)},
+		}, 2 * time.Minute, true},
+		{"invalid Expires", http.Header{"Expires": {"0"}}, 0, true},
+		{"nothing", http.Header{}, 0, false},
+	} {
+		got, ok := originTTL(tc.header, parseCacheControl(tc.header))
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%s: got %v %v, want %v %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestMaxAgeBecomesRedisTTL(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/minute":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/forever":
+			w.Header().Set("Cache-Control", "max-age=31536000")
+		}
+		w.Write([]byte("x"))
+	})
+	doRequest("GET", "/minute")
+	doRequest("GET", "/default")
+	doRequest("GET", "/forever")
+	for path, want := range map[string]time.Duration{
+		"/minute":  60 * time.Second,
+		"/default": defaultTTL,
+		"/forever": maxTTL,
+	} {
+		if got := mr.TTL(keyFor(path)); got != want {
+			t.Errorf("%s: TTL %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestMissingResourcesGetTheNegativeTTL(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/missing-with-ttl":
+			w.Header().Set("Cache-Control", "max-age=120")
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("not here"))
+	})
+	for _, path := range []string{"/missing", "/gone", "/missing-with-ttl"} {
+		doRequest("GET", path)
+	}
+	for path, want := range map[string]time.Duration{
+		"/missing":          negativeTTL,
+		"/gone":             negativeTTL,
+		"/missing-with-ttl": 120 * time.Second,
+	} {
+		if got := mr.TTL(keyFor(path)); got != want {
+			t.Errorf("%s: TTL %v, want %v", path, got, want)
+		}
+	}
+
+	rec := doRequest("GET", "/missing")
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "not here" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("cached 404 replayed as %d %q %q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if hits.Load() != 3 {
+		t.Fatalf("origin hit %d times", hits.Load())
+	}
+}
+
+func TestDefaultTTLAppliesWithoutCacheControl(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("x")) })
+	defaultTTL = time.Minute
+	doRequest("GET", "/plain")
+	if got := mr.TTL(keyFor("/plain")); got != 60*time.Second {
+		t.Fatalf("TTL %v, want 60s", got)
+	}
+}
+
+func TestTTLByQueryString(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/explicit" {
+			w.Header().Set("Cache-Control", "max-age=30")
+		}
+		w.Write([]byte("x"))
+	})
+	ttlNoQuery, ttlWithQuery = time.Hour, 10*time.Second
+	ttlOverrides = TTLOverrides{}
+	if err := ttlOverrides.Set("/static=2h"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { ttlNoQuery, ttlWithQuery, ttlOverrides = 0, 0, TTLOverrides{} }()
+
+	// the origin's caching headers come first, then --ttl-override, then
+	// the TTL for URLs with or without a query
+	for _, tc := range []struct {
+		target string
+		want   time.Duration
+	}{
+		{"/page", time.Hour},
+		{"/search?q=1", 10 * time.Second},
+		{"/explicit?q=1", 30 * time.Second},
+		{"/explicit", 30 * time.Second},
+		{"/static/a.css?v=3", 2 * time.Hour},
+		{"/static/a.css", 2 * time.Hour},
+	} {
+		doRequest("GET", tc.target)
+		if got := mr.TTL(keyFor(tc.target)); got != tc.want {
+			t.Errorf("%s: TTL %v, want %v", tc.target, got, tc.want)
+		}
+	}
+
+	ttlWithQuery = 0
+	doRequest("GET", "/other?q=1")
+	if got := mr.TTL(keyFor("/other?q=1")); got != defaultTTL {
+		t.Errorf("without --ttl-with-query: TTL %v, want --default-ttl", got)
+	}
+}
+
+func TestOriginMaxAgeIsClampedToMaxTTL(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/year":
+			w.Header().Set("Cache-Control", "max-age=31536000")
+		case "/short":
+			w.Header().Set("Cache-Control", "max-age=1")
+		case "/zero":
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("ETag", `"z"`)
+		}
+		w.Write([]byte("x"))
+	})
+	defer func(max, min time.Duration, o TTLOverrides) { maxTTL, minTTL, ttlOverrides = max, min, o }(maxTTL, minTTL, ttlOverrides)
+	maxTTL, minTTL = time.Hour, 5*time.Second
+	ttlOverrides = TTLOverrides{}
+	ttlOverrides.Set("/static=48h")
+
+	for target, want := range map[string]time.Duration{
+		"/year":       time.Hour,
+		"/static/a":   time.Hour,
+		"/short":      5 * time.Second,
+		"/no-headers": 5 * time.Minute,
+	} {
+		doRequest("GET", target)
+		if got := mr.TTL(keyFor(target)); got != want {
+			t.Errorf("%s: TTL %v, want %v", target, got, want)
+		}
+	}
+
+	// max-age=0 keeps meaning revalidate every time
+	doRequest("GET", "/zero")
+	if w := doRequest("GET", "/zero"); w.Header().Get("X-Cache") == "HIT" {
+		t.Fatal("a max-age=0 entry was served as a hit")
+	}
+}
+
+func TestPragmaNoCacheForcesAnOriginFetch(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+	defer func(v bool) { honorPragma = v }(honorPragma)
+	honorPragma = true
+
+	doRequest("GET", "/a")
+	if rec := doRequest("GET", "/a", "Pragma", "no-cache"); rec.Header().Get("X-Cache") == "HIT" || hits.Load() != 2 {
+		t.Fatalf("Pragma: no-cache answered from the cache: X-Cache %q, %d origin requests", rec.Header().Get("X-Cache"), hits.Load())
+	}
+	// Cache-Control wins over Pragma
+	if rec := doRequest("GET", "/a", "Pragma", "no-cache", "Cache-Control", "max-age=60"); rec.Header().Get("X-Cache") != "HIT" || hits.Load() != 2 {
+		t.Fatalf("with Cache-Control: X-Cache %q, %d origin requests", rec.Header().Get("X-Cache"), hits.Load())
+	}
+
+	honorPragma = false
+	if rec := doRequest("GET", "/a", "Pragma", "no-cache"); rec.Header().Get("X-Cache") != "HIT" || hits.Load() != 2 {
+		t.Fatalf("--honor-pragma=false: X-Cache %q, %d origin requests", rec.Header().Get("X-Cache"), hits.Load())
+	}
+}
+
+func TestStoredTTLsVaryWithinTheJitterBand(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1000")
+		w.Write([]byte("ok"))
+	})
+	defer func(v float64) { ttlJitter = v }(ttlJitter)
+	ttlJitter = 10
+
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		path := fmt.Sprintf("/j%d", i)
+		doRequest("GET", path)
+		ttl := mr.TTL(keyFor(path))
+		if ttl < 900*time.Second || ttl > 1100*time.Second {
+			t.Fatalf("%s: TTL %v outside 1000s ±10%%", path, ttl)
+		}
+		seen[ttl] = true
+	}
+	if len(seen) < 20 {
+		t.Fatalf("100 TTLs took only %d values", len(seen))
+	}
+}
+
+func TestJitteredTTLsStayPositive(t *testing.T) {
+	defer func(v float64, max time.Duration) { ttlJitter, maxTTL = v, max }(ttlJitter, maxTTL)
+	ttlJitter, maxTTL = 99, 1500*time.Millisecond
+	for i := 0; i < 1000; i++ {
+		if ttl := jitterTTL(time.Second); ttl <= 0 || ttl > maxTTL {
+			t.Fatalf("jittered TTL %v", ttl)
+		}
+	}
+	if jitterTTL(0) != 0 {
+		t.Fatal("a zero TTL was jittered")
+	}
+	if out := startupError(t, "--origin=http://origin.test", "--ttl-jitter=100"); !strings.Contains(out, "Error: --ttl-jitter must be a percentage from 0 to below 100") {
+		t.Fatal(out)
+	}
+}
+
+// proxyCacheOrigin answers with the X-Proxy-Cache directives of each path
+func proxyCacheOrigin(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/skip":
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Header().Set("X-Proxy-Cache", "skip")
+	case "/ttl":
+		w.Header().Set("Cache-Control", "max-age=5")
+		w.Header().Set("X-Proxy-Cache", "ttl=120")
+	case "/plain":
+		w.Header().Set("X-Proxy-Cache", "ttl=90")
+	case "/big":
+		w.Header().Set("X-Proxy-Cache", "ttl=90")
+		w.Write([]byte(strings.Repeat("x", 2000)))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func TestXProxyCacheSkipKeepsAResponseOutOfTheCache(t *testing.T) {
+	mr, hits := newTestProxy(t, proxyCacheOrigin)
+
+	doRequest("GET", "/skip")
+	rec := doRequest("GET", "/skip")
+	if rec.Header().Get("X-Cache") != "MISS" || hits.Load() != 2 || mr.Exists(keyFor("/skip")) {
+		t.Fatalf("skipped response cached: X-Cache %q, origin hit %d times", rec.Header().Get("X-Cache"), hits.Load())
+	}
+	if v := rec.Header().Get("X-Proxy-Cache"); v != "" {
+		t.Fatalf("X-Proxy-Cache %q reached the client", v)
+	}
+}
+
+func TestXProxyCacheTTLOverridesTheOriginTTL(t *testing.T) {
+	mr, _ := newTestProxy(t, proxyCacheOrigin)
+
+	rec := doRequest("GET", "/ttl")
+	if ttl := mr.TTL(keyFor("/ttl")); ttl != 120*time.Second {
+		t.Fatalf("stored for %v, want 2m0s over max-age=5", ttl)
+	}
+	if v := rec.Header().Get("X-Proxy-Cache"); v != "" {
+		t.Fatalf("X-Proxy-Cache %q reached the client on a miss", v)
+	}
+	rec = doRequest("GET", "/ttl")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("X-Proxy-Cache") != "" {
+		t.Fatalf("X-Cache %q, X-Proxy-Cache %q, want a hit without it", rec.Header().Get("X-Cache"), rec.Header().Get("X-Proxy-Cache"))
+	}
+	doRequest("GET", "/plain")
+	if ttl := mr.TTL(keyFor("/plain")); ttl != 90*time.Second {
+		t.Fatalf("stored for %v, want 1m30s without Cache-Control", ttl)
+	}
+}
+
+func TestXProxyCacheNeverReachesTheClient(t *testing.T) {
+	newTestProxy(t, proxyCacheOrigin)
+	defer func(n int64) { maxCacheableBytes = n }(maxCacheableBytes)
+
+	if rec := doRequest("POST", "/ttl"); rec.Header().Get("X-Proxy-Cache") != "" {
+		t.Fatal("X-Proxy-Cache reached the client on a pass-through")
+	}
+	maxCacheableBytes = 100
+	if rec := doRequest("GET", "/big"); rec.Header().Get("X-Proxy-Cache") != "" || rec.Body.Len() != 2000 {
+		t.Fatalf("streamed %d bytes with X-Proxy-Cache %q", rec.Body.Len(), rec.Header().Get("X-Proxy-Cache"))
+	}
+}
+
+// bypassOrigin numbers its responses and keeps the query and bypass header
+// of every request it gets
+func bypassOrigin(t *testing.T) (queries, headers *[]string) {
+	var n int
+	queries, headers = &[]string{}, &[]string{}
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		n++
+		*queries = append(*queries, r.URL.RawQuery)
+		*headers = append(*headers, r.Header.Get(bypassHeader))
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, n)
+	})
+	allow, refresh := allowBypassHeader, bypassRefresh
+	t.Cleanup(func() { allowBypassHeader, bypassRefresh = allow, refresh })
+	allowBypassHeader, bypassRefresh = true, true
+	doRequest("GET", "/bp?a=1")
+	return queries, headers
+}
+
+func TestBypassHeaderForcesAnOriginFetch(t *testing.T) {
+	_, headers := bypassOrigin(t)
+
+	if rec := doRequest("GET", "/bp?a=1", bypassHeader, "1"); rec.Body.String() != "2" {
+		t.Fatalf("%s: 1 answered %q, want a new origin response", bypassHeader, rec.Body.String())
+	}
+	if (*headers)[1] != "" {
+		t.Fatalf("%s sent on to the origin", bypassHeader)
+	}
+	// the response it got refreshed the entry
+	if rec := doRequest("GET", "/bp?a=1"); rec.Body.String() != "2" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("after the bypass: %q, X-Cache %q", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestNocacheQueryForcesAnOriginFetch(t *testing.T) {
+	queries, _ := bypassOrigin(t)
+
+	if rec := doRequest("GET", "/bp?a=1&nocache=1"); rec.Body.String() != "2" {
+		t.Fatalf("?nocache=1 answered %q, want a new origin response", rec.Body.String())
+	}
+	if (*queries)[1] != "a=1" {
+		t.Fatalf("origin saw the query %q, want nocache taken out", (*queries)[1])
+	}
+	// nocache is not part of the key, so the refreshed entry is the same one
+	if rec := doRequest("GET", "/bp?a=1"); rec.Body.String() != "2" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("after the bypass: %q, X-Cache %q", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if rec := doRequest("GET", "/bp?a=1&nocache=0"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("?nocache=0: X-Cache %q, want HIT", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestBypassWithoutRefreshLeavesTheEntry(t *testing.T) {
+	bypassOrigin(t)
+	bypassRefresh = false
+
+	if rec := doRequest("GET", "/bp?a=1", bypassHeader, "1"); rec.Body.String() != "2" || rec.Header().Get("X-Cache") != "BYPASS" {
+		t.Fatalf("bypass: %q, X-Cache %q", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if rec := doRequest("GET", "/bp?a=1"); rec.Body.String() != "1" {
+		t.Fatalf("entry replaced by %q", rec.Body.String())
+	}
+}
+
+func TestBypassNeedsAllowBypassHeader(t *testing.T) {
+	bypassOrigin(t)
+	allowBypassHeader = false
+
+	if rec := doRequest("GET", "/bp?a=1", bypassHeader, "1"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("%s honored without --allow-bypass-header: X-Cache %q", bypassHeader, rec.Header().Get("X-Cache"))
+	}
+	// nocache is then an ordinary query parameter, in the key like any other
+	if rec := doRequest("GET", "/bp?a=1&nocache=1"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("?nocache=1 without --allow-bypass-header: X-Cache %q, want MISS", rec.Header().Get("X-Cache"))
+	}
+	if rec := doRequest("GET", "/bp?a=1"); rec.Body.String() != "1" {
+		t.Fatalf("entry replaced by %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestCaseInsensitivePathsShareAnEntry(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.RequestURI())
+		mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("img"))
+	})
+	// off by default
+	doRequest("GET", "/Image.PNG?V=A")
+	doRequest("GET", "/image.png?V=A")
+	if hits.Load() != 2 {
+		t.Fatalf("%d origin requests, want 2", hits.Load())
+	}
+
+	defer func(v bool) { caseInsensitivePath = v }(caseInsensitivePath)
+	caseInsensitivePath = true
+	mr.FlushAll()
+	doRequest("GET", "/Image.PNG?V=A")
+	if rec := doRequest("GET", "/image.png?V=A"); rec.Header().Get("X-Cache") != "HIT" || hits.Load() != 3 {
+		t.Fatalf("X-Cache %q after %d origin requests", rec.Header().Get("X-Cache"), hits.Load())
+	}
+	// the query keeps its case
+	if rec := doRequest("GET", "/image.png?v=a"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("other query casing: X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	// and the origin sees the path as it was sent
+	if paths[2] != "/Image.PNG?V=A" {
+		t.Fatalf("origin requests %v", paths)
+	}
+	if n, err := purgeURL(t.Context(), &url.URL{Path: "/IMAGE.png", RawQuery: "V=A"}); err != nil || n != 1 {
+		t.Fatalf("purged %d, %v, keys %v", n, err, mr.Keys())
+	}
+}
+
+func TestCaseInsensitivePrefixPurge(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("img"))
+	})
+	defer func(v bool) { caseInsensitivePath = v }(caseInsensitivePath)
+	caseInsensitivePath = true
+	doRequest("GET", "/Images/A.png")
+	doRequest("GET", "/images/b.png")
+	doRequest("GET", "/other")
+
+	if n := deletedCount(t, adminRequest(t, handlePurge, "DELETE", "/_admin/cache?prefix=/IMAGES/")); n != 2 {
+		t.Fatalf("purged %d, keys %v", n, mr.Keys())
+	}
+	if mr.Exists(keyFor("/images/a.png")) || !mr.Exists(keyFor("/other")) {
+		t.Fatalf("keys left %v", mr.Keys())
+	}
+}
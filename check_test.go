@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestRunCheck(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	redisURL = "redis://" + mr.Addr()
+	if err := runCheck(cache.Options{}, http.DefaultTransport); err != nil {
+		t.Fatal(err)
+	}
+	saved := originServer
+	originServer = "http://127.0.0.1:1"
+	if err := runCheck(cache.Options{}, http.DefaultTransport); err == nil || !strings.HasPrefix(err.Error(), "origin ") {
+		t.Fatalf("origin down: %v", err)
+	}
+	originServer = saved
+	mr.Close()
+	if err := runCheck(cache.Options{}, http.DefaultTransport); err == nil || !strings.HasPrefix(err.Error(), "redis: ") {
+		t.Fatalf("redis down: %v", err)
+	}
+}
+
+func TestCheckFlag(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	args := []string{"--check", "--origin=" + originServer, "--redis=redis://" + mr.Addr()}
+	if out, err := runProxy(t, args...); err != nil || !strings.Contains(out, "ok: redis and origin reachable") {
+		t.Fatalf("healthy check: %v\n%s", err, out)
+	}
+	mr.Close()
+	if out := startupError(t, args...); !strings.Contains(out, "unhealthy: redis:") {
+		t.Fatalf("Redis down: %s", out)
+	}
+}
+
+func TestCheckOriginsProbesWithHead(t *testing.T) {
+	var method, path string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer up.Close()
+	defer func(origin string) { originServer = origin }(originServer)
+
+	// any answer counts, a 404 included
+	originServer = up.URL + "/v2"
+	if err := checkOrigins(http.DefaultTransport); err != nil {
+		t.Fatalf("reachable origin: %v", err)
+	}
+	if method != http.MethodHead || path != "/v2/" {
+		t.Fatalf("probe was %s %s, want HEAD /v2/", method, path)
+	}
+}
+
+func TestCheckOriginsNamesTheUnreachableOrigin(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	defer func(origin string) { originServer = origin }(originServer)
+
+	originServer = down.URL
+	if err := checkOrigins(http.DefaultTransport); err == nil || !strings.Contains(err.Error(), down.URL) {
+		t.Fatalf("unreachable origin: %v", err)
+	}
+}
+
+func TestCheckOriginFlag(t *testing.T) {
+	mr := miniredis.RunT(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	args := []string{"--origin=" + down.URL, "--redis=redis://" + mr.Addr()}
+
+	if out := startupError(t, append(args, "--check-origin=fail")...); !strings.Contains(out, "Error: --check-origin:") {
+		t.Fatalf("fail: %s", out)
+	}
+	if out := startupError(t, append(args, "--check-origin=maybe")...); !strings.Contains(out, "Error: --check-origin must be fail, warn or off") {
+		t.Fatalf("bad mode: %s", out)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestTamperedEntriesAreBypassed(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("genuine"))
+	})
+	cache.VerifyChecksum = true
+	defer func() { cache.VerifyChecksum = false }()
+	logs := captureLog(t)
+
+	doRequest("GET", "/v")
+	raw, err := mr.Get(keyFor("/v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored map[string]any
+	if err := json.Unmarshal([]byte(raw), &stored); err != nil || stored["checksum"] == nil {
+		t.Fatalf("no checksum stored in %s", raw)
+	}
+	if got := doRequest("GET", "/v").Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("X-Cache %q for an intact entry", got)
+	}
+
+	// change the body in Redis behind the proxy's back
+	stored["body"] = "Z2FyYmFnZQ==" // "garbage"
+	tampered, _ := json.Marshal(stored)
+	mr.Set(keyFor("/v"), string(tampered))
+	rec := doRequest("GET", "/v")
+	if rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "genuine" || hits.Load() != 2 {
+		t.Fatalf("tampered entry: X-Cache %q, body %q, %d origin requests", rec.Header().Get("X-Cache"), rec.Body.String(), hits.Load())
+	}
+	if !strings.Contains(logs.String(), cache.ErrChecksum.Error()) {
+		t.Fatalf("mismatch not logged: %s", logs)
+	}
+
+	// without --verify-checksum the tampered body is served as it is
+	mr.Set(keyFor("/v"), string(tampered))
+	cache.VerifyChecksum = false
+	if body := doRequest("GET", "/v").Body.String(); body != "garbage" {
+		t.Fatalf("body %q", body)
+	}
+}
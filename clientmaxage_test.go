@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestClientMaxAgeZeroRevalidatesAFreshEntry(t *testing.T) {
+	var conditional atomic.Int64
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	})
+	doRequest("GET", "/cma")
+	if rec := doRequest("GET", "/cma", "Cache-Control", "max-age=30"); rec.Header().Get("X-Cache") != "HIT" || hits.Load() != 1 {
+		t.Fatalf("max-age=30: %q, %d origin requests", rec.Header().Get("X-Cache"), hits.Load())
+	}
+	rec := doRequest("GET", "/cma", "Cache-Control", "max-age=0")
+	if rec.Code != 200 || rec.Body.String() != "body" || hits.Load() != 2 || conditional.Load() != 1 {
+		t.Fatalf("max-age=0: %d %q, %d origin requests, %d conditional", rec.Code, rec.Body.String(), hits.Load(), conditional.Load())
+	}
+	if rec := doRequest("GET", "/cma"); rec.Header().Get("X-Cache") != "HIT" || hits.Load() != 2 {
+		t.Fatalf("after revalidating: %q, %d origin requests", rec.Header().Get("X-Cache"), hits.Load())
+	}
+}
+
+func TestClientMinFresh(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	})
+	doRequest("GET", "/cmf")
+	if rec := doRequest("GET", "/cmf", "Cache-Control", "min-fresh=10"); rec.Header().Get("X-Cache") != "HIT" || hits.Load() != 1 {
+		t.Fatalf("min-fresh=10: %q, %d origin requests", rec.Header().Get("X-Cache"), hits.Load())
+	}
+	if rec := doRequest("GET", "/cmf", "Cache-Control", "min-fresh=120"); rec.Body.String() != "body" || hits.Load() != 2 {
+		t.Fatalf("min-fresh=120: %q, %d origin requests", rec.Body.String(), hits.Load())
+	}
+}
+
+func TestClientMaxStaleServesAnExpiredCopy(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Write([]byte("body"))
+	})
+	doRequest("GET", "/cms")
+	time.Sleep(1100 * time.Millisecond)
+	rec := doRequest("GET", "/cms", "Cache-Control", "max-stale=30")
+	if rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != "body" {
+		t.Fatalf("max-stale=30: %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	// let the background refresh finish storing before the next test
+	deadline := time.Now().Add(time.Second)
+	for (hits.Load() != 2 || inflightCount() != 0) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("no background refresh: %d origin requests", hits.Load())
+	}
+}
+
+func TestClientFreshnessDirectives(t *testing.T) {
+	now := time.Now()
+	fresh := &cache.Entry{Stored: now.Add(-20 * time.Second), Expires: now.Add(40 * time.Second)}
+	expired := &cache.Entry{Stored: now.Add(-80 * time.Second), Expires: now.Add(-20 * time.Second)}
+	mustRevalidate := &cache.Entry{Stored: expired.Stored, Expires: expired.Expires, MustRevalidate: true}
+	for _, tc := range []struct {
+		cc            string
+		entry         *cache.Entry
+		tooOld, stale bool
+	}{
+		{"", fresh, false, false},
+		{"max-age=30", fresh, false, false},
+		{"max-age=10", fresh, true, false},
+		{"min-fresh=30", fresh, false, false},
+		{"min-fresh=50", fresh, true, false},
+		{"max-stale", expired, false, true},
+		{"max-stale=30", expired, false, true},
+		{"max-stale=10", expired, false, false},
+		{"max-stale=30", fresh, false, false},
+		{"max-stale", mustRevalidate, false, false},
+		{"max-stale=bad", expired, false, false},
+	} {
+		h := http.Header{"Cache-Control": {tc.cc}}
+		cc := parseCacheControl(h)
+		if got := tooOldForClient(cc, tc.entry); got != tc.tooOld {
+			t.Errorf("%q: tooOldForClient = %v, want %v", tc.cc, got, tc.tooOld)
+		}
+		if got := withinMaxStale(cc, tc.entry); got != tc.stale {
+			t.Errorf("%q: withinMaxStale = %v, want %v", tc.cc, got, tc.stale)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestCompressedEntriesAreSmallerInRedis(t *testing.T) {
+	body := strings.Repeat("hello compressible world ", 2000)
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(body))
+	})
+	doRequest("GET", "/plain")
+	cache.Compress = true
+	defer func() { cache.Compress = false }()
+	doRequest("GET", "/gz")
+
+	plain, _ := mr.Get(keyFor("/plain"))
+	gz, _ := mr.Get(keyFor("/gz"))
+	if len(gz)*4 > len(plain) {
+		t.Fatalf("compressed entry is %d bytes, uncompressed %d", len(gz), len(plain))
+	}
+	for _, p := range []string{"/gz", "/plain"} {
+		if rec := doRequest("GET", p); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != body {
+			t.Fatalf("%s did not round-trip: %s", p, rec.Header().Get("X-Cache"))
+		}
+	}
+}
+
+func TestCompressibleBodiesReportAHighRatio(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(bytes.Repeat([]byte("a"), 100000))
+	})
+	defer func(on bool) { cache.Compress = on }(cache.Compress)
+	cache.Compress = true
+
+	before := cache.Compression()
+	doRequest("GET", "/compressible")
+	after := cache.Compression()
+	if after.Entries != before.Entries+1 || after.RawBytes-before.RawBytes != 100000 {
+		t.Fatalf("compression went from %+v to %+v, want one more entry of 100000 bytes", before, after)
+	}
+	if after.Ratio() < 50 || after.SavedBytes() < 90000 {
+		t.Fatalf("ratio %v with %d bytes saved, want a high ratio", after.Ratio(), after.SavedBytes())
+	}
+
+	var resp statsResponse
+	json.Unmarshal(adminRequest(t, handleStats, "GET", "/_admin/stats").Body.Bytes(), &resp)
+	if resp.CompressionRatio != after.Ratio() || resp.CompressionSavedBytes != after.SavedBytes() {
+		t.Fatalf("/_admin/stats reports ratio %v and %d bytes saved, want %v and %d",
+			resp.CompressionRatio, resp.CompressionSavedBytes, after.Ratio(), after.SavedBytes())
+	}
+	samples := scrape(t)
+	if samples["cache_compression_ratio"] != after.Ratio() || samples["cache_compression_saved_bytes"] != float64(after.SavedBytes()) {
+		t.Fatalf("/metrics reports ratio %v and %v bytes saved, want %v and %d",
+			samples["cache_compression_ratio"], samples["cache_compression_saved_bytes"], after.Ratio(), after.SavedBytes())
+	}
+}
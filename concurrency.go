@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errOriginBusy is returned when every --max-origin-concurrency slot stayed
+// taken for the whole --origin-queue-timeout
+var errOriginBusy = errors.New("too many concurrent origin requests")
+
+// originSlots bounds the origin requests in progress, nil means no limit
+var originSlots chan struct{}
+
+// limitedTransport takes an originSlots slot for every origin request and
+// holds it until the response body is closed, since the connection is busy
+// until then. cache hits never get here and don't count
+type limitedTransport struct {
+	base http.RoundTripper
+}
+
+func (t limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if originSlots == nil {
+		return t.base.RoundTrip(req)
+	}
+	timer := time.NewTimer(originQueueTimeout)
+	defer timer.Stop()
+	select {
+	case originSlots <- struct{}{}:
+	case <-timer.C:
+		return nil, errOriginBusy
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	var once sync.Once
+	release := func() { once.Do(func() { <-originSlots }) }
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	// after a switch of protocols the body is the connection itself, which
+	// has to stay writable for the upgrade to be proxied
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &releasingConn{ReadWriteCloser: conn, release: release}
+		return resp, nil
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody gives back an origin slot once the body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// releasingConn is the releasingBody of a switched protocol connection
+type releasingConn struct {
+	io.ReadWriteCloser
+	release func()
+}
+
+func (c *releasingConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.release()
+	return err
+}
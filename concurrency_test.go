@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOriginConcurrencyIsBounded(t *testing.T) {
+	var running, peak atomic.Int32
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(30 * time.Millisecond)
+		running.Add(-1)
+		w.Write([]byte("x"))
+	})
+	originSlots = make(chan struct{}, 2)
+	defer func(timeout time.Duration) { originSlots, originQueueTimeout = nil, timeout }(originQueueTimeout)
+	originQueueTimeout = 5 * time.Second
+
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := doRequest("GET", fmt.Sprintf("/k%d", i)); rec.Code != http.StatusOK {
+				failed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak.Load() != 2 || failed.Load() != 0 {
+		t.Fatalf("%d origin requests at once, %d failed", peak.Load(), failed.Load())
+	}
+	if len(originSlots) != 0 {
+		t.Fatalf("%d slots not given back", len(originSlots))
+	}
+
+	// with every slot taken hits are still served, misses give up
+	originSlots <- struct{}{}
+	originSlots <- struct{}{}
+	originQueueTimeout = 10 * time.Millisecond
+	if rec := doRequest("GET", "/k1"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("hit: status %d, X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if rec := doRequest("GET", "/new"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("saturated: status %d, want 503", rec.Code)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// conditionalHeaders belong to the client's own copy and are never sent on
+// a fetch that fills the cache, the origin could otherwise answer with a
+// 304 for something we don't have
+var conditionalHeaders = []string{
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Match",
+	"If-Unmodified-Since",
+	"If-Range",
+}
+
+// notModified reports whether the client already has entry, so a 304 can
+// be sent instead of the body without asking the origin: its If-None-Match
+// names the ETag of entry, or, when it sends no If-None-Match, its
+// If-Modified-Since is no earlier than the entry's Last-Modified (RFC 7232
+// 6). If-None-Match uses the weak comparison (RFC 7232 2.3.2), W/"a"
+// matches "a"
+func notModified(r *http.Request, entry *cache.Entry) bool {
+	if entry.Status != http.StatusOK {
+		return false
+	}
+	if values := r.Header.Values("If-None-Match"); len(values) > 0 {
+		etag := strings.TrimPrefix(entry.Header.Get("ETag"), "W/")
+		for _, value := range values {
+			for _, tag := range splitList(value) {
+				if tag == "*" || (etag != "" && strings.TrimPrefix(tag, "W/") == etag) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	// If-Modified-Since only has a meaning for GET and HEAD
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(entry.Header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
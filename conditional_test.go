@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestClientIfNoneMatch(t *testing.T) {
+	var sawINM []string
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		sawINM = append(sawINM, r.Header.Get("If-None-Match"))
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `W/"v1"`)
+		w.Write([]byte("body"))
+	})
+	// a miss is fetched without the client's validator, then answered
+	// from what was stored
+	rec := doRequest("GET", "/inm", "If-None-Match", `"v1"`)
+	if rec.Code != 304 || rec.Body.Len() != 0 || sawINM[0] != "" {
+		t.Fatalf("miss: %d %q %v", rec.Code, rec.Body.String(), sawINM)
+	}
+	rec = doRequest("GET", "/inm", "If-None-Match", `"x", W/"v1"`)
+	if rec.Code != 304 || rec.Body.Len() != 0 || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("hit: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest("GET", "/inm", "If-None-Match", `"v2"`); rec.Code != 200 || rec.Body.String() != "body" {
+		t.Fatalf("mismatch: %d", rec.Code)
+	}
+}
+
+func TestNotModifiedComparesETagsWeakly(t *testing.T) {
+	for _, tc := range []struct {
+		etag, ifNoneMatch string
+		want              bool
+	}{
+		{`"v1"`, `"v1"`, true},
+		{`"v1"`, `W/"v1"`, true},
+		{`W/"v1"`, `"v1"`, true},
+		{`W/"v1"`, `W/"v1"`, true},
+		{`"v1"`, `"v2", "v1"`, true},
+		{`"v1"`, `*`, true},
+		{`"v1"`, `"v2"`, false},
+		{`"v1"`, `"V1"`, false},
+		{``, `"v1"`, false},
+	} {
+		entry := &cache.Entry{Status: http.StatusOK, Header: http.Header{}}
+		if tc.etag != "" {
+			entry.Header.Set("ETag", tc.etag)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("If-None-Match", tc.ifNoneMatch)
+		if got := notModified(r, entry); got != tc.want {
+			t.Errorf("ETag %s, If-None-Match %s: %v, want %v", tc.etag, tc.ifNoneMatch, got, tc.want)
+		}
+	}
+}
+
+// validatedOrigin answers with a fresh, validated body
+func validatedOrigin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("ETag", `"v1"`)
+	w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	w.Write([]byte("body"))
+}
+
+func TestFreshEntryAnswers304WithoutTheOrigin(t *testing.T) {
+	_, hits := newTestProxy(t, validatedOrigin)
+	doRequest("GET", "/fresh")
+	before := hits.Load()
+
+	rec := doRequest("GET", "/fresh", "If-None-Match", `"v1"`)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("matching If-None-Match: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("ETag") != `"v1"` {
+		t.Fatalf("304 without the ETag: %v", rec.Header())
+	}
+	if hits.Load() != before {
+		t.Fatalf("origin contacted %d times for a fresh entry", hits.Load()-before)
+	}
+}
+
+func TestIfModifiedSinceOnAFreshEntry(t *testing.T) {
+	_, hits := newTestProxy(t, validatedOrigin)
+	doRequest("GET", "/ims")
+	before := hits.Load()
+
+	rec := doRequest("GET", "/ims", "If-Modified-Since", "Tue, 03 Jan 2006 15:04:05 GMT")
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("later If-Modified-Since: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest("GET", "/ims", "If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT"); rec.Code != http.StatusOK {
+		t.Fatalf("earlier If-Modified-Since: %d, want the body", rec.Code)
+	}
+	// If-None-Match is used instead of If-Modified-Since when both are sent
+	if rec := doRequest("GET", "/ims", "If-None-Match", `"v2"`, "If-Modified-Since", "Tue, 03 Jan 2006 15:04:05 GMT"); rec.Code != http.StatusOK {
+		t.Fatalf("mismatched If-None-Match with If-Modified-Since: %d, want the body", rec.Code)
+	}
+	if hits.Load() != before {
+		t.Fatalf("origin contacted %d times for a fresh entry", hits.Load()-before)
+	}
+}
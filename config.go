@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadConfig sets the flags of fs from the --config file at path. its keys
+// are flag names and its values what the flag would be given, a list for a
+// repeatable flag such as route, or for a comma-separated one. flags given
+// on the command line win over the file, so fs must already be parsed.
+// keys that aren't flags are an error rather than silently ignored
+func loadConfig(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string][]string
+	if strings.EqualFold(filepath.Ext(path), ".json") || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		values, err = parseJSONConfig(data)
+	} else {
+		values, err = parseYAMLConfig(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	onCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+	for name, items := range values {
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s: unknown key %q", path, name)
+		}
+		if onCommandLine[name] {
+			continue
+		}
+		if err := setFlag(fs, f, items); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// setFlag gives f of fs the items of a config value. the built-in flag
+// types get them joined by commas, the repeatable ones of this package one
+// by one. they are set through fs so that, like flags on the command line,
+// they count as given, see flagGiven
+func setFlag(fs *flag.FlagSet, f *flag.Flag, items []string) error {
+	if _, builtin := f.Value.(flag.Getter); builtin {
+		return fs.Set(f.Name, strings.Join(items, ","))
+	}
+	for _, item := range items {
+		if err := fs.Set(f.Name, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseJSONConfig reads a JSON object of strings, numbers, booleans and
+// arrays of those
+func parseJSONConfig(data []byte) (map[string][]string, error) {
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	values := map[string][]string{}
+	for name, value := range raw {
+		list, ok := value.([]interface{})
+		if !ok {
+			list = []interface{}{value}
+		}
+		for _, item := range list {
+			switch item.(type) {
+			case string, json.Number, bool:
+				values[name] = append(values[name], fmt.Sprint(item))
+			default:
+				return nil, fmt.Errorf("%s: values must be strings, numbers, booleans or lists of them", name)
+			}
+		}
+	}
+	return values, nil
+}
+
+// parseYAMLConfig reads the part of YAML a flat config needs: "key: value"
+// lines, where the value may be quoted, a [a, b] list or left empty for a
+// block of "- item" lines below it, and # comments
+func parseYAMLConfig(data []byte) (map[string][]string, error) {
+	values := map[string][]string{}
+	var list string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if item, ok := strings.CutPrefix(trimmed, "- "); ok || trimmed == "-" {
+			if list == "" {
+				return nil, fmt.Errorf("line %d: list item without a key", n)
+			}
+			value, err := yamlScalar(item)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			values[list] = append(values[list], value)
+			continue
+		}
+		if line != trimmed {
+			return nil, fmt.Errorf("line %d: nested values are not supported", n)
+		}
+		name, value, ok := strings.Cut(trimmed, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected key: value", n)
+		}
+		if _, dup := values[name]; dup {
+			return nil, fmt.Errorf("line %d: %s given twice", n, name)
+		}
+		value, err := yamlScalar(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		list = ""
+		switch {
+		case value == "":
+			values[name] = nil
+			list = name
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			items := []string{}
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				item, err := yamlScalar(item)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", n, err)
+				}
+				if item != "" {
+					items = append(items, item)
+				}
+			}
+			values[name] = items
+		default:
+			values[name] = []string{value}
+		}
+	}
+	return values, scanner.Err()
+}
+
+// yamlScalar returns a YAML value without the whitespace and the comment
+// around it, and without its quotes. a quoted value ends at its closing
+// quote, keeping any " #" inside it, and only a comment may follow it. an
+// unquoted one ends at the first " #"
+func yamlScalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = strings.TrimSpace(s[:i])
+		}
+		return s, nil
+	}
+	end := strings.IndexByte(s[1:], s[0]) + 1
+	if end == 0 {
+		return "", fmt.Errorf("missing closing quote in %s", s)
+	}
+	rest := s[end+1:]
+	if after := strings.TrimLeft(rest, " \t"); after != "" && (after[0] != '#' || after == rest) {
+		return "", fmt.Errorf("unexpected %q after the quoted value %s", after, s[:end+1])
+	}
+	return s[1:end], nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configFlags returns a flag set with flags of the kinds loadConfig sets
+func configFlags() (*flag.FlagSet, *string, *int, *time.Duration, *bool, *HeaderRules, *string) {
+	fs := flag.NewFlagSet("t", flag.ContinueOnError)
+	origin := fs.String("origin", "", "")
+	port := fs.Int("port", 0, "")
+	ttl := fs.Duration("ttl", time.Minute, "")
+	dbg := fs.Bool("debug", false, "")
+	rules := &HeaderRules{}
+	fs.Var(rules, "set-response-header", "")
+	methods := fs.String("cacheable-methods", "GET", "")
+	fs.String("config", "", "")
+	return fs, origin, port, ttl, dbg, rules, methods
+}
+
+func TestConfigFileYAML(t *testing.T) {
+	path := writePage(t, "proxy.yaml", `# proxy config
+origin: "http://file.example"
+port: 3000   # listen here
+ttl: 10m
+debug: true
+set-response-header:
+  - "X-A: 1"
+  - X-B: 2
+cacheable-methods: [GET, HEAD]
+`)
+	fs, origin, port, ttl, dbg, rules, methods := configFlags()
+	if err := fs.Parse([]string{"--port", "4000", "--config", path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if *origin != "http://file.example" || *port != 4000 || *ttl != 10*time.Minute || !*dbg || *methods != "GET,HEAD" {
+		t.Fatalf("origin %q, port %d, ttl %v, debug %v, methods %q", *origin, *port, *ttl, *dbg, *methods)
+	}
+	if rules.String() != "X-A: 1,X-B: 2" {
+		t.Fatalf("header rules %q", rules.String())
+	}
+}
+
+func TestYAMLQuotedValuesAndComments(t *testing.T) {
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{`origin: "http://x" # main`, "http://x"},
+		{`origin: 'http://x'   # main`, "http://x"},
+		{`origin: "a #b"`, "a #b"},
+		{`origin: "a #b" # c`, "a #b"},
+		{`origin: http://x # main`, "http://x"},
+		{`origin: a#b`, "a#b"},
+		{`origin: "it's"`, "it's"},
+	} {
+		values, err := parseYAMLConfig([]byte(tc.line + "\n"))
+		if err != nil {
+			t.Errorf("%s: %v", tc.line, err)
+			continue
+		}
+		if got := values["origin"]; len(got) != 1 || got[0] != tc.want {
+			t.Errorf("%s: %q, want %q", tc.line, got, tc.want)
+		}
+	}
+	for _, line := range []string{`origin: "http://x`, `origin: "a" b`, `origin: "a"#b`, "ports:\n  - '1' 2"} {
+		if values, err := parseYAMLConfig([]byte(line + "\n")); err == nil {
+			t.Errorf("%s accepted as %q", line, values)
+		}
+	}
+}
+
+func TestCommandLineOverridesTheConfigFile(t *testing.T) {
+	path := writePage(t, "proxy.json", `{"origin": "http://file.example", "port": 3000, "debug": false, "set-response-header": ["X-A: 1"]}`)
+	fs, origin, port, _, _, rules, _ := configFlags()
+	if err := fs.Parse([]string{"--origin", "http://cli.example", "--set-response-header", "X-C: 3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if *origin != "http://cli.example" || *port != 3000 || rules.String() != "X-C: 3" {
+		t.Fatalf("origin %q, port %d, header rules %q", *origin, *port, rules.String())
+	}
+}
+
+func TestConfigFileRejectsUnknownKeys(t *testing.T) {
+	for name, content := range map[string]string{
+		"a.yaml": "origin: x\nportt: 1\n",
+		"b.json": `{"portt": 1}`,
+		"c.yaml": "config: other.yaml\n",
+		"d.yaml": "origin:\n  host: x\n",
+	} {
+		fs, _, _, _, _, _, _ := configFlags()
+		fs.Parse(nil)
+		err := loadConfig(fs, writePage(t, name, content))
+		if err == nil {
+			t.Errorf("%s accepted", name)
+		} else if name != "d.yaml" && !strings.Contains(err.Error(), "unknown key") {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestConfigFileValuesCountAsGiven(t *testing.T) {
+	path := writePage(t, "proxy.yaml", "port: 3000\nset-response-header: [\"X-A: 1\"]\n")
+	fs, _, _, _, _, _, _ := configFlags()
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if !given["port"] || !given["set-response-header"] || given["origin"] {
+		t.Fatalf("flags given: %v, want port and set-response-header", given)
+	}
+}
+
+func TestConfigFileIsCheckedAtStartup(t *testing.T) {
+	path := writePage(t, "proxy.yaml", "origin: http://origin.test\nportt: 1\n")
+	if out := startupError(t, "--config="+path); !strings.Contains(out, "Error: --config:") || !strings.Contains(out, "unknown key") {
+		t.Fatal(out)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// waitForWaiters waits until n requests are waiting on origin fetches
+func waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for inflightCount() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests waiting, want %d", inflightCount(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCancelStopsOriginFetch(t *testing.T) {
+	aborted := make(chan struct{})
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil).WithContext(ctx))
+	}()
+	waitForWaiters(t, 1)
+	cancel()
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("origin fetch not cancelled")
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still running")
+	}
+	if !cache.Available() {
+		t.Fatal("a cancelled request marked the cache unavailable")
+	}
+	if n := inflightCount(); n != 0 {
+		t.Fatalf("%d requests left waiting", n)
+	}
+}
+
+func TestCancelKeepsSharedFetch(t *testing.T) {
+	release := make(chan struct{})
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("shared"))
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		handleRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/s", nil).WithContext(ctx))
+	}()
+	waitForWaiters(t, 1)
+	var other *httptest.ResponseRecorder
+	go func() {
+		defer wg.Done()
+		other = doRequest("GET", "/s")
+	}()
+	waitForWaiters(t, 2)
+	// the first client leaving must not abort the fetch the second waits on
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if other.Body.String() != "shared" || hits.Load() != 1 {
+		t.Fatalf("remaining client got %d %q, %d origin requests", other.Code, other.Body.String(), hits.Load())
+	}
+	if rec := doRequest("GET", "/s"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("shared fetch not cached: X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestCancelledLookup(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	doRequest("GET", "/c")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cache.Backend().Get(ctx, keyFor("/c")); err == nil {
+		t.Fatal("a Redis Get with a cancelled context succeeded")
+	}
+	if _, ok := getEntry(ctx, keyFor("/c")); ok {
+		t.Fatal("a cancelled lookup hit")
+	}
+	if !cache.Available() {
+		t.Fatal("a cancelled lookup marked the cache unavailable")
+	}
+}
+
+func TestTimedOutLookup(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	doRequest("GET", "/t")
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, ok := getEntry(ctx, keyFor("/t")); ok {
+		t.Fatal("a timed out lookup hit")
+	}
+	storeEntry(ctx, keyFor("/u"), &cache.Entry{Status: http.StatusOK, Body: []byte("u")}, time.Minute)
+	if !cache.Available() {
+		t.Fatal("a request that timed out marked the cache unavailable")
+	}
+	if rec := doRequest("GET", "/t"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("after the timeout: X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+}
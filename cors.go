@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// withCORS applies the static CORS policy of --cors-allow-origin. preflight
+// requests are answered without asking the origin, and responses from an
+// origin that sets no Access-Control-Allow-Origin of its own get one. the
+// origin's own CORS headers always pass through untouched
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(corsAllowOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := corsAllowedOrigin(r.Header.Get("Origin"))
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if allowed != "" {
+				h.Set("Access-Control-Allow-Origin", allowed)
+				h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+				headers := corsAllowHeaders
+				if headers == "" {
+					headers = r.Header.Get("Access-Control-Request-Headers")
+				}
+				if headers != "" {
+					h.Set("Access-Control-Allow-Headers", headers)
+				}
+				if corsMaxAge > 0 {
+					h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: w, allowed: allowed}, r)
+	})
+}
+
+// corsAllowedOrigin returns the Access-Control-Allow-Origin value for a
+// request from origin, empty when it isn't allowed
+func corsAllowedOrigin(origin string) string {
+	if corsAllowOrigins["*"] {
+		return "*"
+	}
+	if origin != "" && corsAllowOrigins[origin] {
+		return origin
+	}
+	return ""
+}
+
+// corsWriter adds the CORS policy to a response unless the origin already
+// answered with its own
+type corsWriter struct {
+	http.ResponseWriter
+	allowed     string
+	wroteHeader bool
+}
+
+func (cw *corsWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		h := cw.Header()
+		if cw.allowed != "" && h.Get("Access-Control-Allow-Origin") == "" {
+			h.Set("Access-Control-Allow-Origin", cw.allowed)
+			if cw.allowed != "*" {
+				h.Add("Vary", "Origin")
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *corsWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes through so streamed responses keep working
+func (cw *corsWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *corsWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
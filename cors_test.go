@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveCORS sends a request through the proxy with the CORS policy in
+// front, header being name, value pairs
+func serveCORS(method, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	withCORS(http.HandlerFunc(handleRequest)).ServeHTTP(w, r)
+	return w
+}
+
+// useCORSPolicy sets a static policy allowing https://app.example
+func useCORSPolicy(t *testing.T) {
+	methods, headers, maxAge := corsAllowMethods, corsAllowHeaders, corsMaxAge
+	t.Cleanup(func() {
+		corsAllowOrigins, corsAllowMethods, corsAllowHeaders, corsMaxAge = nil, methods, headers, maxAge
+	})
+	corsAllowOrigins = map[string]bool{"https://app.example": true}
+	corsAllowMethods = "GET, POST"
+	corsAllowHeaders = ""
+	corsMaxAge = 10 * time.Minute
+}
+
+// corsOrigin answers /own with CORS headers of its own and everything else
+// without any
+func corsOrigin(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/own" {
+		w.Header().Set("Access-Control-Allow-Origin", "https://origin-set.example")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total")
+	}
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Write([]byte("x"))
+}
+
+func TestOriginCORSHeadersArePreserved(t *testing.T) {
+	newTestProxy(t, corsOrigin)
+	for _, want := range []string{"MISS", "HIT"} {
+		rec := serveCORS("GET", "/own", "Origin", "https://app.example")
+		if rec.Header().Get("X-Cache") != want || rec.Header().Get("Access-Control-Allow-Origin") != "https://origin-set.example" ||
+			rec.Header().Get("Access-Control-Expose-Headers") != "X-Total" {
+			t.Fatalf("%s lost the origin's CORS headers: %v", want, rec.Header())
+		}
+	}
+	// a policy doesn't override them either
+	useCORSPolicy(t)
+	if rec := serveCORS("GET", "/own", "Origin", "https://app.example"); rec.Header().Get("Access-Control-Allow-Origin") != "https://origin-set.example" {
+		t.Fatalf("origin header overridden: %v", rec.Header())
+	}
+}
+
+func TestPreflightIsAnsweredByTheProxy(t *testing.T) {
+	_, hits := newTestProxy(t, corsOrigin)
+	useCORSPolicy(t)
+	rec := serveCORS("OPTIONS", "/api", "Origin", "https://app.example", "Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "Content-Type")
+	if rec.Code != http.StatusNoContent || hits.Load() != 0 {
+		t.Fatalf("preflight: status %d, %d origin requests", rec.Code, hits.Load())
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "Content-Type",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("%s %q, want %q", name, got, want)
+		}
+	}
+	rec = serveCORS("OPTIONS", "/api", "Origin", "https://evil.example", "Access-Control-Request-Method", "POST")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" || hits.Load() != 0 {
+		t.Fatalf("disallowed origin: %v", rec.Header())
+	}
+}
+
+func TestCORSPolicyFillsIn(t *testing.T) {
+	newTestProxy(t, corsOrigin)
+	useCORSPolicy(t)
+	rec := serveCORS("GET", "/plain", "Origin", "https://app.example")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example" || rec.Header().Get("Vary") == "" {
+		t.Fatalf("policy not applied: %v", rec.Header())
+	}
+	if rec := serveCORS("GET", "/plain", "Origin", "https://evil.example"); rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("disallowed origin allowed: %v", rec.Header())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCacheableContentTypes(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/logo.png" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	cacheableContentTypes = []string{"image/*", "text/css"}
+	defer func() { cacheableContentTypes = nil }()
+	doRequest("GET", "/logo.png")
+	doRequest("GET", "/index.html")
+	if doRequest("GET", "/logo.png").Header().Get("X-Cache") != "HIT" {
+		t.Fatal("png not cached")
+	}
+	if doRequest("GET", "/index.html").Header().Get("X-Cache") != "MISS" {
+		t.Fatal("html cached")
+	}
+}
+
+func TestIsCacheableContentType(t *testing.T) {
+	cacheableContentTypes = []string{"image/*", "text/css", "application/javascript"}
+	defer func() { cacheableContentTypes = nil }()
+	for contentType, want := range map[string]bool{
+		"image/png":                             true,
+		"image/svg+xml":                         true,
+		"text/css; charset=utf-8":               true,
+		"TEXT/CSS":                              true,
+		"application/javascript":                true,
+		"text/html; charset=utf-8":              false,
+		"application/json":                      false,
+		"imagery/png":                           false,
+		"":                                      false,
+		"application/javascript; charset=utf-8": true,
+	} {
+		h := http.Header{"Content-Type": {contentType}}
+		if got := isCacheableContentType(h); got != want {
+			t.Errorf("%q: %v, want %v", contentType, got, want)
+		}
+	}
+	cacheableContentTypes = nil
+	if !isCacheableContentType(http.Header{}) {
+		t.Fatal("without the flag a response without a type wasn't cacheable")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// isHTML reports whether h describes an HTML document
+func isHTML(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == "text/html"
+}
+
+// withDebugComment returns a copy of body with text added as an HTML
+// comment before the closing </body> tag, or at the end when there is none
+func withDebugComment(body []byte, text string) []byte {
+	// -- would end the comment early
+	comment := []byte("<!-- " + strings.ReplaceAll(text, "--", "- -") + " -->")
+	i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+	if i < 0 {
+		i = len(body)
+	}
+	out := make([]byte, 0, len(body)+len(comment))
+	out = append(out, body[:i]...)
+	out = append(out, comment...)
+	return append(out, body[i:]...)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWithDebugComment(t *testing.T) {
+	for _, tc := range []struct{ body, text, want string }{
+		{"<body>hi</body>", "x", "<body>hi<!-- x --></body>"},
+		{"<BODY>hi</BODY>", "x", "<BODY>hi<!-- x --></BODY>"},
+		{"no body tag", "x", "no body tag<!-- x -->"},
+		{"<body></body>", "key=a--b", "<body><!-- key=a- -b --></body>"},
+	} {
+		if got := string(withDebugComment([]byte(tc.body), tc.text)); got != tc.want {
+			t.Errorf("%q with %q: %q, want %q", tc.body, tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestDebugCommentIsInjectedIntoHTML(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/page" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html><body>hi</body></html>"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"a":1}</body>`))
+	})
+	injectDebugComment = true
+	defer func() { injectDebugComment = false }()
+
+	for _, want := range []string{"MISS", "HIT"} {
+		rec := doRequest("GET", "/page")
+		body := rec.Body.String()
+		if !strings.Contains(body, "<!-- cache: "+want+" age=") || strings.Count(body, "<!--") != 1 || !strings.HasSuffix(body, "--></body></html>") {
+			t.Fatalf("%s body %q", want, body)
+		}
+		if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(len(body)) {
+			t.Fatalf("Content-Length %s for a %d byte body", cl, len(body))
+		}
+	}
+	doRequest("GET", "/json")
+	if body := doRequest("GET", "/json").Body.String(); body != `{"a":1}</body>` {
+		t.Fatalf("JSON body changed to %q", body)
+	}
+}
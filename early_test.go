@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestEarlyRefreshesAreStaggered(t *testing.T) {
+	earlyRefreshBeta = 1
+	defer func() { earlyRefreshBeta = 0 }()
+	// the share of readers refreshing grows smoothly as expiry nears
+	// instead of all of them switching at once
+	share := func(left time.Duration) float64 {
+		e := &cache.Entry{FetchTime: time.Second, Expires: time.Now().Add(left)}
+		n := 0
+		for range 2000 {
+			if refreshEarly(e) {
+				n++
+			}
+		}
+		return float64(n) / 2000
+	}
+	far, mid, near := share(5*time.Second), share(time.Second), share(50*time.Millisecond)
+	if !(far < 0.03 && mid > 0.25 && mid < 0.5 && near > 0.9) {
+		t.Fatalf("refreshing share 5s out %.2f, 1s out %.2f, 50ms out %.2f", far, mid, near)
+	}
+
+	earlyRefreshBeta = 0
+	if share(time.Millisecond) != 0 {
+		t.Fatal("refreshed early with a beta of 0")
+	}
+}
+
+func TestEarlyRefreshFetchesOnceInTheBackground(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	doRequest("GET", "/hot")
+	earlyRefreshBeta = 1e9
+	defer func() { earlyRefreshBeta = 0 }()
+
+	for range 5 {
+		if got := doRequest("GET", "/hot").Header().Get("X-Cache"); got != "HIT" {
+			t.Fatalf("X-Cache %q, the refresh must not hold up the hit", got)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for hits.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	// let the refresh finish storing before the next test
+	for inflightCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("%d origin requests, want one early refresh", hits.Load())
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/avii09/proxy_server/cache"
+)
+
+// originAcceptEncoding is sent on every cacheable origin fetch, so whatever
+// comes back is something decodeEntry understands
+const originAcceptEncoding = "br, gzip, deflate"
+
+// preferredEncoding returns the coding a cached body is sent with to a
+// client sending h: Brotli, then gzip, empty for identity
+func preferredEncoding(h http.Header) string {
+	for _, coding := range []string{"br", "gzip"} {
+		if cache.AcceptsEncoding(h, coding) {
+			return coding
+		}
+	}
+	return ""
+}
+
+// encodesPerClient reports whether entry holds an unencoded body that is
+// compressed for each client as it is served, either because it was
+// decoded for storage or because it is compressible text
+func encodesPerClient(entry *cache.Entry) bool {
+	return entry.Header.Get("Content-Encoding") == "" && (entry.Encoding != "" || isCompressible(entry.Header))
+}
+
+// isCompressible reports whether a body with the Content-Type in h is text
+// worth compressing for clients, rather than e.g. an already compressed
+// image
+func isCompressible(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// decodeEntry replaces a Brotli, gzip or deflate encoded body with the decoded
+// bytes so a single canonical copy is cached. the original coding is kept in
+// entry.Encoding to re-encode for clients that accept it. entries with other
+// codings, or that fail to decode, are left untouched
+func decodeEntry(entry *cache.Entry) {
+	coding := strings.ToLower(entry.Header.Get("Content-Encoding"))
+	var reader io.Reader
+	switch coding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(entry.Body))
+		if err != nil {
+			return
+		}
+		reader = zr
+	case "deflate":
+		reader = flate.NewReader(bytes.NewReader(entry.Body))
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(entry.Body))
+	default:
+		return
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return
+	}
+
+	entry.Body = decoded
+	entry.Encoding = coding
+	entry.Header.Del("Content-Encoding")
+	entry.Header.Set("Content-Length", strconv.Itoa(len(decoded)))
+}
+
+// encodeBody compresses body with coding, br or gzip
+func encodeBody(body []byte, coding string) []byte {
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	if coding == "br" {
+		zw = brotli.NewWriter(&buf)
+	} else {
+		zw = gzip.NewWriter(&buf)
+	}
+	zw.Write(body)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// addVary adds name to the Vary header of h unless it is already listed
+func addVary(h http.Header, name string) {
+	for _, value := range h.Values("Vary") {
+		for _, item := range splitList(value) {
+			if strings.EqualFold(item, name) || item == "*" {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// decodeForClient makes a streamed origin response readable by a client
+// that doesn't accept its Brotli, gzip or deflate coding by decoding it on the fly
+func decodeForClient(r *http.Request, resp *http.Response) {
+	coding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	if cache.AcceptsEncoding(r.Header, coding) {
+		return
+	}
+	var decoded io.Reader
+	switch coding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return
+		}
+		decoded = zr
+	case "deflate":
+		decoded = flate.NewReader(resp.Body)
+	case "br":
+		decoded = brotli.NewReader(resp.Body)
+	default:
+		return
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{decoded, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+}
+
+// gzipForClient compresses a streamed origin response on the fly, with
+// --gzip-responses, for a client accepting gzip. only compressible bodies
+// sent unencoded are, and neither event streams, which would be held back
+// by the compressor, nor responses the origin marked no-transform
+func gzipForClient(r *http.Request, resp *http.Response) {
+	if !gzipResponses || r.Method == http.MethodHead || resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Content-Encoding") != "" || !isCompressible(resp.Header) ||
+		isEventStream(resp.Header) || parseCacheControl(resp.Header).has("no-transform") ||
+		!cache.AcceptsEncoding(r.Header, "gzip") {
+		return
+	}
+	resp.Body = &gzipReader{src: resp.Body}
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	addVary(resp.Header, "Accept-Encoding")
+}
+
+// gzipReader reads src gzip compressed. every chunk read from src is
+// flushed through the compressor, so a body arriving slowly reaches the
+// client as it comes rather than once the compressor's buffer fills
+type gzipReader struct {
+	src  io.ReadCloser
+	zw   *gzip.Writer
+	buf  bytes.Buffer
+	err  error
+	data [32 << 10]byte
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	if g.zw == nil {
+		g.zw = gzip.NewWriter(&g.buf)
+	}
+	for g.buf.Len() == 0 && g.err == nil {
+		n, err := g.src.Read(g.data[:])
+		g.zw.Write(g.data[:n])
+		switch {
+		case err == io.EOF:
+			g.zw.Close()
+			g.err = io.EOF
+		case err != nil:
+			g.err = err
+		case n > 0:
+			g.zw.Flush()
+		}
+	}
+	if g.buf.Len() > 0 {
+		return g.buf.Read(p)
+	}
+	return 0, g.err
+}
+
+func (g *gzipReader) Close() error {
+	return g.src.Close()
+}
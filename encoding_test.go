@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// gunzip decodes a gzip body, failing the test when it isn't one
+func gunzip(t *testing.T, body []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("body is not gzip: %v", err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestGzipOriginServesEveryClient(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write(encodeBody([]byte("hello world"), "gzip"))
+	})
+
+	plain := doRequest("GET", "/g")
+	if plain.Body.String() != "hello world" || plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("plain client got %q encoded %q", plain.Body.String(), plain.Header().Get("Content-Encoding"))
+	}
+	gz := doRequest("GET", "/g", "Accept-Encoding", "gzip")
+	if gz.Header().Get("Content-Encoding") != "gzip" || gz.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("gzip client got encoding %q, X-Cache %q", gz.Header().Get("Content-Encoding"), gz.Header().Get("X-Cache"))
+	}
+	if got := gunzip(t, gz.Body.Bytes()); got != "hello world" {
+		t.Fatalf("gzip client decoded %q", got)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("origin hit %d times, want one canonical copy", hits.Load())
+	}
+	entry, ok := getEntry(t.Context(), keyFor("/g"))
+	if !ok || string(entry.Body) != "hello world" || entry.Encoding != "gzip" {
+		t.Fatalf("stored %v, keys %v", entry, mr.Keys())
+	}
+}
+
+func TestDeflateOriginIsDecoded(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "deflate")
+		zw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		zw.Write([]byte("deflated"))
+		zw.Close()
+	})
+	if rec := doRequest("GET", "/d"); rec.Body.String() != "deflated" || rec.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("got %q encoded %q", rec.Body.String(), rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestUncachedGzipIsDecodedForPlainClients(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(encodeBody([]byte("hello world"), "gzip"))
+	})
+	maxCacheableBytes = 5
+	defer func() { maxCacheableBytes = 10 << 20 }()
+	if rec := doRequest("GET", "/big"); rec.Body.String() != "hello world" || rec.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("streamed response got %q encoded %q", rec.Body.String(), rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestBrotliThenGzipThenIdentity(t *testing.T) {
+	body := strings.Repeat("<p>brotli</p>", 200)
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(body))
+	})
+	rec := doRequest("GET", "/br", "Accept-Encoding", "gzip, br")
+	if rec.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("br client got Content-Encoding %q", rec.Header().Get("Content-Encoding"))
+	}
+	if got, err := io.ReadAll(brotli.NewReader(rec.Body)); err != nil || string(got) != body {
+		t.Fatalf("br body did not decode: %v", err)
+	}
+	rec = doRequest("GET", "/br", "Accept-Encoding", "gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("X-Cache") != "HIT" || gunzip(t, rec.Body.Bytes()) != body {
+		t.Fatalf("gzip client got Content-Encoding %q, X-Cache %q", rec.Header().Get("Content-Encoding"), rec.Header().Get("X-Cache"))
+	}
+	rec = doRequest("GET", "/br")
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != body {
+		t.Fatalf("plain client got Content-Encoding %q", rec.Header().Get("Content-Encoding"))
+	}
+	if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+		t.Fatalf("Vary %q", rec.Header().Get("Vary"))
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("%d origin requests, want one canonical copy", hits.Load())
+	}
+}
+
+func TestIncompressibleTypesAreNotBrotliEncoded(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("png bytes"))
+	})
+	for range 2 {
+		if rec := doRequest("GET", "/img", "Accept-Encoding", "br"); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "png bytes" {
+			t.Fatalf("image served with Content-Encoding %q", rec.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestGzipResponsesForGzipClientsOnly(t *testing.T) {
+	text := strings.Repeat("hello world ", 2000)
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img":
+			w.Header().Set("Content-Type", "image/png")
+		case "/pre":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte(text))
+			zw.Close()
+			return
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		w.Write([]byte(text))
+	})
+	defer func(v bool, paths []*regexp.Regexp) { gzipResponses, noCachePaths = v, paths }(gzipResponses, noCachePaths)
+	gzipResponses = true
+	// uncached, so the origin's identity body is compressed on the way out
+	noCachePaths = []*regexp.Regexp{regexp.MustCompile("^/")}
+
+	rec := doRequest("GET", "/t", "Accept-Encoding", "gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" || rec.Body.Len() >= len(text) {
+		t.Fatalf("Content-Encoding %q, Vary %q, %d bytes for %d", rec.Header().Get("Content-Encoding"), rec.Header().Get("Vary"), rec.Body.Len(), len(text))
+	}
+	if gunzip(t, rec.Body.Bytes()) != text {
+		t.Fatal("gzip body doesn't decode to the origin's")
+	}
+	if rec := doRequest("GET", "/t"); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != text {
+		t.Fatalf("plain client got Content-Encoding %q", rec.Header().Get("Content-Encoding"))
+	}
+	if rec := doRequest("GET", "/img", "Accept-Encoding", "gzip"); rec.Header().Get("Content-Encoding") != "" {
+		t.Fatal("an image was compressed")
+	}
+	// already compressed content isn't compressed twice
+	if rec := doRequest("GET", "/pre", "Accept-Encoding", "gzip"); gunzip(t, rec.Body.Bytes()) != text {
+		t.Fatal("gzip content was compressed twice")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// errorPage replaces the plain text of gateway errors when --error-page is
+// set, sent as errorPageType with errorPageStatus, or the error's own
+// status when that is 0
+var (
+	errorPage       []byte
+	errorPageType   string
+	errorPageStatus int
+)
+
+// outagePage and outageStatus replace the answer when the origin fails
+// while the cache is unreachable too, so there was nothing to fall back
+// on. outageStatus 0 keeps the error's own status
+var (
+	outagePage     []byte
+	outagePageType string
+	outageStatus   int
+)
+
+// maintenancePage is the built-in --outage-page
+const maintenancePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Down for maintenance</title></head>
+<body>
+<h1>Down for maintenance</h1>
+<p>This service is temporarily unavailable. Please try again in a few minutes.</p>
+</body>
+</html>
+`
+
+// loadErrorPage reads the --error-page file
+func loadErrorPage(path, contentType string) error {
+	var err error
+	errorPage, errorPageType, err = readPage(path, contentType)
+	return err
+}
+
+// loadOutagePage reads the --outage-page file, or picks the built-in
+// maintenance page for "builtin"
+func loadOutagePage(path, contentType string) error {
+	if path == "builtin" {
+		outagePage, outagePageType = []byte(maintenancePage), "text/html; charset=utf-8"
+		return nil
+	}
+	var err error
+	outagePage, outagePageType, err = readPage(path, contentType)
+	return err
+}
+
+// readPage reads a page to answer errors with. without an explicit content
+// type one is guessed from the file extension
+func readPage(path, contentType string) ([]byte, string, error) {
+	page, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(path))
+	}
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	return page, contentType, nil
+}
+
+// gatewayError answers with a 502, 503 or 504 for an origin we couldn't
+// get a response from, using the --error-page when there is one. when the
+// cache is down as well that is an outage of its own, logged as such and
+// answered with the --outage-page and --outage-status when configured
+func gatewayError(w http.ResponseWriter, msg string, status int) {
+	page, pageType := errorPage, errorPageType
+	if errorPageStatus != 0 {
+		status = errorPageStatus
+	}
+	if !cachingDisabled && !cache.Available() {
+		slog.Error("cache and origin both unavailable", "error", msg)
+		if outageStatus != 0 {
+			status = outageStatus
+		}
+		if outagePage != nil {
+			page, pageType = outagePage, outagePageType
+		}
+	}
+	if page == nil {
+		http.Error(w, msg, status)
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", pageType)
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(page)
+}
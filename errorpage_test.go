@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePage writes a page to serve errors with, returning its path
+func writePage(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadPageGuessesTheType(t *testing.T) {
+	for name, want := range map[string]string{
+		"down.html": "text/html; charset=utf-8",
+		"down.json": "application/json",
+		"down":      "text/html; charset=utf-8",
+	} {
+		if _, got, err := readPage(writePage(t, name, "x"), ""); err != nil || got != want {
+			t.Errorf("%s: %q %v, want %q", name, got, err, want)
+		}
+	}
+	if _, got, _ := readPage(writePage(t, "down.html", "x"), "text/plain"); got != "text/plain" {
+		t.Errorf("explicit type replaced by %q", got)
+	}
+	if _, _, err := readPage(filepath.Join(t.TempDir(), "missing.html"), ""); err == nil {
+		t.Error("a missing page loaded")
+	}
+}
+
+func TestErrorPageWhenTheOriginIsDown(t *testing.T) {
+	down := false
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			conn, _, _ := http.NewResponseController(w).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Write([]byte("cached"))
+	})
+	if err := loadErrorPage(writePage(t, "down.html", "<h1>We'll be right back</h1>"), ""); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { errorPage, errorPageType, errorPageStatus, errorPageFallback = nil, "", 0, false }()
+	doRequest("GET", "/cached")
+	down = true
+
+	rec := doRequest("GET", "/down")
+	if rec.Code != http.StatusBadGateway || rec.Body.String() != "<h1>We'll be right back</h1>" || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("%d %q %q", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	errorPageStatus = http.StatusServiceUnavailable
+	if rec := doRequest("GET", "/down"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d with --error-page-status 503", rec.Code)
+	}
+
+	// once expired the cached copy is only used with --error-page-fallback
+	time.Sleep(1100 * time.Millisecond)
+	if rec := doRequest("GET", "/cached"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expired entry served without --error-page-fallback: %d", rec.Code)
+	}
+	errorPageFallback = true
+	if rec := doRequest("GET", "/cached"); rec.Code != http.StatusOK || rec.Body.String() != "cached" || rec.Header().Get("X-Cache") != "STALE-ERROR" {
+		t.Fatalf("fallback: %d %q, X-Cache %q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestOutagePageWhenRedisAndTheOriginAreDown(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	originServer = "http://127.0.0.1:1"
+	logs := captureLog(t)
+
+	// with Redis up an origin failure is an ordinary 502
+	if rec := doRequest("GET", "/o"); rec.Code != http.StatusBadGateway || strings.Contains(logs.String(), "cache and origin both unavailable") {
+		t.Fatalf("%d, logged %s", rec.Code, logs)
+	}
+
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	mr.Close()
+	originServer = "http://127.0.0.1:1"
+	if err := loadOutagePage("builtin", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { outagePage, outagePageType, outageStatus = nil, "", 0 }()
+	outageStatus = http.StatusServiceUnavailable
+
+	rec := doRequest("GET", "/o")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "maintenance") ||
+		rec.Header().Get("Cache-Control") != "no-store" || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("%d %v %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+	if !strings.Contains(logs.String(), "cache and origin both unavailable") {
+		t.Fatalf("outage not logged as such: %s", logs)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestMaxEntriesEviction(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	cache.EnableEviction(cache.KeyPrefix+"__lru", 2)
+	defer cache.EnableEviction("", 0)
+	doRequest("GET", "/e1")
+	time.Sleep(5 * time.Millisecond)
+	doRequest("GET", "/e2")
+	time.Sleep(5 * time.Millisecond)
+	doRequest("GET", "/e1") // hit, e1 is now most recent
+	time.Sleep(5 * time.Millisecond)
+	doRequest("GET", "/e3")
+	n, err := cache.Evict()
+	if err != nil || n != 1 {
+		t.Fatalf("evicted %d, %v", n, err)
+	}
+	if mr.Exists(keyFor("/e2")) || !mr.Exists(keyFor("/e1")) || !mr.Exists(keyFor("/e3")) {
+		t.Fatalf("the least recently used /e2 should have gone: %v", mr.Keys())
+	}
+}
+
+func TestMaxEntriesNeedsRedis(t *testing.T) {
+	out := startupError(t, "--origin=http://origin.test", "--cache-backend=memory", "--max-entries=10")
+	if !strings.Contains(out, "Error: --max-entries needs the redis cache backend") {
+		t.Fatal(out)
+	}
+}
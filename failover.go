@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// failoverTransport retries a request for --origin against each of
+// originFallbacks in turn while the answer is a connection error or a 5xx.
+// whichever origin succeeds has its response cached under the usual key.
+// requests with a body that can't be replayed only get one try, and ones
+// that aren't idempotent only fail over when they never reached the origin
+type failoverTransport struct {
+	base http.RoundTripper
+}
+
+func (t failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	rest, ok := originRest(req)
+	if !ok || len(originFallbacks) == 0 || !replayable(req) {
+		return resp, err
+	}
+
+	for _, fallback := range originFallbacks {
+		if !mayFailOver(req, resp, err) {
+			break
+		}
+		target, perr := url.Parse(fallback + rest)
+		if perr != nil {
+			break
+		}
+		if err != nil {
+			slog.Warn("origin failed, trying fallback", "origin", req.URL.Host, "fallback", target.Host, "error", err)
+		} else {
+			slog.Warn("origin failed, trying fallback", "origin", req.URL.Host, "fallback", target.Host, "status", resp.StatusCode)
+			resp.Body.Close()
+		}
+
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, perr = req.GetBody(); perr != nil {
+				return nil, perr
+			}
+		}
+		// the Host follows the origin unless --host-header pinned it
+		if retry.Host == req.URL.Host {
+			retry.Host = target.Host
+		}
+		retry.URL = target
+		req = retry
+		resp, err = t.base.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// originRest returns what follows --origin in the URL of req, false when
+// req isn't for --origin
+func originRest(req *http.Request) (string, bool) {
+	rest, ok := strings.CutPrefix(req.URL.String(), originServer)
+	return rest, ok && (rest == "" || rest[0] == '/' || rest[0] == '?')
+}
+
+// needsFailover reports whether the outcome of an origin request is worth
+// trying a fallback for. a client that went away isn't
+func needsFailover(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return resp.StatusCode >= 500
+}
+
+// mayFailOver reports whether req may be sent to another origin after the
+// outcome resp, err. an idempotent request may whenever needsFailover says
+// so. any other, like a POST, may only when it never reached the origin,
+// which may already have acted on it before answering with a 5xx
+func mayFailOver(req *http.Request, resp *http.Response, err error) bool {
+	if !needsFailover(resp, err) {
+		return false
+	}
+	return idempotent(req.Method) || (err != nil && notSent(err))
+}
+
+// notSent reports whether err means a request never got to the origin:
+// it couldn't be connected to, or the proxy refused to send it there
+func notSent(err error) bool {
+	var op *net.OpError
+	if errors.As(err, &op) && op.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, errCircuitOpen) || errors.Is(err, errOriginBusy)
+}
+
+// replayable reports whether req can be sent a second time
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// hasFallbacks reports whether origin fails over to other origins, or
+// spreads its load over a pool of them, in which case an open breaker
+// doesn't mean the request has to fail
+func hasFallbacks(origin string) bool {
+	return origin == originServer && (len(originFallbacks) > 0 || len(originPool) > 0)
+}
+
+// parseOrigins parses a comma-separated list of origin URLs
+func parseOrigins(value string) ([]string, error) {
+	var origins []string
+	for _, item := range splitList(value) {
+		origin, err := parseOrigin(item)
+		if err != nil {
+			return nil, err
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// parseOrigin checks that value is an http or https base URL, which may
+// have a path such as http://api:9000/v2 that every request path goes
+// under, and returns it without the trailing slashes of that path so
+// joinOrigin can put a request path behind it
+func parseOrigin(value string) (string, error) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.RawQuery != "" || u.ForceQuery || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("invalid origin %q", value)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	return u.String(), nil
+}
+
+// joinOrigin returns the URL of target, a request path with its query, on
+// origin. one slash separates the two however many either side
+// brings, so a base path of /v2 or /v2/ and a path of /users both give
+// /v2/users, and the root of the origin is its base path with a slash
+func joinOrigin(origin, target string) string {
+	return strings.TrimRight(origin, "/") + "/" + strings.TrimPrefix(target, "/")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFallbackServesWhenPrimaryRefuses(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	var fallbackHost string
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackHost = r.Host
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("from fallback " + r.URL.Path))
+	}))
+	defer fallback.Close()
+	originServer = closed.URL
+	originFallbacks = []string{fallback.URL}
+	defer func() { originFallbacks = nil }()
+
+	rec := doRequest("GET", "/a")
+	if rec.Code != http.StatusOK || rec.Body.String() != "from fallback /a" {
+		t.Fatalf("%d %q", rec.Code, rec.Body.String())
+	}
+	if fallbackHost != fallback.Listener.Addr().String() {
+		t.Fatalf("fallback was sent Host %q", fallbackHost)
+	}
+	if got := doRequest("GET", "/a").Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("fallback response not cached under the primary key: X-Cache %q", got)
+	}
+}
+
+func TestFallbacksAreTriedInOrder(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from fallback " + r.URL.Path))
+	}))
+	defer fallback.Close()
+	defer func() { originFallbacks = nil }()
+
+	// the primary answers 502 and the first fallback refuses
+	originFallbacks = []string{closed.URL, fallback.URL}
+	if rec := doRequest("GET", "/b"); rec.Code != http.StatusOK || rec.Body.String() != "from fallback /b" || hits.Load() != 1 {
+		t.Fatalf("%d %q, %d primary requests", rec.Code, rec.Body.String(), hits.Load())
+	}
+
+	// with no fallback succeeding the error stands
+	originFallbacks = []string{closed.URL}
+	if rec := doRequest("GET", "/c"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", rec.Code)
+	}
+}
+
+func TestPostsThatReachedTheOriginAreNotFailedOver(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	var resent atomic.Int64
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resent.Add(1)
+		w.Write([]byte("from fallback"))
+	}))
+	defer fallback.Close()
+	originFallbacks = []string{fallback.URL}
+	defer func() { originFallbacks = nil }()
+
+	if rec := doRequest("POST", "/orders"); rec.Code != http.StatusInternalServerError || hits.Load() != 1 || resent.Load() != 0 {
+		t.Fatalf("POST answered %d, primary got %d, fallback %d", rec.Code, hits.Load(), resent.Load())
+	}
+	// an idempotent method fails over as before
+	if rec := doRequest("PUT", "/orders/1"); rec.Body.String() != "from fallback" || resent.Load() != 1 {
+		t.Fatalf("PUT answered %q, fallback got %d", rec.Body.String(), resent.Load())
+	}
+
+	// a POST that couldn't connect never reached the primary
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	originServer = closed.URL
+	if rec := doRequest("POST", "/orders"); rec.Body.String() != "from fallback" || resent.Load() != 2 {
+		t.Fatalf("POST to a closed primary answered %q, fallback got %d", rec.Body.String(), resent.Load())
+	}
+}
+
+func TestParseOrigins(t *testing.T) {
+	origins, err := parseOrigins("http://a:1/, https://b/v2/")
+	if err != nil || len(origins) != 2 || origins[0] != "http://a:1" || origins[1] != "https://b/v2" {
+		t.Fatalf("%q %v", origins, err)
+	}
+	for _, bad := range []string{"ftp://x", "http://", "http://a?x=1", "http://u:p@a"} {
+		if _, err := parseOrigins(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestJoinOriginBasePath(t *testing.T) {
+	for _, tc := range []struct{ flag, target, want string }{
+		{"http://api:9000/v2", "/users", "http://api:9000/v2/users"},
+		{"http://api:9000/v2/", "/users", "http://api:9000/v2/users"},
+		{"http://api:9000/v2//", "/users?a=1", "http://api:9000/v2/users?a=1"},
+		{"http://api:9000/v2", "users", "http://api:9000/v2/users"},
+		{"http://api:9000/v2", "/", "http://api:9000/v2/"},
+		{"http://api:9000", "/users/", "http://api:9000/users/"},
+		{"http://api:9000/", "/", "http://api:9000/"},
+		{"https://api/a%2Fb/", "/c", "https://api/a%2Fb/c"},
+	} {
+		origin, err := parseOrigin(tc.flag)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.flag, err)
+		}
+		if got := joinOrigin(origin, tc.target); got != tc.want {
+			t.Errorf("%s + %s = %s, want %s", tc.flag, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestParseOriginRejectsWhatIsNotABaseURL(t *testing.T) {
+	for _, bad := range []string{"api:9000", "ftp://api", "http://api/v2?x=1", "http://api/#f", "http:///v2"} {
+		if _, err := parseOrigin(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestRequestsGoUnderTheOriginBasePath(t *testing.T) {
+	var paths []string
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		w.Write([]byte("ok"))
+	})
+	origin, err := parseOrigin(originServer + "/v2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	originServer = origin
+
+	doRequest("GET", "/users?id=1")
+	doRequest("GET", "/")
+	if len(paths) != 2 || paths[0] != "/v2/users?id=1" || paths[1] != "/v2/" {
+		t.Fatalf("origin saw %q, want /v2/users?id=1 and /v2/", paths)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// fetchLockPoll is how often a request waiting on another instance's fetch
+// checks whether the entry arrived
+const fetchLockPoll = 50 * time.Millisecond
+
+// fetchLocked is fetchAndStore behind a lock in Redis, with --fetch-lock-ttl,
+// so that when several proxies share the cache only one of them asks the
+// origin for key. originGroup already does this within one process. while
+// another instance holds the lock a stale entry is served right away,
+// otherwise the request waits up to --fetch-lock-wait for the entry to show
+// up and asks the origin itself after that, or once the lock is gone
+func fetchLocked(ctx context.Context, w http.ResponseWriter, r *http.Request, targetURL, key string, stale *cache.Entry) (*originResult, error) {
+	if fetchLockTTL <= 0 {
+		return fetchAndStore(ctx, w, r, targetURL, key, stale)
+	}
+
+	deadline := time.Now().Add(fetchLockWait)
+	for {
+		unlock, ok := cache.Lock(ctx, cache.LockKey(key), fetchLockTTL)
+		if ok {
+			defer unlock()
+			break
+		}
+		if stale != nil && mayServeStale(stale) {
+			traceOf(r).add("another instance is fetching, serving stale")
+			serveEntry(w, r, key, stale, "STALE")
+			return &originResult{entry: stale, variant: cache.VariantKey(key, stale.Vary, r.Header), status: "STALE"}, nil
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(fetchLockPoll):
+		}
+		if entry, found := lookupEntry(ctx, key, r.Header); found && entry.Fresh() {
+			traceOf(r).add("another instance fetched the entry")
+			serveEntry(w, r, key, entry, "HIT")
+			return &originResult{entry: entry, variant: cache.VariantKey(key, entry.Vary, r.Header), status: "HIT"}, nil
+		}
+	}
+	return fetchAndStore(ctx, w, r, targetURL, key, stale)
+}
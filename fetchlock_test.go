@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestFetchLockPreventsADoubleFetch(t *testing.T) {
+	var mu sync.Mutex
+	fetches := 0
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		time.Sleep(150 * time.Millisecond)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("fresh"))
+	})
+	defer func(ttl, wait time.Duration) { fetchLockTTL, fetchLockWait = ttl, wait }(fetchLockTTL, fetchLockWait)
+	fetchLockTTL, fetchLockWait = 5*time.Second, 2*time.Second
+
+	target := originServer + "/k"
+	key := cache.Key("GET", target)
+	// two instances refreshing the same key: calling fetchLocked directly
+	// bypasses the in-process coalescing, like separate proxies would
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 2)
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/k", nil)
+			if _, err := fetchLocked(context.Background(), recs[i], r, target, key, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+	if fetches != 1 {
+		t.Fatalf("origin fetched %d times", fetches)
+	}
+	for _, rec := range recs {
+		if rec.Body.String() != "fresh" {
+			t.Fatalf("%q", rec.Body)
+		}
+	}
+	if recs[1].Header().Get("X-Cache") != "HIT" {
+		t.Fatal(recs[1].Header().Get("X-Cache"))
+	}
+	if mr.Exists(cache.LockKey(key)) {
+		t.Fatal("lock not released")
+	}
+}
+
+func TestFetchLockHolderElsewhereServesStale(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Header().Set("ETag", `"a"`)
+		w.Write([]byte("v"))
+	})
+	defer func(ttl, wait time.Duration) { fetchLockTTL, fetchLockWait = ttl, wait }(fetchLockTTL, fetchLockWait)
+	fetchLockTTL, fetchLockWait = 5*time.Second, time.Second
+
+	doRequest("GET", "/s")
+	mr.FastForward(2 * time.Second)
+	memCache = nil
+	key := cache.Key("GET", originServer+"/s")
+	e, _ := getEntry(context.Background(), key)
+	e.Expires = time.Now().Add(-time.Second)
+	storeEntry(context.Background(), key, e, -time.Second+time.Millisecond)
+
+	// another instance holds the lock
+	mr.Set(cache.LockKey(key), "theirs")
+	w := doRequest("GET", "/s")
+	if w.Header().Get("X-Cache") != "STALE" || hits.Load() != 1 {
+		t.Fatalf("%s hits=%d", w.Header().Get("X-Cache"), hits.Load())
+	}
+	if v, _ := mr.Get(cache.LockKey(key)); v != "theirs" {
+		t.Fatal("someone else's lock was touched")
+	}
+
+	mr.Del(cache.LockKey(key))
+	if w := doRequest("GET", "/s"); w.Header().Get("X-Cache") == "STALE" || hits.Load() != 2 {
+		t.Fatalf("%s hits=%d", w.Header().Get("X-Cache"), hits.Load())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// splitList splits a comma-separated flag value, trimming whitespace and
+// dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// flagGiven reports whether the flag called name was set, on the command
+// line or in the --config file, rather than left at its default
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) { given = given || f.Name == name })
+	return given
+}
+
+// parseStatusList parses a comma-separated list of HTTP status codes
+func parseStatusList(value string) (map[int]bool, error) {
+	statuses := map[int]bool{}
+	for _, item := range splitList(value) {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", item)
+		}
+		statuses[code] = true
+	}
+	return statuses, nil
+}
+
+// parseMethodList parses a comma-separated list of the request methods
+// whose responses may be cached. POST is left to --cache-post-paths, it can
+// only be cached by its body
+func parseMethodList(value string) (map[string]bool, error) {
+	methods := map[string]bool{}
+	for _, item := range splitList(value) {
+		method := strings.ToUpper(item)
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		case http.MethodPost:
+			return nil, fmt.Errorf("POST is cached with --cache-post-paths")
+		default:
+			return nil, fmt.Errorf("method %q can't be cached", item)
+		}
+		methods[method] = true
+	}
+	return methods, nil
+}
+
+// parseKeyStrategy parses --key-strategy, reporting whether keys are hashed
+func parseKeyStrategy(value string) (bool, error) {
+	switch value {
+	case "url":
+		return false, nil
+	case "hash":
+		return true, nil
+	}
+	return false, fmt.Errorf("%q must be url or hash", value)
+}
+
+// parseNameSet parses a comma-separated list of names into a set, nil when
+// the list is empty
+func parseNameSet(value string) map[string]bool {
+	items := splitList(value)
+	if len(items) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// parseRegexList compiles a comma-separated list of regular expressions
+func parseRegexList(value string) ([]*regexp.Regexp, error) {
+	var list []*regexp.Regexp
+	for _, item := range splitList(value) {
+		re, err := regexp.Compile(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", item, err)
+		}
+		list = append(list, re)
+	}
+	return list, nil
+}
+
+// matchAny reports whether s matches any of the patterns
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestParseRegexList(t *testing.T) {
+	list, err := parseRegexList("^/login, ^/checkout/ ,")
+	if err != nil || len(list) != 2 {
+		t.Fatalf("parsed %v, %v", list, err)
+	}
+	for path, want := range map[string]bool{
+		"/login":          true,
+		"/checkout/cart":  true,
+		"/checkout":       false,
+		"/account/login":  false,
+		"/products/login": false,
+	} {
+		if got := matchAny(list, path); got != want {
+			t.Errorf("%s: matched %v, want %v", path, got, want)
+		}
+	}
+	if _, err := parseRegexList("^/ok,(unclosed"); err == nil {
+		t.Fatal("invalid pattern accepted")
+	}
+}
+
+func TestParseKeyStrategy(t *testing.T) {
+	if hashed, err := parseKeyStrategy("hash"); err != nil || !hashed {
+		t.Fatalf("hash: %v, %v", hashed, err)
+	}
+	if hashed, err := parseKeyStrategy("url"); err != nil || hashed {
+		t.Fatalf("url: %v, %v", hashed, err)
+	}
+	if _, err := parseKeyStrategy("md5"); err == nil {
+		t.Fatal("md5 accepted")
+	}
+}
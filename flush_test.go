@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFlushOnShutdownKeepsForeignKeys(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	doRequest("GET", "/a")
+	doRequest("GET", "/b")
+	mr.Set("other:key", "keep")
+	mr.Set("proxyless", "keep")
+	if !mr.Exists(keyFor("/a")) || !mr.Exists(keyFor("/b")) {
+		t.Fatal(mr.Keys())
+	}
+
+	defer func(v bool) { flushOnShutdown = v }(flushOnShutdown)
+	flushOnShutdown = true
+	if err := closeCache(); err != nil {
+		t.Fatal(err)
+	}
+	keys := mr.Keys()
+	if len(keys) != 2 || keys[0] != "other:key" || keys[1] != "proxyless" {
+		t.Fatalf("keys left after the flush: %v", keys)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestNoCacheOnAForcedPathIsStoredWithTheForcedTTL(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache, no-store, private")
+		switch r.URL.Path {
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/forced/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+		}
+		w.Write([]byte("x"))
+	})
+	defer func(paths []*regexp.Regexp, ttl time.Duration) { forceCachePaths, forceCacheTTL = paths, ttl }(forceCachePaths, forceCacheTTL)
+	forceCachePaths = []*regexp.Regexp{regexp.MustCompile("^/forced"), regexp.MustCompile("^/broken")}
+	forceCacheTTL = 90 * time.Second
+
+	doRequest("GET", "/forced/a")
+	if w := doRequest("GET", "/forced/a"); w.Header().Get("X-Cache") != "HIT" || hits.Load() != 1 {
+		t.Fatalf("X-Cache %q after %d origin requests", w.Header().Get("X-Cache"), hits.Load())
+	}
+	if ttl := mr.TTL(keyFor("/forced/a")); ttl != 90*time.Second {
+		t.Fatalf("TTL %v, want the forced 90s", ttl)
+	}
+
+	// other paths, error statuses and cookies are left alone
+	for _, target := range []string{"/other", "/broken", "/forced/login"} {
+		start := hits.Load()
+		doRequest("GET", target)
+		doRequest("GET", target)
+		if hits.Load()-start != 2 {
+			t.Errorf("%s: %d origin requests, want 2", target, hits.Load()-start)
+		}
+	}
+}
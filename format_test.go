@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestBinaryBodiesSurviveEveryFormat(t *testing.T) {
+	bin := make([]byte, 70000)
+	for i := range bin {
+		bin[i] = byte(i * 7)
+	}
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(bin)
+	})
+	defer func(f cache.Serializer) { cache.Format = f }(cache.Format)
+	for i, name := range []string{"json", "gob", "msgpack"} {
+		cache.Format, _ = cache.FormatNamed(name)
+		target := "/bin/" + name
+		doRequest("GET", target)
+		if rec := doRequest("GET", target); rec.Header().Get("X-Cache") != "HIT" || !bytes.Equal(rec.Body.Bytes(), bin) || hits.Load() != int64(i+1) {
+			t.Fatalf("%s: X-Cache %q, %d origin requests", name, rec.Header().Get("X-Cache"), hits.Load())
+		}
+	}
+}
+
+func TestCacheFormatIsChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--cache-format=xml"); !strings.Contains(out, "Error: --cache-format:") {
+		t.Fatal(out)
+	}
+}
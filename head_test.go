@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeadFromCachedGet(t *testing.T) {
+	var methods []string
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+	// uncached, a real HEAD goes to the origin
+	if rec := doRequest("HEAD", "/hd"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.Len() != 0 {
+		t.Fatalf("uncached HEAD: %q, %d body bytes", rec.Header().Get("X-Cache"), rec.Body.Len())
+	}
+	// cached, the GET entry answers without its body
+	doRequest("GET", "/hd")
+	rec := doRequest("HEAD", "/hd")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "5" {
+		t.Fatalf("cached HEAD: %q, %d body bytes, Content-Length %q", rec.Header().Get("X-Cache"), rec.Body.Len(), rec.Header().Get("Content-Length"))
+	}
+	if len(methods) != 2 || methods[0] != "HEAD" || methods[1] != "GET" {
+		t.Fatalf("origin saw %v", methods)
+	}
+}
+
+// headJoinOrigin answers once release is closed, setting a cookie on /login
+func headJoinOrigin(release chan struct{}, methods *[]string, mu *sync.Mutex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*methods = append(*methods, r.Method)
+		mu.Unlock()
+		if r.Method == "GET" {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: r.Method})
+		}
+		w.Write([]byte("hello"))
+	}
+}
+
+func TestHeadJoinsAnInFlightGet(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var methods []string
+	newTestProxy(t, headJoinOrigin(release, &methods, &mu))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		doRequest("GET", "/j")
+	}()
+	waitForWaiters(t, 1)
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	head := doRequest("HEAD", "/j")
+	<-done
+	if head.Code != http.StatusOK || head.Body.Len() != 0 || head.Header().Get("Content-Length") != "5" {
+		t.Fatalf("%d, Content-Length %q, %d body bytes", head.Code, head.Header().Get("Content-Length"), head.Body.Len())
+	}
+	if rec := doRequest("HEAD", "/j"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("later HEAD: X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(methods) != 1 || methods[0] != "GET" {
+		t.Fatalf("origin saw %v", methods)
+	}
+}
+
+func TestHeadDoesNotJoinAPrivateGet(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var methods []string
+	newTestProxy(t, headJoinOrigin(release, &methods, &mu))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		doRequest("GET", "/login")
+	}()
+	waitForWaiters(t, 1)
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	head := doRequest("HEAD", "/login")
+	<-done
+	if head.Header().Get("Set-Cookie") != "session=HEAD" {
+		t.Fatalf("HEAD got Set-Cookie %q", head.Header().Get("Set-Cookie"))
+	}
+}
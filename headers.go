@@ -0,0 +1,36 @@
+package main
+
+import "net/http"
+
+// copyHeader adds every value of src to dst, keeping multi-valued headers
+// such as Set-Cookie intact
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// filterRequestHeader applies --forward-headers and --strip-headers to the
+// client headers of an origin request. with an allowlist only the headers
+// in it are forwarded, besides the request ID and the Connection and
+// Upgrade headers, which the proxy handles itself as hop-by-hop headers.
+// the headers the proxy sets on its own, like X-Forwarded-For, are added
+// afterwards and never filtered
+func filterRequestHeader(h http.Header) {
+	if forwardHeaders != nil {
+		for name := range h {
+			switch name {
+			case http.CanonicalHeaderKey(requestIDHeader), "Connection", "Upgrade":
+				continue
+			}
+			if !forwardHeaders[name] {
+				delete(h, name)
+			}
+		}
+	}
+	for _, name := range stripHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// headerEcho is an origin that keeps the headers of the last request it got
+func headerEcho(t *testing.T) *http.Header {
+	var got http.Header
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Cache-Control", "no-store")
+	})
+	allow, deny := forwardHeaders, stripHeaders
+	t.Cleanup(func() { forwardHeaders, stripHeaders = allow, deny })
+	return &got
+}
+
+func TestStripHeadersRemovesDeniedHeaders(t *testing.T) {
+	got := headerEcho(t)
+	stripHeaders = []string{"x-internal-token", "Cookie"}
+
+	doRequest("GET", "/a", "X-Internal-Token", "secret", "Cookie", "s=1", "Accept", "text/html")
+	if (*got).Get("X-Internal-Token") != "" || (*got).Get("Cookie") != "" {
+		t.Fatalf("denied headers reached the origin: %v", *got)
+	}
+	if (*got).Get("Accept") != "text/html" {
+		t.Fatalf("Accept = %q, want it forwarded", (*got).Get("Accept"))
+	}
+}
+
+func TestForwardHeadersOnlyPassesTheAllowlist(t *testing.T) {
+	got := headerEcho(t)
+	forwardHeaders = map[string]bool{"Accept": true, "Authorization": true}
+
+	doRequest("GET", "/b", "Accept", "text/html", "Authorization", "Bearer x", "X-Debug", "1", "User-Agent", "ua", "X-Request-ID", "rid")
+	if (*got).Get("Accept") != "text/html" || (*got).Get("Authorization") != "Bearer x" {
+		t.Fatalf("allowlisted headers missing: %v", *got)
+	}
+	if (*got).Get("X-Debug") != "" || (*got).Get("User-Agent") != "" {
+		t.Fatalf("headers outside the allowlist reached the origin: %v", *got)
+	}
+	// what the proxy sets itself is not filtered
+	if (*got).Get("X-Forwarded-For") == "" || (*got).Get("X-Forwarded-Proto") == "" || (*got).Get("X-Request-ID") != "rid" {
+		t.Fatalf("proxy headers were filtered: %v", *got)
+	}
+
+	// with both, the denylist wins
+	stripHeaders = []string{"Authorization"}
+	doRequest("GET", "/c", "Accept", "a", "Authorization", "Bearer x")
+	if (*got).Get("Authorization") != "" || (*got).Get("Accept") != "a" {
+		t.Fatalf("denylist did not win over the allowlist: %v", *got)
+	}
+}
+
+func TestHopByHopHeadersAreStrippedBeforeTheAllowlist(t *testing.T) {
+	got := headerEcho(t)
+	forwardHeaders = map[string]bool{"Accept": true, "X-Hop": true}
+
+	doRequest("GET", "/d", "Accept", "a", "X-Hop", "1", "Connection", "X-Hop")
+	if (*got).Get("X-Hop") != "" {
+		t.Fatalf("header named in Connection reached the origin: %v", *got)
+	}
+	if (*got).Get("Accept") != "a" {
+		t.Fatalf("Accept = %q, want it forwarded", (*got).Get("Accept"))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// handleHealthz is the liveness probe, it succeeds as long as the process
+// is serving requests
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz is the readiness probe, it fails with 503 while Redis can't
+// be reached
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := cache.Ready(r.Context()); err != nil {
+		http.Error(w, "Redis unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// runCheck pings Redis, unless the cache is kept in memory, and every
+// configured origin for the --check mode used by container HEALTHCHECK
+// directives
+func runCheck(redisOpts cache.Options, transport http.RoundTripper) error {
+	if cacheBackend != "memory" {
+		if err := cache.Ping(redisURL, redisOpts); err != nil {
+			return fmt.Errorf("redis: %w", err)
+		}
+	}
+	return checkOrigins(transport)
+}
+
+// checkOrigins sends a HEAD / to every configured origin, for --check and
+// the --check-origin probe at startup. an origin counts as up as soon as it
+// answers at all, whatever the status
+func checkOrigins(transport http.RoundTripper) error {
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   originTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	origins := router.Origins()
+	if originServer != "" {
+		origins = append(origins, originServer)
+	}
+	for _, origin := range origins {
+		if err := probeOrigin(client, origin); err != nil {
+			return fmt.Errorf("origin %s: %w", origin, err)
+		}
+	}
+	return nil
+}
+
+// probeOrigin sends origin a HEAD /, any answer meaning it is up
+func probeOrigin(client *http.Client, origin string) error {
+	resp, err := client.Head(joinOrigin(origin, "/"))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
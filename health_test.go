@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	mr.Close()
+	rec := httptest.NewRecorder()
+	handleHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("healthz with Redis down: %d %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	rec := httptest.NewRecorder()
+	handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("readyz with Redis up: %d", rec.Code)
+	}
+
+	mr.Close()
+	rec = httptest.NewRecorder()
+	handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("readyz with Redis down: %d %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	if hits.Load() != 0 || len(mr.Keys()) != 0 {
+		t.Fatalf("probes reached the origin or the cache: %d %v", hits.Load(), mr.Keys())
+	}
+}
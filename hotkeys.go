@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// hotSweepInterval is how often hot keys are checked for an expiry coming up
+var hotSweepInterval = time.Second
+
+// hotKey is what the refresher knows about a key that was hit recently:
+// the first request for it, to fetch it again with the same headers, and
+// when the entry served expires. hits counts the hits since windowStart,
+// hot is set once --hot-key-hits of them came within one --hot-key-window
+// and lasts while every window brings as many
+type hotKey struct {
+	req         *http.Request
+	targetURL   string
+	expires     time.Time
+	hits        int
+	windowStart time.Time
+	hot         bool
+	refreshing  bool
+}
+
+// hotKeys tracks the fresh hits of every key in this process, the way the
+// in-memory tier keeps track of use
+var hotKeys = struct {
+	sync.Mutex
+	keys map[string]*hotKey
+}{keys: map[string]*hotKey{}}
+
+// recordHit counts a fresh hit on key for --hot-key-hits. only GETs and
+// HEADs count, a cached POST can't be fetched again without its body
+func recordHit(r *http.Request, targetURL, key string, entry *cache.Entry) {
+	if hotKeyHits <= 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return
+	}
+	hotKeys.Lock()
+	defer hotKeys.Unlock()
+	hk, ok := hotKeys.keys[key]
+	if !ok {
+		req := r.Clone(context.Background())
+		req.Method = http.MethodGet
+		req.Body = http.NoBody
+		hk = &hotKey{req: req, targetURL: targetURL, windowStart: time.Now()}
+		hotKeys.keys[key] = hk
+	}
+	hk.hits++
+	if hk.hits >= hotKeyHits {
+		hk.hot = true
+	}
+	if !entry.Expires.Equal(hk.expires) {
+		hk.expires = entry.Expires
+		hk.refreshing = false
+	}
+}
+
+// refreshHotKeys runs sweepHotKeys every hotSweepInterval
+func refreshHotKeys() {
+	ticker := time.NewTicker(hotSweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		sweepHotKeys(now)
+	}
+}
+
+// sweepHotKeys refreshes, in the background, the hot keys expiring within
+// --hot-key-refresh-ahead, so a key in demand never goes cold. keys whose
+// window ended are judged on its hits, and forgotten once neither hot nor
+// hit anymore
+func sweepHotKeys(now time.Time) {
+	due := map[string]*hotKey{}
+	hotKeys.Lock()
+	for key, hk := range hotKeys.keys {
+		if now.Sub(hk.windowStart) >= hotKeyWindow {
+			hk.hot = hk.hits >= hotKeyHits
+			if !hk.hot && hk.hits == 0 {
+				delete(hotKeys.keys, key)
+				continue
+			}
+			hk.hits = 0
+			hk.windowStart = now
+		}
+		if hk.hot && !hk.refreshing && hk.expires.Sub(now) <= hotKeyRefreshAhead {
+			hk.refreshing = true
+			due[key] = hk
+		}
+	}
+	hotKeys.Unlock()
+
+	// req and targetURL never change, they are safe to use unlocked. the
+	// entry is revalidated when it has validators and fetched again if not
+	for key, hk := range due {
+		stale, _ := lookupEntry(hk.req.Context(), key, hk.req.Header)
+		revalidateInBackground(hk.req, hk.targetURL, key, stale)
+	}
+}
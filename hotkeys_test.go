@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHotKeyIsRefreshedBeforeExpiry(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]int{}
+	counts := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return seen[path]
+	}
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.URL.Path]++
+		n := seen[r.URL.Path]
+		mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=2")
+		fmt.Fprint(w, n)
+	})
+	defer func(n int, window, ahead time.Duration) {
+		hotKeyHits, hotKeyWindow, hotKeyRefreshAhead = n, window, ahead
+		hotKeys.keys = map[string]*hotKey{}
+	}(hotKeyHits, hotKeyWindow, hotKeyRefreshAhead)
+	hotKeyHits, hotKeyWindow, hotKeyRefreshAhead = 3, time.Minute, time.Second
+
+	for i := 0; i < 4; i++ {
+		doRequest("GET", "/hot")
+	}
+	doRequest("GET", "/cold")
+	doRequest("GET", "/cold")
+
+	// more than a second left: not yet
+	sweepHotKeys(time.Now())
+	if counts("/hot") != 1 {
+		t.Fatal("refreshed too early")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	sweepHotKeys(time.Now())
+	time.Sleep(200 * time.Millisecond)
+	if counts("/hot") != 2 || counts("/cold") != 1 {
+		t.Fatalf("origin requests: hot %d, cold %d", counts("/hot"), counts("/cold"))
+	}
+	sweepHotKeys(time.Now())
+	time.Sleep(100 * time.Millisecond)
+	if counts("/hot") != 2 {
+		t.Fatal("a refreshed key was refreshed again")
+	}
+
+	// past the first expiry the hot key is still cached, the cold one not
+	time.Sleep(900 * time.Millisecond)
+	if rec := doRequest("GET", "/hot"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "2" {
+		t.Fatalf("hot: X-Cache %q, %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := doRequest("GET", "/cold"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "2" {
+		t.Fatalf("cold: X-Cache %q, %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestHotKeySettingsAreChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--hot-key-hits=3", "--hot-key-window=0s"); !strings.Contains(out, "Error: --hot-key-hits can't be negative and needs a positive --hot-key-window") {
+		t.Fatal(out)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// doHTTP10 sends the proxy a request as an HTTP/1.0 client would
+func doHTTP10(target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.0", 1, 0
+	w := httptest.NewRecorder()
+	handleRequest(w, r)
+	return w
+}
+
+// useHTTP10CacheHeaders sets --http10-cache-headers for a test
+func useHTTP10CacheHeaders(t *testing.T, mode string) {
+	previous := http10CacheHeaders
+	http10CacheHeaders = mode
+	t.Cleanup(func() { http10CacheHeaders = previous })
+}
+
+// checkExpires fails t unless rec has an Expires about d from now
+func checkExpires(t *testing.T, rec *httptest.ResponseRecorder, d time.Duration) {
+	t.Helper()
+	expires, err := http.ParseTime(rec.Header().Get("Expires"))
+	if err != nil {
+		t.Fatalf("Expires %q: %v", rec.Header().Get("Expires"), err)
+	}
+	if want := time.Now().Add(d); expires.Before(want.Add(-2*time.Second)) || expires.After(want.Add(time.Second)) {
+		t.Fatalf("Expires %v, want about %v", expires, want)
+	}
+}
+
+func TestHTTP10ClientsGetExpiresOnAHit(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("legacy"))
+	})
+	useHTTP10CacheHeaders(t, "add")
+	miss := doHTTP10("/legacy")
+	if miss.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first request: X-Cache %q", miss.Header().Get("X-Cache"))
+	}
+	checkExpires(t, miss, time.Minute)
+
+	rec := doHTTP10("/legacy")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "legacy" {
+		t.Fatalf("not a hit: %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	checkExpires(t, rec, time.Minute)
+	if rec.Header().Get("Cache-Control") != "max-age=60" {
+		t.Fatalf("add dropped Cache-Control: %v", rec.Header())
+	}
+	if rec := doRequest("GET", "/legacy"); rec.Header().Get("Expires") != "" {
+		t.Fatalf("HTTP/1.1 client got Expires %q", rec.Header().Get("Expires"))
+	}
+}
+
+func TestHTTP10ExpiresCountsTheAge(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Age", "30")
+		w.Write([]byte("aged"))
+	})
+	useHTTP10CacheHeaders(t, "add")
+	doHTTP10("/aged")
+	checkExpires(t, doHTTP10("/aged"), 30*time.Second)
+}
+
+func TestHTTP10ReplaceDropsCacheControl(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("replaced"))
+	})
+	useHTTP10CacheHeaders(t, "replace")
+	doHTTP10("/replaced")
+	rec := doHTTP10("/replaced")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Cache-Control") != "" {
+		t.Fatalf("replace: %v", rec.Header())
+	}
+	checkExpires(t, rec, time.Minute)
+	if rec := doRequest("GET", "/replaced"); rec.Header().Get("Cache-Control") != "max-age=60" {
+		t.Fatalf("HTTP/1.1 client lost Cache-Control: %v", rec.Header())
+	}
+}
+
+func TestHTTP10NoCacheGetsPragma(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte("revalidate"))
+	})
+	useHTTP10CacheHeaders(t, "add")
+	rec := doHTTP10("/nc")
+	if rec.Header().Get("Pragma") != "no-cache" || rec.Header().Get("Expires") != "Thu, 01 Jan 1970 00:00:00 GMT" {
+		t.Fatalf("no-cache: %v", rec.Header())
+	}
+}
+
+func TestHTTP10CacheHeadersOffByDefault(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("plain"))
+	})
+	useHTTP10CacheHeaders(t, "off")
+	doHTTP10("/plain")
+	if rec := doHTTP10("/plain"); rec.Header().Get("Expires") != "" || rec.Header().Get("Pragma") != "" {
+		t.Fatalf("off: %v", rec.Header())
+	}
+}
+
+func TestHTTP10CacheHeadersValue(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--http10-cache-headers=both"); !strings.Contains(out, "Error: --http10-cache-headers must be add, replace or off") {
+		t.Fatalf("output: %s", out)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+)
+
+// originGroup collapses concurrent misses for the same cache key into a
+// single origin fetch whose result is shared by every waiting request
+var originGroup singleflight.Group
+
+// flight is the origin fetch running for one key. waiters counts the
+// requests waiting on it, the one doing the fetch included, and interested
+// those of them whose client is still connected. ctx is the fetch's own
+// context, cancelled once interested drops to zero. done is closed once
+// the fetch is over, result and err then hold its outcome for joinFetch
+type flight struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	waiters    int
+	interested int
+
+	finish sync.Once
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// inflight holds the fetch in progress for each key, so its waiters show up
+// on /_admin/inflight
+var (
+	inflightMu sync.Mutex
+	inflight   = map[string]*flight{}
+)
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "inflight_origin_requests",
+	Help: "Origin fetches currently shared through request coalescing.",
+}, func() float64 {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+	return float64(len(inflight))
+})
+
+// coalesce runs fn through originGroup on behalf of a request whose
+// context is ctx. the result may be shared with other requests, so one
+// client going away must not cancel the fetch for everybody else. the
+// context fn is given is only cancelled once every waiting client is gone,
+// and the key is forgotten then so the next request starts a fetch of its
+// own instead of joining the aborted one
+func coalesce(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error, bool) {
+	inflightMu.Lock()
+	f := inflight[key]
+	if f == nil {
+		fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{ctx: fetchCtx, cancel: cancel, done: make(chan struct{})}
+		inflight[key] = f
+	}
+	f.waiters++
+	f.interested++
+	inflightMu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		inflightMu.Lock()
+		defer inflightMu.Unlock()
+		if f.interested--; f.interested == 0 && inflight[key] == f {
+			f.cancel()
+			originGroup.Forget(key)
+			delete(inflight, key)
+		}
+	})
+	defer func() {
+		inflightMu.Lock()
+		defer inflightMu.Unlock()
+		if stop() {
+			f.interested--
+		}
+		if f.waiters--; f.waiters == 0 {
+			f.cancel()
+			if inflight[key] == f {
+				delete(inflight, key)
+			}
+		}
+	}()
+	return originGroup.Do(key, func() (interface{}, error) {
+		result, err := fn(f.ctx)
+		f.finish.Do(func() {
+			f.result, f.err = result, err
+			close(f.done)
+		})
+		return result, err
+	})
+}
+
+// joinFetch waits for the origin fetch in progress for key, if there is
+// one, and returns its result. unlike coalesce it never starts a fetch, it
+// is how a HEAD makes use of a GET that is already on its way
+func joinFetch(ctx context.Context, key string) (*originResult, bool) {
+	inflightMu.Lock()
+	f := inflight[key]
+	inflightMu.Unlock()
+	if f == nil {
+		return nil, false
+	}
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, false
+	}
+	res, ok := f.result.(*originResult)
+	return res, ok && f.err == nil
+}
+
+// inflightKey is one entry in the /_admin/inflight listing
+type inflightKey struct {
+	Key     string `json:"key"`
+	Waiters int    `json:"waiters"`
+}
+
+// handleInflight lists the keys with an origin fetch in progress, busiest
+// first
+func handleInflight(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	inflightMu.Lock()
+	keys := make([]inflightKey, 0, len(inflight))
+	for key, f := range inflight {
+		keys = append(keys, inflightKey{key, f.waiters})
+	}
+	inflightMu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Waiters != keys[j].Waiters {
+			return keys[i].Waiters > keys[j].Waiters
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	writeJSON(w, http.StatusOK, keys)
+}
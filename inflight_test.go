@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// inflightCount returns the requests currently waiting on origin fetches
+func inflightCount() int {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+	n := 0
+	for _, f := range inflight {
+		n += f.waiters
+	}
+	return n
+}
+
+func TestInflightRisesThenFalls(t *testing.T) {
+	release := make(chan struct{})
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("x"))
+	})
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doRequest("GET", "/slow")
+		}()
+	}
+	defer wg.Wait()
+	defer close(release)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for inflightCount() < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := inflightCount(); n != 5 {
+		t.Fatalf("%d requests waiting, want 5", n)
+	}
+	if got := scrape(t)["inflight_origin_requests"]; got != 1 {
+		t.Fatalf("inflight_origin_requests %v, want 1", got)
+	}
+	rec := adminRequest(t, handleInflight, "GET", "/_admin/inflight")
+	var keys []inflightKey
+	if err := json.Unmarshal(rec.Body.Bytes(), &keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Key != keyFor("/slow") || keys[0].Waiters != 5 {
+		t.Fatalf("in-flight keys %s", rec.Body.String())
+	}
+
+	release <- struct{}{}
+	wg.Wait()
+	if n := inflightCount(); n != 0 {
+		t.Fatalf("%d requests still waiting", n)
+	}
+	if got := scrape(t)["inflight_origin_requests"]; got != 0 {
+		t.Fatalf("inflight_origin_requests %v after the fetch, want 0", got)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestCacheKey(t *testing.T) {
+	defer func() {
+		cacheQueryParams, ignoreQueryParams, caseInsensitivePath = nil, nil, false
+	}()
+	for _, tc := range []struct {
+		name   string
+		setup  func()
+		method string
+		origin string
+		target string
+		want   string
+	}{
+		{"plain", nil, "GET", "http://o", "/a?x=1", "proxy:GET http://o/a?x=1"},
+		{"method", nil, "POST", "http://o", "/a", "proxy:POST http://o/a"},
+		{"origin with a path", nil, "GET", "http://o/base/", "/a", "proxy:GET http://o/base/a"},
+		{"escaped path", nil, "GET", "http://o", "/a%2Fb/c%20d", "proxy:GET http://o/a%2Fb/c%20d"},
+		{"empty query", nil, "GET", "http://o", "/a?", "proxy:GET http://o/a"},
+		{"query order kept", nil, "GET", "http://o", "/a?b=2&a=1", "proxy:GET http://o/a?b=2&a=1"},
+		{"ignored params", func() { ignoreQueryParams = parseNameSet("utm_source") },
+			"GET", "http://o", "/a?b=2&utm_source=x&a=1", "proxy:GET http://o/a?a=1&b=2"},
+		{"allowed params", func() { cacheQueryParams = parseNameSet("id") },
+			"GET", "http://o", "/a?session=1&id=7", "proxy:GET http://o/a?id=7"},
+		{"no allowed params", func() { cacheQueryParams = parseNameSet("id") },
+			"GET", "http://o", "/a?session=1", "proxy:GET http://o/a"},
+		{"case-insensitive path", func() { caseInsensitivePath = true },
+			"GET", "http://o", "/Docs/Intro?Q=A", "proxy:GET http://o/docs/intro?Q=A"},
+	} {
+		cacheQueryParams, ignoreQueryParams, caseInsensitivePath = nil, nil, false
+		if tc.setup != nil {
+			tc.setup()
+		}
+		u, err := url.Parse(tc.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cacheKey(tc.method, tc.origin, u); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCacheKeyIsSharedByPurges(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("x")) })
+	ignoreQueryParams = parseNameSet("utm_source")
+	defer func() { ignoreQueryParams = nil }()
+
+	doRequest("GET", "/p?id=1&utm_source=mail")
+	u, _ := url.Parse("/p?utm_source=ad&id=1")
+	if !mr.Exists(cacheKey(http.MethodGet, originServer, u)) {
+		t.Fatalf("key not found under %q: %v", cacheKey(http.MethodGet, originServer, u), mr.Keys())
+	}
+	if n, err := purgeURL(t.Context(), u); err != nil || n != 1 {
+		t.Fatalf("purge deleted %d, %v", n, err)
+	}
+	if len(mr.Keys()) != 0 {
+		t.Fatalf("keys left %v", mr.Keys())
+	}
+}
+
+func TestCacheKeyHeaderOnlyWhenExposed(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/lang" {
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		w.Write([]byte("x"))
+	})
+	for _, want := range []string{"MISS", "HIT"} {
+		if rec := doRequest("GET", "/k"); rec.Header().Get("X-Cache") != want || rec.Header().Get("X-Cache-Key") != "" {
+			t.Fatalf("%s exposed the key by default: %q", want, rec.Header().Get("X-Cache-Key"))
+		}
+	}
+
+	exposeCacheKey = true
+	defer func() { exposeCacheKey = false }()
+	if got := doRequest("GET", "/k").Header().Get("X-Cache-Key"); got != keyFor("/k") {
+		t.Fatalf("hit: X-Cache-Key %q, want %q", got, keyFor("/k"))
+	}
+	if got := doRequest("GET", "/fresh").Header().Get("X-Cache-Key"); got != keyFor("/fresh") {
+		t.Fatalf("miss: X-Cache-Key %q, want %q", got, keyFor("/fresh"))
+	}
+	doRequest("GET", "/lang", "Accept-Language", "de")
+	want := cache.VariantKey(keyFor("/lang"), []string{"Accept-Language"}, http.Header{"Accept-Language": {"de"}})
+	if got := doRequest("GET", "/lang", "Accept-Language", "de").Header().Get("X-Cache-Key"); got != want {
+		t.Fatalf("variant: X-Cache-Key %q, want %q", got, want)
+	}
+}
+
+func TestCacheKeyIsLoggedAtDebug(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer func(level slog.Level) { logLevel.Set(level) }(logLevel.Level())
+	logLevel.Set(slog.LevelDebug)
+	logs := captureLog(t)
+	doRequest("GET", "/logged")
+	if !strings.Contains(logs.String(), `"msg":"cache key"`) || !strings.Contains(logs.String(), `"key":"`+keyFor("/logged")+`"`) {
+		t.Fatalf("no debug line with the key: %s", logs)
+	}
+}
+
+func TestQueriesCantReachAnotherURLsDerivedKeys(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.URL.RawQuery + " " + r.Header.Get("Accept-Language")))
+	})
+	if rec := doRequest("GET", "/v?x", "Accept-Language", "de"); rec.Body.String() != "x de" {
+		t.Fatalf("variant: %q", rec.Body.String())
+	}
+	// the same key but for the separator, without the header
+	rec := doRequest("GET", "/v?x|Accept-Language=de")
+	if rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "x|Accept-Language=de " {
+		t.Fatalf("crafted query got %q %q, the other URL's variant", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	// purging /v?x leaves the URL that only starts like its variants
+	u, _ := url.Parse("/v?x")
+	if _, err := purgeURL(t.Context(), u); err != nil {
+		t.Fatal(err)
+	}
+	crafted := cache.VariantKey(keyFor("/v?x|Accept-Language=de"), []string{"Accept-Language"}, http.Header{})
+	if !mr.Exists(crafted) {
+		t.Fatalf("purge of /v?x deleted %q: %v", crafted, mr.Keys())
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	defer func(accept bool, cookies, sessions []string, auth bool) {
+		varyAccept, varyCookies, sessionCookies, segmentAuth = accept, cookies, sessions, auth
+	}(varyAccept, varyCookies, sessionCookies, segmentAuth)
+	request := func(method, target string, pairs ...string) *http.Request {
+		r, _ := http.NewRequest(method, target, nil)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			r.Header.Add(pairs[i], pairs[i+1])
+		}
+		return r
+	}
+	plain := "proxy:GET http://o/a?x=1"
+	for _, tc := range []struct {
+		name  string
+		setup func()
+		r     *http.Request
+		body  []byte
+		want  string
+	}{
+		{"plain", nil, request("GET", "/a?x=1"), nil, plain},
+		{"HEAD shares the GET", nil, request("HEAD", "/a?x=1"), nil, plain},
+		{"POST by its body", nil, request("POST", "/a?x=1"), []byte("q"),
+			cache.BodyKey("proxy:POST http://o/a?x=1", []byte("q"))},
+		{"--vary-accept", func() { varyAccept = true }, request("GET", "/a?x=1", "Accept", "text/html"), nil,
+			plain + "|Accept=text/html"},
+		{"--vary-cookies", func() { varyCookies = []string{"lang"} }, request("GET", "/a?x=1", "Cookie", "lang=de"), nil,
+			plain + "|cookies=lang=de"},
+		{"session cookie", func() { sessionCookies = []string{"sid"} }, request("GET", "/a?x=1", "Cookie", "sid=1"), nil,
+			plain + "|auth"},
+		{"Authorization without --segment-auth", nil, request("GET", "/a?x=1", "Authorization", "Bearer a"), nil, plain},
+		{"Authorization with --segment-auth", func() { segmentAuth = true }, request("GET", "/a?x=1", "Authorization", "Bearer a"), nil,
+			plain + "|auth"},
+		{"all of them", func() { varyAccept, varyCookies, segmentAuth = true, []string{"lang"}, true },
+			request("GET", "/a?x=1", "Accept", "text/html", "Cookie", "lang=de", "Authorization", "Bearer a"), nil,
+			plain + "|Accept=text/html|cookies=lang=de|auth"},
+	} {
+		varyAccept, varyCookies, sessionCookies, segmentAuth = false, nil, nil, false
+		if tc.setup != nil {
+			tc.setup()
+		}
+		if got := requestKey(tc.r, "http://o", tc.body); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWarmUpsStoreUnderTheRequestKey(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("warm")) })
+	defer func(v bool) { varyAccept = v }(varyAccept)
+	varyAccept = true
+
+	if rec := adminRequestBody(t, handleWarm, "POST", "/_admin/warm", `["/warmed"]`); rec.Code != http.StatusOK {
+		t.Fatalf("warm answered %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest("GET", "/warmed"); rec.Header().Get("X-Cache") != "HIT" || hits.Load() != 1 {
+		t.Fatalf("after warming: X-Cache %q, %d origin requests", rec.Header().Get("X-Cache"), hits.Load())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// requestIDHeader carries the correlation ID of a request. an incoming
+// value is kept, otherwise one is generated, and either way it is echoed
+// back to the client and forwarded to the origin
+const requestIDHeader = "X-Request-ID"
+
+// logLevel is the minimum level written by the default logger
+var logLevel slog.LevelVar
+
+// setupLogging makes slog emit JSON lines to stdout at the given level
+func setupLogging(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	logLevel.Set(l)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: &logLevel})))
+	return nil
+}
+
+// handleLogLevel reports the level of the default logger, and changes it
+// without a restart when POSTed a new one, e.g. to debug an incident. the
+// change is logged at warning level so it shows whatever the level
+//
+//	POST /_admin/loglevel?level=debug
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+			http.Error(w, "level must be debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+		previous := logLevel.Level()
+		logLevel.Set(l)
+		slog.Warn("log level changed", "from", previous.String(), "to", l.String())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": logLevel.Level().String()})
+}
+
+// requestInfo collects what the access log needs to know about a request
+// while it is being handled
+type requestInfo struct {
+	originNanos atomic.Int64
+}
+
+type requestInfoKey struct{}
+
+// addOriginLatency records time spent waiting on the origin for the
+// request ctx belongs to
+func addOriginLatency(ctx context.Context, d time.Duration) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.originNanos.Add(int64(d))
+	}
+}
+
+// newRequestID returns a random 16 character hex ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestLog assigns every request a correlation ID and writes one
+// structured log line per request once it has been served
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		slog.Info("request",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"cache", rec.Header().Get("X-Cache"),
+			"origin_latency_ms", time.Duration(info.originNanos.Load()).Milliseconds(),
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes through so streamed responses keep working
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
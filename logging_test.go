@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// captureLog sends the default logger to a buffer until the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: &logLevel})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// requestLines returns the access log lines in buf
+func requestLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var fields map[string]any
+		if err := json.Unmarshal(line, &fields); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		if fields["msg"] == "request" {
+			lines = append(lines, fields)
+		}
+	}
+	return lines
+}
+
+func TestRequestLog(t *testing.T) {
+	var forwardedID string
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwardedID = r.Header.Get(requestIDHeader)
+		w.Write([]byte("x"))
+	})
+	buf := captureLog(t)
+	handler := withRequestLog(http.HandlerFunc(handleRequest))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/logged", nil))
+	id := rec.Header().Get(requestIDHeader)
+	if len(id) != 16 || forwardedID != id {
+		t.Fatalf("generated ID %q, origin got %q", id, forwardedID)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/logged", nil)
+	req.Header.Set(requestIDHeader, "abc123")
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get(requestIDHeader); got != "abc123" {
+		t.Fatalf("propagated ID echoed as %q", got)
+	}
+
+	lines := requestLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("%d request lines in %s", len(lines), buf)
+	}
+	for i, want := range []struct{ id, cache string }{{id, "MISS"}, {"abc123", "HIT"}} {
+		line := lines[i]
+		if line["request_id"] != want.id || line["method"] != "GET" || line["path"] != "/logged" ||
+			line["status"] != float64(200) || line["cache"] != want.cache {
+			t.Errorf("line %d: %v", i, line)
+		}
+		if _, ok := line["origin_latency_ms"]; !ok {
+			t.Errorf("line %d has no origin_latency_ms: %v", i, line)
+		}
+	}
+}
+
+func TestSetupLoggingRejectsUnknownLevels(t *testing.T) {
+	if err := setupLogging("loud"); err == nil {
+		t.Fatal("unknown level accepted")
+	}
+}
+
+func TestLogLevelEndpointChangesTheLevel(t *testing.T) {
+	defer func(l slog.Level) { logLevel.Set(l) }(logLevel.Level())
+	logLevel.Set(slog.LevelInfo)
+	captureLog(t)
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("debug logging already on")
+	}
+
+	adminSecret = testAdminSecret
+	t.Cleanup(func() { adminSecret = "" })
+	r := httptest.NewRequest("POST", "/_admin/loglevel?level=debug", nil)
+	r.Header.Set(adminSecretHeader, "wrong")
+	rec := httptest.NewRecorder()
+	handleLogLevel(rec, r)
+	if rec.Code != http.StatusForbidden || logLevel.Level() != slog.LevelInfo {
+		t.Fatalf("wrong secret: %d, level %v", rec.Code, logLevel.Level())
+	}
+
+	rec = adminRequest(t, handleLogLevel, "POST", "/_admin/loglevel?level=debug")
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"level\":\"DEBUG\"}\n" || !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatalf("debug: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := adminRequest(t, handleLogLevel, "POST", "/_admin/loglevel?level=loud"); rec.Code != http.StatusBadRequest || logLevel.Level() != slog.LevelDebug {
+		t.Fatalf("unknown level: %d, level %v", rec.Code, logLevel.Level())
+	}
+	adminRequest(t, handleLogLevel, "POST", "/_admin/loglevel?level=warn")
+	if slog.Default().Enabled(context.Background(), slog.LevelInfo) {
+		t.Fatal("info logging still on at warn")
+	}
+	if rec := adminRequest(t, handleLogLevel, "GET", "/_admin/loglevel"); rec.Body.String() != "{\"level\":\"WARN\"}\n" {
+		t.Fatalf("GET: %s", rec.Body.String())
+	}
+}
@@ -1,85 +1,1029 @@
 package main
 
 import (
- "flag"
- "fmt"
- "io"
- "log"
- "net/http"
- "os"
- "time"
-
- "github.com/avii09/proxy_server/cache"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
- originServer string
- port         string
+	originServer string
+	port         string
+	redisURL     string
+	adminSecret  string
+	adminUser    string
+	adminPass    string
+	defaultTTL   time.Duration
+	maxTTL       time.Duration
+	minTTL       time.Duration
+	negativeTTL  time.Duration
+	redirectTTL  time.Duration
+
+	// ttlJitter is the percentage stored TTLs are randomly moved by
+	ttlJitter float64
+
+	// ttlNoQuery and ttlWithQuery replace defaultTTL for URLs without and
+	// with a query string
+	ttlNoQuery   time.Duration
+	ttlWithQuery time.Duration
+
+	// staleRetention is how long entries that can be revalidated are kept
+	// in Redis after they go stale
+	staleRetention time.Duration
+
+	// staleIfError is how long past expiry an entry may be served when the
+	// origin fails, for responses without their own stale-if-error
+	staleIfError time.Duration
+
+	// corsAllowOrigins is the static CORS policy, the origins allowed or *.
+	// when it is set preflights are answered with corsAllowMethods,
+	// corsAllowHeaders (default whatever was asked for) and corsMaxAge
+	corsAllowOrigins map[string]bool
+	corsAllowMethods string
+	corsAllowHeaders string
+	corsMaxAge       time.Duration
+
+	// originQueueTimeout is how long an origin request waits for one of the
+	// --max-origin-concurrency slots
+	originQueueTimeout time.Duration
+
+	// allowedOriginHosts are the only hosts origin requests may go to,
+	// nil allows any. allowPrivateOrigins lets the proxy dial private and
+	// link-local addresses, which it otherwise refuses
+	allowedOriginHosts  map[string]bool
+	allowPrivateOrigins bool
+
+	// trailingSlash is "strip" or "add" to give every path the same
+	// trailing slash, empty to leave paths alone
+	trailingSlash string
+
+	// rateLimitExemptHits keeps cache hits out of --rate-limit
+	rateLimitExemptHits bool
+
+	// cacheAfter is how many requests within cacheAfterWindow a URL needs
+	// before its response is stored, 0 or 1 stores it right away
+	cacheAfter       int
+	cacheAfterWindow time.Duration
+
+	// errorPageFallback serves whatever stale entry is left when the origin
+	// fails, before resorting to the --error-page
+	errorPageFallback bool
+
+	// exposeCacheKey sends the cache key of every response in X-Cache-Key
+	exposeCacheKey bool
+
+	// exposeVariant adds a hash of the variant served to X-Cache when the
+	// response varies
+	exposeVariant bool
+
+	// earlyRefreshBeta scales how far ahead of expiry a hit may refresh its
+	// entry in the background, 0 disables early refreshes
+	earlyRefreshBeta float64
+
+	// hotKeyHits fresh hits within hotKeyWindow make a key hot, and hot
+	// keys are refreshed hotKeyRefreshAhead before they expire. 0 hits
+	// disables the refresher
+	hotKeyHits         int
+	hotKeyWindow       time.Duration
+	hotKeyRefreshAhead time.Duration
+
+	shutdownTimeout time.Duration
+	originTimeout   time.Duration
+
+	// originIdleConns idle connections are kept open to each origin host
+	// for up to originIdleTimeout, originKeepAlive is the TCP keep-alive
+	// period of origin connections, 0 or less disables connection reuse
+	originIdleConns   = 64
+	originIdleTimeout = 90 * time.Second
+	originKeepAlive   = 30 * time.Second
+
+	// followRedirects has origin redirects followed instead of passed on
+	followRedirects bool
+
+	// originRetries is how often a failed idempotent origin request is sent
+	// again, waiting originRetryBackoff before the first retry
+	originRetries      int
+	originRetryBackoff time.Duration
+
+	// with fetchLockTTL set only one of the proxies sharing the cache
+	// fetches a key at a time, holding a lock in Redis for at most that
+	// long. the others wait up to fetchLockWait for its result
+	fetchLockTTL  time.Duration
+	fetchLockWait time.Duration
+
+	// flushOnShutdown deletes the keys under the key prefix on a clean
+	// shutdown
+	flushOnShutdown bool
+
+	// socketMode is the permissions of a unix socket listener
+	socketMode os.FileMode = 0o660
+
+	// tlsCertFile and tlsKeyFile make the listener serve HTTPS, with HTTP/2
+	// negotiated for clients supporting it. h2c allows HTTP/2 without TLS
+	tlsCertFile string
+	tlsKeyFile  string
+	h2c         bool
+
+	// httpsRedirectAddr, when set, is a second listener redirecting plain
+	// HTTP requests to the HTTPS one
+	httpsRedirectAddr string
+
+	// maxCacheableBytes bounds how much of a response body is buffered;
+	// anything larger is streamed to the client and not cached
+	maxCacheableBytes int64
+
+	// bufferRequestBodies reads request bodies before they are forwarded,
+	// so retries and fallbacks can send them again. up to
+	// requestMemoryBytes stay in memory, larger ones go to a file in
+	// requestSpillDir
+	bufferRequestBodies bool
+	requestMemoryBytes  int64
+	requestSpillDir     string
+
+	// cacheRanges stores the ranges of a URL whose full body isn't cached
+	// one by one, for large media files mostly asked for in parts
+	cacheRanges bool
+
+	// writeChunkBytes is how much of a cached body is written to a client
+	// before flushing
+	writeChunkBytes int
+
+	// maxRequestBytes limits the size of client request bodies
+	maxRequestBytes int64
+
+	// cachingDisabled turns the proxy into a plain pass-through, e.g. to
+	// debug the origin
+	cachingDisabled bool
+
+	// stripPrefix is removed from and addPrefix put in front of request
+	// paths before they are forwarded
+	stripPrefix string
+	addPrefix   string
+
+	// indexDocument is appended to paths ending in a slash, so /docs/ is
+	// fetched and cached as /docs/index.html
+	indexDocument string
+
+	// cacheBackend is where entries are stored: redis or memory
+	cacheBackend string
+
+	// memCache is the optional in-memory tier checked before Redis
+	memCache *cache.LRU
+
+	// noCachePaths are request paths that always bypass the cache
+	noCachePaths []*regexp.Regexp
+
+	// forceCachePaths are request paths whose responses are cached for
+	// forceCacheTTL whatever the origin's Cache-Control says
+	forceCachePaths []*regexp.Regexp
+	forceCacheTTL   time.Duration
+
+	// cachePostPaths lists paths whose POST requests are cached by body
+	cachePostPaths []*regexp.Regexp
+
+	// hostHeader is "origin", "preserve" or the Host to send to the origin
+	hostHeader string
+
+	// originFallbacks are tried in order when originServer fails
+	originFallbacks []string
+
+	// originPool, when set, are the origins requests for originServer are
+	// spread over, by weight, at random or in turns as originBalance says.
+	// a member that failed sits out originPoolCooldown
+	originPool         []*poolMember
+	originBalance      string
+	originPoolCooldown time.Duration
+
+	// router sends path prefixes to other origins than originServer
+	router Router
+
+	// breakerThreshold consecutive origin failures within breakerWindow open
+	// the origin's circuit breaker for breakerCooldown
+	breakerThreshold int
+	breakerWindow    time.Duration
+	breakerCooldown  time.Duration
+
+	// ttlOverrides give paths their own TTL, as a fallback for responses
+	// without caching headers or, with ttlOverrideWins, over them
+	ttlOverrides    TTLOverrides
+	ttlOverrideWins bool
+
+	// cacheQueryParams, when set, are the only query parameters that go
+	// into the cache key, and ignoreQueryParams never do
+	cacheQueryParams  map[string]bool
+	ignoreQueryParams map[string]bool
+
+	// caseInsensitivePath lowercases the path in cache keys, for origins
+	// that don't tell /Image.PNG and /image.png apart
+	caseInsensitivePath bool
+
+	// cacheableContentTypes, when set, limits caching to these media types,
+	// which may end in /* to match every subtype
+	cacheableContentTypes []string
+
+	// segmentAuth keeps requests with an Authorization header, and
+	// sessionCookies requests with one of these cookies, apart from
+	// anonymous ones in the cache. all authenticated requests still share
+	// one entry, only its value matters to the origin
+	segmentAuth    bool
+	sessionCookies []string
+
+	// allowBypassHeader lets clients skip the cache with X-Bypass-Cache: 1
+	// or ?nocache=1, and bypassRefresh has the response they get stored
+	allowBypassHeader bool
+	bypassRefresh     bool
+
+	// varyAccept puts the request's Accept in every cache key, for origins
+	// that negotiate the content type without saying so in Vary
+	varyAccept bool
+
+	// varyCookies are the cookies whose values go into the cache key, for
+	// pages that differ by e.g. a language cookie but are otherwise shared.
+	// other cookies don't change the key
+	varyCookies []string
+
+	// minifyBodies minifies HTML, JSON and CSS bodies before they are stored
+	minifyBodies bool
+
+	// honorPragma treats Pragma: no-cache on a request without
+	// Cache-Control like Cache-Control: no-cache
+	honorPragma bool
+
+	// http10CacheHeaders is what --http10-cache-headers does for HTTP/1.0
+	// clients: off, add or replace
+	http10CacheHeaders string
+
+	// gzipResponses compresses text streamed from the origin for clients
+	// accepting gzip, the way cached entries always are
+	gzipResponses bool
+
+	// cacheSetCookie lets responses carrying Set-Cookie be stored. off by
+	// default since the cookie, often a session, would go to every client
+	cacheSetCookie bool
+
+	// cacheableMethods are the request methods served from and stored in
+	// the cache. HEAD is answered from the cached GET
+	cacheableMethods = map[string]bool{http.MethodGet: true, http.MethodHead: true}
+
+	// cacheableStatuses are stored even without explicit caching headers
+	cacheableStatuses map[int]bool
+
+	// routeStatuses replace cacheableStatuses for matching paths, and only
+	// those statuses are ever stored there
+	routeStatuses RouteStatuses
+
+	// statusRewrites change the status entries are served with under
+	// matching paths, the stored entry keeping the origin's
+	statusRewrites StatusRewrites
+
+	// injectDebugComment adds cache diagnostics to served HTML
+	injectDebugComment bool
+
+	// allowCacheTrace honours X-Cache-Trace from any client, not only
+	// admins
+	allowCacheTrace bool
+
+	// origin response headers are rewritten by these rules before they are
+	// cached, and with rewriteLocation redirects to an origin point back at
+	// the proxy
+	removeResponseHeaders []string
+	setResponseHeaders    HeaderRules
+	addResponseHeaders    HeaderRules
+	rewriteLocation       bool
+
+	// forwardHeaders, when set, are the only client headers sent to the
+	// origin, and stripHeaders are never sent
+	forwardHeaders map[string]bool
+	stripHeaders   []string
+
+	// stripStoredHeaders are dropped from responses before they are
+	// cached, hits get a fresh Date and Age instead
+	stripStoredHeaders []string
 )
 
 func main() {
- // Parse command-line arguments.
- // This is done to dynamically set the port and origin server URL, instead of hardcoding them.
+	// proxy bench --url ... load-tests a running proxy instead of being one
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Args[2:], os.Stdout); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Parse command-line arguments.
+	// This is done to dynamically set the port and origin server URL, instead of hardcoding them.
+
+	// user will start server => go run server/main.go --port <port_no> --origin <origin_server_url>
+	flag.StringVar(&port, "port", "8080", "Port on which the proxy server will run, on all interfaces")
+	listen := flag.String("listen", "", "host:port or unix:/path/to/socket to listen on, e.g. 127.0.0.1:8080 (overrides --port)")
+	socketModeFlag := flag.String("socket-mode", "0660", "Permissions of the --listen unix socket, in octal")
+	flag.StringVar(&originServer, "origin", "", "URL of the origin server")
+	flag.Var(&router, "route", "Route a path prefix to another origin, e.g. /api=http://api:9000 (repeatable)")
+	flag.StringVar(&hostHeader, "host-header", "origin", "Host header sent to the origin: origin (the origin's host), preserve (the client's Host) or an explicit host name")
+	flag.StringVar(&redisURL, "redis", envOr("REDIS_URL", cache.DefaultRedisURL), "Redis connection URL (defaults to $REDIS_URL)")
+	flag.StringVar(&adminSecret, "admin-secret", os.Getenv("ADMIN_SECRET"), "Shared secret required in the X-Admin-Secret header for /_admin endpoints (defaults to $ADMIN_SECRET)")
+	flag.StringVar(&adminUser, "admin-user", os.Getenv("ADMIN_USER"), "Basic Auth user for /_admin endpoints (defaults to $ADMIN_USER)")
+	flag.StringVar(&adminPass, "admin-pass", os.Getenv("ADMIN_PASS"), "Basic Auth password for /_admin endpoints (defaults to $ADMIN_PASS)")
+	flag.StringVar(&cache.KeyPrefix, "key-prefix", cache.KeyPrefix, "Prefix for every Redis key written by the proxy")
+	flag.StringVar(&cache.Version, "cache-version", os.Getenv("CACHE_VERSION"), "Version embedded in every cache key, changing it invalidates the whole cache (defaults to $CACHE_VERSION)")
+	keyStrategy := flag.String("key-strategy", "url", "What identifies a request in Redis keys: url (readable) or hash (its SHA-256, fixed length however long the URL)")
+	flag.BoolVar(&cache.HashKeys, "hash-keys", false, "Same as --key-strategy hash")
+	flag.DurationVar(&defaultTTL, "default-ttl", 300*time.Second, "TTL for responses without caching headers")
+	flag.DurationVar(&negativeTTL, "negative-ttl", 30*time.Second, "TTL for 404 and 410 responses without caching headers")
+	flag.DurationVar(&redirectTTL, "redirect-ttl", 0, "TTL for cached 3xx redirects without caching headers (0 uses the TTL content gets)")
+	flag.DurationVar(&maxTTL, "max-ttl", 24*time.Hour, "Upper bound for every TTL, whether from the origin, an override or a default (0 disables the cap)")
+	flag.DurationVar(&minTTL, "min-ttl", 0, "Lower bound for every TTL above zero, e.g. 1s to keep a hot key from being refetched constantly")
+	flag.BoolVar(&adaptiveTTL, "adaptive-ttl", false, "Lengthen the TTL of keys whose last copy was mostly served from the cache and shorten it for keys rarely reused")
+	flag.Float64Var(&adaptiveHighRatio, "adaptive-ttl-high", 0.9, "Hit ratio of a key's last copy from which --adaptive-ttl lengthens its TTL")
+	flag.Float64Var(&adaptiveLowRatio, "adaptive-ttl-low", 0.5, "Hit ratio of a key's last copy below which --adaptive-ttl shortens its TTL")
+	flag.Float64Var(&adaptiveMaxFactor, "adaptive-ttl-max", 4, "How many times longer --adaptive-ttl keeps keys with a high hit ratio")
+	flag.Float64Var(&adaptiveMinFactor, "adaptive-ttl-min", 0.25, "Fraction of their TTL --adaptive-ttl keeps keys with a low hit ratio (0 stops caching them)")
+	flag.Float64Var(&ttlJitter, "ttl-jitter", 0, "Percentage by which every stored TTL is randomly lengthened or shortened, e.g. 10 for ±10%, so entries stored together don't expire together")
+	flag.DurationVar(&ttlNoQuery, "ttl-no-query", 0, "TTL for responses without caching headers to URLs without a query string, when no --ttl-override matches (default --default-ttl)")
+	flag.DurationVar(&ttlWithQuery, "ttl-with-query", 0, "TTL for responses without caching headers to URLs with a query string, when no --ttl-override matches (default --default-ttl)")
+	flag.Var(&ttlOverrides, "ttl-override", "TTL for a path prefix or regex, e.g. /static=24h (repeatable, first match wins)")
+	flag.IntVar(&cacheAfter, "cache-after", 0, "Only cache a URL once it has been requested this many times within --cache-after-window (0 caches on the first request)")
+	flag.DurationVar(&cacheAfterWindow, "cache-after-window", 10*time.Minute, "Window in which --cache-after requests are counted")
+	errorPagePath := flag.String("error-page", "", "File served instead of the plain error text when the origin can't be reached or times out")
+	errorPageContentType := flag.String("error-page-type", "", "Content-Type of --error-page (default guessed from its extension)")
+	flag.IntVar(&errorPageStatus, "error-page-status", 0, "Status sent with --error-page (default the 502, 503 or 504 of the error)")
+	outagePagePath := flag.String("outage-page", "", "File served when the origin fails while Redis is down too, or builtin for a maintenance page")
+	outagePageContentType := flag.String("outage-page-type", "", "Content-Type of --outage-page (default guessed from its extension)")
+	flag.IntVar(&outageStatus, "outage-status", 0, "Status sent when the origin fails while Redis is down too (default that of the origin error)")
+	flag.BoolVar(&errorPageFallback, "error-page-fallback", false, "On origin failure serve any stale cached copy, however old, before the error page")
+	flag.BoolVar(&exposeVariant, "expose-variant", false, "Add a short hash of the request headers a varying response was selected by to X-Cache, e.g. HIT;v=1a2b3c4d, for debugging")
+	flag.BoolVar(&exposeCacheKey, "expose-cache-key", false, "Send the cache key used for a request in an X-Cache-Key response header, for debugging")
+	flag.BoolVar(&injectDebugComment, "inject-debug-comment", false, "Add an HTML comment with the cache status, age and key to text/html responses")
+	flag.BoolVar(&allowCacheTrace, "cache-trace", false, "Answer any request sending X-Cache-Trace with the caching decisions made for it, not only admin requests")
+	forwardHeaderList := flag.String("forward-headers", "", "Comma-separated client headers that are the only ones forwarded to the origin, e.g. Accept,Accept-Language,Authorization (default all)")
+	stripHeaderList := flag.String("strip-headers", "", "Comma-separated client headers never forwarded to the origin, e.g. Cookie,X-Internal-Token")
+	stripStoredList := flag.String("strip-stored-headers", defaultStripStoredHeaders, "Comma-separated origin response headers left out of cache entries, since replaying them on hits would be wrong (an empty list stores every header). Set-Cookie is left out of the default with --cache-set-cookie")
+	removeHeaderList := flag.String("remove-response-header", "", "Comma-separated origin response headers to drop, e.g. Server,X-Powered-By")
+	flag.Var(&setResponseHeaders, "set-response-header", "Replace an origin response header, e.g. \"Cache-Control: max-age=60\" (repeatable)")
+	flag.Var(&addResponseHeaders, "add-response-header", "Add a header to origin responses, e.g. \"X-Served-By: cache\" (repeatable)")
+	flag.BoolVar(&rewriteLocation, "rewrite-location", false, "Point Location headers naming the origin at the proxy host instead")
+	flag.Var(&statusRewrites, "serve-status", "Serve cached entries stored with one status with another under a path prefix or regex, e.g. /legacy=203:200 (repeatable, first match wins)")
+	flag.Var(&routeStatuses, "route-statuses", "Only cache these statuses under a path prefix or regex, e.g. /api=200 (repeatable, first match wins)")
+	flag.BoolVar(&ttlOverrideWins, "ttl-override-wins", false, "Let --ttl-override take precedence over the origin's caching headers")
+	flag.IntVar(&originIdleConns, "max-idle-conns-per-host", originIdleConns, "Idle connections kept open to each origin host for reuse")
+	flag.DurationVar(&originIdleTimeout, "idle-conn-timeout", originIdleTimeout, "How long an idle origin connection is kept open (0 means no limit)")
+	flag.DurationVar(&originKeepAlive, "keep-alive", originKeepAlive, "TCP keep-alive period of origin connections, 0 disables keep-alive and connection reuse")
+	flag.DurationVar(&originTimeout, "origin-timeout", 30*time.Second, "How long to wait for the origin to start responding before returning 504")
+	flag.IntVar(&breakerThreshold, "breaker-threshold", 5, "Consecutive origin failures that open the circuit breaker (0 disables it)")
+	flag.DurationVar(&breakerWindow, "breaker-window", 30*time.Second, "Window in which failures count as consecutive for the circuit breaker")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "How long an open circuit breaker answers 503 without contacting the origin")
+	flag.DurationVar(&staleRetention, "stale-retention", time.Hour, "How long stale entries are kept for revalidation after they expire")
+	flag.IntVar(&hotKeyHits, "hot-key-hits", 0, "Hits within --hot-key-window that make a key hot, hot keys are refreshed before they expire (0 disables it)")
+	flag.DurationVar(&hotKeyWindow, "hot-key-window", time.Minute, "Window --hot-key-hits are counted in")
+	flag.DurationVar(&hotKeyRefreshAhead, "hot-key-refresh-ahead", 10*time.Second, "How long before its expiry a hot key is refreshed")
+	flag.Float64Var(&earlyRefreshBeta, "early-refresh-beta", 0, "Refresh hot entries in the background shortly before they expire, spread out at random (1 is a good start, larger refreshes earlier, 0 disables it)")
+	flag.DurationVar(&staleIfError, "stale-if-error", 0, "How long past expiry a cached entry may be served when the origin fails, unless the origin sets stale-if-error (0 disables it)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 15*time.Second, "How long to wait for in-flight requests on shutdown")
+	flag.BoolVar(&followRedirects, "follow-redirects", false, "Follow origin redirects for GET and HEAD, serving and caching the final response under the requested URL")
+	flag.IntVar(&originRetries, "origin-retries", 0, "How many times an idempotent request is retried when the origin fails to connect or answers with a 5xx")
+	flag.DurationVar(&originRetryBackoff, "origin-retry-backoff", 100*time.Millisecond, "Wait before the first origin retry, doubled for each one after it")
+	flag.DurationVar(&fetchLockTTL, "fetch-lock-ttl", 0, "Take a lock in Redis around each origin fetch, held at most this long, so proxies sharing the cache don't fetch the same key at once (0 disables)")
+	flag.DurationVar(&fetchLockWait, "fetch-lock-wait", 3*time.Second, "How long a request waits for another proxy's fetch of its key before asking the origin itself")
+	flag.BoolVar(&flushOnShutdown, "flush-on-shutdown", false, "Delete the keys under --key-prefix on a clean shutdown, e.g. for throwaway environments")
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "PEM certificate to serve HTTPS and HTTP/2 with, together with --tls-key")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "PEM private key for --tls-cert")
+	flag.StringVar(&httpsRedirectAddr, "https-redirect", "", "host:port to answer plain HTTP on with a redirect to HTTPS, e.g. :80 (needs --tls-cert)")
+	flag.BoolVar(&h2c, "h2c", false, "Also accept HTTP/2 without TLS (prior knowledge), e.g. behind a load balancer speaking h2c")
+	var timeouts serverTimeouts
+	flag.DurationVar(&timeouts.readHeader, "read-header-timeout", 10*time.Second, "How long a client may take to send the request headers")
+	flag.DurationVar(&timeouts.read, "read-timeout", time.Minute, "How long a client may take to send a whole request, body included (0 means no limit)")
+	flag.DurationVar(&timeouts.write, "write-timeout", 0, "How long writing a response may take (0 means no limit, which long downloads and event streams need)")
+	flag.DurationVar(&timeouts.idle, "idle-timeout", 2*time.Minute, "How long an idle keep-alive connection is kept open")
+	flag.Int64Var(&maxCacheableBytes, "max-cacheable-bytes", 10<<20, "Largest response body that is buffered and cached")
+	flag.BoolVar(&bufferRequestBodies, "buffer-request-bodies", false, "Read request bodies before forwarding them, so requests with a body can be retried and failed over too")
+	flag.Int64Var(&requestMemoryBytes, "request-memory-bytes", 1<<20, "Largest request body --buffer-request-bodies keeps in memory, larger ones are written to a temporary file")
+	flag.StringVar(&requestSpillDir, "request-spill-dir", "", "Directory for the temporary files of --buffer-request-bodies (default the system's temporary directory)")
+	flag.BoolVar(&cacheRanges, "cache-ranges", false, "Cache each byte range asked of a URL whose full body isn't cached as an entry of its own, so repeated ranges of large files skip the origin")
+	flag.IntVar(&writeChunkBytes, "write-chunk-bytes", 32<<10, "Write cached bodies to clients this many bytes at a time, flushing in between")
+	flag.Int64Var(&maxRequestBytes, "max-request-bytes", 10<<20, "Largest request body accepted from clients, larger ones get 413 (0 disables the limit)")
+	usageInterval := flag.Duration("usage-interval", time.Minute, "How often the bytes stored in the cache are summed up for the cache_stored_bytes metric (0 disables it)")
+	entryCountInterval := flag.Duration("entry-count-interval", 0, "How often to log the number of keys the proxy has in the cache (0 disables it)")
+	flag.Int64Var(&entryCountWarn, "entry-count-warn", 0, "Log the entry count as a warning when there are more keys than this (0 never warns)")
+	topKeys := flag.Bool("top-keys", false, "Count the requests for every key in Redis, for GET /_admin/top")
+	topKeysWindow := flag.Duration("top-keys-window", time.Hour, "How long --top-keys counts before starting over (0 counts until DELETE /_admin/top)")
+	maxEntries := flag.Int64("max-entries", 0, "Most keys kept in Redis, the least recently used are evicted beyond that (0 disables the limit)")
+	flag.BoolVar(&gzipResponses, "gzip-responses", false, "Gzip compressible responses streamed from the origin without being cached, such as pass-throughs and bodies over --max-cacheable-bytes, for clients accepting gzip")
+	flag.BoolVar(&cache.Compress, "compress-cache", false, "Gzip response bodies before storing them in Redis")
+	flag.IntVar(&cache.CompressMinBytes, "compress-min-bytes", cache.CompressMinBytes, "Smallest body compressed with --compress-cache")
+	cacheFormat := flag.String("cache-format", "json", "How entries are serialized in Redis: json, gob or msgpack, the last two keeping bodies binary. entries in any of them stay readable")
+	flag.BoolVar(&cache.VerifyChecksum, "verify-checksum", false, "Check cached bodies against their stored SHA-256 and treat a mismatch as a miss")
+	flag.BoolVar(&cachingDisabled, "no-cache", false, "Forward every request to the origin without reading or writing the cache")
+	flag.StringVar(&stripPrefix, "strip-prefix", "", "Path prefix removed before forwarding, e.g. /proxy/v1")
+	flag.StringVar(&addPrefix, "add-prefix", "", "Path prefix added before forwarding, e.g. /api")
+	flag.StringVar(&cacheBackend, "cache-backend", "redis", "Where cached entries are stored: redis, or memory for a single instance without Redis (lost on restart)")
+	memCacheGrace := flag.Duration("mem-cache-grace", 0, "How long past its expiry the in-memory tier keeps an entry to serve stale, while it is refreshed, when Redis no longer has it")
+	memCacheSize := flag.Int("mem-cache-size", 0, "Number of entries kept in an in-memory LRU in front of Redis (0 disables it)")
+	originCAFile := flag.String("origin-ca-file", "", "PEM file with extra CA certificates trusted for https origins")
+	originInsecure := flag.Bool("origin-insecure-skip-verify", false, "Don't verify origin TLS certificates (unsafe, for testing only)")
+	cachePostList := flag.String("cache-post-paths", "", "Comma-separated regexes of paths whose POST requests are idempotent queries, cached by a hash of their body, e.g. ^/graphql$")
+	forceCacheList := flag.String("force-cache-paths", "", "Comma-separated regexes of paths cached for --force-cache-ttl even when the origin forbids it")
+	flag.DurationVar(&forceCacheTTL, "force-cache-ttl", 0, "TTL of responses on --force-cache-paths")
+	noCacheList := flag.String("no-cache-paths", "", "Comma-separated regexes of paths that always bypass the cache, e.g. ^/login,^/checkout")
+	cacheParamList := flag.String("cache-query-params", "", "Comma-separated query parameters that make up the cache key, all others are ignored for caching (default all)")
+	ignoreParamList := flag.String("ignore-query-params", "", "Comma-separated query parameters left out of the cache key, e.g. utm_source,fbclid")
+	checkOrigin := flag.String("check-origin", "off", "Send a HEAD / to every origin at startup and, when one doesn't answer, fail to start or warn: fail, warn or off")
+	check := flag.Bool("check", false, "Ping Redis and the origin, print the result and exit 0 or 1 without starting the server, e.g. for a Docker HEALTHCHECK")
+	level := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	var redisOpts cache.Options
+	flag.IntVar(&redisOpts.PoolSize, "redis-pool-size", 0, "Maximum number of Redis connections (0 uses the client default of 10 per CPU)")
+	flag.DurationVar(&redisOpts.DialTimeout, "redis-dial-timeout", 0, "Timeout for connecting to Redis (0 uses the client default of 5s)")
+	flag.DurationVar(&redisOpts.ReadTimeout, "redis-read-timeout", 0, "Timeout for Redis reads (0 uses the client default of 5s)")
+	flag.DurationVar(&redisOpts.WriteTimeout, "redis-write-timeout", 0, "Timeout for Redis writes (0 uses the read timeout)")
+	flag.BoolVar(&caseInsensitivePath, "case-insensitive-path", false, "Lowercase the path, not the query, in cache keys so differently cased URLs share one entry")
+	flag.BoolVar(&segmentAuth, "segment-auth", false, "Cache requests with an Authorization header apart from anonymous ones, for responses the origin allows sharing with public, s-maxage or must-revalidate")
+	flag.BoolVar(&allowBypassHeader, "allow-bypass-header", false, "Let clients skip the cache with an X-Bypass-Cache: 1 header or a nocache=1 query parameter, e.g. to test the origin")
+	flag.BoolVar(&bypassRefresh, "bypass-refresh", true, "Store what the origin sends for a request bypassing the cache, replacing the cached copy")
+	flag.BoolVar(&varyAccept, "vary-accept", false, "Cache every response per Accept header, as if the origin always sent Vary: Accept")
+	varyCookieList := flag.String("vary-cookies", "", "Comma-separated cookies whose values are part of the cache key, e.g. lang,theme, all other cookies being ignored")
+	sessionCookieList := flag.String("session-cookie", "", "Comma-separated cookies marking a logged-in user, whose requests are cached apart from anonymous ones")
+	flag.BoolVar(&minifyBodies, "minify", false, "Minify HTML, JSON and CSS responses once as they are cached, hits serve the smaller body")
+	offline := flag.Bool("offline-mode", false, "Serve only what is cached, fresh or stale, and never contact the origin, e.g. during its maintenance (toggled at runtime with PUT and DELETE /_admin/offline)")
+	flag.IntVar(&offlineStatus, "offline-status", http.StatusServiceUnavailable, "Status of misses in --offline-mode")
+	flag.IntVar(&offlineRetryAfter, "offline-retry-after", 300, "Retry-After seconds sent with misses in --offline-mode (0 sends none)")
+	recordFile := flag.String("record", "", "Write origin responses to this file, replacing it, for --replay to serve later as test fixtures. event streams and bodies over --max-cacheable-bytes are not recorded")
+	replayFile := flag.String("replay", "", "Answer origin requests from a file written with --record and never contact the origin, which must be the same --origin")
+	flag.StringVar(&http10CacheHeaders, "http10-cache-headers", "off", "Translate Cache-Control into Expires and Pragma for HTTP/1.0 clients, which may not understand it: add them, replace Cache-Control with them, or off")
+	flag.BoolVar(&honorPragma, "honor-pragma", true, "Revalidate with the origin when a request without Cache-Control sends Pragma: no-cache (--honor-pragma=false for clients sending it needlessly)")
+	flag.BoolVar(&cacheSetCookie, "cache-set-cookie", false, "Cache responses that set cookies, for origins whose cookies are the same for everybody, and send the cookie along on hits. --strip-stored-headers must not list Set-Cookie with it")
+	contentTypeList := flag.String("cacheable-content-types", "", "Comma-separated media types that may be cached, e.g. image/*,text/css,application/javascript (default all)")
+	poolList := flag.String("origin-pool", "", "Comma-separated origins, each optionally with =weight, sharing the load of --origin, which still names them in cache keys")
+	flag.StringVar(&originBalance, "origin-balance", "random", "How --origin-pool members are picked: random, by weight, or round-robin")
+	flag.DurationVar(&originPoolCooldown, "origin-pool-cooldown", 10*time.Second, "How long a failing --origin-pool member is left out")
+	fallbackList := flag.String("origin-fallback", "", "Comma-separated origins tried in order when --origin fails to connect or answers with a 5xx")
+	flag.StringVar(&indexDocument, "index-document", "", "File name appended to paths ending in a slash before they are forwarded and cached, e.g. index.html (default off)")
+	flag.StringVar(&trailingSlash, "normalize-trailing-slash", "", "Collapse duplicate slashes and strip or add the trailing slash of every path before caching and forwarding: strip or add (default off)")
+	allowedHostList := flag.String("allowed-origin-hosts", "", "Comma-separated host names origin requests may be sent to, trusted even on private addresses (default any public host)")
+	flag.BoolVar(&allowPrivateOrigins, "allow-private-origins", false, "Allow origin requests to private and link-local addresses such as 10.0.0.0/8 or 169.254.169.254")
+	maxOriginConcurrency := flag.Int("max-origin-concurrency", 0, "Maximum origin requests in progress at once, further ones queue (0 means no limit)")
+	flag.DurationVar(&originQueueTimeout, "origin-queue-timeout", 5*time.Second, "How long an origin request waits for a --max-origin-concurrency slot before answering 503")
+	corsOriginList := flag.String("cors-allow-origin", "", "Comma-separated origins allowed by CORS, or *, added when the origin sets no CORS headers itself and used to answer preflights (default off)")
+	flag.StringVar(&corsAllowMethods, "cors-allow-methods", "GET, HEAD, POST, OPTIONS", "Methods allowed in answers to CORS preflights")
+	flag.StringVar(&corsAllowHeaders, "cors-allow-headers", "", "Request headers allowed in answers to CORS preflights (default the ones asked for)")
+	flag.DurationVar(&corsMaxAge, "cors-max-age", 10*time.Minute, "How long browsers may cache an answer to a CORS preflight")
+	rateLimit := flag.Float64("rate-limit", 0, "Requests per second allowed per client IP (0 disables rate limiting)")
+	rateBurst := flag.Int("rate-burst", 10, "Requests a client may send at once before --rate-limit applies")
+	flag.BoolVar(&rateLimitExemptHits, "rate-limit-exempt-hits", false, "Don't count requests answered from the cache against --rate-limit")
+	methodList := flag.String("cacheable-methods", "GET,HEAD", "Request methods whose responses are cached: GET, HEAD and OPTIONS, e.g. to cache CORS preflights")
+	statusList := flag.String("cacheable-statuses", "200,203,204,300,301,308,404,410", "Status codes cached without explicit caching headers")
+	configPath := flag.String("config", "", "YAML or JSON file of flag values, flags given on the command line override it")
+	flag.Parse()
+	if *configPath != "" {
+		if err := loadConfig(flag.CommandLine, *configPath); err != nil {
+			fmt.Println("Error: --config:", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := setupLogging(*level); err != nil {
+		fmt.Println("Error: --log-level:", err)
+		os.Exit(1)
+	}
+
+	// Check if the --origin flag is provided, it can only be left out when
+	// routes cover the paths being proxied
+	if originServer == "" && router.Len() == 0 {
+		fmt.Println("Error: --origin flag is required")
+		os.Exit(1)
+	}
+
+	var err error
+	if originServer != "" {
+		if originServer, err = parseOrigin(originServer); err != nil {
+			fmt.Println("Error: --origin:", err)
+			os.Exit(1)
+		}
+	}
+	originFallbacks, err = parseOrigins(*fallbackList)
+	if err != nil {
+		fmt.Println("Error: --origin-fallback:", err)
+		os.Exit(1)
+	}
+	originPool, err = parseOriginPool(*poolList)
+	if err != nil {
+		fmt.Println("Error: --origin-pool:", err)
+		os.Exit(1)
+	}
+	if *recordFile != "" && *replayFile != "" {
+		fmt.Println("Error: --record and --replay can't be used together")
+		os.Exit(1)
+	}
+	if http10CacheHeaders != "off" && http10CacheHeaders != "add" && http10CacheHeaders != "replace" {
+		fmt.Println("Error: --http10-cache-headers must be add, replace or off")
+		os.Exit(1)
+	}
+	if *checkOrigin != "off" && *checkOrigin != "warn" && *checkOrigin != "fail" {
+		fmt.Println("Error: --check-origin must be fail, warn or off")
+		os.Exit(1)
+	}
+	if originBalance != "random" && originBalance != "round-robin" {
+		fmt.Println("Error: --origin-balance must be random or round-robin")
+		os.Exit(1)
+	}
+
+	addr, err := listenAddr(*listen, port)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	mode, err := strconv.ParseUint(*socketModeFlag, 8, 32)
+	if err != nil || mode > 0o777 {
+		fmt.Println("Error: --socket-mode must be octal permissions such as 0660")
+		os.Exit(1)
+	}
+	socketMode = os.FileMode(mode)
+
+	if err := validatePrefix(stripPrefix); err != nil {
+		fmt.Println("Error: --strip-prefix", err)
+		os.Exit(1)
+	}
+	if err := validatePrefix(addPrefix); err != nil {
+		fmt.Println("Error: --add-prefix", err)
+		os.Exit(1)
+	}
+
+	if err := validateIndexDocument(indexDocument); err != nil {
+		fmt.Println("Error: --index-document", err)
+		os.Exit(1)
+	}
+
+	if trailingSlash != "" && trailingSlash != "strip" && trailingSlash != "add" {
+		fmt.Println("Error: --normalize-trailing-slash must be strip or add")
+		os.Exit(1)
+	}
+
+	if cacheBackend != "redis" && cacheBackend != "memory" {
+		fmt.Println("Error: --cache-backend must be redis or memory")
+		os.Exit(1)
+	}
+	if cache.Format, err = cache.FormatNamed(*cacheFormat); err != nil {
+		fmt.Println("Error: --cache-format:", err)
+		os.Exit(1)
+	}
+	if cacheBackend == "memory" && *maxEntries > 0 {
+		fmt.Println("Error: --max-entries needs the redis cache backend")
+		os.Exit(1)
+	}
+	if offlineStatus < 100 || offlineStatus > 599 {
+		fmt.Println("Error: --offline-status must be an HTTP status code")
+		os.Exit(1)
+	}
+	if offlineRetryAfter < 0 {
+		fmt.Println("Error: --offline-retry-after can't be negative")
+		os.Exit(1)
+	}
+	offlineMode.Store(*offline)
+	if cacheBackend == "memory" && *topKeys {
+		fmt.Println("Error: --top-keys needs the redis cache backend")
+		os.Exit(1)
+	}
+	if *topKeysWindow < 0 {
+		fmt.Println("Error: --top-keys-window can't be negative")
+		os.Exit(1)
+	}
+
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		fmt.Println("Error: --tls-cert and --tls-key go together")
+		os.Exit(1)
+	}
+	if tlsCertFile != "" {
+		serverCerts, err = newCertReloader(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			fmt.Println("Error: --tls-cert:", err)
+			os.Exit(1)
+		}
+		go reloadOnHangup(serverCerts)
+	}
+	if httpsRedirectAddr != "" && tlsCertFile == "" {
+		fmt.Println("Error: --https-redirect needs --tls-cert")
+		os.Exit(1)
+	}
+
+	if *errorPagePath != "" {
+		if err := loadErrorPage(*errorPagePath, *errorPageContentType); err != nil {
+			fmt.Println("Error: --error-page:", err)
+			os.Exit(1)
+		}
+	}
+	if errorPageStatus != 0 && (errorPageStatus < 100 || errorPageStatus > 599) {
+		fmt.Println("Error: --error-page-status must be an HTTP status code")
+		os.Exit(1)
+	}
+	if *outagePagePath != "" {
+		if err := loadOutagePage(*outagePagePath, *outagePageContentType); err != nil {
+			fmt.Println("Error: --outage-page:", err)
+			os.Exit(1)
+		}
+	}
+	if outageStatus != 0 && (outageStatus < 100 || outageStatus > 599) {
+		fmt.Println("Error: --outage-status must be an HTTP status code")
+		os.Exit(1)
+	}
+
+	if defaultTTL <= 0 {
+		fmt.Println("Error: --default-ttl must be positive")
+		os.Exit(1)
+	}
+	if flushOnShutdown && cache.KeyPrefix == "" {
+		fmt.Println("Error: --flush-on-shutdown needs a --key-prefix, it would empty the whole database")
+		os.Exit(1)
+	}
+	hashKeys, err := parseKeyStrategy(*keyStrategy)
+	if err != nil {
+		fmt.Println("Error: --key-strategy:", err)
+		os.Exit(1)
+	}
+	cache.HashKeys = cache.HashKeys || hashKeys
+	if minTTL < 0 || (maxTTL > 0 && minTTL > maxTTL) {
+		fmt.Println("Error: --min-ttl must be between 0 and --max-ttl")
+		os.Exit(1)
+	}
+	if adaptiveLowRatio < 0 || adaptiveLowRatio > adaptiveHighRatio || adaptiveHighRatio > 1 {
+		fmt.Println("Error: --adaptive-ttl-low and --adaptive-ttl-high must be ratios from 0 to 1, low below high")
+		os.Exit(1)
+	}
+	if adaptiveMaxFactor < 1 || adaptiveMinFactor < 0 || adaptiveMinFactor > 1 {
+		fmt.Println("Error: --adaptive-ttl-max must be at least 1 and --adaptive-ttl-min from 0 to 1")
+		os.Exit(1)
+	}
+	if ttlJitter < 0 || ttlJitter >= 100 {
+		fmt.Println("Error: --ttl-jitter must be a percentage from 0 to below 100")
+		os.Exit(1)
+	}
+	if fetchLockTTL < 0 || fetchLockWait < 0 {
+		fmt.Println("Error: --fetch-lock-ttl and --fetch-lock-wait can't be negative")
+		os.Exit(1)
+	}
+	if hotKeyHits < 0 || (hotKeyHits > 0 && (hotKeyWindow <= 0 || hotKeyRefreshAhead <= 0)) {
+		fmt.Println("Error: --hot-key-hits can't be negative and needs a positive --hot-key-window and --hot-key-refresh-ahead")
+		os.Exit(1)
+	}
+	if originRetries < 0 || originRetryBackoff < 0 {
+		fmt.Println("Error: --origin-retries and --origin-retry-backoff can't be negative")
+		os.Exit(1)
+	}
+	if originIdleConns < 1 || originIdleTimeout < 0 {
+		fmt.Println("Error: --max-idle-conns-per-host must be at least 1 and --idle-conn-timeout can't be negative")
+		os.Exit(1)
+	}
+	if ttlNoQuery < 0 || ttlWithQuery < 0 {
+		fmt.Println("Error: --ttl-no-query and --ttl-with-query can't be negative")
+		os.Exit(1)
+	}
 
- // user will start server => go run server/main.go --port <port_no> --origin <origin_server_url>
- flag.StringVar(&port, "port", "8080", "Port on which the proxy server will run")
- flag.StringVar(&originServer, "origin", "", "URL of the origin server")
- flag.Parse()
+	if *maxOriginConcurrency > 0 {
+		originSlots = make(chan struct{}, *maxOriginConcurrency)
+	}
 
- // Check if the --origin flag is provided
- if originServer == "" {
-  fmt.Println("Error: --origin flag is required")
-  os.Exit(1)
- }
+	if *rateLimit < 0 {
+		fmt.Println("Error: --rate-limit must not be negative")
+		os.Exit(1)
+	}
+	if *rateLimit > 0 {
+		clientLimiter = newRateLimiter(*rateLimit, *rateBurst)
+	}
 
- // initialize the cache
- cache.InitRedis()
+	if maxCacheableBytes <= 0 {
+		fmt.Println("Error: --max-cacheable-bytes must be positive")
+		os.Exit(1)
+	}
+	if entryCountWarn < 0 {
+		fmt.Println("Error: --entry-count-warn must not be negative")
+		os.Exit(1)
+	}
+	if requestMemoryBytes < 0 {
+		fmt.Println("Error: --request-memory-bytes must not be negative")
+		os.Exit(1)
+	}
+	if writeChunkBytes <= 0 {
+		fmt.Println("Error: --write-chunk-bytes must be positive")
+		os.Exit(1)
+	}
 
- // Start the proxy server
- fmt.Printf("Caching proxy server running on port %s, forwarding to %s\n", port, originServer)
- http.HandleFunc("/", handleRequest)
+	removeResponseHeaders = splitList(*removeHeaderList)
+	stripStoredHeaders, err = parseStoredHeaders(*stripStoredList, flagGiven("strip-stored-headers"))
+	if err != nil {
+		fmt.Println("Error: --strip-stored-headers", err)
+		os.Exit(1)
+	}
+	if names := splitList(*forwardHeaderList); len(names) > 0 {
+		forwardHeaders = map[string]bool{}
+		for _, name := range names {
+			forwardHeaders[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	stripHeaders = splitList(*stripHeaderList)
+	cacheableMethods, err = parseMethodList(*methodList)
+	if err != nil {
+		fmt.Println("Error: --cacheable-methods:", err)
+		os.Exit(1)
+	}
+	cacheableStatuses, err = parseStatusList(*statusList)
+	if err != nil {
+		fmt.Println("Error: --cacheable-statuses:", err)
+		os.Exit(1)
+	}
+	noCachePaths, err = parseRegexList(*noCacheList)
+	if err != nil {
+		fmt.Println("Error: --no-cache-paths:", err)
+		os.Exit(1)
+	}
+	forceCachePaths, err = parseRegexList(*forceCacheList)
+	if err != nil {
+		fmt.Println("Error: --force-cache-paths:", err)
+		os.Exit(1)
+	}
+	if len(forceCachePaths) > 0 {
+		if forceCacheTTL <= 0 {
+			fmt.Println("Error: --force-cache-paths needs a positive --force-cache-ttl")
+			os.Exit(1)
+		}
+		slog.Warn("caching responses on --force-cache-paths against the origin's Cache-Control, private or no-store content may be served to everyone", "paths", *forceCacheList, "ttl", forceCacheTTL)
+	}
+	cachePostPaths, err = parseRegexList(*cachePostList)
+	if err != nil {
+		fmt.Println("Error: --cache-post-paths:", err)
+		os.Exit(1)
+	}
+
+	cacheableContentTypes = splitList(strings.ToLower(*contentTypeList))
+	sessionCookies = splitList(*sessionCookieList)
+	varyCookies = splitList(*varyCookieList)
+	corsAllowOrigins = parseNameSet(*corsOriginList)
+	allowedOriginHosts = parseNameSet(strings.ToLower(*allowedHostList))
+	cacheQueryParams = parseNameSet(*cacheParamList)
+	ignoreQueryParams = parseNameSet(*ignoreParamList)
+
+	tlsConfig, err := originTLSConfig(*originCAFile, *originInsecure)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if *originInsecure {
+		slog.Warn("origin TLS certificate verification is disabled")
+	}
+	transport := newOriginTransport(originTimeout, tlsConfig)
+	if *recordFile != "" {
+		if transport, err = newRecordTransport(*recordFile, transport); err != nil {
+			fmt.Println("Error: --record:", err)
+			os.Exit(1)
+		}
+		slog.Info("recording origin responses", "path", *recordFile)
+	}
+	if *replayFile != "" {
+		if transport, err = newReplayTransport(*replayFile); err != nil {
+			fmt.Println("Error: --replay:", err)
+			os.Exit(1)
+		}
+		slog.Info("replaying recorded origin responses", "path", *replayFile)
+	}
+	originProxy = newOriginProxy(transport)
+
+	if *check {
+		if err := runCheck(redisOpts, transport); err != nil {
+			fmt.Println("unhealthy:", err)
+			os.Exit(1)
+		}
+		fmt.Println("ok: redis and origin reachable")
+		return
+	}
+
+	// a wrong --origin shows up now rather than on the first request
+	if *checkOrigin != "off" {
+		if err := checkOrigins(transport); err != nil {
+			if *checkOrigin == "fail" {
+				fmt.Println("Error: --check-origin:", err)
+				os.Exit(1)
+			}
+			slog.Warn("origin unreachable at startup", "error", err)
+		}
+	}
+
+	if *memCacheGrace < 0 {
+		fmt.Println("Error: --mem-cache-grace must not be negative")
+		os.Exit(1)
+	}
+	if *memCacheSize > 0 {
+		memCache = cache.NewLRU(*memCacheSize)
+		memCache.SetGrace(*memCacheGrace)
+	}
+
+	// initialize the cache
+	if cacheBackend == "memory" {
+		cache.Use(cache.NewMemory())
+	} else if err := cache.InitRedis(redisURL, redisOpts); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if *maxEntries > 0 {
+		cache.EnableEviction(cache.KeyPrefix+"__lru", *maxEntries)
+	}
+	if *topKeys {
+		cache.EnableTopKeys(cache.KeyPrefix+"__top", *topKeysWindow)
+	}
+	if *entryCountInterval > 0 {
+		go logEntryCount(*entryCountInterval)
+	}
+	if *usageInterval > 0 {
+		go sampleUsage(*usageInterval)
+	}
+	if hotKeyHits > 0 {
+		go refreshHotKeys()
+	}
+
+	// Start the proxy server
+	slog.Info("Caching proxy server running", "addr", addr, "origin", originServer)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/_admin/cache", handlePurge)
+	http.HandleFunc("/_admin/stats", handleStats)
+	http.HandleFunc("/_admin/warm", handleWarm)
+	http.HandleFunc("/_admin/version", handleVersion)
+	http.HandleFunc("/_admin/inflight", handleInflight)
+	http.HandleFunc("/_admin/entry", handleEntry)
+	http.HandleFunc("/_admin/top", handleTop)
+	http.HandleFunc("/_admin/offline", handleOffline)
+	http.HandleFunc("/_admin/loglevel", handleLogLevel)
+	http.HandleFunc("/_admin/routes", handleRoutes)
+	http.Handle("/", withCORS(http.HandlerFunc(handleRequest)))
+
+	server := newServer(addr, withRequestLog(http.DefaultServeMux), timeouts)
+	if err := runServer(server); err != nil {
+		slog.Error("Server stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+// runServer serves, along with the --https-redirect listener, until SIGINT
+// or SIGTERM arrives, then stops accepting connections, waits up to
+// shutdownTimeout for in-flight requests to finish and closes the Redis
+// client
+func runServer(server *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ln, err := listenOn(server.Addr)
+	if err != nil {
+		cache.Close()
+		return err
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- serve(server, ln)
+	}()
+	var redirect *http.Server
+	if httpsRedirectAddr != "" {
+		redirect = &http.Server{
+			Addr:              httpsRedirectAddr,
+			Handler:           redirectToHTTPS(server.Addr),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			errCh <- redirect.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		cache.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, draining in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if redirect != nil {
+		redirect.Shutdown(shutdownCtx)
+	}
+	err = server.Shutdown(shutdownCtx)
+
+	if closeErr := closeCache(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// closeCache closes the cache once the server has stopped, with
+// --flush-on-shutdown deleting the proxy's keys first
+func closeCache() error {
+	if flushOnShutdown {
+		n, err := cache.Flush(context.Background())
+		if err != nil {
+			slog.Warn("Flushing the cache failed", "error", err)
+		} else {
+			slog.Info("Flushed the cache", "keys", n)
+		}
+	}
+	return cache.Close()
+}
+
+// serverTimeouts are the limits put on client connections
+type serverTimeouts struct {
+	readHeader, read, write, idle time.Duration
+}
+
+// newServer returns the server for handler on addr. HTTP/1.1 with
+// keep-alive is always served, HTTP/2 over TLS and, with --h2c, without
+func newServer(addr string, handler http.Handler, timeouts serverTimeouts) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(h2c)
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.readHeader,
+		ReadTimeout:       timeouts.read,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
+		Protocols:         &protocols,
+	}
+}
+
+// serve accepts connections on ln, over TLS when --tls-cert is set
+func serve(server *http.Server, ln net.Listener) error {
+	if tlsCertFile != "" {
+		return serveTLS(server, ln)
+	}
+	return server.Serve(ln)
+}
+
+// listenAddr returns the address to listen on: --listen when given, else
+// every interface on --port. a unix:/path address is a unix socket
+func listenAddr(listen, port string) (string, error) {
+	addr := listen
+	if addr == "" {
+		addr = ":" + port
+	}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return "", fmt.Errorf("invalid listen address %q: no socket path", addr)
+		}
+		return addr, nil
+	}
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port in listen address %q", addr)
+	}
+	return addr, nil
+}
 
- log.Fatal(http.ListenAndServe(":"+port, nil))
+// listenOn opens the listener for addr as returned by listenAddr. a socket
+// left behind by an earlier run is replaced, any other file at the path is
+// an error. the socket gets socketMode and is removed again when the
+// listener is closed
+func listenOn(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, socketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
 }
 
-// handleRequest will forward the incoming req to the origin server and return the response
-func handleRequest(w http.ResponseWriter, r *http.Request) {
- // construct the target URL
- targetURL := originServer + r.URL.Path
-
- // try to get cached response
- cachedResponse, err := cache.GetClient().Get(cache.Ctx, targetURL).Result()
- if err == nil {
-  fmt.Println("Cache HIT")
-  w.Write([]byte(cachedResponse)) // send cached response to client
-  return
- }
-
- fmt.Println("Cache MISS")
- // forward request to the origin server
- resp, err := http.Get(targetURL)
- if err != nil {
-  http.Error(w, "Error contacting origin server", http.StatusBadGateway)
-  return
- }
- defer resp.Body.Close()
-
- // copy response headers
- for key, values := range resp.Header {
-  for _, value := range values {
-   w.Header().Add(key, value)
-  }
- }
-
- // copy response status code
- w.WriteHeader(resp.StatusCode)
-
- // read response body
- body, _ := io.ReadAll(resp.Body)
-
- // store response in Redis cache
- cache.GetClient().Set(cache.Ctx, targetURL, body, 300*time.Second) // cache for 5 mins
-
- // send response to client
- w.Write(body)
+// envOr returns the value of the environment variable key, or fallback when
+// it is unset or empty
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
 }
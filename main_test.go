@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRunMain runs main with the arguments in $PROXY_MAIN_ARGS, for
+// runProxy. it does nothing in a normal test run
+func TestRunMain(t *testing.T) {
+	args, ok := os.LookupEnv("PROXY_MAIN_ARGS")
+	if !ok {
+		t.Skip("only run by runProxy")
+	}
+	os.Args = append([]string{"proxy"}, strings.Split(args, "\n")...)
+	main()
+}
+
+// runProxy runs the proxy with args in a process of its own, returning
+// what it printed and how it exited
+func runProxy(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRunMain$")
+	cmd.Env = append(os.Environ(), "PROXY_MAIN_ARGS="+strings.Join(args, "\n"))
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// startupError is runProxy for arguments the proxy must refuse to start
+// with, failing the test unless it exited with an error
+func startupError(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := runProxy(t, args...)
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("%v: started, or couldn't run: %v\n%s", args, err, out)
+	}
+	return out
+}
+
+func TestEnvOr(t *testing.T) {
+	t.Setenv("REDIS_URL", "redis://cache.internal:6379")
+	if got := envOr("REDIS_URL", "redis://default@redis:6379"); got != "redis://cache.internal:6379" {
+		t.Fatalf("got %q", got)
+	}
+	t.Setenv("REDIS_URL", "")
+	if got := envOr("REDIS_URL", "redis://default@redis:6379"); got != "redis://default@redis:6379" {
+		t.Fatalf("fallback %q", got)
+	}
+}
+
+// unixClient returns a client sending every request to the socket at path
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	shutdownTimeout = 5 * time.Second
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "finished")
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer(newServer("unix:"+socket, handler, serverTimeouts{}))
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		// the socket shows up once runServer is listening
+		client := unixClient(socket)
+		for {
+			resp, err := client.Get("http://proxy/slow")
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			got <- result{string(b), err}
+			return
+		}
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached the server")
+	}
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+
+	if res := <-got; res.err != nil || res.body != "finished" {
+		t.Fatalf("in-flight request: %q %v", res.body, res.err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("runServer: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runServer didn't return")
+	}
+}
+
+func TestDefaultTTLMustBePositive(t *testing.T) {
+	for _, value := range []string{"0s", "-1m"} {
+		if out := startupError(t, "--origin=http://origin.test", "--default-ttl="+value); !strings.Contains(out, "Error: --default-ttl must be positive") {
+			t.Errorf("%s: %s", value, out)
+		}
+	}
+}
+
+func TestTrailingSlashModeIsChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--normalize-trailing-slash=both"); !strings.Contains(out, "Error: --normalize-trailing-slash must be strip or add") {
+		t.Fatal(out)
+	}
+}
+
+func TestCacheBackendIsChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--cache-backend=disk"); !strings.Contains(out, "Error: --cache-backend must be redis or memory") {
+		t.Fatal(out)
+	}
+}
+
+func TestCacheableMethodsAreChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--cacheable-methods=GET,PUT"); !strings.Contains(out, "Error: --cacheable-methods:") {
+		t.Fatal(out)
+	}
+}
+
+func TestFlushOnShutdownNeedsAPrefix(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--flush-on-shutdown", "--key-prefix="); !strings.Contains(out, "Error: --flush-on-shutdown needs a --key-prefix") {
+		t.Fatal(out)
+	}
+}
+
+func TestOriginRetriesAreChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--origin-retries=-1"); !strings.Contains(out, "Error: --origin-retries and --origin-retry-backoff can't be negative") {
+		t.Fatal(out)
+	}
+}
+
+func TestMinTTLMustNotExceedMaxTTL(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--min-ttl=2h", "--max-ttl=1h"); !strings.Contains(out, "Error: --min-ttl must be between 0 and --max-ttl") {
+		t.Fatal(out)
+	}
+}
+
+func TestOutageStatusIsChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--outage-status=42"); !strings.Contains(out, "Error: --outage-status must be an HTTP status code") {
+		t.Fatal(out)
+	}
+}
+
+func TestForceCachePathsNeedATTL(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--force-cache-paths=^/static"); !strings.Contains(out, "Error: --force-cache-paths needs a positive --force-cache-ttl") {
+		t.Fatal(out)
+	}
+}
+
+func TestIdleConnsAreChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--max-idle-conns-per-host=0"); !strings.Contains(out, "Error: --max-idle-conns-per-host must be at least 1") {
+		t.Fatal(out)
+	}
+}
+
+func TestStrippingSetCookieConflictsWithCacheSetCookie(t *testing.T) {
+	const want = "Error: --strip-stored-headers must not list Set-Cookie with --cache-set-cookie"
+	if out := startupError(t, "--origin=http://origin.test", "--cache-set-cookie", "--strip-stored-headers=Date,Set-Cookie"); !strings.Contains(out, want) {
+		t.Fatalf("command line: %s", out)
+	}
+	path := writePage(t, "proxy.yaml", "strip-stored-headers: [Date, Set-Cookie]\n")
+	if out := startupError(t, "--origin=http://origin.test", "--cache-set-cookie", "--config="+path); !strings.Contains(out, want) {
+		t.Fatalf("config file: %s", out)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		listen, port, want string
+		ok                 bool
+	}{
+		{"", "8080", ":8080", true},
+		{"127.0.0.1:9000", "8080", "127.0.0.1:9000", true},
+		{"[::1]:9000", "8080", "[::1]:9000", true},
+		{"unix:/run/proxy.sock", "8080", "unix:/run/proxy.sock", true},
+		{"unix:", "8080", "", false},
+		{"127.0.0.1", "8080", "", false},
+		{"127.0.0.1:http2", "8080", "", false},
+		{"127.0.0.1:70000", "8080", "", false},
+		{"", "nope", "", false},
+	} {
+		addr, err := listenAddr(tc.listen, tc.port)
+		if (err == nil) != tc.ok || addr != tc.want {
+			t.Errorf("--listen %q --port %q: %q, %v", tc.listen, tc.port, addr, err)
+		}
+	}
+}
+
+func TestListenOnLoopback(t *testing.T) {
+	ln, err := listenOn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}), serverTimeouts{})
+	go server.Serve(ln)
+	defer server.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	resp, err := http.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("loopback got %d", resp.StatusCode)
+	}
+
+	// any other address of this host must not reach the listener
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		ip, ok := a.(*net.IPNet)
+		if !ok || ip.IP.IsLoopback() || ip.IP.To4() == nil {
+			continue
+		}
+		addr := net.JoinHostPort(ip.IP.String(), strconv.Itoa(port))
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.Close()
+			t.Errorf("listener reachable on %s", addr)
+		}
+	}
+}
+
+func TestListenOnUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	// a stale socket from an earlier run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	defer func(m os.FileMode) { socketMode = m }(socketMode)
+	socketMode = 0o600
+	ln, err := listenOn("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode %v, %v", info.Mode(), err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(handleHealthz)}
+	go server.Serve(ln)
+
+	resp, err := unixClient(path).Get("http://proxy/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("healthz over the socket got %d", resp.StatusCode)
+	}
+
+	server.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket left behind: %v", err)
+	}
+
+	// a regular file in the way is never removed
+	os.WriteFile(path, []byte("x"), 0o600)
+	if _, err := listenOn("unix:" + path); err == nil {
+		t.Fatal("listened over a regular file")
+	}
+}
+
+func TestSocketModeIsChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--socket-mode=rw"); !strings.Contains(out, "Error: --socket-mode must be octal permissions") {
+		t.Fatal(out)
+	}
+}
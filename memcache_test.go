@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestMemCacheSparesRedis(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hot"))
+	})
+	counted := useCountingCache()
+	memCache = cache.NewLRU(8)
+	defer func() { memCache = nil }()
+
+	if rec := doRequest("GET", "/hot"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first request X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	gets := counted.gets.Load()
+	rec := doRequest("GET", "/hot")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "hot" {
+		t.Fatalf("second request got %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if n := counted.gets.Load() - gets; n != 0 {
+		t.Fatalf("second request read the shared cache %d times", n)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("origin hit %d times", hits.Load())
+	}
+}
+
+func TestPurgeEmptiesMemCache(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hot"))
+	})
+	useCountingCache()
+	memCache = cache.NewLRU(8)
+	defer func() { memCache = nil }()
+
+	doRequest("GET", "/hot")
+	if _, err := purgeURL(t.Context(), &url.URL{Path: "/hot"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := memCache.Get(keyFor("/hot")); ok {
+		t.Fatal("purged entry still in memory")
+	}
+	if rec := doRequest("GET", "/hot"); rec.Header().Get("X-Cache") != "MISS" || hits.Load() != 2 {
+		t.Fatalf("after purge X-Cache %q, origin hits %d", rec.Header().Get("X-Cache"), hits.Load())
+	}
+}
+
+func TestMemCacheGraceServesWhatRedisEvicted(t *testing.T) {
+	var n atomic.Int32
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Write([]byte(strconv.Itoa(int(n.Add(1)))))
+	})
+	memCache = cache.NewLRU(10)
+	memCache.SetGrace(time.Minute)
+	defer func() { memCache = nil }()
+
+	if rec := doRequest("GET", "/grace"); rec.Body.String() != "1" {
+		t.Fatalf("filling the cache got %q", rec.Body.String())
+	}
+	// Redis drops the entry and the memory copy expires
+	mr.Del(keyFor("/grace"))
+	time.Sleep(1100 * time.Millisecond)
+
+	rec := doRequest("GET", "/grace")
+	if rec.Body.String() != "1" || rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("within the grace: %q, X-Cache %q, want the memory copy as STALE", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	// serving it refreshed the entry in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for (!mr.Exists(keyFor("/grace")) || inflightCount() != 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rec = doRequest("GET", "/grace")
+	if rec.Body.String() != "2" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("after the refresh: %q, X-Cache %q", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestWithoutMemCacheGraceAnEvictedEntryIsAMiss(t *testing.T) {
+	var n atomic.Int32
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Write([]byte(strconv.Itoa(int(n.Add(1)))))
+	})
+	memCache = cache.NewLRU(10)
+	defer func() { memCache = nil }()
+
+	doRequest("GET", "/grace")
+	mr.Del(keyFor("/grace"))
+	time.Sleep(1100 * time.Millisecond)
+	if rec := doRequest("GET", "/grace"); rec.Body.String() != "2" || rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("no grace: %q, X-Cache %q, want a MISS", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestMemCacheGraceIsChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--mem-cache-grace=-1s"); !strings.Contains(out, "Error: --mem-cache-grace must not be negative") {
+		t.Fatal(out)
+	}
+}
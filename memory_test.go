@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestHandlerOnTheMemoryBackend(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body " + r.URL.Path))
+	})
+	mem := cache.NewMemory()
+	cache.Use(mem)
+
+	if rec := doRequest("GET", "/m"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first request: X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	rec := doRequest("GET", "/m")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "body /m" || hits.Load() != 1 {
+		t.Fatalf("X-Cache %q, body %q, %d origin requests", rec.Header().Get("X-Cache"), rec.Body.String(), hits.Load())
+	}
+	if ttl := rec.Header().Get("X-Cache-TTL"); ttl != "60" && ttl != "59" {
+		t.Fatalf("X-Cache-TTL %q", ttl)
+	}
+	doRequest("GET", "/m/sub")
+	if n, _ := mem.Len(context.Background()); n != 2 {
+		t.Fatalf("%d keys stored, want 2", n)
+	}
+
+	rec = adminRequest(t, handlePurge, "DELETE", "/_admin/cache?prefix=/m")
+	if n := deletedCount(t, rec); n != 2 {
+		t.Fatalf("prefix purge deleted %d, want 2", n)
+	}
+	if got := doRequest("GET", "/m").Header().Get("X-Cache"); got != "MISS" {
+		t.Fatalf("after the purge: X-Cache %q", got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOptionsIsCachedOnlyWhenListed(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.Write([]byte(r.Method))
+	})
+	defer func(methods map[string]bool) { cacheableMethods = methods }(cacheableMethods)
+
+	doRequest("OPTIONS", "/o")
+	if rec := doRequest("OPTIONS", "/o"); rec.Header().Get("X-Cache") != "MISS" || hits.Load() != 2 {
+		t.Fatalf("by default: X-Cache %q, %d origin requests", rec.Header().Get("X-Cache"), hits.Load())
+	}
+
+	cacheableMethods, _ = parseMethodList("GET, head, OPTIONS")
+	doRequest("OPTIONS", "/p")
+	rec := doRequest("OPTIONS", "/p")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "OPTIONS" || hits.Load() != 3 {
+		t.Fatalf("listed: X-Cache %q, body %q, %d origin requests", rec.Header().Get("X-Cache"), rec.Body.String(), hits.Load())
+	}
+	// the key includes the method, GET has an entry of its own
+	if rec := doRequest("GET", "/p"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "GET" {
+		t.Fatalf("GET: X-Cache %q, body %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	rec = adminRequest(t, handlePurge, "DELETE", "/_admin/cache?url=/p")
+	if n := deletedCount(t, rec); n != 2 {
+		t.Fatalf("purge deleted %d, want the GET and OPTIONS entries", n)
+	}
+
+	cacheableMethods, _ = parseMethodList("GET")
+	doRequest("HEAD", "/h")
+	if rec := doRequest("HEAD", "/h"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("HEAD left out: X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestParseMethodList(t *testing.T) {
+	for _, bad := range []string{"POST", "DELETE", "FOO", "GET,PUT"} {
+		if _, err := parseMethodList(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	m, err := parseMethodList("get,OPTIONS")
+	if err != nil || !m["GET"] || !m["OPTIONS"] || m["HEAD"] {
+		t.Fatalf("%v %v", m, err)
+	}
+}
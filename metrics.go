@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// stats backs both the Prometheus counters and /_admin/stats so the two
+	// always agree
+	stats cache.Stats
+
+	// startTime is used to report uptime
+	startTime = time.Now()
+)
+
+// Prometheus metrics served on /metrics
+var (
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "cache_hits_total",
+		Help: "Requests served from the cache.",
+	}, func() float64 { return float64(stats.Snapshot().Hits) })
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "cache_misses_total",
+		Help: "Cacheable requests that had to go to the origin.",
+	}, func() float64 { return float64(stats.Snapshot().Misses) })
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "cache_errors_total",
+		Help: "Requests answered with an error because the origin failed.",
+	}, func() float64 { return float64(stats.Snapshot().Errors) })
+	originDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "origin_request_duration_seconds",
+		Help:    "Time spent waiting for the origin to respond.",
+		Buckets: prometheus.DefBuckets,
+	})
+	originErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "origin_errors_total",
+		Help: "Origin requests that failed without a response.",
+	})
+	entryBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cache_entry_bytes",
+		Help:    "Size of the entries written to the cache, headers included.",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cache_compression_ratio",
+		Help: "Size of the bodies --compress-cache compressed over their compressed size.",
+	}, func() float64 { return cache.Compression().Ratio() })
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cache_compression_saved_bytes",
+		Help: "Bytes --compress-cache took off the bodies it compressed.",
+	}, func() float64 { return float64(cache.Compression().SavedBytes()) })
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cache_stored_bytes",
+		Help: "Bytes stored under the key prefix at the last --usage-interval sample.",
+	}, func() float64 { return float64(storedBytes.Load()) })
+)
+
+// storedBytes is the last sample taken by sampleUsage
+var storedBytes atomic.Int64
+
+// entryCountWarn is the number of keys beyond which logEntryCount warns,
+// 0 for never
+var entryCountWarn int64
+
+// logEntryCount logs how many keys the proxy has in the cache every
+// interval, as a warning once there are more than --entry-count-warn,
+// which may be a key explosion such as an unbounded query parameter
+func logEntryCount(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		checkEntryCount(ctx)
+		cancel()
+	}
+}
+
+// checkEntryCount counts the keys once for logEntryCount
+func checkEntryCount(ctx context.Context) {
+	if !cache.Available() {
+		return
+	}
+	n, err := cache.StoredKeys(ctx)
+	if err != nil {
+		cache.ReportError(ctx, err)
+		return
+	}
+	if entryCountWarn > 0 && n > entryCountWarn {
+		slog.Warn("cache entry count above --entry-count-warn", "keys", n, "threshold", entryCountWarn)
+		return
+	}
+	slog.Info("cache entry count", "keys", n)
+}
+
+// sampleUsage updates cache_stored_bytes every interval, walking the keys
+// of the proxy in the cache
+func sampleUsage(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if cache.Available() {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			n, err := cache.StoredBytes(ctx)
+			if err != nil {
+				cache.ReportError(ctx, err)
+			} else {
+				storedBytes.Store(n)
+			}
+			cancel()
+		}
+		<-ticker.C
+	}
+}
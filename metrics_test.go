@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrape returns the unlabelled samples /metrics exposes, by name. a
+// histogram's _count and _sum are included
+func scrape(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	samples := map[string]float64{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || strings.HasPrefix(name, "#") || strings.Contains(name, "{") {
+			continue
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			samples[name] = v
+		}
+	}
+	return samples
+}
+
+func TestMetricsCountHitsAndMisses(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	before := scrape(t)
+	doRequest("GET", "/metered")
+	doRequest("GET", "/metered")
+	after := scrape(t)
+	for name, want := range map[string]float64{
+		"cache_hits_total":                      1,
+		"cache_misses_total":                    1,
+		"origin_request_duration_seconds_count": 1,
+	} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s moved by %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestOriginErrorsAreCounted(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	originServer = "http://127.0.0.1:1"
+	before := scrape(t)
+	doRequest("GET", "/unreachable")
+	if got := scrape(t)["origin_errors_total"] - before["origin_errors_total"]; got != 1 {
+		t.Fatalf("origin_errors_total moved by %v", got)
+	}
+}
+
+func TestStoringEntriesObservesTheirBytes(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/big" {
+			w.Write([]byte(strings.Repeat("b", 10000)))
+			return
+		}
+		w.Write([]byte(strings.Repeat("s", 100)))
+	})
+	before := scrape(t)
+	doRequest("GET", "/small")
+	doRequest("GET", "/big")
+	doRequest("GET", "/big")
+	after := scrape(t)
+
+	if n := after["cache_entry_bytes_count"] - before["cache_entry_bytes_count"]; n != 2 {
+		t.Fatalf("%v entries observed, want 2", n)
+	}
+	// each entry is its body and some metadata
+	sum := after["cache_entry_bytes_sum"] - before["cache_entry_bytes_sum"]
+	if sum < 10100 || sum > 16000 {
+		t.Fatalf("observed %v bytes for bodies of 10100", sum)
+	}
+	if n, err := cache.StoredBytes(t.Context()); err != nil || float64(n) != sum {
+		t.Fatalf("stored bytes %d, %v, want the observed %v", n, err, sum)
+	}
+}
+
+// sizedCache is a backend claiming to hold n keys
+type sizedCache struct {
+	cache.Cache
+	n int64
+}
+
+func (c sizedCache) Len(ctx context.Context) (int64, error) { return c.n, nil }
+
+func TestEntryCountWarnsAboveTheThreshold(t *testing.T) {
+	logs := captureLog(t)
+	defer func(n int64) { entryCountWarn = n }(entryCountWarn)
+	entryCountWarn = 1000
+
+	cache.Use(sizedCache{Cache: cache.NewMemory(), n: 10})
+	checkEntryCount(context.Background())
+	if out := logs.String(); !strings.Contains(out, `"level":"INFO"`) || !strings.Contains(out, `"keys":10`) {
+		t.Fatalf("below the threshold logged %s", out)
+	}
+
+	logs.Reset()
+	cache.Use(sizedCache{Cache: cache.NewMemory(), n: 5000})
+	checkEntryCount(context.Background())
+	if out := logs.String(); !strings.Contains(out, `"level":"WARN"`) || !strings.Contains(out, `"keys":5000`) {
+		t.Fatalf("above the threshold logged %s", out)
+	}
+}
+
+func TestEntryCountWarnIsChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--entry-count-warn=-1"); !strings.Contains(out, "Error: --entry-count-warn must not be negative") {
+		t.Fatal(out)
+	}
+}
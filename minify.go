@@ -0,0 +1,60 @@
+package main
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/json"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// minifier minifies the media types --minify handles. HTML keeps its
+// document and end tags, quotes, default attribute values and conditional
+// comments, the CSS of <style> elements is minified with it and scripts
+// are left as written
+var minifier = func() *minify.M {
+	m := minify.New()
+	m.Add("text/html", &html.Minifier{
+		KeepSpecialComments: true,
+		KeepDefaultAttrVals: true,
+		KeepDocumentTags:    true,
+		KeepEndTags:         true,
+		KeepQuotes:          true,
+	})
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("application/json", json.Minify)
+	return m
+}()
+
+// minifyEntry shrinks the body of an HTML, JSON or CSS entry about to be
+// stored, with --minify, so every hit serves the smaller copy. a body the
+// minifier can't parse, like JSONP sent as JSON, is stored as it came, and
+// /*! comments in CSS are kept. the origin's ETag no longer matches the
+// bytes and becomes weak
+func minifyEntry(entry *cache.Entry) {
+	if !minifyBodies || len(entry.Body) == 0 || entry.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(entry.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/html", "application/json", "text/css":
+	default:
+		return
+	}
+	body, err := minifier.Bytes(mediaType, entry.Body)
+	if err != nil || len(body) >= len(entry.Body) {
+		return
+	}
+	entry.Body = body
+	if entry.Header.Get("Content-Length") != "" {
+		entry.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if etag := entry.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		entry.Header.Set("ETag", "W/"+etag)
+	}
+}
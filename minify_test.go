@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testHTML = `<!DOCTYPE html>
+<html>
+  <head>
+    <!-- build 1234 -->
+    <!--[if IE]><p>ie</p><![endif]-->
+    <title>  Hello   World </title>
+    <style>
+      body  { color: red }
+    </style>
+    <script>
+      var s = "a   b";  // keep
+    </script>
+  </head>
+  <body>
+    <p title="two  spaces">Some
+       text</p>
+    <pre>
+  line one
+    line two
+</pre>
+    <textarea>  a
+  b</textarea>
+  </body>
+</html>
+`
+
+// minifyOrigin starts a proxy with --minify whose origin serves an HTML
+// page, JSON, JSONP and CSS
+func minifyOrigin(t *testing.T) {
+	t.Helper()
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Content-Length", strconv.Itoa(len(testHTML)))
+			w.Write([]byte(testHTML))
+		case "/data":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{\n  \"a\": [1, 2],\n  \"b\": \"x  y\"\n}\n"))
+		case "/jsonp":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("cb({\"a\": 1});"))
+		case "/style":
+			w.Header().Set("Content-Type", "text/css")
+			w.Write([]byte("/*! license */\n/* note */\na > b ,  c {\n  margin : calc(1px + 2px);\n  content: \"a  ;  b\";\n}\n"))
+		}
+	})
+	previous := minifyBodies
+	t.Cleanup(func() { minifyBodies = previous })
+	minifyBodies = true
+}
+
+func TestCachedHTMLIsMinifiedAndIntact(t *testing.T) {
+	minifyOrigin(t)
+	doRequest("GET", "/page")
+	w := doRequest("GET", "/page")
+	body := w.Body.String()
+	if w.Header().Get("X-Cache") != "HIT" || len(body) >= len(testHTML) || w.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Fatalf("X-Cache %q, %d bytes from %d, Content-Length %q", w.Header().Get("X-Cache"), len(body), len(testHTML), w.Header().Get("Content-Length"))
+	}
+	// the bytes changed, so the validator is weak now
+	if w.Header().Get("ETag") != `W/"v1"` {
+		t.Fatalf("ETag %q", w.Header().Get("ETag"))
+	}
+	for _, want := range []string{
+		"<html><head><!--[if IE]><p>ie</p><![endif]--><title>Hello World</title>",
+		"<style>body{color:red}</style>",
+		// scripts are left as written
+		"<script>\n      var s = \"a   b\";  // keep\n    </script>",
+		"<p title=\"two  spaces\">Some\ntext</p>",
+		"<pre>\n  line one\n    line two\n</pre>",
+		"<textarea>  a\n  b</textarea>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("missing %q in %q", want, body)
+		}
+	}
+	if strings.Contains(body, "build 1234") {
+		t.Fatalf("comment kept in %q", body)
+	}
+
+	// nothing was cut off either end
+	if !strings.HasPrefix(strings.ToLower(body), "<!doctype html>") || !strings.HasSuffix(body, "</html>") {
+		t.Fatalf("minified page %q", body)
+	}
+}
+
+func TestCachedJSONAndCSSAreMinified(t *testing.T) {
+	minifyOrigin(t)
+	doRequest("GET", "/data")
+	if w := doRequest("GET", "/data"); w.Body.String() != `{"a":[1,2],"b":"x  y"}` || !json.Valid(w.Body.Bytes()) {
+		t.Fatalf("JSON %q", w.Body.String())
+	}
+	// JSONP isn't JSON and is left alone
+	if w := doRequest("GET", "/jsonp"); w.Body.String() != "cb({\"a\": 1});" || w.Header().Get("ETag") != `"v1"` {
+		t.Fatalf("JSONP %q, ETag %q", w.Body.String(), w.Header().Get("ETag"))
+	}
+	doRequest("GET", "/style")
+	if w := doRequest("GET", "/style"); w.Body.String() != "/*!license*/a>b,c{margin:calc(1px + 2px);content:\"a  ;  b\"}" {
+		t.Fatalf("CSS %q", w.Body.String())
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// errOffline is returned instead of contacting an origin in --offline-mode
+var errOffline = errors.New("proxy is in offline mode")
+
+// offlineMode, set by --offline-mode and /_admin/offline, keeps every
+// request away from the origins, for planned maintenance. cached entries
+// are still served, fresh or not, misses get offlineStatus with a
+// Retry-After of offlineRetryAfter seconds
+var (
+	offlineMode       atomic.Bool
+	offlineStatus     int
+	offlineRetryAfter int
+)
+
+// offlineTransport refuses every origin request while offlineMode is on,
+// whatever it is for: a miss, a pass-through, a background revalidation or
+// a warm-up
+type offlineTransport struct {
+	base http.RoundTripper
+}
+
+func (t offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if offlineMode.Load() {
+		return nil, errOffline
+	}
+	return t.base.RoundTrip(req)
+}
+
+// serveOffline answers a cacheable request in offlineMode from whatever the
+// cache holds, found telling whether there is an entry at all. a stale
+// entry the origin said must be revalidated can't be
+func serveOffline(w http.ResponseWriter, r *http.Request, key string, entry *cache.Entry, found bool) {
+	traceOf(r).add("offline mode")
+	if !found || !mayServeStale(entry) {
+		countMiss(r)
+		originError(w, r, errOffline)
+		return
+	}
+	countHit(r)
+	if entry.Fresh() {
+		serveEntry(w, r, key, entry, "HIT")
+		return
+	}
+	serveEntry(w, r, key, entry, "STALE")
+}
+
+// offlineError answers a request that would have needed the origin while
+// offlineMode is on
+func offlineError(w http.ResponseWriter) {
+	if offlineRetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(offlineRetryAfter))
+	}
+	gatewayError(w, "Origin server under maintenance", offlineStatus)
+}
+
+// handleOffline reports whether the proxy is in offline mode, PUT turns it
+// on and DELETE off again
+//
+//	PUT /_admin/offline
+//	DELETE /_admin/offline
+func handleOffline(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		offlineMode.Store(true)
+	case http.MethodDelete:
+		offlineMode.Store(false)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"offline": offlineMode.Load()})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func offlineOrigin(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/old" {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+	} else {
+		w.Header().Set("Cache-Control", "max-age=60")
+	}
+	w.Write([]byte("ok"))
+}
+
+func TestOfflineModeServesHitsAndRefusesMisses(t *testing.T) {
+	_, hits := newTestProxy(t, offlineOrigin)
+	defer func(status, retryAfter int) { offlineStatus, offlineRetryAfter = status, retryAfter }(offlineStatus, offlineRetryAfter)
+	offlineStatus, offlineRetryAfter = http.StatusServiceUnavailable, 120
+	doRequest("GET", "/a")
+	doRequest("GET", "/old")
+	offlineMode.Store(true)
+	defer offlineMode.Store(false)
+
+	if rec := doRequest("GET", "/a"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "ok" {
+		t.Fatalf("hit: %d, X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	// a client's no-cache can't reach the origin either
+	if rec := doRequest("GET", "/a", "Cache-Control", "no-cache"); rec.Code != http.StatusOK {
+		t.Fatalf("no-cache: %d", rec.Code)
+	}
+	// a stale entry beats the error
+	if rec := doRequest("GET", "/old"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("stale: %d, X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if rec := doRequest("GET", "/b"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "120" {
+		t.Fatalf("miss: %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := doRequest("POST", "/c"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST: %d", rec.Code)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("%d origin requests, want the 2 before going offline", hits.Load())
+	}
+}
+
+func TestOfflineModeIsToggledAtRuntime(t *testing.T) {
+	_, hits := newTestProxy(t, offlineOrigin)
+	defer func(status int) { offlineStatus = status }(offlineStatus)
+	offlineStatus = http.StatusServiceUnavailable
+	defer offlineMode.Store(false)
+
+	if rec := adminRequest(t, handleOffline, "PUT", "/_admin/offline"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"offline":true`) {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest("GET", "/b"); rec.Code != http.StatusServiceUnavailable || hits.Load() != 0 {
+		t.Fatalf("offline miss: %d after %d origin requests", rec.Code, hits.Load())
+	}
+	if rec := adminRequest(t, handleOffline, "DELETE", "/_admin/offline"); rec.Code != http.StatusOK || offlineMode.Load() {
+		t.Fatalf("DELETE: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest("GET", "/b"); rec.Code != http.StatusOK || hits.Load() != 1 {
+		t.Fatalf("back online: %d after %d origin requests", rec.Code, hits.Load())
+	}
+	if rec := adminRequest(t, handleOffline, "POST", "/_admin/offline"); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST: %d", rec.Code)
+	}
+}
+
+func TestOfflineStatusIsChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--offline-status=1000"); !strings.Contains(out, "Error: --offline-status must be an HTTP status code") {
+		t.Fatal(out)
+	}
+}
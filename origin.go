@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// originProxy forwards every request that isn't answered from the cache.
+// main replaces it once the timeout and TLS flags are known
+var originProxy = newOriginProxy(newOriginTransport(0, nil))
+
+// newOriginTransport returns a transport that gives up on an origin that
+// hasn't started responding within timeout. the limit only covers the wait
+// for response headers so that large downloads can still stream for as long
+// as they need. tlsConfig is used for https origins, nil means the system
+// defaults. private addresses are never dialed, see guardedDial. every
+// origin gets a connection pool of its own, sized by --max-idle-conns-per-host
+// and --idle-conn-timeout
+func newOriginTransport(timeout time.Duration, tlsConfig *tls.Config) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: originKeepAlive}
+	if originKeepAlive <= 0 {
+		// net.Dialer takes a negative KeepAlive to mean none
+		dialer.KeepAlive = -1
+		transport.DisableKeepAlives = true
+	}
+	transport.DialContext = guardedDial(dialer)
+	transport.ResponseHeaderTimeout = timeout
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = originIdleConns
+	transport.IdleConnTimeout = originIdleTimeout
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &originTransports{template: transport, pools: map[string]*http.Transport{}}
+}
+
+// originTransports sends each request through the transport of its origin,
+// a clone of template made on first use, so that a busy origin can't take
+// the idle connections another one would reuse
+type originTransports struct {
+	template *http.Transport
+
+	mu    sync.Mutex
+	pools map[string]*http.Transport
+}
+
+func (t *originTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transportFor(req.URL.Scheme + "://" + req.URL.Host).RoundTrip(req)
+}
+
+// transportFor returns the transport of origin, creating it if needed
+func (t *originTransports) transportFor(origin string) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	transport, ok := t.pools[origin]
+	if !ok {
+		transport = t.template.Clone()
+		t.pools[origin] = transport
+	}
+	return transport
+}
+
+// CloseIdleConnections closes the idle connections of every origin
+func (t *originTransports) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, transport := range t.pools {
+		transport.CloseIdleConnections()
+	}
+}
+
+// newOriginProxy returns the reverse proxy that talks to the origins through
+// transport. what it does with a response depends on the proxyState attached
+// to the request. errors it can only log, such as a streamed body cut off
+// after the headers went out, end up in the structured log
+func newOriginProxy(transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director:       directToOrigin,
+		Transport:      offlineTransport{newRedirectTransport(failoverTransport{balanceTransport{retryTransport{instrumentedTransport{limitedTransport{transport}}}}})},
+		ModifyResponse: modifyOriginResponse,
+		ErrorHandler:   handleOriginError,
+		ErrorLog:       slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// instrumentedTransport records the latency and failures of origin requests
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !originHostAllowed(req.URL.Hostname()) {
+		return nil, fmt.Errorf("%w: %s", errOriginForbidden, req.URL.Hostname())
+	}
+	breaker := breakerFor(req.URL.Host)
+	if !breaker.Allow() {
+		return nil, errCircuitOpen
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start)
+	originDuration.Observe(elapsed.Seconds())
+	addOriginLatency(req.Context(), elapsed)
+	if err != nil {
+		originErrors.Inc()
+	}
+	// a client hanging up, or us refusing to connect or running out of
+	// slots, says nothing about the origin
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, errOriginForbidden) && !errors.Is(err, errOriginBusy) {
+		breaker.Record(err != nil || resp.StatusCode >= 500)
+	}
+	return resp, err
+}
+
+// proxyState travels with a request through originProxy. target is the
+// origin URL, client the request being answered and status the X-Cache
+// value for responses that aren't cached. when store is set the response
+// is cached under key and the outcome left in result, stale being an
+// entry to revalidate. err is set when the origin couldn't be reached
+type proxyState struct {
+	target *url.URL
+	client *http.Request
+	status string
+
+	store   bool
+	key     string
+	stale   *cache.Entry
+	started time.Time
+	result  *originResult
+	err     error
+}
+
+type proxyStateKey struct{}
+
+// withProxyState returns a copy of r carrying state for originProxy
+func withProxyState(ctx context.Context, r *http.Request, state *proxyState) *http.Request {
+	return r.WithContext(context.WithValue(ctx, proxyStateKey{}, state))
+}
+
+func proxyStateOf(r *http.Request) *proxyState {
+	state, _ := r.Context().Value(proxyStateKey{}).(*proxyState)
+	return state
+}
+
+// directToOrigin points the outgoing request at the origin and sets the
+// Host header it is sent with
+func directToOrigin(req *http.Request) {
+	state := proxyStateOf(req)
+	req.URL.Scheme = state.target.Scheme
+	req.URL.Host = state.target.Host
+	req.URL.Path = state.target.Path
+	req.URL.RawPath = state.target.RawPath
+	req.URL.RawQuery = state.target.RawQuery
+	req.URL.ForceQuery = state.target.ForceQuery
+	req.Host = outboundHost(state)
+	filterRequestHeader(req.Header)
+
+	// tell the origin about the client. X-Forwarded-For is appended to by
+	// the proxy itself once the Director returns
+	proto := "http"
+	if state.client.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", state.client.Host)
+	if !state.store {
+		return
+	}
+	for _, name := range conditionalHeaders {
+		req.Header.Del(name)
+	}
+	// the full body is stored, ranges are cut from it when served
+	req.Header.Del("Range")
+
+	// ask for codings we can decode, so the cached copy doesn't depend on
+	// what the client that happened to miss first accepts
+	req.Header.Set("Accept-Encoding", originAcceptEncoding)
+	if stale := state.stale; stale != nil {
+		if etag := stale.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := stale.Header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+}
+
+// outboundHost returns the Host header for a request to state.target as
+// chosen by --host-header: the origin's own host, the one the client asked
+// for, or a fixed name
+func outboundHost(state *proxyState) string {
+	switch hostHeader {
+	case "", "origin":
+		return state.target.Host
+	case "preserve":
+		return state.client.Host
+	default:
+		return hostHeader
+	}
+}
+
+// modifyOriginResponse caches the origin response when the request asked for
+// it and turns it into what the client gets to see
+func modifyOriginResponse(resp *http.Response) error {
+	state := proxyStateOf(resp.Request)
+	transformResponseHeader(resp.Header)
+	if !state.store {
+		resp.Header.Del(proxyCacheHeader)
+		gzipForClient(state.client, resp)
+		rewriteLocationHeader(state.client, resp.Header)
+		legacyCacheHeaders(state.client, resp.Header)
+		resp.Header.Set("X-Cache", state.status)
+		traceOf(state.client).setHeader(resp.Header)
+		return nil
+	}
+
+	res, err := cacheOriginResponse(state, resp)
+	if err != nil {
+		return err
+	}
+	state.result = res
+	if res.entry == nil {
+		resp.Header.Del(proxyCacheHeader)
+		decodeForClient(state.client, resp)
+		gzipForClient(state.client, resp)
+		rewriteLocationHeader(state.client, resp.Header)
+		legacyCacheHeaders(state.client, resp.Header)
+		resp.Header.Set("X-Cache", "MISS")
+		traceOf(state.client).add("not stored: body larger than --max-cacheable-bytes")
+		traceOf(state.client).setHeader(resp.Header)
+		return nil
+	}
+
+	header, body := entryRepresentation(state.client, state.key, res.entry, res.status)
+	header.Set("X-Cache", xCacheValue(state.client, state.key, res.entry, res.status))
+	traceOf(state.client).setHeader(header)
+	resp.StatusCode = res.entry.Status
+	if notModified(state.client, res.entry) {
+		header.Del("Content-Length")
+		resp.StatusCode = http.StatusNotModified
+		body = nil
+	}
+	resp.Header = header
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return nil
+}
+
+// notUpdatedBy304 are the stored headers a 304 leaves alone: the
+// hop-by-hop ones, which only concern the connection it came on, and
+// those describing the stored body, which the 304 has none of
+var notUpdatedBy304 = map[string]bool{
+	"Connection":         true,
+	"Keep-Alive":         true,
+	"Proxy-Connection":   true,
+	"Proxy-Authenticate": true,
+	"Te":                 true,
+	"Trailer":            true,
+	"Upgrade":            true,
+	"Transfer-Encoding":  true,
+	"Content-Length":     true,
+	"Content-Encoding":   true,
+}
+
+// updateStoredHeaders replaces the headers of a stored response by those
+// of the 304 that revalidated it (RFC 7234 4.3.4), except notUpdatedBy304
+// and any the 304 names in its Connection
+func updateStoredHeaders(stored, notModified http.Header) {
+	skip := map[string]bool{}
+	for _, value := range notModified.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			skip[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for name, values := range notModified {
+		if !notUpdatedBy304[name] && !skip[name] {
+			stored[name] = values
+		}
+	}
+}
+
+// cacheOriginResponse stores resp under state.key when the origin allows it.
+// when state.stale was revalidated a 304 answer refreshes and returns the
+// stale entry without downloading the body again. bodies larger than
+// maxCacheableBytes are not buffered, the result then has no entry and resp
+// is left to be streamed
+func cacheOriginResponse(state *proxyState, resp *http.Response) (*originResult, error) {
+	stale := state.stale
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		entry := &cache.Entry{
+			Status: stale.Status,
+			Header: stale.Header.Clone(),
+			Body:   stale.Body,
+		}
+		updateStoredHeaders(entry.Header, resp.Header)
+		entry.Encoding = stale.Encoding
+		if entry.Encoding != "" {
+			entry.Header.Del("Content-Encoding")
+		}
+		entry.FetchTime = time.Since(state.started)
+		res := storeResponse(resp.Request.Context(), state.client, state.key, entry)
+		res.status = "REVALIDATED"
+		return res, nil
+	}
+
+	noteRetryAfter(state.key, resp)
+
+	// a server error is not worth caching when a stale copy can be
+	// served instead
+	if resp.StatusCode >= 500 && usableOnError(stale) {
+		resp.Body.Close()
+		return staleOnError(state, fmt.Errorf("origin answered %d", resp.StatusCode)), nil
+	}
+
+	// an event stream never ends, reading it would hold back every event.
+	// the proxy flushes it to the client as each one arrives
+	if isEventStream(resp.Header) {
+		return &originResult{}, nil
+	}
+
+	// read response body, but never more than we are willing to cache
+	if resp.ContentLength > maxCacheableBytes {
+		return &originResult{}, nil
+	}
+	// a connection dropped mid-body leaves a truncated body that must
+	// neither be cached nor passed off as complete. nothing has been sent
+	// to the client yet, so it gets a 502 or the stale entry instead
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCacheableBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		slog.Warn("origin response truncated", "key", state.key, "bytes", len(body), "error", err)
+		return nil, fmt.Errorf("origin response truncated after %d bytes: %w", len(body), err)
+	}
+	if int64(len(body)) > maxCacheableBytes {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return &originResult{}, nil
+	}
+	resp.Body.Close()
+
+	entry := &cache.Entry{
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   body,
+	}
+	decodeEntry(entry)
+	// a chunked response comes without a Content-Length. the body was
+	// read to its last chunk, so hits can be sent with one. 1xx and 204
+	// responses never have one (RFC 7230 3.3.2)
+	if entry.Header.Get("Content-Length") == "" && entry.Status >= 200 && entry.Status != http.StatusNoContent {
+		entry.Header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	}
+	entry.FetchTime = time.Since(state.started)
+	return storeResponse(resp.Request.Context(), state.client, state.key, entry), nil
+}
+
+// isEventStream reports whether h describes a Server-Sent Events stream
+func isEventStream(h http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// handleOriginError answers a request whose origin fetch failed and
+// remembers the error for requests waiting on the same fetch. a stale entry
+// within its stale-if-error window is served instead, unless the client
+// itself is to blame
+func handleOriginError(w http.ResponseWriter, req *http.Request, err error) {
+	state := proxyStateOf(req)
+	var maxErr *http.MaxBytesError
+	if state.store && usableOnError(state.stale) && !errors.As(err, &maxErr) {
+		state.result = staleOnError(state, err)
+		serveEntry(w, state.client, state.key, state.result.entry, state.result.status)
+		return
+	}
+	state.err = err
+	traceOf(state.client).add("origin failed: %v", err)
+	traceOf(state.client).setHeader(w.Header())
+	originError(w, state.client, err)
+}
+
+// staleOnError returns the result serving state.stale in place of a failed
+// origin response
+func staleOnError(state *proxyState, err error) *originResult {
+	slog.Warn("origin failed, serving stale entry", "key", state.key, "error", err)
+	return &originResult{
+		entry:   state.stale,
+		variant: cache.VariantKey(state.key, state.stale.Vary, state.client.Header),
+		status:  "STALE-ERROR",
+	}
+}
+
+// originError answers a request whose origin fetch failed: 413 when the
+// client body went over --max-request-bytes, 503 while the origin's circuit
+// breaker is open or no origin slot came free, --offline-status in offline
+// mode, 403 for a host we may not contact, 504 when the origin was too slow
+// and 502 for anything else, such as a refused connection
+func originError(w http.ResponseWriter, r *http.Request, err error) {
+	countError(r)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, errCircuitOpen) || errors.Is(err, errOriginBusy) {
+		gatewayError(w, "Origin server unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errOffline) {
+		offlineError(w)
+		return
+	}
+	if errors.Is(err, errOriginForbidden) {
+		http.Error(w, "Origin host not allowed", http.StatusForbidden)
+		return
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		gatewayError(w, "Origin server timed out", http.StatusGatewayTimeout)
+		return
+	}
+	gatewayError(w, "Error contacting origin server", http.StatusBadGateway)
+}
+
+// originTLSConfig builds the TLS settings for https origins. caFile adds a
+// PEM bundle of extra trusted CAs, e.g. for internal backends with self-signed
+// certificates, and insecure turns certificate verification off entirely
+func originTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	if caFile == "" && !insecure {
+		return nil, nil
+	}
+	if caFile != "" && insecure {
+		return nil, errors.New("--origin-ca-file and --origin-insecure-skip-verify are mutually exclusive")
+	}
+	if insecure {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestClientHeadersReachOrigin(t *testing.T) {
+	var got http.Header
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte("x"))
+	})
+	doRequest("GET", "/api/me",
+		"Authorization", "Bearer token-1",
+		"Accept", "application/json",
+		"User-Agent", "client/1.0",
+		"Cookie", "session=abc",
+		"Connection", "X-Hop",
+		"X-Hop", "1",
+		"Keep-Alive", "timeout=5",
+		"Proxy-Authorization", "Basic cHJveHk6cHc=")
+	for name, want := range map[string]string{
+		"Authorization": "Bearer token-1",
+		"Accept":        "application/json",
+		"User-Agent":    "client/1.0",
+		"Cookie":        "session=abc",
+	} {
+		if got.Get(name) != want {
+			t.Errorf("%s: origin got %q, want %q", name, got.Get(name), want)
+		}
+	}
+	for _, name := range []string{"X-Hop", "Keep-Alive", "Proxy-Authorization"} {
+		if got.Get(name) != "" {
+			t.Errorf("hop-by-hop %s forwarded: %q", name, got.Get(name))
+		}
+	}
+}
+
+func TestAuthorizedResponsesAreNotShared(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/public" {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte(r.Header.Get("Authorization")))
+	})
+	doRequest("GET", "/me", "Authorization", "Bearer alice")
+	if rec := doRequest("GET", "/me"); rec.Body.String() == "Bearer alice" {
+		t.Fatal("an authorized response was served to an anonymous client")
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("%d origin requests", hits.Load())
+	}
+
+	doRequest("GET", "/public", "Authorization", "Bearer alice")
+	if !mr.Exists(keyFor("/public")) {
+		t.Fatal("a response marked public was not stored")
+	}
+}
+
+func TestSlowOriginTimesOut(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("late"))
+	})
+	defer func(p *httputil.ReverseProxy) { originProxy = p }(originProxy)
+	originProxy = newOriginProxy(newOriginTransport(50*time.Millisecond, nil))
+
+	start := time.Now()
+	if rec := doRequest("GET", "/slow"); rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d, want 504", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("gave up after %s", elapsed)
+	}
+	if len(mr.Keys()) != 0 {
+		t.Fatalf("timeout stored: %v", mr.Keys())
+	}
+}
+
+func TestRefusedOriginIsBadGateway(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	originServer = closed.URL
+
+	if rec := doRequest("GET", "/refused"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", rec.Code)
+	}
+}
+
+func TestRedisErrorsPassThrough(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("live"))
+	})
+	mr.SetError("ERR injected failure")
+	for i := 0; i < 2; i++ {
+		if rec := doRequest("GET", "/r"); rec.Code != http.StatusOK || rec.Body.String() != "live" {
+			t.Fatalf("request %d got %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("origin hit %d times, want every request passed through", hits.Load())
+	}
+	if cache.Available() {
+		t.Fatal("Redis still considered available")
+	}
+}
+
+func TestRedisDownPassesThrough(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("live")) })
+	mr.Close()
+	for i := 0; i < 2; i++ {
+		if rec := doRequest("GET", "/d"); rec.Code != http.StatusOK || rec.Body.String() != "live" {
+			t.Fatalf("request %d got %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("origin hit %d times", hits.Load())
+	}
+}
+
+func TestRedirectPassesThroughUntouched(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			w.Header().Set("X-Origin", "1")
+			http.Redirect(w, r, "/new?from=old", http.StatusFound)
+			return
+		}
+		w.Write([]byte("new"))
+	})
+	rec := doRequest("GET", "/old")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/new?from=old" || rec.Header().Get("X-Origin") != "1" {
+		t.Fatalf("got %d %v", rec.Code, rec.Header())
+	}
+	if rec.Body.String() == "new" || hits.Load() != 1 {
+		t.Fatalf("redirect was followed: %q, %d origin requests", rec.Body.String(), hits.Load())
+	}
+}
+
+func TestChunkedOriginBody(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range []string{"one ", "two ", "three"} {
+			w.Write([]byte(part))
+			w.(http.Flusher).Flush()
+		}
+	})
+	if rec := doRequest("GET", "/chunked"); rec.Body.String() != "one two three" {
+		t.Fatalf("got %q", rec.Body.String())
+	}
+}
+
+func TestHostHeaderModes(t *testing.T) {
+	defer func(mode string) { hostHeader = mode }(hostHeader)
+	for _, tc := range []struct{ mode, want string }{
+		{"origin", ""},
+		{"preserve", "client.example"},
+		{"backend.internal", "backend.internal"},
+	} {
+		var host string
+		newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			host = r.Host
+			w.Write([]byte("x"))
+		})
+		want := tc.want
+		if want == "" {
+			want = strings.TrimPrefix(originServer, "http://")
+		}
+		hostHeader = tc.mode
+		r := httptest.NewRequest("GET", "/host-"+tc.mode, nil)
+		r.Host = "client.example"
+		handleRequest(httptest.NewRecorder(), r)
+		if host != want {
+			t.Errorf("%s: origin saw Host %q, want %q", tc.mode, host, want)
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	var got http.Header
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte("x"))
+	})
+
+	direct := httptest.NewRequest("GET", "/fwd", nil)
+	direct.Host = "shop.example"
+	direct.RemoteAddr = "10.1.2.3:4444"
+	handleRequest(httptest.NewRecorder(), direct)
+	if got.Get("X-Forwarded-For") != "10.1.2.3" || got.Get("X-Forwarded-Proto") != "http" || got.Get("X-Forwarded-Host") != "shop.example" {
+		t.Fatalf("direct client: %v", got)
+	}
+
+	chained := httptest.NewRequest("GET", "https://shop.example/fwd-chained", nil)
+	chained.RemoteAddr = "10.1.2.3:4444"
+	chained.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.2")
+	handleRequest(httptest.NewRecorder(), chained)
+	if got.Get("X-Forwarded-For") != "203.0.113.7, 198.51.100.2, 10.1.2.3" {
+		t.Fatalf("chain %q", got.Get("X-Forwarded-For"))
+	}
+	if got.Get("X-Forwarded-Proto") != "https" || got.Get("X-Forwarded-Host") != "shop.example" {
+		t.Fatalf("TLS client: %v", got)
+	}
+}
+
+func TestTruncatedOriginBodyIsNotCached(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\nCache-Control: max-age=60\r\n\r\nonly ten b")
+		buf.Flush()
+		conn.Close()
+	})
+	logs := captureLog(t)
+	for i := 1; i <= 2; i++ {
+		if rec := doRequest("GET", "/cut"); rec.Code != http.StatusBadGateway {
+			t.Fatalf("request %d: status %d, want 502", i, rec.Code)
+		}
+		if hits.Load() != int64(i) || mr.Exists(keyFor("/cut")) {
+			t.Fatalf("truncated body was cached, %d origin requests", hits.Load())
+		}
+	}
+	if !strings.Contains(logs.String(), "origin response truncated") {
+		t.Fatalf("truncation not logged: %s", logs)
+	}
+}
+
+// chunkedBody is what chunkedOrigin sends, 1000 bytes at a time
+var chunkedBody = bytes.Repeat([]byte("chunk!"), 2000)
+
+// chunkedOrigin answers with chunkedBody chunked, without a Content-Length
+func chunkedOrigin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	for i := 0; i < len(chunkedBody); i += 1000 {
+		w.Write(chunkedBody[i : i+1000])
+		w.(http.Flusher).Flush()
+	}
+}
+
+func TestChunkedResponsesAreStoredWithTheirLength(t *testing.T) {
+	newTestProxy(t, chunkedOrigin)
+
+	rec := doRequest("GET", "/chunked")
+	if !bytes.Equal(rec.Body.Bytes(), chunkedBody) || rec.Header().Get("Content-Length") != "12000" {
+		t.Fatalf("miss: %d bytes with Content-Length %q", rec.Body.Len(), rec.Header().Get("Content-Length"))
+	}
+	e, ok := getEntry(t.Context(), keyFor("/chunked"))
+	if !ok || e.Header.Get("Content-Length") != "12000" || len(e.Body) != 12000 {
+		t.Fatalf("stored entry %+v", e)
+	}
+	rec = doRequest("GET", "/chunked")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Content-Length") != "12000" || !bytes.Equal(rec.Body.Bytes(), chunkedBody) {
+		t.Fatalf("hit: X-Cache %q, Content-Length %q", rec.Header().Get("X-Cache"), rec.Header().Get("Content-Length"))
+	}
+}
+
+func TestTruncatedChunkedResponseIsNotCached(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, _ := http.NewResponseController(w).Hijack()
+		buf.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nCache-Control: max-age=60\r\n\r\n5\r\nhello\r\n")
+		buf.Flush()
+		conn.Close()
+	})
+	if rec := doRequest("GET", "/truncated"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", rec.Code)
+	}
+	if mr.Exists(keyFor("/truncated")) {
+		t.Fatal("truncated chunked body was cached")
+	}
+}
+
+func TestLargeChunkedResponsesStreamThrough(t *testing.T) {
+	mr, _ := newTestProxy(t, chunkedOrigin)
+	defer func(n int64) { maxCacheableBytes = n }(maxCacheableBytes)
+	maxCacheableBytes = 5000
+
+	rec := doRequest("GET", "/large")
+	if !bytes.Equal(rec.Body.Bytes(), chunkedBody) || rec.Header().Get("Content-Length") != "" {
+		t.Fatalf("%d bytes with Content-Length %q, want all of it chunked", rec.Body.Len(), rec.Header().Get("Content-Length"))
+	}
+	if mr.Exists(keyFor("/large")) {
+		t.Fatal("body over --max-cacheable-bytes was cached")
+	}
+}
+
+// benchmarkOriginConns sends parallel requests through the origin
+// transport and reports how many connections the origin had to accept
+func benchmarkOriginConns(b *testing.B, idle int) {
+	var conns atomic.Int64
+	o := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		io.WriteString(w, "x")
+	}))
+	o.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	o.Start()
+	defer o.Close()
+	defer func(n int) { originIdleConns = n }(originIdleConns)
+	originIdleConns = idle
+	transport := newOriginTransport(0, nil)
+	client := &http.Client{Transport: transport}
+
+	// requests come in bursts, after each one the connections beyond the
+	// idle limit are closed and have to be dialed again for the next
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < 16; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := client.Get(o.URL)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}()
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+}
+
+func BenchmarkOriginConnsDefaultPool(b *testing.B) { benchmarkOriginConns(b, 2) }
+func BenchmarkOriginConnsTunedPool(b *testing.B)   { benchmarkOriginConns(b, 64) }
+
+func TestEveryOriginGetsAPoolOfItsOwn(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.RemoteAddr] = true
+		mu.Unlock()
+	})
+	a, b := httptest.NewServer(h), httptest.NewServer(h)
+	defer a.Close()
+	defer b.Close()
+	transport := newOriginTransport(0, nil).(*originTransports)
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		for _, u := range []string{a.URL, b.URL} {
+			resp, err := client.Get(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+	// three requests to each origin over one reused connection apiece
+	if len(transport.pools) != 2 || len(seen) != 2 {
+		t.Fatalf("%d pools, connections from %v", len(transport.pools), seen)
+	}
+}
+
+func TestNoKeepAliveDialsEveryRequest(t *testing.T) {
+	var conns atomic.Int64
+	o := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	o.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	o.Start()
+	defer o.Close()
+	defer func(d time.Duration) { originKeepAlive = d }(originKeepAlive)
+	originKeepAlive = 0
+
+	client := &http.Client{Transport: newOriginTransport(0, nil)}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(o.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if conns.Load() != 3 {
+		t.Fatalf("%d connections for 3 requests, want 3", conns.Load())
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pathPattern matches request paths. a pattern starting with / matches that
+// path prefix on segment boundaries, anything else is a regular expression
+type pathPattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func parsePathPattern(pattern string) (pathPattern, error) {
+	p := pathPattern{pattern: pattern}
+	if strings.HasPrefix(pattern, "/") {
+		return p, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return p, err
+	}
+	p.re = re
+	return p, nil
+}
+
+func (p pathPattern) match(path string) bool {
+	if p.re != nil {
+		return p.re.MatchString(path)
+	}
+	return matchPrefix(path, p.pattern)
+}
+
+// cutRule splits a pattern=value flag value at the last =, since regular
+// expressions may contain one themselves
+func cutRule(value, form string) (pathPattern, string, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return pathPattern{}, "", fmt.Errorf("%q must look like %s", value, form)
+	}
+	p, err := parsePathPattern(value[:i])
+	if err != nil {
+		return p, "", fmt.Errorf("invalid pattern in %q: %w", value, err)
+	}
+	return p, value[i+1:], nil
+}
+
+// TTLOverrides is an ordered list of rules giving paths their own TTL. the
+// first matching rule wins
+type TTLOverrides struct {
+	rules []ttlRule
+}
+
+type ttlRule struct {
+	pathPattern
+	ttl time.Duration
+}
+
+// TTL returns the override for path
+func (o *TTLOverrides) TTL(path string) (time.Duration, bool) {
+	for _, rule := range o.rules {
+		if rule.match(path) {
+			return rule.ttl, true
+		}
+	}
+	return 0, false
+}
+
+// String implements flag.Value
+func (o *TTLOverrides) String() string {
+	var parts []string
+	for _, rule := range o.rules {
+		parts = append(parts, rule.pattern+"="+rule.ttl.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value, parsing one pattern=duration rule such as
+// /static=24h or ^/quotes/[a-z]+$=10s
+func (o *TTLOverrides) Set(value string) error {
+	pattern, arg, err := cutRule(value, "/prefix=duration")
+	if err != nil {
+		return err
+	}
+	ttl, err := time.ParseDuration(arg)
+	if err != nil || ttl < 0 {
+		return fmt.Errorf("invalid TTL in %q", value)
+	}
+	o.rules = append(o.rules, ttlRule{pattern, ttl})
+	return nil
+}
+
+// RouteStatuses is an ordered list of rules replacing --cacheable-statuses
+// for matching paths. the first matching rule wins
+type RouteStatuses struct {
+	rules []statusRule
+}
+
+type statusRule struct {
+	pathPattern
+	list     string
+	statuses map[int]bool
+}
+
+// Statuses returns the cacheable statuses configured for path
+func (rs *RouteStatuses) Statuses(path string) (map[int]bool, bool) {
+	for _, rule := range rs.rules {
+		if rule.match(path) {
+			return rule.statuses, true
+		}
+	}
+	return nil, false
+}
+
+// String implements flag.Value
+func (rs *RouteStatuses) String() string {
+	var parts []string
+	for _, rule := range rs.rules {
+		parts = append(parts, rule.pattern+"="+rule.list)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Set implements flag.Value, parsing one pattern=statuses rule such as
+// /static=200,301
+func (rs *RouteStatuses) Set(value string) error {
+	pattern, arg, err := cutRule(value, "/prefix=200,301")
+	if err != nil {
+		return err
+	}
+	statuses, err := parseStatusList(arg)
+	if err != nil {
+		return fmt.Errorf("%q: %w", value, err)
+	}
+	rs.rules = append(rs.rules, statusRule{pattern, arg, statuses})
+	return nil
+}
+
+// StatusRewrites is an ordered list of rules changing the status cached
+// entries under a path are served with, the entry itself keeping the one
+// the origin sent. the first rule matching both path and status wins
+type StatusRewrites struct {
+	rules []rewriteRule
+}
+
+type rewriteRule struct {
+	pathPattern
+	from, to int
+}
+
+// Status returns the status an entry stored with status is served with
+// under path
+func (sr *StatusRewrites) Status(path string, status int) int {
+	for _, rule := range sr.rules {
+		if rule.from == status && rule.match(path) {
+			return rule.to
+		}
+	}
+	return status
+}
+
+// String implements flag.Value
+func (sr *StatusRewrites) String() string {
+	var parts []string
+	for _, rule := range sr.rules {
+		parts = append(parts, fmt.Sprintf("%s=%d:%d", rule.pattern, rule.from, rule.to))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value, parsing one pattern=from:to rule such as
+// /legacy=203:200
+func (sr *StatusRewrites) Set(value string) error {
+	pattern, arg, err := cutRule(value, "/prefix=203:200")
+	if err != nil {
+		return err
+	}
+	from, to, ok := strings.Cut(arg, ":")
+	rule := rewriteRule{pathPattern: pattern}
+	rule.from, err = strconv.Atoi(from)
+	if err == nil {
+		rule.to, err = strconv.Atoi(to)
+	}
+	if !ok || err != nil || rule.from < 100 || rule.from > 599 || rule.to < 100 || rule.to > 599 {
+		return fmt.Errorf("%q must look like /prefix=203:200", value)
+	}
+	sr.rules = append(sr.rules, rule)
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTTLOverridesFirstMatchWins(t *testing.T) {
+	var o TTLOverrides
+	for _, value := range []string{"/static/fonts=720h", "/static=24h", `^/quotes/\w+$=10s`, "/a=b=1m"} {
+		if err := o.Set(value); err != nil {
+			t.Fatalf("%s: %v", value, err)
+		}
+	}
+	for _, tc := range []struct {
+		path string
+		ttl  time.Duration
+		ok   bool
+	}{
+		{"/static/logo.png", 24 * time.Hour, true},
+		{"/static/fonts/a.woff", 720 * time.Hour, true},
+		{"/quotes/abc", 10 * time.Second, true},
+		{"/quotes/abc/history", 0, false},
+		{"/staticfiles", 0, false},
+		{"/other", 0, false},
+	} {
+		if ttl, ok := o.TTL(tc.path); ttl != tc.ttl || ok != tc.ok {
+			t.Errorf("%s: %v %v, want %v %v", tc.path, ttl, ok, tc.ttl, tc.ok)
+		}
+	}
+	for _, value := range []string{"/static", "=1h", "/static=soon", "/static=-1h", "(unclosed=1h"} {
+		if err := (&TTLOverrides{}).Set(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+func TestTTLOverrides(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/static/hdr.css" {
+			w.Header().Set("Cache-Control", "max-age=5")
+		}
+		w.Write([]byte("x"))
+	})
+	ttlOverrides = TTLOverrides{}
+	ttlOverrides.Set("/static=24h")
+	ttlOverrides.Set(`^/quotes/\w+$=10s`)
+	defer func() { ttlOverrides, ttlOverrideWins = TTLOverrides{}, false }()
+
+	// without --ttl-override-wins the overrides only fill in for missing
+	// caching headers
+	for path, want := range map[string]time.Duration{
+		"/static/logo.png": 24 * time.Hour,
+		"/quotes/abc":      10 * time.Second,
+		"/other":           defaultTTL,
+		"/static/hdr.css":  5 * time.Second,
+	} {
+		doRequest("GET", path)
+		if got := mr.TTL(keyFor(path)); got != want {
+			t.Errorf("%s: TTL %v, want %v", path, got, want)
+		}
+	}
+
+	ttlOverrideWins = true
+	doRequest("GET", "/static/hdr.css?v=2")
+	if got := mr.TTL(keyFor("/static/hdr.css?v=2")); got != 24*time.Hour {
+		t.Errorf("with --ttl-override-wins: TTL %v, want 24h", got)
+	}
+}
+
+func TestRouteStatuses(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere", http.StatusMovedPermanently)
+	})
+	routeStatuses = RouteStatuses{}
+	if err := routeStatuses.Set("/api=200"); err != nil {
+		t.Fatal(err)
+	}
+	if err := routeStatuses.Set("/static=200,301"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { routeStatuses = RouteStatuses{} }()
+
+	for path, want := range map[string]string{"/static/a": "HIT", "/api/a": "MISS", "/other": "HIT"} {
+		doRequest("GET", path)
+		if got := doRequest("GET", path).Header().Get("X-Cache"); got != want {
+			t.Errorf("301 for %s: X-Cache %q, want %q", path, got, want)
+		}
+	}
+	for _, bad := range []string{"/x=abc", "/x", "/x=99"} {
+		if err := routeStatuses.Set(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestParseStatusRewrites(t *testing.T) {
+	var sr StatusRewrites
+	for _, rule := range []string{"/legacy=404:200", "^/leg=203:200"} {
+		if err := sr.Set(rule); err != nil {
+			t.Fatalf("%s: %v", rule, err)
+		}
+	}
+	// the first rule matching both path and status wins
+	if got := sr.Status("/legacy/a", 203); got != 200 {
+		t.Fatalf("/legacy/a 203 served as %d, want 200", got)
+	}
+	if got := sr.Status("/other", 203); got != 203 {
+		t.Fatalf("/other 203 served as %d, want it unchanged", got)
+	}
+	for _, bad := range []string{"/a=203", "/a=203:x", "/a=99:200", "/a=200:600"} {
+		if err := new(StatusRewrites).Set(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestServeStatusLeavesTheStoredEntry(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusNonAuthoritativeInfo)
+		w.Write([]byte("body"))
+	})
+	defer func(sr StatusRewrites) { statusRewrites = sr }(statusRewrites)
+	statusRewrites = StatusRewrites{}
+	if err := statusRewrites.Set("/legacy=203:200"); err != nil {
+		t.Fatal(err)
+	}
+
+	// what the origin sent is passed on as is, only hits are rewritten
+	if rec := doRequest("GET", "/legacy/a"); rec.Code != http.StatusNonAuthoritativeInfo {
+		t.Fatalf("miss answered %d, want 203", rec.Code)
+	}
+	rec := doRequest("GET", "/legacy/a")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "body" {
+		t.Fatalf("hit answered %d %q, X-Cache %q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if e, ok := getEntry(t.Context(), keyFor("/legacy/a")); !ok || e.Status != http.StatusNonAuthoritativeInfo {
+		t.Fatalf("stored entry %+v, want its 203 kept", e)
+	}
+	if rec := doRequest("HEAD", "/legacy/a"); rec.Code != http.StatusOK {
+		t.Fatalf("HEAD hit answered %d, want 200", rec.Code)
+	}
+
+	doRequest("GET", "/other")
+	if rec := doRequest("GET", "/other"); rec.Code != http.StatusNonAuthoritativeInfo {
+		t.Fatalf("unmatched path answered %d, want 203", rec.Code)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// poolMember is one of the --origin-pool origins sharing the load of
+// --origin. downUntil, in Unix nanoseconds, keeps it out of the rotation
+// for --origin-pool-cooldown after it failed
+type poolMember struct {
+	origin    string
+	host      string
+	weight    int
+	downUntil atomic.Int64
+}
+
+// poolTurn counts the picks of --origin-balance round-robin
+var poolTurn atomic.Uint64
+
+// parseOriginPool parses a comma-separated list of origin URLs, each
+// optionally followed by =weight, 1 when left out
+func parseOriginPool(value string) ([]*poolMember, error) {
+	var members []*poolMember
+	for _, item := range splitList(value) {
+		weight := 1
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid weight in %q", item)
+			}
+			item, weight = item[:i], n
+		}
+		origins, err := parseOrigins(item)
+		if err != nil {
+			return nil, err
+		}
+		u, _ := url.Parse(origins[0])
+		members = append(members, &poolMember{origin: origins[0], host: u.Host, weight: weight})
+	}
+	return members, nil
+}
+
+// healthy reports whether m may be picked: neither cooling down after a
+// failure nor behind an open circuit breaker
+func (m *poolMember) healthy(now time.Time) bool {
+	return now.UnixNano() >= m.downUntil.Load() && !breakerFor(m.host).Open()
+}
+
+// pickMember chooses the origin for the next request among the members not
+// in tried, by weight, at random or in turns as --origin-balance says.
+// healthy members go first, when there are none the others still get a
+// chance rather than failing the request outright. nil means every member
+// was tried
+func pickMember(tried map[*poolMember]bool) *poolMember {
+	now := time.Now()
+	var candidates []*poolMember
+	for _, m := range originPool {
+		if !tried[m] && m.healthy(now) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, m := range originPool {
+			if !tried[m] {
+				candidates = append(candidates, m)
+			}
+		}
+	}
+	total := 0
+	for _, m := range candidates {
+		total += m.weight
+	}
+	if total == 0 {
+		return nil
+	}
+	var n int
+	if originBalance == "round-robin" {
+		n = int(poolTurn.Add(1) % uint64(total))
+	} else {
+		n = rand.N(total)
+	}
+	for _, m := range candidates {
+		if n -= m.weight; n < 0 {
+			return m
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// balanceTransport sends requests for --origin to a member of
+// --origin-pool instead. the request URL, and with it the cache key, still
+// names --origin, so whichever member answers every proxy shares the
+// entry. a member answering with a connection error or a 5xx is left out
+// for --origin-pool-cooldown and the request, when it can be replayed,
+// goes to another one. like with --origin-fallbacks, one that isn't
+// idempotent only does when it never reached the first member
+type balanceTransport struct {
+	base http.RoundTripper
+}
+
+func (t balanceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rest, ok := originRest(req)
+	if !ok || len(originPool) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	tried := map[*poolMember]bool{}
+	for {
+		m := pickMember(tried)
+		tried[m] = true
+		target, err := url.Parse(m.origin + rest)
+		if err != nil {
+			return nil, err
+		}
+		out := req.Clone(req.Context())
+		if req.GetBody != nil && len(tried) > 1 {
+			if out.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		// the Host follows the origin unless --host-header pinned it
+		if out.Host == req.URL.Host {
+			out.Host = target.Host
+		}
+		out.URL = target
+
+		resp, err := t.base.RoundTrip(out)
+		if !needsFailover(resp, err) {
+			return resp, err
+		}
+		m.downUntil.Store(time.Now().Add(originPoolCooldown).UnixNano())
+		if !replayable(req) || !mayFailOver(req, resp, err) || len(tried) == len(originPool) {
+			return resp, err
+		}
+		if err != nil {
+			slog.Warn("pool origin failed, trying another", "origin", m.host, "error", err)
+		} else {
+			slog.Warn("pool origin failed, trying another", "origin", m.host, "status", resp.StatusCode)
+			resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// poolCounts counts the requests each pool member answered
+type poolCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *poolCounts) get(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[name]
+}
+
+// member starts a pool member answering with status and its name. /same
+// may be cached, nothing else
+func (c *poolCounts) member(t *testing.T, name string, status int) string {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		c.counts[name]++
+		c.mu.Unlock()
+		if r.URL.Path == "/same" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(s.Close)
+	return s.URL
+}
+
+// usePool starts a proxy whose --origin is never reached, its requests
+// going to the pool members instead
+func usePool(t *testing.T) *poolCounts {
+	t.Helper()
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { t.Error("--origin itself was reached") })
+	pool, balance, cooldown := originPool, originBalance, originPoolCooldown
+	t.Cleanup(func() { originPool, originBalance, originPoolCooldown = pool, balance, cooldown })
+	originBalance = "random"
+	return &poolCounts{counts: map[string]int{}}
+}
+
+func TestPoolSpreadsRequestsByWeight(t *testing.T) {
+	c := usePool(t)
+	a, b, d := c.member(t, "a", http.StatusOK), c.member(t, "b", http.StatusOK), c.member(t, "c", http.StatusOK)
+	var err error
+	if originPool, err = parseOriginPool(fmt.Sprintf("%s=3,%s,%s=6", a, b, d)); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"random", "round-robin"} {
+		originBalance = mode
+		c.counts = map[string]int{}
+		for i := 0; i < 1000; i++ {
+			if rec := doRequest("GET", fmt.Sprintf("/x%d", i)); rec.Code != http.StatusOK {
+				t.Fatalf("%s: status %d", mode, rec.Code)
+			}
+		}
+		// weights 3, 1 and 6 of 10
+		if n := c.get("a"); n < 220 || n > 380 {
+			t.Errorf("%s: a answered %d of 1000, want about 300", mode, n)
+		}
+		if n := c.get("b"); n < 50 || n > 170 {
+			t.Errorf("%s: b answered %d of 1000, want about 100", mode, n)
+		}
+		if n := c.get("c"); n < 520 || n > 680 {
+			t.Errorf("%s: c answered %d of 1000, want about 600", mode, n)
+		}
+	}
+}
+
+func TestPoolMembersShareTheCache(t *testing.T) {
+	c := usePool(t)
+	originPool, _ = parseOriginPool(c.member(t, "a", http.StatusOK) + "," + c.member(t, "b", http.StatusOK))
+	originBalance = "round-robin"
+
+	first := doRequest("GET", "/same")
+	if rec := doRequest("GET", "/same"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != first.Body.String() {
+		t.Fatalf("X-Cache %q, %q after %q", rec.Header().Get("X-Cache"), rec.Body.String(), first.Body.String())
+	}
+	if c.get("a")+c.get("b") != 1 {
+		t.Fatalf("members answered a %d, b %d", c.get("a"), c.get("b"))
+	}
+}
+
+func TestPoolLeavesOutAFailingMember(t *testing.T) {
+	c := usePool(t)
+	originPool, _ = parseOriginPool(c.member(t, "bad", http.StatusServiceUnavailable) + "," + c.member(t, "a", http.StatusOK))
+	originPoolCooldown = time.Hour
+
+	// after its first failure, that request going to another member
+	for i := 0; i < 50; i++ {
+		if rec := doRequest("GET", fmt.Sprintf("/y%d", i)); rec.Code != http.StatusOK || rec.Body.String() != "a" {
+			t.Fatalf("%d %q", rec.Code, rec.Body.String())
+		}
+	}
+	if c.get("bad") != 1 || c.get("a") != 50 {
+		t.Fatalf("members answered bad %d, a %d", c.get("bad"), c.get("a"))
+	}
+}
+
+func TestPoolDoesNotResendAPostThatReachedAMember(t *testing.T) {
+	c := usePool(t)
+	originPool, _ = parseOriginPool(c.member(t, "bad", http.StatusInternalServerError) + "," + c.member(t, "a", http.StatusOK))
+	originBalance = "round-robin"
+	originPoolCooldown = time.Hour
+
+	// round-robin gets to the failing member within two requests
+	for i := 0; i < 2 && c.get("bad") == 0; i++ {
+		before := c.get("a")
+		rec := doRequest("POST", "/orders")
+		if c.get("bad") == 1 && (rec.Code != http.StatusInternalServerError || c.get("a") != before) {
+			t.Fatalf("POST answered %d %q, a got %d after %d", rec.Code, rec.Body.String(), c.get("a"), before)
+		}
+	}
+	if c.get("bad") != 1 {
+		t.Fatalf("the failing member got %d requests", c.get("bad"))
+	}
+}
+
+func TestPoolSendsAPostOnWhenAMemberCantBeReached(t *testing.T) {
+	c := usePool(t)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	originPool, _ = parseOriginPool(closed.URL + "," + c.member(t, "a", http.StatusOK))
+	originBalance = "round-robin"
+
+	for i := 0; i < 4; i++ {
+		if rec := doRequest("POST", "/orders"); rec.Code != http.StatusOK || rec.Body.String() != "a" {
+			t.Fatalf("POST %d answered %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestParseOriginPool(t *testing.T) {
+	for _, v := range []string{"http://x=0", "http://x=a", "ftp://x"} {
+		if _, err := parseOriginPool(v); err == nil {
+			t.Errorf("%s accepted", v)
+		}
+	}
+	if out := startupError(t, "--origin=http://origin.test", "--origin-balance=least-conn"); !strings.Contains(out, "Error: --origin-balance must be random or round-robin") {
+		t.Fatal(out)
+	}
+}
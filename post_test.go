@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// doBody sends a request with body through the proxy
+func doBody(method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handleRequest(w, r)
+	return w
+}
+
+func TestPostsAreCachedByBody(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Method + ":" + string(b)))
+	})
+	cachePostPaths = []*regexp.Regexp{regexp.MustCompile("^/graphql$")}
+	defer func() { cachePostPaths = nil }()
+
+	q := `{"query":"{ a }"}`
+	if rec := doBody("POST", "/graphql", q); rec.Body.String() != "POST:"+q || rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first POST: %q, X-Cache %q", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if rec := doBody("POST", "/graphql", q); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "POST:"+q || hits.Load() != 1 {
+		t.Fatalf("same body: %q, X-Cache %q, %d origin requests", rec.Body.String(), rec.Header().Get("X-Cache"), hits.Load())
+	}
+	if rec := doBody("POST", "/graphql", `{"query":"{ b }"}`); rec.Header().Get("X-Cache") != "MISS" || hits.Load() != 2 {
+		t.Fatalf("different body: X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	// the GET of the same URL is an entry of its own
+	if rec := doRequest("GET", "/graphql"); rec.Body.String() != "GET:" {
+		t.Fatalf("GET answered with %q", rec.Body.String())
+	}
+	// POSTs to other paths are never cached
+	doBody("POST", "/other", q)
+	if rec := doBody("POST", "/other", q); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("POST to another path: X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestPurgesRemoveCachedPosts(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	cachePostPaths = []*regexp.Regexp{regexp.MustCompile("^/graphql")}
+	defer func() { cachePostPaths = nil }()
+	q := `{"query":"{ a }"}`
+	remaining := func() int {
+		n := 0
+		for _, key := range mr.Keys() {
+			if strings.Contains(key, "POST ") {
+				n++
+			}
+		}
+		return n
+	}
+
+	doBody("POST", "/graphql", q)
+	if n, err := purgeURL(t.Context(), &url.URL{Path: "/graphql"}); err != nil || n != 1 || remaining() != 0 {
+		t.Fatalf("url purge deleted %d, left %d: %v", n, remaining(), err)
+	}
+
+	doBody("POST", "/graphql", q)
+	rec := adminRequest(t, handlePurgeMethod, "PURGE", "/graphql")
+	if n := deletedCount(t, rec); n != 1 || remaining() != 0 {
+		t.Fatalf("PURGE deleted %d, left %d", n, remaining())
+	}
+
+	doBody("POST", "/graphql/v1", q)
+	doBody("POST", "/graphql/v2", q)
+	rec = adminRequest(t, handlePurge, "DELETE", "/_admin/cache?prefix=/graphql/")
+	if n := deletedCount(t, rec); n != 2 || remaining() != 0 {
+		t.Fatalf("prefix purge deleted %d, left %d", n, remaining())
+	}
+}
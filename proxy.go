@@ -0,0 +1,995 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// handleRequest will forward the incoming req to the origin server and return the response
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PURGE" {
+		handlePurgeMethod(w, r)
+		return
+	}
+	r = withCacheTrace(r)
+	trace := traceOf(r)
+	// with --rate-limit-exempt-hits only requests needing the origin count
+	// against the client's rate limit, see passThrough and below
+	if !rateLimitExemptHits && !allowClient(w, r) {
+		return
+	}
+
+	// refuse oversized uploads up front, and cut off bodies that turn out
+	// larger than announced while they are forwarded
+	if maxRequestBytes > 0 {
+		if r.ContentLength > maxRequestBytes {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+	}
+	if bufferRequestBodies {
+		cleanup, err := spoolBody(r)
+		defer cleanup()
+		if err != nil {
+			originError(w, r, err)
+			return
+		}
+	}
+
+	// the path is checked before the target URL and key are built from it,
+	// so no dot segment, encoded or not, leads the origin somewhere else
+	u, err := checkPath(r.URL)
+	if err != nil {
+		trace.add("rejected path %q", r.URL.EscapedPath())
+		http.Error(w, "Bad request path", http.StatusBadRequest)
+		return
+	}
+
+	// from here on the rewritten path is the one routed, cached and
+	// forwarded
+	r.URL = rewriteURL(u)
+	bypass := takeBypass(r)
+
+	origin, ok := resolveOrigin(r.URL.Path)
+	if !ok {
+		http.Error(w, "No origin configured for this path", http.StatusBadGateway)
+		return
+	}
+
+	// construct the target URL, keeping the query string so that
+	// /search?q=a and /search?q=b are forwarded and cached separately. the
+	// origin is part of the URL and therefore of the cache key, so routed
+	// backends never collide
+	targetURL := joinOrigin(origin, requestTarget(r))
+
+	// a WebSocket is a connection of its own, nothing about it is cached
+	if isWebSocket(r) {
+		trace.add("websocket upgrade")
+		tunnelWebSocket(w, r, targetURL)
+		return
+	}
+
+	// with --no-cache the proxy only forwards, Redis is never touched
+	if cachingDisabled {
+		trace.add("caching disabled by --no-cache")
+		passThrough(w, r, targetURL, "DISABLED")
+		return
+	}
+
+	// only the --cacheable-methods are served from or stored in the cache,
+	// everything else goes straight to the origin. POSTs to --cache-post-paths are
+	// queries that are cached by their body
+	cachePost := r.Method == http.MethodPost && matchAny(cachePostPaths, r.URL.Path)
+	if !isCacheableMethod(r.Method) && !cachePost {
+		trace.add("method %s not cacheable", r.Method)
+		passThrough(w, r, targetURL, "MISS")
+		return
+	}
+
+	// paths matching --no-cache-paths are never read from or written to
+	// the cache
+	if matchAny(noCachePaths, r.URL.Path) {
+		trace.add("path matches --no-cache-paths")
+		passThrough(w, r, targetURL, "BYPASS")
+		return
+	}
+	// with --bypass-refresh off a bypass is a plain pass-through, else
+	// the cache is skipped for the lookup only and the fresh response
+	// stored as usual, see below
+	if bypass && !bypassRefresh {
+		trace.add("bypass requested")
+		passThrough(w, r, targetURL, "BYPASS")
+		return
+	}
+	// a POST to --cache-post-paths is keyed by its body too
+	var body []byte
+	if cachePost {
+		buffered, ok, err := bufferBody(r)
+		if err != nil {
+			originError(w, r, err)
+			return
+		}
+		if !ok {
+			trace.add("POST body too large to key")
+			passThrough(w, r, targetURL, "MISS")
+			return
+		}
+		body = buffered
+	}
+	if authenticated(r) {
+		trace.add("authenticated request")
+	}
+	key := requestKey(r, origin, body)
+	slog.Debug("cache key", "request_id", r.Header.Get(requestIDHeader), "path", r.URL.Path, "key", key)
+	cache.CountRequest(r.Context(), key)
+	trace.add("method %s cacheable", r.Method)
+	trace.add("key %s", key)
+	// the key reveals how entries are organized, so it is only shown on
+	// request
+	if exposeCacheKey {
+		w.Header().Set("X-Cache-Key", key)
+	}
+
+	// a client sending Cache-Control: no-cache wants a fresh copy, so never
+	// answer it from the cache without asking the origin. neither when the
+	// cached copy is older than its max-age or too close to expiring for
+	// its min-fresh
+	reqCC := requestCacheControl(r.Header)
+
+	// try to get cached response. an entry that is stale, or that the
+	// origin marked no-cache, is kept around to be revalidated. an entry in
+	// a coding we couldn't decode is only usable by clients accepting it
+	entry, found := lookupEntry(r.Context(), key, r.Header)
+	if found && !cache.AcceptsEncoding(r.Header, entry.Header.Get("Content-Encoding")) {
+		trace.add("cached coding %s not accepted", entry.Header.Get("Content-Encoding"))
+		found = false
+	}
+	switch {
+	case !found:
+		trace.add("lookup miss")
+	case entry.Fresh():
+		trace.add("lookup fresh, age %ds", int(entry.Age().Seconds()))
+	default:
+		trace.add("lookup stale, expired %ds ago", int(time.Since(entry.Expires).Seconds()))
+	}
+	revalidate := reqCC.has("no-cache")
+	if revalidate {
+		trace.add("request no-cache")
+	} else if found && tooOldForClient(reqCC, entry) {
+		trace.add("cached copy too old for the request's max-age or min-fresh")
+		revalidate = true
+	}
+	if offlineMode.Load() {
+		serveOffline(w, r, key, entry, found)
+		return
+	}
+	if bypass && found {
+		trace.add("bypass requested, cached copy ignored")
+		entry, found = nil, false
+	}
+	if found && entry.Fresh() && !entry.NoCache && !revalidate {
+		countHit(r)
+		serveEntry(w, r, key, entry, "HIT")
+		recordHit(r, targetURL, key, entry)
+		countUse(r.Context(), key, entry)
+		if r.Method == http.MethodGet && refreshEarly(entry) {
+			revalidateInBackground(r, targetURL, key, entry)
+		}
+		return
+	}
+	// a client sending max-stale takes an expired copy that recent, which
+	// a GET refreshes in the background for those that don't
+	if found && !entry.NoCache && !revalidate && withinMaxStale(reqCC, entry) {
+		trace.add("stale copy within the request's max-stale")
+		countHit(r)
+		serveEntry(w, r, key, entry, "STALE")
+		if r.Method == http.MethodGet {
+			revalidateInBackground(r, targetURL, key, entry)
+		}
+		return
+	}
+	// an entry only the in-memory tier still has, within --mem-cache-grace,
+	// is served stale rather than waiting for the origin, and refreshed in
+	// the background
+	if found && entry.Graced() && !entry.NoCache && !revalidate && mayServeStale(entry) {
+		trace.add("evicted from the cache, served from memory within --mem-cache-grace")
+		countHit(r)
+		serveEntry(w, r, key, entry, "STALE")
+		revalidateInBackground(r, targetURL, key, entry)
+		return
+	}
+	// a HEAD never fills the cache. without a fresh GET it waits for a GET
+	// already being fetched, and when there is none either the origin gets
+	// asked the real HEAD
+	if r.Method == http.MethodHead {
+		countMiss(r)
+		if res, ok := joinFetch(r.Context(), key); ok && res.entry != nil && !res.private &&
+			cache.VariantKey(key, res.entry.Vary, r.Header) == res.variant {
+			trace.add("HEAD shared the GET fetch of another request")
+			serveEntry(w, r, key, res.entry, res.status)
+			return
+		}
+		trace.add("HEAD without a fresh GET, forwarded")
+		passThrough(w, r, targetURL, "MISS")
+		return
+	}
+	// within the origin's stale-while-revalidate window the stale copy is
+	// served right away while one background fetch refreshes it
+	if found && !entry.NoCache && !revalidate && withinStaleWhileRevalidate(entry) {
+		countHit(r)
+		serveEntry(w, r, key, entry, "STALE")
+		revalidateInBackground(r, targetURL, key, entry)
+		return
+	}
+	// a range the cache can't answer is forwarded as is, the partial
+	// response isn't stored unless --cache-ranges stores it by itself
+	if isRangeRequest(r) && cacheRanges {
+		serveRangeCached(w, r, targetURL, key)
+		return
+	}
+	if isRangeRequest(r) {
+		trace.add("range not in the cache, forwarded")
+		countMiss(r)
+		passThrough(w, r, targetURL, "MISS")
+		return
+	}
+	if rateLimitExemptHits && !allowClient(w, r) {
+		return
+	}
+	// while the origin's breaker is open it isn't asked at all, and any copy
+	// we still have beats an error. with fallbacks those are asked instead
+	if originBreaker(origin).Open() && !hasFallbacks(origin) {
+		trace.add("origin circuit breaker open")
+		if found && mayServeStale(entry) {
+			countHit(r)
+			serveEntry(w, r, key, entry, "STALE")
+			return
+		}
+		countMiss(r)
+		originError(w, r, errCircuitOpen)
+		return
+	}
+	// the same goes for a key whose origin answered 503 with a Retry-After
+	// that hasn't passed yet
+	if wait, ok := retryWait(key); ok {
+		trace.add("origin asked to retry after %ds", int(wait.Seconds())+1)
+		if found && mayServeStale(entry) {
+			countHit(r)
+			serveEntry(w, r, key, entry, "STALE")
+			return
+		}
+		countMiss(r)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		gatewayError(w, "Origin server unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// with --cache-after a URL is only stored once it has been asked for
+	// often enough, until then it is forwarded like an uncacheable request
+	if !found && cacheAfter > 1 && !popular(r.Context(), key) {
+		trace.add("requested fewer than --cache-after times, forwarded")
+		countMiss(r)
+		passThrough(w, r, targetURL, "MISS")
+		return
+	}
+	// a stale entry is revalidated when it has validators, and served
+	// instead of an error when the origin fails
+	var stale *cache.Entry
+	if found {
+		stale = entry
+	}
+	countMiss(r)
+
+	// only one request per key goes to the origin, the rest wait for it.
+	// fn runs on the calling goroutine, so leader tells us whether this
+	// request is the one that did the fetch
+	leader := false
+	result, err, _ := coalesce(r.Context(), key, func(ctx context.Context) (interface{}, error) {
+		leader = true
+		trace.add("fetching from origin")
+		return fetchLocked(ctx, w, r, targetURL, key, stale)
+	})
+	// the proxy has already answered the request that did the fetch
+	if leader {
+		return
+	}
+	trace.add("shared the origin fetch of another request")
+	if err != nil {
+		trace.setHeader(w.Header())
+		originError(w, r, err)
+		return
+	}
+	res := result.(*originResult)
+
+	// a body too large to cache can only be streamed to the request that
+	// fetched it, a private one is that request's client's alone, and a
+	// shared response is only usable if it is the representation this
+	// request would have selected. otherwise the other waiters fetch their
+	// own copy
+	if res.entry == nil || res.private || cache.VariantKey(key, res.entry.Vary, r.Header) != res.variant {
+		trace.add("shared response not usable, fetching from origin")
+		fetchAndStore(r.Context(), w, r, targetURL, key, stale)
+		return
+	}
+	serveEntry(w, r, key, res.entry, res.status)
+}
+
+// popular counts a request for key and reports whether it was the
+// cacheAfter-th within cacheAfterWindow or later. the count lives next to
+// the entry's key, so purging the URL resets it. when the cache can't count
+// the request is cached as usual
+func popular(ctx context.Context, key string) bool {
+	if !cache.Available() {
+		return true
+	}
+	n, err := cache.Backend().Incr(ctx, key+"|seen", cacheAfterWindow)
+	if err != nil {
+		cache.ReportError(ctx, err)
+		return true
+	}
+	return n >= int64(cacheAfter)
+}
+
+// withinStaleWhileRevalidate reports whether a stale entry is still inside
+// the stale-while-revalidate window the origin gave it
+func withinStaleWhileRevalidate(entry *cache.Entry) bool {
+	swr, ok := parseCacheControl(entry.Header).seconds("stale-while-revalidate")
+	return ok && !entry.Fresh() && !entry.MustRevalidate && time.Now().Before(entry.Expires.Add(swr))
+}
+
+// refreshEarly decides, the XFetch way, whether a fresh entry is refreshed
+// ahead of its expiry. the nearer the expiry and the longer the entry took
+// to fetch the likelier it gets, so the readers of a hot key don't all find
+// it expired at the same moment
+func refreshEarly(entry *cache.Entry) bool {
+	if earlyRefreshBeta <= 0 || entry.FetchTime <= 0 || entry.Expires.IsZero() {
+		return false
+	}
+	// 1-rand is never 0, whose log would be infinite
+	ahead := float64(entry.FetchTime) * earlyRefreshBeta * -math.Log(1-rand.Float64())
+	return ahead >= float64(time.Until(entry.Expires))
+}
+
+// staleIfErrorWindow returns how long past its expiry entry may still be
+// served when the origin fails: the origin's stale-if-error, else
+// --stale-if-error
+func staleIfErrorWindow(entry *cache.Entry) time.Duration {
+	if sie, ok := parseCacheControl(entry.Header).seconds("stale-if-error"); ok {
+		return sie
+	}
+	return staleIfError
+}
+
+// mayServeStale reports whether entry may be served without asking the
+// origin: it is fresh, or the origin didn't forbid serving it stale with
+// must-revalidate
+func mayServeStale(entry *cache.Entry) bool {
+	return entry.Fresh() || !entry.MustRevalidate
+}
+
+// usableOnError reports whether entry may stand in for a failed origin.
+// with --error-page-fallback any stale copy beats the error page, except
+// one the origin said must be revalidated
+func usableOnError(entry *cache.Entry) bool {
+	if entry != nil && !mayServeStale(entry) {
+		return false
+	}
+	if entry != nil && errorPageFallback {
+		return true
+	}
+	return entry != nil && time.Now().Before(entry.Expires.Add(staleIfErrorWindow(entry)))
+}
+
+// revalidateInBackground refreshes a stale entry without making the client
+// wait. the fetch is coalesced, so however many stale hits come
+// in at once only one refresh per key is running
+func revalidateInBackground(r *http.Request, targetURL, key string, stale *cache.Entry) {
+	// r is done with once the handler returns, so work on a copy
+	bgReq := r.Clone(context.WithoutCancel(r.Context()))
+	bgReq.Body = http.NoBody
+	if r.GetBody != nil {
+		bgReq.Body, _ = r.GetBody()
+	}
+	go func() {
+		_, err, _ := coalesce(bgReq.Context(), key, func(ctx context.Context) (interface{}, error) {
+			return fetchLocked(ctx, discardResponse{}, bgReq, targetURL, key, stale)
+		})
+		if err != nil {
+			slog.Warn("background revalidation failed", "key", key, "error", err)
+		}
+	}()
+}
+
+// originResult is the value shared by requests collapsed into one fetch.
+// variant records which representation the fetching request selected.
+// entry is nil when the body was too large to buffer and could only be
+// streamed to the fetching request. stored is set when the entry went into
+// the cache. status is the X-Cache value the entry is served with:
+// REVALIDATED when the origin answered 304 for a stale entry, STALE-ERROR
+// when the stale entry stood in for a failed origin, MISS otherwise.
+// private is set when the entry is for the fetching request's client
+// alone, see personalRefusal
+type originResult struct {
+	entry   *cache.Entry
+	variant string
+	stored  bool
+	status  string
+	private bool
+}
+
+// discardResponse is the ResponseWriter of fetches nobody is waiting for
+type discardResponse struct{}
+
+func (discardResponse) Header() http.Header         { return http.Header{} }
+func (discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (discardResponse) WriteHeader(int)             {}
+
+// resolveOrigin picks the origin for path, falling back to --origin when no
+// route matches
+func resolveOrigin(path string) (string, bool) {
+	if origin, ok := router.Origin(path); ok {
+		return origin, true
+	}
+	return originServer, originServer != ""
+}
+
+// lookupEntry returns the cached entry for key, fresh or not. when the
+// origin varied the response the entry under key is a marker and the
+// representation matching the request headers is looked up instead
+func lookupEntry(ctx context.Context, key string, reqHeader http.Header) (*cache.Entry, bool) {
+	entry, ok := getEntry(ctx, key)
+	if ok && entry.IsVaryMarker() {
+		entry, ok = getEntry(ctx, cache.VariantKey(key, entry.Vary, reqHeader))
+	}
+	if !ok || entry.IsVaryMarker() {
+		return nil, false
+	}
+	return entry, true
+}
+
+// getEntry reads and decodes the entry stored under key, trying the
+// in-memory tier before Redis and remembering Redis hits in memory
+func getEntry(ctx context.Context, key string) (*cache.Entry, bool) {
+	if entry, ok := memCache.Get(key); ok {
+		return entry, true
+	}
+
+	// with Redis down every lookup is a miss and the origin serves it
+	if !cache.Available() {
+		return nil, false
+	}
+	cachedResponse, err := cache.Backend().Get(ctx, key)
+	if err != nil {
+		cache.ReportError(ctx, err)
+		// an entry Redis evicted, or can't return, may still be in memory
+		// within --mem-cache-grace
+		return memCache.GetStale(key)
+	}
+	entry, err := cache.UnmarshalEntry(cachedResponse)
+	if err != nil {
+		// a damaged entry is a miss, the origin's answer replaces it
+		slog.Warn("unreadable cache entry", "key", key, "error", err)
+		return nil, false
+	}
+	// hits from the in-memory tier don't count as uses, that would cost the
+	// Redis round trip it exists to save
+	cache.Touch(ctx, key)
+	// only fresh entries are kept in memory, stale ones always go back to
+	// Redis and the origin
+	if !entry.Expires.IsZero() {
+		memCache.Add(key, entry, time.Until(entry.Expires))
+	}
+	return entry, true
+}
+
+// storeEntry writes entry to Redis and the in-memory tier under key. the
+// entry is fresh for ttl, and entries that can be revalidated (and vary
+// markers, which their variants depend on) are kept in Redis for another
+// staleRetention after that, or longer if they may be served stale while
+// revalidating or when the origin fails
+func storeEntry(ctx context.Context, key string, entry *cache.Entry, ttl time.Duration) {
+	entry.Stored = time.Now()
+	entry.Expires = entry.Stored.Add(ttl)
+	keyTTL := ttl
+	if entry.IsVaryMarker() || entry.CanRevalidate() {
+		keyTTL += staleRetention
+	}
+	if swr, ok := parseCacheControl(entry.Header).seconds("stale-while-revalidate"); ok && ttl+swr > keyTTL {
+		keyTTL = ttl + swr
+	}
+	if sie := staleIfErrorWindow(entry); ttl+sie > keyTTL {
+		keyTTL = ttl + sie
+	}
+	if keyTTL <= 0 {
+		return
+	}
+	entry = withoutStoredHeaders(entry)
+	memCache.Add(key, entry, ttl)
+	if !cache.Available() {
+		return
+	}
+	if data, err := entry.Marshal(); err == nil {
+		entryBytes.Observe(float64(len(data)))
+		cache.ReportError(ctx, cache.Backend().Set(ctx, key, data, keyTTL))
+		cache.Touch(ctx, key)
+		cache.Tag(ctx, key, strings.Fields(entry.Header.Get("Surrogate-Key")), keyTTL)
+	}
+}
+
+// serveEntry writes entry to the client. a HEAD gets the status and headers
+// only, with Content-Length still describing the body, a client that
+// already has the entry's ETag gets a 304 and a Range request the bytes it
+// asks for. a --serve-status rule for the path changes the status the
+// entry goes out with, never the entry
+func serveEntry(w http.ResponseWriter, r *http.Request, key string, entry *cache.Entry, status string) {
+	header, body := entryRepresentation(r, key, entry, status)
+	copyHeader(w.Header(), header)
+	served := statusRewrites.Status(r.URL.Path, entry.Status)
+	if served != entry.Status {
+		traceOf(r).add("stored %d served as %d", entry.Status, served)
+	}
+	notMod := notModified(r, entry)
+	if notMod {
+		traceOf(r).add("client copy is current, 304 from the cache")
+	}
+	// X-Cache has to be set before WriteHeader or it is never sent
+	w.Header().Set("X-Cache", xCacheValue(r, key, entry, status))
+	traceOf(r).setHeader(w.Header())
+	if exposeCacheKey {
+		w.Header().Set("X-Cache-Key", cache.VariantKey(key, entry.Vary, r.Header))
+	}
+	if status == "HIT" {
+		if ttl, ok := storedTTL(r.Context(), cache.VariantKey(key, entry.Vary, r.Header)); ok {
+			w.Header().Set("X-Cache-TTL", strconv.Itoa(int(ttl.Seconds())))
+		}
+	}
+	if notMod {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if servesRange(r, entry) {
+		serveRange(w, r, body)
+		return
+	}
+	if r.Method == http.MethodHead {
+		if w.Header().Get("Content-Length") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.WriteHeader(served)
+		return
+	}
+	w.WriteHeader(served)
+	if err := writeBody(w, r, body); err != nil {
+		slog.Debug("client went away during a cached response", "key", key, "error", err)
+	}
+}
+
+// storedTTL returns how long key has left in the cache. ok is false when
+// the key has no expiry or the cache can't be asked
+func storedTTL(ctx context.Context, key string) (time.Duration, bool) {
+	if !cache.Available() {
+		return 0, false
+	}
+	ttl, err := cache.Backend().TTL(ctx, key)
+	if err != nil {
+		cache.ReportError(ctx, err)
+		return 0, false
+	}
+	return ttl, ttl > 0
+}
+
+// staleWarnings are the Warning headers (RFC 7234 5.5) that go with stale
+// content: 110 whenever it is served, and 111 too when that is because the
+// origin failed to revalidate it
+var staleWarnings = map[string][]string{
+	"STALE":       {`110 - "Response is Stale"`},
+	"STALE-ERROR": {`110 - "Response is Stale"`, `111 - "Revalidation Failed"`},
+}
+
+// entryRepresentation returns the headers and body r gets for entry. the
+// headers are copied so an entry shared between several requests is never
+// modified. a body the origin sent encoded is stored decoded, and like any
+// other compressible body it is encoded here with the best coding the
+// client accepts. status is the X-Cache value, stale ones add a Warning.
+// key is only reported by --inject-debug-comment
+func entryRepresentation(r *http.Request, key string, entry *cache.Entry, status string) (http.Header, []byte) {
+	header := entry.Header.Clone()
+	rewriteLocationHeader(r, header)
+	for _, warning := range staleWarnings[status] {
+		header.Add("Warning", warning)
+	}
+	if !entry.Stored.IsZero() {
+		header.Set("Age", strconv.Itoa(int(entry.Age().Seconds())))
+	}
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	legacyCacheHeaders(r, header)
+	body := entry.Body
+	if injectDebugComment && isHTML(header) && header.Get("Content-Encoding") == "" {
+		body = withDebugComment(body, fmt.Sprintf("cache: %s age=%ds key=%s", status, int(entry.Age().Seconds()), key))
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if encodesPerClient(entry) {
+		addVary(header, "Accept-Encoding")
+		if coding := preferredEncoding(r.Header); coding != "" {
+			body = encodeBody(body, coding)
+			header.Set("Content-Encoding", coding)
+			header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+	}
+	return header, body
+}
+
+// passThrough forwards an uncacheable request and streams the origin
+// response back without buffering it, reporting status in X-Cache
+func passThrough(w http.ResponseWriter, r *http.Request, targetURL, status string) {
+	if rateLimitExemptHits && !allowClient(w, r) {
+		return
+	}
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		http.Error(w, "Error creating origin request", http.StatusInternalServerError)
+		return
+	}
+	state := &proxyState{target: target, client: r, status: status}
+	originProxy.ServeHTTP(w, withProxyState(r.Context(), r, state))
+}
+
+// fetchAndStore fetches targetURL from the origin through originProxy,
+// answering w and storing the response under key when the origin allows
+// it. when stale is set its validators are sent along, and it is served
+// instead when the origin fails within its stale-if-error window. errors
+// are returned rather than cached so the next request tries the origin
+// again. the fetch runs in ctx, which is cancelled when nobody waits for it
+// anymore
+func fetchAndStore(ctx context.Context, w http.ResponseWriter, r *http.Request, targetURL, key string, stale *cache.Entry) (*originResult, error) {
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		http.Error(w, "Error creating origin request", http.StatusInternalServerError)
+		return nil, err
+	}
+	state := &proxyState{target: target, client: r, store: true, key: key, stale: stale, started: time.Now()}
+	serveUntilAborted(w, withProxyState(ctx, r, state))
+	if state.err != nil {
+		return nil, state.err
+	}
+	if state.result == nil {
+		return nil, errors.New("origin response aborted")
+	}
+	return state.result, nil
+}
+
+// serveUntilAborted runs originProxy for a fetch whose result is shared.
+// the proxy aborts the handler when a client goes away while its response
+// is copied, but a cached entry is complete by then and the other waiters
+// can still be given it
+func serveUntilAborted(w http.ResponseWriter, req *http.Request) {
+	defer func() {
+		if p := recover(); p != nil && p != http.ErrAbortHandler {
+			panic(p)
+		}
+	}()
+	originProxy.ServeHTTP(w, req)
+}
+
+// storeResponse stores entry in Redis cache together with its status and
+// headers, unless the origin asked us not to keep it and the path isn't on
+// --force-cache-paths. Vary: * means no request could ever be matched
+// against the stored copy
+func storeResponse(ctx context.Context, r *http.Request, key string, entry *cache.Entry) *originResult {
+	respCC := parseCacheControl(entry.Header)
+	proxyCC := takeProxyCache(entry.Header)
+	// on --force-cache-paths the origin's Cache-Control doesn't count, not
+	// even no-store or private
+	forced := matchAny(forceCachePaths, r.URL.Path)
+	if forced {
+		respCC = cacheControl{}
+	}
+	vary, varyOK := varyHeaders(entry.Header)
+	if encodesPerClient(entry) {
+		// an unencoded body is the same for every Accept-Encoding
+		vary = without(vary, "Accept-Encoding")
+	}
+	entry.NoCache = respCC.has("no-cache")
+	entry.MustRevalidate = respCC.has("must-revalidate") || respCC.has("proxy-revalidate")
+	entry.Vary = vary
+
+	ttl := responseTTL(r.URL, entry.Status, entry.Header, respCC)
+	if secs, ok := proxyCC.seconds("ttl"); ok {
+		ttl = clampTTL(secs)
+	}
+	if forced {
+		ttl = forceCacheTTL
+	}
+	res := &originResult{entry: entry, variant: cache.VariantKey(key, vary, r.Header), status: "MISS"}
+	trace := traceOf(r)
+	trace.add("origin status %d, Cache-Control %q", entry.Status, entry.Header.Get("Cache-Control"))
+	if forced {
+		trace.add("path matches --force-cache-paths")
+	}
+	trace.add("ttl %s", ttl)
+	// a response for one user: unlike a no-store response, which is just
+	// not kept, it may not even be shared with requests waiting on this
+	// fetch
+	if reason := personalRefusal(r, entry.Header, respCC, forced); reason != "" {
+		trace.add("not stored: %s", reason)
+		slog.Debug("response for one client forwarded without caching", "key", key, "reason", reason)
+		res.private = true
+		return res
+	}
+	if proxyCC.has("skip") && !forced {
+		trace.add("not stored: origin sent %s: skip", proxyCacheHeader)
+		return res
+	}
+	if reason := storeRefusal(r.URL.Path, entry, respCC, ttl, varyOK); reason != "" {
+		trace.add("not stored: %s", reason)
+		return res
+	}
+	if adaptiveTTL && !forced {
+		ttl = adaptTTL(ctx, key, ttl)
+		trace.add("adaptive ttl %s", ttl)
+		if ttl <= 0 && !entry.CanRevalidate() {
+			trace.add("not stored: rarely reused")
+			return res
+		}
+	}
+	ttl = jitterTTL(ttl)
+	minifyEntry(entry)
+	if len(vary) > 0 {
+		storeEntry(ctx, key, &cache.Entry{Vary: vary}, ttl)
+		storeEntry(ctx, res.variant, entry, ttl)
+	} else {
+		storeEntry(ctx, key, entry, ttl)
+	}
+	trace.add("stored")
+	res.stored = true
+	return res
+}
+
+// personalRefusal returns why the response to r is meant for its client
+// alone, empty when it may be shared: it sets a cookie and
+// --cache-set-cookie isn't given, the origin said private, or r sent
+// credentials and the origin didn't allow sharing the response with
+// public, s-maxage or must-revalidate (RFC 7234 3.2). on a forced path
+// only the cookie counts
+func personalRefusal(r *http.Request, h http.Header, cc cacheControl, forced bool) string {
+	switch {
+	case len(h.Values("Set-Cookie")) > 0 && !cacheSetCookie:
+		return "origin sent Set-Cookie"
+	case forced:
+		return ""
+	case cc.has("private"):
+		return "origin sent private"
+	case r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate"):
+		return "request sent Authorization"
+	}
+	return ""
+}
+
+// storeRefusal returns why a response for path may not be stored, empty
+// when it may. an entry that is stale right away is still worth keeping
+// when it can be revalidated cheaply next time
+func storeRefusal(path string, entry *cache.Entry, cc cacheControl, ttl time.Duration, varyOK bool) string {
+	switch {
+	case !isCacheableStatus(path, entry.Status, entry.Header, cc):
+		return fmt.Sprintf("status %d not cacheable", entry.Status)
+	case !isCacheableContentType(entry.Header):
+		return fmt.Sprintf("content type %q not cacheable", entry.Header.Get("Content-Type"))
+	case cc.has("no-store"):
+		return "origin sent no-store"
+	case !varyOK:
+		return "origin sent Vary: *"
+	case ttl <= 0 && !entry.CanRevalidate():
+		return "no lifetime and no validators"
+	}
+	return ""
+}
+
+// isCacheableStatus reports whether a response for path with the given
+// status may be stored. a --route-statuses rule for the path is final.
+// otherwise statuses outside cacheableStatuses, such as a transient 500,
+// are only cached when the origin explicitly gave them a lifetime
+func isCacheableStatus(path string, status int, h http.Header, cc cacheControl) bool {
+	if statuses, ok := routeStatuses.Statuses(path); ok {
+		return statuses[status]
+	}
+	if cacheableStatuses[status] {
+		return true
+	}
+	return cc.has("s-maxage") || cc.has("max-age") || h.Get("Expires") != ""
+}
+
+// isCacheableContentType reports whether the Content-Type of h is one of
+// --cacheable-content-types, where type/* matches any subtype. without the
+// flag every type is cacheable
+func isCacheableContentType(h http.Header) bool {
+	if len(cacheableContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, pattern := range cacheableContentTypes {
+		if pattern == "*/*" || pattern == mediaType ||
+			(strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferBody reads the body of r into memory so it can be hashed into the
+// key and still be sent to the origin, as often as needed. a body larger
+// than maxCacheableBytes is not worth caching by, ok is then false and r
+// is left to be streamed as usual
+func bufferBody(r *http.Request) (body []byte, ok bool, err error) {
+	body, err = io.ReadAll(io.LimitReader(r.Body, maxCacheableBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > maxCacheableBytes {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return body, true, nil
+}
+
+// isCacheableMethod reports whether responses to method may be cached, as
+// set by --cacheable-methods
+func isCacheableMethod(method string) bool {
+	return cacheableMethods[method]
+}
+
+// purgedMethods returns the methods whose entries a purge of path removes:
+// GET, which HEAD shares, any other cacheable method, and POST when path
+// is one of --cache-post-paths. a prefix purge covers paths that can't be
+// matched one by one, it takes POST along whenever --cache-post-paths is set
+func purgedMethods(path string, prefix bool) []string {
+	methods := []string{http.MethodGet}
+	if cacheableMethods[http.MethodOptions] {
+		methods = append(methods, http.MethodOptions)
+	}
+	if prefix && len(cachePostPaths) > 0 || matchAny(cachePostPaths, path) {
+		methods = append(methods, http.MethodPost)
+	}
+	return methods
+}
+
+// keyMethod returns the method a request for method is cached under. a
+// HEAD is answered from the cached GET, anything else has entries of its
+// own
+func keyMethod(method string) string {
+	if method == http.MethodHead {
+		return http.MethodGet
+	}
+	return method
+}
+
+// authenticated reports whether r comes from a logged-in user as told by
+// --segment-auth and --session-cookie. only the presence of the
+// credentials counts
+func authenticated(r *http.Request) bool {
+	if segmentAuth && r.Header.Get("Authorization") != "" {
+		return true
+	}
+	for _, name := range sessionCookies {
+		if _, err := r.Cookie(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheKey returns the plain key of a method request for the client URL u
+// sent to origin. purges and the admin entry lookup build their keys with
+// it and requests with requestKey, both through cache.BuildKey, so they
+// agree on where an entry lives. the keys of variants, POST bodies,
+// cookies and logged-in users extend it
+func cacheKey(method, origin string, u *url.URL) string {
+	return cache.BuildKey(keyRequest(method, origin, u, nil), nil)
+}
+
+// requestKey returns the key the response to r, sent to origin, is cached
+// under: its Accept variant with --vary-accept, the hash of body for a
+// POST cached by its body, its --vary-cookies and whether it is from a
+// logged-in user added to the key of its URL. body is nil for any other
+// request. a HEAD is answered from the cached GET, so it shares the key
+func requestKey(r *http.Request, origin string, body []byte) string {
+	method := keyMethod(r.Method)
+	if body != nil {
+		method = http.MethodPost
+	}
+	var vary []string
+	if varyAccept {
+		vary = []string{"Accept"}
+	}
+	key := cache.BuildKey(keyRequest(method, origin, r.URL, r.Header), vary)
+	if body != nil {
+		key = cache.BodyKey(key, body)
+	}
+	if len(varyCookies) > 0 {
+		key = cache.CookieKey(key, varyCookies, r)
+	}
+	if authenticated(r) {
+		key = cache.AuthKey(key)
+	}
+	return key
+}
+
+// keyRequest returns the request cache.BuildKey keys a method request for
+// the client URL u with: the URL it is sent to at origin, normalized by
+// cacheTarget, and header for the headers it varies on
+func keyRequest(method, origin string, u *url.URL, header http.Header) *http.Request {
+	target := joinOrigin(origin, cacheTarget(u))
+	parsed, err := url.Parse(target)
+	if err != nil {
+		// origins are checked at startup and cacheTarget only gives escaped
+		// paths, so this isn't expected. the key is then the URL as it is
+		parsed = &url.URL{Opaque: target}
+	}
+	return &http.Request{Method: method, URL: parsed, Header: header}
+}
+
+// cacheTarget returns the path and query of u as they go into the cache
+// key. with --cache-query-params or --ignore-query-params the query is cut
+// down to the parameters that select the content and sorted, so links
+// differing only in e.g. utm_source share one entry. with
+// --case-insensitive-path the path is lowercased, the query never is. the
+// origin still gets the full query and the path as it was sent
+func cacheTarget(u *url.URL) string {
+	path := u.EscapedPath()
+	if caseInsensitivePath {
+		path = strings.ToLower(path)
+	}
+	if cacheQueryParams == nil && ignoreQueryParams == nil {
+		if u.RawQuery == "" {
+			return path
+		}
+		return path + "?" + u.RawQuery
+	}
+	query := u.Query()
+	for name := range query {
+		if ignoreQueryParams[name] || (cacheQueryParams != nil && !cacheQueryParams[name]) {
+			delete(query, name)
+		}
+	}
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
+
+// requestTarget returns the escaped path of r followed by its query string.
+// an empty query never leaves a trailing "?"
+func requestTarget(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return r.URL.EscapedPath()
+	}
+	return r.URL.EscapedPath() + "?" + r.URL.RawQuery
+}
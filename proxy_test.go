@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/avii09/proxy_server/cache"
+)
+
+// newTestProxy points the proxy at an origin answering with h and at a
+// miniredis for the cache, both gone when the test ends. hits counts the
+// requests the origin got
+func newTestProxy(t *testing.T, h http.HandlerFunc) (*miniredis.Miniredis, *atomic.Int64) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	if err := cache.InitRedis("redis://"+mr.Addr(), cache.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	hits := &atomic.Int64{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		h(w, r)
+	}))
+	t.Cleanup(origin.Close)
+	originServer = origin.URL
+	defaultTTL = 5 * time.Minute
+	maxTTL = 24 * time.Hour
+	negativeTTL = 30 * time.Second
+	staleRetention = time.Hour
+	maxCacheableBytes = 10 << 20
+	writeChunkBytes = 32 << 10
+	cacheableStatuses, _ = parseStatusList("200,203,204,300,301,308,404,410")
+	return mr, hits
+}
+
+// doRequest sends a request for target through the proxy, with header given
+// as name, value pairs
+func doRequest(method, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	handleRequest(w, r)
+	return w
+}
+
+// countingCache counts the reads and writes that reach the Cache it wraps
+type countingCache struct {
+	cache.Cache
+	gets, sets atomic.Int64
+}
+
+func (c *countingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.gets.Add(1)
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *countingCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.sets.Add(1)
+	return c.Cache.Set(ctx, key, value, ttl)
+}
+
+// useCountingCache puts a countingCache over an in-memory cache in place
+// of Redis
+func useCountingCache() *countingCache {
+	c := &countingCache{Cache: cache.NewMemory()}
+	cache.Use(c)
+	return c
+}
+
+// keyFor returns the key a GET for target is cached under
+func keyFor(target string) string {
+	return cache.Key(http.MethodGet, originServer+target)
+}
+
+func TestQueryStringsAreSeparateEntries(t *testing.T) {
+	var forwarded []string
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.URL.RequestURI())
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.RawQuery))
+	})
+	a := doRequest("GET", "/search?q=1")
+	b := doRequest("GET", "/search?q=2")
+	if a.Body.String() != "q=1" || b.Body.String() != "q=2" {
+		t.Fatalf("bodies %q and %q", a.Body.String(), b.Body.String())
+	}
+	if !mr.Exists(keyFor("/search?q=1")) || !mr.Exists(keyFor("/search?q=2")) {
+		t.Fatalf("want an entry per query string, have %v", mr.Keys())
+	}
+	if rec := doRequest("GET", "/search?q=1"); rec.Body.String() != "q=1" || hits.Load() != 2 {
+		t.Fatalf("repeat: body %q, %d origin requests", rec.Body.String(), hits.Load())
+	}
+	if strings.Join(forwarded, " ") != "/search?q=1 /search?q=2" {
+		t.Fatalf("forwarded %v", forwarded)
+	}
+}
+
+func TestEmptyQueryLeavesNoQuestionMark(t *testing.T) {
+	var forwarded string
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.RequestURI()
+		w.Write([]byte("x"))
+	})
+	doRequest("GET", "/page?")
+	if forwarded != "/page" {
+		t.Fatalf("forwarded %q", forwarded)
+	}
+	if !mr.Exists(keyFor("/page")) {
+		t.Fatalf("keys %v", mr.Keys())
+	}
+}
+
+func TestPostBodyReachesOrigin(t *testing.T) {
+	const body = `{"name":"widget","tags":["a","b"]}`
+	var method, contentType, received string
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		method, contentType = r.Method, r.Header.Get("Content-Type")
+		b, _ := io.ReadAll(r.Body)
+		received = string(b)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("created"))
+	})
+	for range 2 {
+		r := httptest.NewRequest("POST", "/items", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handleRequest(w, r)
+		if w.Body.String() != "created" {
+			t.Fatalf("response %d %q", w.Code, w.Body.String())
+		}
+	}
+	if method != "POST" || contentType != "application/json" || received != body {
+		t.Fatalf("origin got %s %q %q", method, contentType, received)
+	}
+	if hits.Load() != 2 || len(mr.Keys()) != 0 {
+		t.Fatalf("POST cached: %d origin requests, keys %v", hits.Load(), mr.Keys())
+	}
+}
+
+func TestXCacheHeader(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	if got := doRequest("GET", "/x-cache").Header().Get("X-Cache"); got != "MISS" {
+		t.Fatalf("first request: X-Cache %q", got)
+	}
+	if got := doRequest("GET", "/x-cache").Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("second request: X-Cache %q", got)
+	}
+}
+
+func TestHitRestoresStatusAndHeaders(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Add("Link", "</a.css>; rel=preload")
+		w.Header().Add("Link", "</b.js>; rel=preload")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.WriteHeader(http.StatusNonAuthoritativeInfo)
+		w.Write([]byte(`{"ok":true}`))
+	})
+	doRequest("GET", "/round-trip")
+	rec := doRequest("GET", "/round-trip")
+	if rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	if rec.Code != http.StatusNonAuthoritativeInfo || rec.Body.String() != `{"ok":true}` {
+		t.Fatalf("hit %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("Content-Type %q", got)
+	}
+	if got := rec.Header().Values("Link"); len(got) != 2 {
+		t.Fatalf("Link %q", got)
+	}
+	if rec.Header().Get("X-Hop") != "" || rec.Header().Get("Connection") != "" {
+		t.Fatalf("hop-by-hop headers replayed: %v", rec.Header())
+	}
+}
+
+func TestOriginCacheControlNoStore(t *testing.T) {
+	for _, cc := range []string{"no-store", "private", "no-store, max-age=60"} {
+		mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", cc)
+			w.Write([]byte("secret"))
+		})
+		doRequest("GET", "/account")
+		if rec := doRequest("GET", "/account"); rec.Body.String() != "secret" {
+			t.Fatalf("%s: body %q", cc, rec.Body.String())
+		}
+		if len(mr.Keys()) != 0 || hits.Load() != 2 {
+			t.Fatalf("%s: keys %v, %d origin requests", cc, mr.Keys(), hits.Load())
+		}
+	}
+}
+
+func TestPrivateResponsesAreForwardedButNeverStored(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		w.Write([]byte("mine"))
+	})
+	logs := captureLog(t)
+	defer func(l slog.Level) { logLevel.Set(l) }(logLevel.Level())
+	logLevel.Set(slog.LevelDebug)
+
+	for i := 1; i <= 2; i++ {
+		rec := doRequest("GET", "/private")
+		if rec.Code != http.StatusOK || rec.Body.String() != "mine" || rec.Header().Get("X-Cache") != "MISS" {
+			t.Fatalf("request %d: %d %q, X-Cache %q", i, rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+		}
+	}
+	if hits.Load() != 2 || len(mr.Keys()) != 0 {
+		t.Fatalf("%d origin requests, keys %v, want 2 and none", hits.Load(), mr.Keys())
+	}
+	if !strings.Contains(logs.String(), `"reason":"origin sent private"`) {
+		t.Fatalf("decision not logged: %s", logs)
+	}
+}
+
+func TestPrivateResponsesAreNotSharedWithWaiters(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int64
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		w.Write([]byte("mine"))
+	})
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := doRequest("GET", "/private"); rec.Body.String() != "mine" {
+				t.Errorf("body %q", rec.Body.String())
+			}
+		}()
+		waitForWaiters(t, i)
+	}
+	close(release)
+	wg.Wait()
+	if hits.Load() != 3 {
+		t.Fatalf("%d origin requests for 3 clients, want each to fetch its own", hits.Load())
+	}
+}
+
+func TestNoCacheIsStoredButRevalidated(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/feed" {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("x"))
+	})
+	doRequest("GET", "/feed")
+	if !mr.Exists(keyFor("/feed")) {
+		t.Fatal("no-cache response not stored")
+	}
+	if rec := doRequest("GET", "/feed"); rec.Header().Get("X-Cache") == "HIT" || hits.Load() != 2 {
+		t.Fatalf("no-cache entry served without the origin: %q", rec.Header().Get("X-Cache"))
+	}
+
+	doRequest("GET", "/page")
+	if rec := doRequest("GET", "/page", "Cache-Control", "no-cache"); rec.Header().Get("X-Cache") == "HIT" || hits.Load() != 4 {
+		t.Fatalf("client no-cache answered from the cache: %q", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestErrorStatusesAreNotStored(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/forbidden-with-ttl":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusForbidden)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	counter := useCountingCache()
+	for range 2 {
+		if rec := doRequest("GET", "/broken"); rec.Code != http.StatusInternalServerError {
+			t.Fatalf("status %d", rec.Code)
+		}
+	}
+	if counter.sets.Load() != 0 || hits.Load() != 2 {
+		t.Fatalf("500 stored: %d sets, %d origin requests", counter.sets.Load(), hits.Load())
+	}
+
+	// a heuristically cacheable status, and one the origin gave a lifetime
+	doRequest("GET", "/missing")
+	doRequest("GET", "/forbidden-with-ttl")
+	if counter.sets.Load() != 2 {
+		t.Fatalf("%d sets, want 2", counter.sets.Load())
+	}
+
+	cacheableStatuses, _ = parseStatusList("200")
+	doRequest("GET", "/missing?again")
+	if counter.sets.Load() != 2 {
+		t.Fatal("404 stored although --cacheable-statuses leaves it out")
+	}
+}
+
+func TestConcurrentMissesShareOneFetch(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("X-Origin", "1")
+		io.WriteString(w, "shared")
+	})
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 50)
+	for i := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = doRequest("GET", "/cold")
+		}()
+	}
+	wg.Wait()
+	if hits.Load() != 1 {
+		t.Fatalf("%d origin requests", hits.Load())
+	}
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != "shared" || rec.Header().Get("X-Origin") != "1" {
+			t.Fatalf("response %d: %d %q %v", i, rec.Code, rec.Body.String(), rec.Header())
+		}
+	}
+}
+
+func TestOriginErrorIsNotShared(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			panic(http.ErrAbortHandler)
+		}
+		io.WriteString(w, "ok")
+	})
+	if rec := doRequest("GET", "/flaky"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("failing origin: %d", rec.Code)
+	}
+	fail.Store(false)
+	if rec := doRequest("GET", "/flaky"); rec.Code != http.StatusOK || rec.Body.String() != "ok" || hits.Load() != 2 {
+		t.Fatalf("after the error: %d %q, %d origin requests", rec.Code, rec.Body.String(), hits.Load())
+	}
+}
+
+func TestOversizedRequestBodies(t *testing.T) {
+	var received []int
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, len(body))
+	})
+	maxRequestBytes = 10
+	defer func() { maxRequestBytes = 0 }()
+
+	declared := httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("a", 100)))
+	rec := httptest.NewRecorder()
+	handleRequest(rec, declared)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("declared oversized body got %d", rec.Code)
+	}
+
+	chunked := httptest.NewRequest("POST", "/upload", io.NopCloser(strings.NewReader(strings.Repeat("a", 100))))
+	chunked.ContentLength = -1
+	rec = httptest.NewRecorder()
+	handleRequest(rec, chunked)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunked oversized body got %d", rec.Code)
+	}
+
+	small := httptest.NewRequest("POST", "/upload", strings.NewReader("0123456789"))
+	rec = httptest.NewRecorder()
+	handleRequest(rec, small)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("body at the limit got %d", rec.Code)
+	}
+	if len(received) == 0 || received[len(received)-1] != 10 {
+		t.Fatalf("origin received %v", received)
+	}
+}
+
+func TestNoCachePathsBypass(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	counter := useCountingCache()
+	noCachePaths, _ = parseRegexList("^/login")
+	defer func() { noCachePaths = nil }()
+
+	for range 2 {
+		if rec := doRequest("GET", "/login"); rec.Header().Get("X-Cache") != "BYPASS" {
+			t.Fatalf("X-Cache %q", rec.Header().Get("X-Cache"))
+		}
+	}
+	if counter.gets.Load() != 0 || counter.sets.Load() != 0 || hits.Load() != 2 {
+		t.Fatalf("bypassed path touched the cache: %d gets, %d sets, %d origin requests",
+			counter.gets.Load(), counter.sets.Load(), hits.Load())
+	}
+	if rec := doRequest("GET", "/products"); rec.Header().Get("X-Cache") != "MISS" || counter.sets.Load() == 0 {
+		t.Fatalf("other path X-Cache %q, %d sets", rec.Header().Get("X-Cache"), counter.sets.Load())
+	}
+}
+
+func TestIgnoredQueryParamsShareAnEntry(t *testing.T) {
+	var forwarded []string
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.URL.RawQuery)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.Query().Get("id")))
+	})
+	ignoreQueryParams = parseNameSet("utm_source,fbclid")
+	defer func() { ignoreQueryParams = nil }()
+
+	doRequest("GET", "/p?id=1&utm_source=a")
+	rec := doRequest("GET", "/p?utm_source=b&id=1&fbclid=x")
+	if rec.Header().Get("X-Cache") != "HIT" || hits.Load() != 1 {
+		t.Fatalf("X-Cache %q, %d origin requests", rec.Header().Get("X-Cache"), hits.Load())
+	}
+	if forwarded[0] != "id=1&utm_source=a" {
+		t.Fatalf("origin got query %q, want it whole", forwarded[0])
+	}
+	if rec := doRequest("GET", "/p?id=2&utm_source=a"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "2" {
+		t.Fatalf("id didn't fragment the cache: %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestCacheQueryParamsAllowList(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	cacheQueryParams = parseNameSet("page,id")
+	defer func() { cacheQueryParams = nil }()
+
+	doRequest("GET", "/list?page=2&id=7&session=abc")
+	if rec := doRequest("GET", "/list?id=7&session=def&page=2"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	if rec := doRequest("GET", "/list?page=3&id=7"); rec.Header().Get("X-Cache") != "MISS" || hits.Load() != 2 {
+		t.Fatalf("page didn't fragment the cache: %q", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestNoCacheNeverTouchesRedis(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	cachingDisabled = true
+	defer func() { cachingDisabled = false }()
+	commands := mr.CommandCount()
+	before := scrape(t)
+	for range 2 {
+		if rec := doRequest("GET", "/nc"); rec.Header().Get("X-Cache") != "DISABLED" || rec.Body.String() != "x" {
+			t.Fatalf("X-Cache %q, body %q", rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+	}
+	if n := mr.CommandCount() - commands; n != 0 || hits.Load() != 2 {
+		t.Fatalf("%d Redis commands and %d origin requests, want 0 and 2", n, hits.Load())
+	}
+	if got := scrape(t)["origin_request_duration_seconds_count"] - before["origin_request_duration_seconds_count"]; got != 2 {
+		t.Fatalf("origin requests metered %v times, want 2", got)
+	}
+}
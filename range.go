@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// isRangeRequest reports whether r asks for part of the body only
+func isRangeRequest(r *http.Request) bool {
+	return r.Header.Get("Range") != ""
+}
+
+// servesRange reports whether the Range of r is answered out of entry. only
+// a complete 200 body can be cut into ranges
+func servesRange(r *http.Request, entry *cache.Entry) bool {
+	return isRangeRequest(r) && entry.Status == http.StatusOK &&
+		(r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// serveRange answers a Range request with the part of body it asks for as
+// a 206, with 416 when the range lies outside the body, or with the whole
+// body when an If-Range no longer matches the entry. the headers are
+// already set on w
+func serveRange(w http.ResponseWriter, r *http.Request, body []byte) {
+	// an If-Range date is compared against Last-Modified. without one the
+	// time is zero, which ServeContent ignores
+	modified, _ := http.ParseTime(w.Header().Get("Last-Modified"))
+	http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rangeOrigin serves a ten byte body, with Range support
+func rangeOrigin(ranges *[]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*ranges = append(*ranges, r.Header.Get("Range"))
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}
+}
+
+func TestRangeMissGoesToTheOrigin(t *testing.T) {
+	var ranges []string
+	mr, _ := newTestProxy(t, rangeOrigin(&ranges))
+	rec := doRequest("GET", "/v", "Range", "bytes=2-4")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" || rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("%d %q, X-Cache %q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=2-4" {
+		t.Fatalf("origin was asked for %q", ranges)
+	}
+	if mr.Exists(keyFor("/v")) {
+		t.Fatal("a partial body was stored as the whole entry")
+	}
+}
+
+func TestRangeServedFromCache(t *testing.T) {
+	var ranges []string
+	_, hits := newTestProxy(t, rangeOrigin(&ranges))
+	if rec := doRequest("GET", "/v"); rec.Body.String() != "0123456789" {
+		t.Fatalf("full body %q", rec.Body.String())
+	}
+
+	rec := doRequest("GET", "/v", "Range", "bytes=2-4")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("%d %q, X-Cache %q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if rec.Header().Get("Content-Range") != "bytes 2-4/10" || rec.Header().Get("Content-Length") != "3" {
+		t.Fatalf("Content-Range %q, Content-Length %q", rec.Header().Get("Content-Range"), rec.Header().Get("Content-Length"))
+	}
+	if rec := doRequest("GET", "/v", "Range", "bytes=-3"); rec.Body.String() != "789" {
+		t.Fatalf("suffix range %q", rec.Body.String())
+	}
+	rec = doRequest("GET", "/v", "Range", "bytes=20-30")
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */10" {
+		t.Fatalf("unsatisfiable range: %d, Content-Range %q", rec.Code, rec.Header().Get("Content-Range"))
+	}
+	// an If-Range for another version gets the whole body
+	rec = doRequest("GET", "/v", "Range", "bytes=2-4", "If-Range", `"v0"`)
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+		t.Fatalf("stale If-Range: %d %q", rec.Code, rec.Body.String())
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("%d origin requests, want 1", hits.Load())
+	}
+}
+
+// mediaOrigin serves a 1000 byte video, with Range support
+func mediaOrigin(ranges *[]string) http.HandlerFunc {
+	body := strings.Repeat("0123456789", 100)
+	return func(w http.ResponseWriter, r *http.Request) {
+		*ranges = append(*ranges, r.Header.Get("Range"))
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}
+}
+
+func TestCacheRangesServesARepeatedRangeFromCache(t *testing.T) {
+	var ranges []string
+	_, hits := newTestProxy(t, mediaOrigin(&ranges))
+	defer func(on bool) { cacheRanges = on }(cacheRanges)
+	cacheRanges = true
+
+	rec := doRequest("GET", "/movie", "Range", "bytes=10-19")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "0123456789" || rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first range: %d %q, X-Cache %q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	// the same range written differently is the same entry
+	rec = doRequest("GET", "/movie", "Range", "bytes = 10-19")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "0123456789" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("repeated range: %d %q, X-Cache %q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("%d origin requests for one range, want 1", hits.Load())
+	}
+	if rec.Header().Get("Content-Range") != "bytes 10-19/1000" || rec.Header().Get("Content-Length") != "10" {
+		t.Fatalf("Content-Range %q, Content-Length %q", rec.Header().Get("Content-Range"), rec.Header().Get("Content-Length"))
+	}
+
+	rec = doRequest("GET", "/movie", "Range", "bytes=0-4")
+	if rec.Body.String() != "01234" || hits.Load() != 2 || ranges[1] != "bytes=0-4" {
+		t.Fatalf("another range: %q after %d origin requests for %q", rec.Body.String(), hits.Load(), ranges)
+	}
+	// a range doesn't stand in for the full body
+	if rec := doRequest("GET", "/movie"); rec.Header().Get("X-Cache") != "MISS" || hits.Load() != 3 {
+		t.Fatalf("full body: X-Cache %q, want a MISS", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestRangesAreNotCachedWithoutCacheRanges(t *testing.T) {
+	var ranges []string
+	_, hits := newTestProxy(t, mediaOrigin(&ranges))
+
+	doRequest("GET", "/film", "Range", "bytes=0-1")
+	doRequest("GET", "/film", "Range", "bytes=0-1")
+	if hits.Load() != 2 {
+		t.Fatalf("%d origin requests, want every range sent on", hits.Load())
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// rangeKey returns the key a byte range of the plain key is cached under
+// with --cache-ranges. the range is written without whitespace so the same
+// range asked for differently shares one entry. like variant keys it
+// starts with key followed by "|"
+func rangeKey(key, spec string) string {
+	return key + "|range=" + cache.EscapeKeyPart(strings.ToLower(strings.Join(strings.Fields(spec), "")))
+}
+
+// serveRangeCached answers a range request with --cache-ranges, for a URL
+// whose full body isn't cached. each range is an entry of its own: a
+// fresh one is served as the 206 it was, anything else is forwarded with
+// its Range and the origin's 206 stored for the next request asking for
+// the same bytes. a range with an If-Range is only forwarded, it can't be
+// checked against an entry that has no full body
+func serveRangeCached(w http.ResponseWriter, r *http.Request, targetURL, key string) {
+	trace := traceOf(r)
+	if r.Method != http.MethodGet || r.Header.Get("If-Range") != "" {
+		trace.add("range not in the cache, forwarded")
+		countMiss(r)
+		passThrough(w, r, targetURL, "MISS")
+		return
+	}
+	rkey := rangeKey(key, r.Header.Get("Range"))
+	trace.add("range key %s", rkey)
+	if entry, ok := getEntry(r.Context(), rkey); ok && entry.Fresh() &&
+		cache.AcceptsEncoding(r.Header, entry.Header.Get("Content-Encoding")) {
+		countHit(r)
+		copyHeader(w.Header(), entry.Header)
+		w.Header().Set("Age", strconv.Itoa(int(entry.Age().Seconds())))
+		legacyCacheHeaders(r, w.Header())
+		w.Header().Set("X-Cache", "HIT")
+		trace.add("range served from the cache")
+		trace.setHeader(w.Header())
+		w.WriteHeader(entry.Status)
+		writeBody(w, r, entry.Body)
+		return
+	}
+
+	countMiss(r)
+	rec := &rangeRecorder{ResponseWriter: w}
+	passThrough(rec, r, targetURL, "MISS")
+	if entry, ttl, ok := rec.entry(r); ok {
+		storeEntry(r.Context(), rkey, entry, ttl)
+	}
+}
+
+// rangeRecorder keeps a copy of the response passThrough writes to a
+// client, up to maxCacheableBytes, for serveRangeCached to store. its
+// headers are apart from those the client already has, such as CORS ones,
+// which aren't the origin's to store
+type rangeRecorder struct {
+	http.ResponseWriter
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rr *rangeRecorder) Header() http.Header {
+	if rr.header == nil {
+		rr.header = http.Header{}
+	}
+	return rr.header
+}
+
+func (rr *rangeRecorder) WriteHeader(status int) {
+	if rr.status != 0 {
+		return
+	}
+	rr.status = status
+	for name, values := range rr.Header() {
+		rr.ResponseWriter.Header()[name] = values
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *rangeRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.WriteHeader(http.StatusOK)
+	}
+	if !rr.overflow {
+		if int64(rr.body.Len()+len(b)) > maxCacheableBytes {
+			rr.overflow = true
+			rr.body.Reset()
+		} else {
+			rr.body.Write(b)
+		}
+	}
+	return rr.ResponseWriter.Write(b)
+}
+
+func (rr *rangeRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// entry returns the recorded response as an entry along with how long it
+// may be stored. only a complete 206 is, judged as its full 200 response
+// would be. one that varies is left alone, its variants would need keys of
+// their own
+func (rr *rangeRecorder) entry(r *http.Request) (*cache.Entry, time.Duration, bool) {
+	header := rr.Header().Clone()
+	if rr.status != http.StatusPartialContent || rr.overflow || header.Get("Content-Range") == "" {
+		return nil, 0, false
+	}
+	// a copy cut short by the origin or the client is not the range
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err != nil || length != rr.body.Len() {
+		return nil, 0, false
+	}
+	header.Del("X-Cache")
+	header.Del(cacheTraceHeader)
+	vary, varyOK := varyHeaders(header)
+	cc := parseCacheControl(header)
+	ttl := jitterTTL(responseTTL(r.URL, http.StatusOK, header, cc))
+	full := &cache.Entry{Status: http.StatusOK, Header: header}
+	if personalRefusal(r, header, cc, false) != "" || storeRefusal(r.URL.Path, full, cc, ttl, varyOK && len(vary) == 0) != "" || ttl <= 0 {
+		return nil, 0, false
+	}
+	return &cache.Entry{Status: rr.status, Header: header, Body: bytes.Clone(rr.body.Bytes())}, ttl, true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter(20, 2)
+	for i := range 2 {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d within the burst refused", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait <= 0 || wait > 50*time.Millisecond {
+		t.Fatalf("past the burst: allowed %v, wait %v", ok, wait)
+	}
+	time.Sleep(wait + 10*time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("no token after waiting")
+	}
+	if ok, _ := (*rateLimiter)(nil).Allow("a"); !ok {
+		t.Fatal("a nil limiter refused")
+	}
+}
+
+func TestClientsOverTheLimitGet429(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("x"))
+	})
+	clientLimiter = newRateLimiter(0.001, 3)
+	defer func() { clientLimiter = nil }()
+	for i := range 3 {
+		if rec := doRequest("GET", "/x"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, rec.Code)
+		}
+	}
+	rec := doRequest("GET", "/x")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", rec.Code)
+	}
+	if secs, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || secs < 1 {
+		t.Fatalf("Retry-After %q", rec.Header().Get("Retry-After"))
+	}
+	if hits.Load() != 3 {
+		t.Fatalf("%d origin requests, want 3", hits.Load())
+	}
+	// another client has a bucket of its own
+	if rec := doRequest("GET", "/x", "X-Forwarded-For", "10.0.0.9, 10.0.0.1"); rec.Code != http.StatusOK {
+		t.Fatalf("other client: status %d", rec.Code)
+	}
+}
+
+func TestRateLimitExemptHits(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	clientLimiter = newRateLimiter(0.001, 1)
+	rateLimitExemptHits = true
+	defer func() { clientLimiter, rateLimitExemptHits = nil, false }()
+	doRequest("GET", "/c")
+	for i := range 5 {
+		if rec := doRequest("GET", "/c"); rec.Code != http.StatusOK {
+			t.Fatalf("hit %d: status %d", i, rec.Code)
+		}
+	}
+	if rec := doRequest("GET", "/other"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("miss: status %d, want 429", rec.Code)
+	}
+	if rec := doRequest("POST", "/c"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("POST: status %d, want 429", rec.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct{ xff, remote, want string }{
+		{"", "192.0.2.1:5000", "192.0.2.1"},
+		{"10.0.0.9, 10.0.0.1", "192.0.2.1:5000", "10.0.0.9"},
+		{" , 10.0.0.1", "192.0.2.1:5000", "192.0.2.1"},
+		{"", "unix", "unix"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("X-Forwarded-For %q from %s: %q, want %q", tc.xff, tc.remote, got, tc.want)
+		}
+	}
+}
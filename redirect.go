@@ -0,0 +1,38 @@
+package main
+
+import "net/http"
+
+// maxRedirects is how many redirects --follow-redirects follows for one
+// request. the last redirect is passed on once it is reached
+const maxRedirects = 10
+
+// redirectTransport follows the redirects of the origin for GET and HEAD
+// requests with --follow-redirects, so the client gets, and the cache stores
+// under the URL that was asked for, the final response. without the flag a
+// 3xx is passed on, and cached, with its Location as the origin sent it
+type redirectTransport struct {
+	client *http.Client
+}
+
+func newRedirectTransport(base http.RoundTripper) redirectTransport {
+	return redirectTransport{client: &http.Client{
+		Transport: base,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}}
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !followRedirects || (req.Method != http.MethodGet && req.Method != http.MethodHead) || req.Header.Get("Upgrade") != "" {
+		return t.client.Transport.RoundTrip(req)
+	}
+	// the proxied request still has the RequestURI it arrived with, which
+	// http.Client refuses
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	return t.client.Do(out)
+}
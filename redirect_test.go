@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func redirectOrigin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	switch r.URL.Path {
+	case "/old":
+		http.Redirect(w, r, "/mid", http.StatusFound)
+	case "/mid":
+		http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+	case "/loop":
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	default:
+		w.Write([]byte("final"))
+	}
+}
+
+func TestRedirectsAreCachedAsIs(t *testing.T) {
+	_, hits := newTestProxy(t, redirectOrigin)
+	rec := doRequest("GET", "/old")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/mid" || hits.Load() != 1 {
+		t.Fatalf("%d, Location %q, %d origin requests", rec.Code, rec.Header().Get("Location"), hits.Load())
+	}
+	if rec := doRequest("GET", "/old"); rec.Code != http.StatusFound || rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Location") != "/mid" {
+		t.Fatalf("%d, X-Cache %q, Location %q", rec.Code, rec.Header().Get("X-Cache"), rec.Header().Get("Location"))
+	}
+}
+
+func TestFollowedRedirectsAreCachedUnderTheRequestedURL(t *testing.T) {
+	_, hits := newTestProxy(t, redirectOrigin)
+	defer func(v bool) { followRedirects = v }(followRedirects)
+	followRedirects = true
+
+	rec := doRequest("GET", "/mid")
+	if rec.Code != http.StatusOK || rec.Body.String() != "final" || rec.Header().Get("Location") != "" || hits.Load() != 2 {
+		t.Fatalf("%d %q, Location %q, %d origin requests", rec.Code, rec.Body.String(), rec.Header().Get("Location"), hits.Load())
+	}
+	if rec := doRequest("GET", "/mid"); rec.Body.String() != "final" || rec.Header().Get("X-Cache") != "HIT" || hits.Load() != 2 {
+		t.Fatalf("%q, X-Cache %q, %d origin requests", rec.Body.String(), rec.Header().Get("X-Cache"), hits.Load())
+	}
+	// the redirect's target wasn't cached along the way
+	if rec := doRequest("GET", "/new"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("target X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+
+	// a redirect loop ends with the last redirect after ten hops
+	hits.Store(0)
+	if rec := doRequest("GET", "/loop"); rec.Code != http.StatusFound || hits.Load() != 11 {
+		t.Fatalf("loop: %d after %d origin requests", rec.Code, hits.Load())
+	}
+}
+
+func TestCachedRedirectsUseTheRedirectTTL(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		case "/told":
+			w.Header().Set("Cache-Control", "max-age=60")
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		default:
+			w.Write([]byte("content"))
+		}
+	})
+	defer func(d time.Duration) { redirectTTL = d }(redirectTTL)
+	redirectTTL = 2 * time.Hour
+
+	doRequest("GET", "/old")
+	if rec := doRequest("GET", "/old"); rec.Code != http.StatusMovedPermanently || rec.Header().Get("X-Cache") != "HIT" || hits.Load() != 1 {
+		t.Fatalf("%d, X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if ttl := mr.TTL(keyFor("/old")); ttl != 2*time.Hour {
+		t.Fatalf("redirect TTL %v, want 2h", ttl)
+	}
+	doRequest("GET", "/page")
+	if ttl := mr.TTL(keyFor("/page")); ttl != defaultTTL {
+		t.Fatalf("content TTL %v, want the default %v", ttl, defaultTTL)
+	}
+	// the origin's own lifetime wins
+	doRequest("GET", "/told")
+	if ttl := mr.TTL(keyFor("/told")); ttl != time.Minute {
+		t.Fatalf("origin's redirect TTL %v, want 1m", ttl)
+	}
+}
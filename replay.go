@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// errNotRecorded is returned in --replay for a request the recording has
+// no response for
+var errNotRecorded = errors.New("no recorded response")
+
+// recordedResponse is an origin response as --record writes it to disk,
+// one JSON object per line
+type recordedResponse struct {
+	Key    string      `json:"key"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// recordingKey is what responses are recorded under: the method and the
+// URL the origin was sent, so a replay needs the same --origin
+func recordingKey(req *http.Request) string {
+	return req.Method + " " + req.URL.String()
+}
+
+// recordTransport, with --record, keeps a copy of origin responses in a
+// file for --replay to serve later. each response is appended as a line
+// of its own, so recording costs one write and the file is complete
+// whenever the proxy stops. a request asked for again gets a later line,
+// which the replay uses, except with a 304 that only answers the
+// revalidation it was sent for. like the cache, event streams and bodies
+// over --max-cacheable-bytes go to the client unread and unrecorded
+type recordTransport struct {
+	base http.RoundTripper
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newRecordTransport starts a recording at path, replacing the file there
+func newRecordTransport(path string, base http.RoundTripper) (*recordTransport, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &recordTransport{base: base, path: path, file: f}, nil
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode == http.StatusNotModified {
+		return resp, err
+	}
+	if isEventStream(resp.Header) || resp.ContentLength > maxCacheableBytes {
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCacheableBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > maxCacheableBytes {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	line, err := json.Marshal(recordedResponse{Key: recordingKey(req), Status: resp.StatusCode, Header: resp.Header, Body: body})
+	if err == nil {
+		t.mu.Lock()
+		_, err = t.file.Write(append(line, '\n'))
+		t.mu.Unlock()
+	}
+	if err != nil {
+		slog.Warn("response not recorded", "path", t.path, "error", err)
+	}
+	return resp, nil
+}
+
+// replayTransport answers origin requests from a file --record wrote,
+// with --replay, and never contacts an origin. what the proxy does with
+// the responses, caching included, is the same as it was while recording
+type replayTransport struct {
+	responses map[string]recordedResponse
+}
+
+// newReplayTransport loads the recording at path, a later line for a
+// request replacing an earlier one. a last line cut short, by the proxy
+// stopping while it was written, is left out
+func newReplayTransport(path string) (replayTransport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return replayTransport{}, err
+	}
+	defer f.Close()
+	responses := map[string]recordedResponse{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var recorded recordedResponse
+		err := dec.Decode(&recorded)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			slog.Warn("incomplete last response of the recording left out", "path", path)
+			break
+		}
+		if err != nil {
+			return replayTransport{}, fmt.Errorf("%s: %w", path, err)
+		}
+		responses[recorded.Key] = recorded
+	}
+	return replayTransport{responses: responses}, nil
+}
+
+func (t replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	recorded, ok := t.responses[recordingKey(req)]
+	if !ok {
+		return nil, fmt.Errorf("%w for %s", errNotRecorded, recordingKey(req))
+	}
+	header := recorded.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	contentLength := int64(len(recorded.Body))
+	if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		contentLength = n
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(recorded.Body)),
+		ContentLength: contentLength,
+		Request:       req,
+	}, nil
+}
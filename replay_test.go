@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// useRecording sends origin requests through a --record transport writing
+// to a file in a temporary directory, and returns the file's path
+func useRecording(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fixtures.jsonl")
+	record, err := newRecordTransport(path, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := originProxy
+	originProxy = newOriginProxy(record)
+	t.Cleanup(func() {
+		originProxy = previous
+		record.file.Close()
+	})
+	return path
+}
+
+// useReplay answers origin requests from the recording at path
+func useReplay(t *testing.T, path string) {
+	t.Helper()
+	replay, err := newReplayTransport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := originProxy
+	originProxy = newOriginProxy(replay)
+	t.Cleanup(func() { originProxy = previous })
+}
+
+// recordedLines returns the lines of the recording at path
+func recordedLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestRecordReplay(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Fixture", "yes")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("recorded " + r.URL.RawQuery))
+	})
+	path := useRecording(t)
+	first := doRequest("GET", "/fixture?a=1")
+	if first.Code != 200 || first.Body.String() != "recorded a=1" || hits.Load() != 1 {
+		t.Fatalf("record: %d %q %d", first.Code, first.Body.String(), hits.Load())
+	}
+
+	// a fresh cache, and no origin
+	origin := originServer
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { t.Error("origin contacted") })
+	originServer = origin
+	useReplay(t, path)
+	for range 2 {
+		rec := doRequest("GET", "/fixture?a=1")
+		if rec.Code != 200 || rec.Body.String() != first.Body.String() || rec.Header().Get("X-Fixture") != "yes" ||
+			rec.Header().Get("Content-Type") != "text/plain" {
+			t.Fatalf("replay: %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+		}
+	}
+	if rec := doRequest("GET", "/fixture?a=2"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("unrecorded: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRecordingAppendsALinePerResponse(t *testing.T) {
+	var n atomic.Int64
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("version " + strconv.FormatInt(n.Add(1), 10)))
+	})
+	path := useRecording(t)
+	doRequest("GET", "/changing")
+	if lines := recordedLines(t, path); len(lines) != 1 {
+		t.Fatalf("after one response: %q", lines)
+	}
+	doRequest("GET", "/changing")
+	doRequest("GET", "/other")
+	if lines := recordedLines(t, path); len(lines) != 3 {
+		t.Fatalf("after three responses: %q", lines)
+	}
+
+	origin := originServer
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { t.Error("origin contacted") })
+	originServer = origin
+	useReplay(t, path)
+	if rec := doRequest("GET", "/changing"); rec.Body.String() != "version 2" {
+		t.Fatalf("replayed %q, want the later recording", rec.Body.String())
+	}
+}
+
+func TestEventStreamsAreNotRecorded(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: one\n\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("data: two\n\n"))
+	})
+	path := useRecording(t)
+	rec := doRequest("GET", "/events")
+	if rec.Body.String() != "data: one\n\ndata: two\n\n" {
+		t.Fatalf("stream: %q", rec.Body.String())
+	}
+	if lines := recordedLines(t, path); len(lines) != 0 {
+		t.Fatalf("event stream recorded: %q", lines)
+	}
+}
+
+func TestOversizedBodiesAreNotRecorded(t *testing.T) {
+	body := strings.Repeat("x", 64)
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("length") {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.Write([]byte(body))
+	})
+	defer func(n int64) { maxCacheableBytes = n }(maxCacheableBytes)
+	maxCacheableBytes = 16
+	path := useRecording(t)
+	for _, target := range []string{"/big?length", "/big"} {
+		if rec := doRequest("GET", target); rec.Body.String() != body {
+			t.Fatalf("%s: got %d bytes, want %d", target, rec.Body.Len(), len(body))
+		}
+	}
+	if lines := recordedLines(t, path); len(lines) != 0 {
+		t.Fatalf("oversized body recorded: %q", lines)
+	}
+}
+
+func TestReplayLeavesOutATruncatedLastLine(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("kept"))
+	})
+	path := useRecording(t)
+	doRequest("GET", "/kept")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := append(bytes.Clone(data), data[:len(data)/2]...)
+	if err := os.WriteFile(path, cut, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useReplay(t, path)
+	if rec := doRequest("GET", "/kept"); rec.Code != 200 || rec.Body.String() != "kept" {
+		t.Fatalf("replay: %d %q", rec.Code, rec.Body.String())
+	}
+
+	broken := append([]byte("{not json}\n"), data...)
+	if err := os.WriteFile(path, broken, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newReplayTransport(path); err == nil {
+		t.Fatal("a corrupt line was accepted")
+	}
+}
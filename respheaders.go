@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// HeaderRules is a repeatable flag of "Name: value" response headers
+type HeaderRules struct {
+	rules []headerRule
+}
+
+type headerRule struct {
+	name  string
+	value string
+}
+
+// String implements flag.Value
+func (hr *HeaderRules) String() string {
+	var parts []string
+	for _, rule := range hr.rules {
+		parts = append(parts, rule.name+": "+rule.value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value, adding one Name: value header
+func (hr *HeaderRules) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("%q must look like Name: value", value)
+	}
+	hr.rules = append(hr.rules, headerRule{http.CanonicalHeaderKey(name), strings.TrimSpace(v)})
+	return nil
+}
+
+// transformResponseHeader applies --remove-response-header,
+// --set-response-header and --add-response-header, in that order, to the
+// headers of an origin response. it runs before the response is cached, so
+// the stored entry already looks the way clients are meant to see it
+func transformResponseHeader(h http.Header) {
+	for _, name := range removeResponseHeaders {
+		h.Del(name)
+	}
+	for _, rule := range setResponseHeaders.rules {
+		h.Set(rule.name, rule.value)
+	}
+	for _, rule := range addResponseHeaders.rules {
+		h.Add(rule.name, rule.value)
+	}
+}
+
+// withoutStoredHeaders returns entry as it is stored, without the
+// --strip-stored-headers that would be wrong replayed on a hit, like the
+// Date of the original response. entry, which the response being fetched
+// is still served from, is left alone. hits get a Date and Age of their
+// own, see entryRepresentation
+func withoutStoredHeaders(entry *cache.Entry) *cache.Entry {
+	if len(stripStoredHeaders) == 0 {
+		return entry
+	}
+	stored := *entry
+	stored.Header = entry.Header.Clone()
+	for _, name := range stripStoredHeaders {
+		stored.Header.Del(name)
+	}
+	return &stored
+}
+
+// defaultStripStoredHeaders is the --strip-stored-headers default. Age is
+// kept, hits adding the time since the entry was stored to the Age the
+// origin sent, see Entry.Age
+const defaultStripStoredHeaders = "Date,X-Request-ID,Set-Cookie"
+
+// parseStoredHeaders parses --strip-stored-headers, given telling whether
+// it was set rather than left at its default. --cache-set-cookie is meant
+// to send the cookie along on hits, so Set-Cookie is taken out of the
+// default list, and a list given with it is an error
+func parseStoredHeaders(value string, given bool) ([]string, error) {
+	names := splitList(value)
+	if !cacheSetCookie {
+		return names, nil
+	}
+	var kept []string
+	for _, name := range names {
+		if !strings.EqualFold(name, "Set-Cookie") {
+			kept = append(kept, name)
+		} else if given {
+			return nil, errors.New("must not list Set-Cookie with --cache-set-cookie")
+		}
+	}
+	return kept, nil
+}
+
+// rewriteLocationHeader points a Location at one of r's origins back at the
+// proxy, with --rewrite-location, so a redirect doesn't send the client
+// around the cache. the proxy's host is the one r was sent to, which
+// depends on the client, so this is done as each response is sent rather
+// than before it is cached
+func rewriteLocationHeader(r *http.Request, h http.Header) {
+	location := h.Get("Location")
+	if !rewriteLocation || location == "" {
+		return
+	}
+	loc, err := url.Parse(location)
+	if err != nil || loc.Host == "" {
+		return
+	}
+	origin, _ := resolveOrigin(r.URL.Path)
+	candidates := []string{origin}
+	if hasFallbacks(origin) {
+		candidates = append(candidates, originFallbacks...)
+	}
+	for _, candidate := range candidates {
+		o, err := url.Parse(candidate)
+		if err != nil || !strings.EqualFold(o.Host, loc.Host) {
+			continue
+		}
+		// an origin with a base path serves what the proxy has under /
+		path := loc.Path
+		if base := strings.TrimSuffix(o.Path, "/"); base != "" && matchPrefix(path, base) {
+			path = "/" + strings.TrimPrefix(path[len(base):], "/")
+		}
+		loc.Scheme = "http"
+		if r.TLS != nil {
+			loc.Scheme = "https"
+		}
+		loc.Host = r.Host
+		loc.Path, loc.RawPath = path, ""
+		h.Set("Location", loc.String())
+		return
+	}
+}
+
+// legacyCacheHeaders puts what the Cache-Control of a response served to
+// an HTTP/1.0 client says into the headers it knows, with
+// --http10-cache-headers: an Expires for a max-age, counting the Age
+// already spent, and Pragma: no-cache with an Expires in the past for a
+// response it mustn't reuse. replace drops Cache-Control afterwards
+func legacyCacheHeaders(r *http.Request, h http.Header) {
+	if (http10CacheHeaders != "add" && http10CacheHeaders != "replace") || r.ProtoAtLeast(1, 1) {
+		return
+	}
+	cc := parseCacheControl(h)
+	if len(cc) == 0 {
+		return
+	}
+	now := time.Now()
+	if cc.has("no-store") || cc.has("no-cache") || cc.has("private") {
+		h.Set("Pragma", "no-cache")
+		h.Set("Expires", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+	} else if maxAge, ok := cc.seconds("max-age"); ok {
+		age, _ := strconv.Atoi(h.Get("Age"))
+		h.Set("Expires", now.Add(maxAge-time.Duration(age)*time.Second).UTC().Format(http.TimeFormat))
+	}
+	if http10CacheHeaders == "replace" {
+		h.Del("Cache-Control")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseHeaderRules(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.2")
+		w.Header().Set("X-Powered-By", "php")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+	removeResponseHeaders = []string{"Server", "x-powered-by"}
+	setResponseHeaders, addResponseHeaders = HeaderRules{}, HeaderRules{}
+	if err := setResponseHeaders.Set("Cache-Control: max-age=120"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addResponseHeaders.Set("X-Served-By: edge"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		removeResponseHeaders, setResponseHeaders, addResponseHeaders = nil, HeaderRules{}, HeaderRules{}
+	}()
+
+	for _, want := range []string{"MISS", "HIT"} {
+		rec := doRequest("GET", "/a")
+		if rec.Header().Get("X-Cache") != want || rec.Header().Get("Server") != "" || rec.Header().Get("X-Powered-By") != "" {
+			t.Fatalf("%s kept a removed header: %v", want, rec.Header())
+		}
+		if rec.Header().Get("Cache-Control") != "max-age=120" || rec.Header().Get("X-Served-By") != "edge" {
+			t.Fatalf("%s without the set and added headers: %v", want, rec.Header())
+		}
+	}
+	// a pass-through gets the rules too
+	if rec := doRequest("DELETE", "/a"); rec.Header().Get("Server") != "" {
+		t.Fatalf("pass-through kept Server %q", rec.Header().Get("Server"))
+	}
+
+	var bad HeaderRules
+	for _, rule := range []string{"NoColon", ": v", "Two Words: v"} {
+		if bad.Set(rule) == nil {
+			t.Errorf("%q accepted", rule)
+		}
+	}
+}
+
+func TestRedirectLocationIsRewritten(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.Redirect(w, r, originServer+"/new?x=1", http.StatusMovedPermanently)
+	})
+	rewriteLocation = true
+	defer func() { rewriteLocation = false }()
+
+	for _, want := range []string{"MISS", "HIT"} {
+		rec := doRequest("GET", "/old")
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("X-Cache") != want {
+			t.Fatalf("%d, X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+		}
+		if loc := rec.Header().Get("Location"); loc != "http://example.com/new?x=1" {
+			t.Fatalf("%s Location %q", want, loc)
+		}
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("%d origin requests, want 1", hits.Load())
+	}
+}
+
+func TestRewriteLocationHeader(t *testing.T) {
+	defer func(origin string) { originServer, rewriteLocation = origin, false }(originServer)
+	originServer = "http://origin.internal/v2"
+	rewriteLocation = true
+	for _, tc := range []struct {
+		location, want string
+		tls            bool
+	}{
+		{"http://origin.internal/v2/users?page=2", "http://proxy.example/users?page=2", false},
+		{"https://ORIGIN.internal/v2/", "https://proxy.example/", true},
+		{"https://other.example/x", "https://other.example/x", false},
+		{"/relative", "/relative", false},
+	} {
+		r, _ := http.NewRequest("GET", "/old", nil)
+		r.Host = "proxy.example"
+		if tc.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		h := http.Header{"Location": {tc.location}}
+		rewriteLocationHeader(r, h)
+		if got := h.Get("Location"); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.location, got, tc.want)
+		}
+	}
+}
+
+// useStoredHeaders applies --strip-stored-headers as the flag would, given
+// telling whether it was set explicitly
+func useStoredHeaders(t *testing.T, value string, given bool) {
+	t.Helper()
+	previous := stripStoredHeaders
+	t.Cleanup(func() { stripStoredHeaders = previous })
+	names, err := parseStoredHeaders(value, given)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripStoredHeaders = names
+}
+
+func TestHitsGetAFreshDate(t *testing.T) {
+	stored := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=7200")
+		w.Header().Set("Date", stored)
+		w.Header().Set("X-Request-ID", "origin-id")
+		w.Header().Set("X-Kept", "yes")
+		w.Write([]byte("body"))
+	})
+	useStoredHeaders(t, defaultStripStoredHeaders, false)
+
+	if rec := doRequest("GET", "/strip"); rec.Header().Get("Date") != stored {
+		t.Fatalf("miss Date %q, want the origin's %q", rec.Header().Get("Date"), stored)
+	}
+	e, ok := getEntry(t.Context(), keyFor("/strip"))
+	if !ok || e.Header.Get("Date") != "" || e.Header.Get("X-Request-Id") != "" || e.Header.Get("X-Kept") != "yes" {
+		t.Fatalf("stored headers %v", e.Header)
+	}
+	rec := doRequest("GET", "/strip")
+	date, err := http.ParseTime(rec.Header().Get("Date"))
+	if rec.Header().Get("X-Cache") != "HIT" || err != nil || time.Since(date) > 2*time.Second {
+		t.Fatalf("hit Date %q (%v), want the current time", rec.Header().Get("Date"), err)
+	}
+	if rec.Header().Get("Age") != "0" {
+		t.Fatalf("hit Age %q, want 0", rec.Header().Get("Age"))
+	}
+}
+
+func TestCacheSetCookieKeepsTheCookieOnHits(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Set-Cookie", "a=b")
+		w.Write([]byte("body"))
+	})
+	defer func(v bool) { cacheSetCookie = v }(cacheSetCookie)
+	cacheSetCookie = true
+	useStoredHeaders(t, defaultStripStoredHeaders, false)
+
+	doRequest("GET", "/cookie")
+	rec := doRequest("GET", "/cookie")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Set-Cookie") != "a=b" {
+		t.Fatalf("hit: X-Cache %q, Set-Cookie %q, want the cookie sent along", rec.Header().Get("X-Cache"), rec.Header().Get("Set-Cookie"))
+	}
+}
+
+func TestParseStoredHeaders(t *testing.T) {
+	defer func(v bool) { cacheSetCookie = v }(cacheSetCookie)
+	for _, tc := range []struct {
+		value     string
+		given, on bool
+		want      string
+		ok        bool
+	}{
+		{defaultStripStoredHeaders, false, false, "Date,X-Request-ID,Set-Cookie", true},
+		{defaultStripStoredHeaders, false, true, "Date,X-Request-ID", true},
+		{"Date, X-Trace", true, true, "Date,X-Trace", true},
+		{"Date,set-cookie", true, true, "", false},
+		{"Date,Set-Cookie", true, false, "Date,Set-Cookie", true},
+		{"", true, false, "", true},
+	} {
+		cacheSetCookie = tc.on
+		names, err := parseStoredHeaders(tc.value, tc.given)
+		if got := strings.Join(names, ","); (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%q given %v, --cache-set-cookie %v: %q, %v", tc.value, tc.given, tc.on, got, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// retryTransport sends an idempotent request up to originRetries more
+// times while the origin answers with a connection error or a 5xx, waiting
+// originRetryBackoff, doubled on each attempt and jittered, in between. the
+// last answer is returned whatever it is
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if originRetries <= 0 || !idempotent(req.Method) || !replayable(req) {
+		return resp, err
+	}
+
+	for attempt := 0; attempt < originRetries && retryable(resp, err); attempt++ {
+		wait := retryBackoff(attempt)
+		if err != nil {
+			slog.Warn("origin failed, retrying", "origin", req.URL.Host, "attempt", attempt+1, "wait", wait, "error", err)
+		} else {
+			slog.Warn("origin failed, retrying", "origin", req.URL.Host, "attempt", attempt+1, "wait", wait, "status", resp.StatusCode)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			if resp != nil {
+				return resp, nil
+			}
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			var berr error
+			if retry.Body, berr = req.GetBody(); berr != nil {
+				return nil, berr
+			}
+		}
+		resp, err = t.base.RoundTrip(retry)
+	}
+	return resp, err
+}
+
+// retryable reports whether the outcome of an origin request is worth
+// another try. refusals of our own making, like an open breaker or a host
+// we may not contact, would only fail again
+func retryable(resp *http.Response, err error) bool {
+	if errors.Is(err, errCircuitOpen) || errors.Is(err, errOriginForbidden) || errors.Is(err, errOriginBusy) {
+		return false
+	}
+	return needsFailover(resp, err)
+}
+
+// idempotent reports whether a request with method may be sent twice
+// without changing its effect (RFC 9110 9.2.2)
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryBackoff returns the wait before retry attempt+1: originRetryBackoff
+// doubled attempt times, with up to half of it taken off at random so the
+// retries of many requests don't line up
+func retryBackoff(attempt int) time.Duration {
+	d := originRetryBackoff << min(attempt, 16)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
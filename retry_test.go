@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOriginFailsOnceThenSucceeds(t *testing.T) {
+	var calls atomic.Int64
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 || r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	defer func(n int, d time.Duration) { originRetries, originRetryBackoff = n, d }(originRetries, originRetryBackoff)
+	originRetries, originRetryBackoff = 2, 5*time.Millisecond
+
+	if w := doRequest("GET", "/r"); w.Code != http.StatusOK || w.Body.String() != "ok" || hits.Load() != 2 {
+		t.Fatalf("%d %q after %d origin requests", w.Code, w.Body, hits.Load())
+	}
+
+	// a POST gets a single try
+	calls.Store(0)
+	if w := doRequest("POST", "/r"); w.Code != http.StatusBadGateway || hits.Load() != 3 {
+		t.Fatalf("POST: %d after %d origin requests", w.Code, hits.Load())
+	}
+
+	// the last answer is passed on once the retries run out
+	start := hits.Load()
+	if w := doRequest("GET", "/down"); w.Code != http.StatusBadGateway || hits.Load()-start != 3 {
+		t.Fatalf("%d after %d tries", w.Code, hits.Load()-start)
+	}
+}
+
+func TestDroppedConnectionIsRetried(t *testing.T) {
+	var calls atomic.Int64
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	defer func(n int, d time.Duration) { originRetries, originRetryBackoff = n, d }(originRetries, originRetryBackoff)
+	originRetries, originRetryBackoff = 1, time.Millisecond
+
+	if w := doRequest("GET", "/x"); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("%d %q", w.Code, w.Body)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("%d origin requests, want 2", calls.Load())
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(d time.Duration) { originRetryBackoff = d }(originRetryBackoff)
+	originRetryBackoff = 100 * time.Millisecond
+	for attempt := 0; attempt < 4; attempt++ {
+		full := originRetryBackoff << attempt
+		if d := retryBackoff(attempt); d < full/2 || d > full {
+			t.Errorf("attempt %d waits %v, want %v to %v", attempt, d, full/2, full)
+		}
+	}
+	for method, want := range map[string]bool{"GET": true, "PUT": true, "DELETE": true, "POST": false, "PATCH": false} {
+		if idempotent(method) != want {
+			t.Errorf("idempotent(%s) = %v", method, !want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExpiredEntryIsRevalidated(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	var conditional []http.Header
+	var bodies int
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("Cache-Control", "max-age=1")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional = append(conditional, r.Header.Clone())
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		bodies++
+		w.Write([]byte("body"))
+	})
+
+	doRequest("GET", "/e")
+	time.Sleep(1100 * time.Millisecond)
+	rec := doRequest("GET", "/e")
+	if rec.Code != http.StatusOK || rec.Body.String() != "body" || rec.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Fatalf("revalidation got %d %q %q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if len(conditional) != 1 || conditional[0].Get("If-Modified-Since") != lastModified {
+		t.Fatalf("conditional requests %v", conditional)
+	}
+	entry, ok := getEntry(t.Context(), keyFor("/e"))
+	if !ok || !entry.Expires.After(time.Now()) {
+		t.Fatalf("expiry not refreshed: %v", entry)
+	}
+	if rec := doRequest("GET", "/e"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "body" {
+		t.Fatalf("after revalidation got %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if bodies != 1 {
+		t.Fatalf("origin sent the body %d times", bodies)
+	}
+}
+
+func TestA304KeepsTheStoredBodyHeaders(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			// net/http drops the Content-Length of a 304, some origins send it
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\nCache-Control: max-age=60\r\n" +
+				"Content-Length: 0\r\nX-Version: 2\r\nConnection: close\r\n\r\n")
+			buf.Flush()
+			return
+		}
+		w.Header().Set("Content-Length", "4")
+		w.Header().Set("X-Version", "1")
+		w.Write([]byte("body"))
+	})
+	doRequest("GET", "/full")
+	if rec := doRequest("GET", "/full", "Cache-Control", "max-age=0"); rec.Header().Get("X-Cache") != "REVALIDATED" || rec.Body.String() != "body" {
+		t.Fatalf("revalidation got %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	rec := doRequest("GET", "/full")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "body" || rec.Header().Get("Content-Length") != "4" {
+		t.Fatalf("after the 304: %q %q, Content-Length %q", rec.Header().Get("X-Cache"), rec.Body.String(), rec.Header().Get("Content-Length"))
+	}
+	if rec.Header().Get("X-Version") != "2" {
+		t.Fatalf("the 304's headers weren't merged: X-Version %q", rec.Header().Get("X-Version"))
+	}
+}
+
+func TestUpdateStoredHeaders(t *testing.T) {
+	stored := http.Header{
+		"Content-Length":   {"4"},
+		"Content-Encoding": {"gzip"},
+		"Etag":             {`"v1"`},
+		"X-Kept":           {"a"},
+	}
+	updateStoredHeaders(stored, http.Header{
+		"Content-Length":    {"0"},
+		"Content-Encoding":  {"br"},
+		"Transfer-Encoding": {"chunked"},
+		"Connection":        {"X-Hop"},
+		"X-Hop":             {"1"},
+		"Etag":              {`"v2"`},
+		"Cache-Control":     {"max-age=30"},
+	})
+	want := http.Header{
+		"Content-Length":   {"4"},
+		"Content-Encoding": {"gzip"},
+		"Etag":             {`"v2"`},
+		"X-Kept":           {"a"},
+		"Cache-Control":    {"max-age=30"},
+	}
+	if len(stored) != len(want) {
+		t.Fatalf("headers %v, want %v", stored, want)
+	}
+	for name := range want {
+		if stored.Get(name) != want.Get(name) {
+			t.Fatalf("headers %v, want %v", stored, want)
+		}
+	}
+}
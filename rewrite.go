@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// rewriteURL applies --strip-prefix, --add-prefix,
+// --normalize-trailing-slash and --index-document to the path of u,
+// returning a copy. the client path is cleaned first, which also collapses
+// duplicate slashes, so a ../ in it can never reach above the origin root
+// or out of the added prefix. the rewrite works on the escaped path, so an
+// escaped slash such as %2F stays escaped on its way to the origin
+func rewriteURL(u *url.URL) *url.URL {
+	if stripPrefix == "" && addPrefix == "" && trailingSlash == "" && indexDocument == "" {
+		return u
+	}
+	rewritten := *u
+	p := normalizeTrailingSlash(cleanPath(u.EscapedPath()))
+	if strip := escapePath(stripPrefix); strip != "" && matchPrefix(p, strip) {
+		p = cleanPath(strings.TrimPrefix(p, strings.TrimSuffix(strip, "/")))
+	}
+	if addPrefix != "" && addPrefix != "/" {
+		p = strings.TrimSuffix(escapePath(addPrefix), "/") + p
+	}
+	// a directory is asked for its index document, under which it is
+	// cached too
+	if indexDocument != "" && strings.HasSuffix(p, "/") {
+		p += escapePath(indexDocument)
+	}
+	decoded, err := url.PathUnescape(p)
+	if err != nil {
+		decoded = p
+	}
+	rewritten.Path = decoded
+	rewritten.RawPath = ""
+	if rewritten.EscapedPath() != p {
+		rewritten.RawPath = p
+	}
+	return &rewritten
+}
+
+// escapePath returns p escaped the way it appears in a URL
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// cleanPath returns p as a rooted path with every . and .. resolved,
+// keeping a trailing slash
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// normalizeTrailingSlash strips or adds the trailing slash of p as
+// --normalize-trailing-slash asks. the root keeps its slash, and paths
+// whose last segment looks like a file name such as /app.js never get one
+func normalizeTrailingSlash(p string) string {
+	switch trailingSlash {
+	case "strip":
+		if p != "/" {
+			return strings.TrimSuffix(p, "/")
+		}
+	case "add":
+		if !strings.HasSuffix(p, "/") && !strings.Contains(path.Base(p), ".") {
+			return p + "/"
+		}
+	}
+	return p
+}
+
+// validateIndexDocument checks an --index-document value, a plain file name
+func validateIndexDocument(name string) error {
+	if strings.Contains(name, "/") || name == "." || name == ".." {
+		return errors.New("must be a file name such as index.html")
+	}
+	return nil
+}
+
+// validatePrefix checks a --strip-prefix or --add-prefix value
+func validatePrefix(prefix string) error {
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return errors.New("must start with /")
+	}
+	if strings.Contains(prefix, "..") {
+		return errors.New("must not contain ..")
+	}
+	return nil
+}
+
+// errBadPath is returned by checkPath for a path trying to escape the origin
+// root or hide a traversal from us
+var errBadPath = errors.New("invalid request path")
+
+// checkPath validates the client path of u before anything is built from
+// it, returning u with its . and .. segments resolved. a literal .. is
+// resolved as long as it stays under the root, and the escaped form is
+// cleaned too so what the origin sees matches what is cached. a path that
+// climbs above the root, that only becomes a traversal once decoded, like
+// ..%2F or %2e%2e/, that hides one behind a backslash or a second round of
+// escaping, or that holds control characters is an error
+func checkPath(u *url.URL) (*url.URL, error) {
+	if strings.ContainsFunc(u.Path, func(r rune) bool { return r < 0x20 || r == 0x7f }) {
+		return nil, errBadPath
+	}
+	// once decoded, and once more for origins that decode twice, no segment
+	// may be a .. unless the client wrote it plainly
+	twice, err := url.PathUnescape(u.Path)
+	if err != nil {
+		twice = u.Path
+	}
+	raw := u.EscapedPath()
+	if hasDotDot(u.Path) && !hasDotDot(raw) || hasDotDot(twice) && !hasDotDot(raw) {
+		return nil, errBadPath
+	}
+	if !hasDotSegment(raw) {
+		return u, nil
+	}
+	if climbsAboveRoot(raw) {
+		return nil, errBadPath
+	}
+	cleaned := cleanPath(raw)
+	decoded, err := url.PathUnescape(cleaned)
+	if err != nil {
+		return nil, errBadPath
+	}
+	checked := *u
+	checked.Path = decoded
+	checked.RawPath = ""
+	if checked.EscapedPath() != cleaned {
+		checked.RawPath = cleaned
+	}
+	return &checked, nil
+}
+
+// pathSegments splits p on slashes, and on backslashes which some servers
+// take for slashes too
+func pathSegments(p string) []string {
+	return strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' })
+}
+
+// hasDotDot reports whether a segment of p is ..
+func hasDotDot(p string) bool {
+	for _, segment := range pathSegments(p) {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDotSegment reports whether a segment of p is . or .. and needs
+// resolving
+func hasDotSegment(p string) bool {
+	for _, segment := range pathSegments(p) {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// climbsAboveRoot reports whether the .. segments of p go further up than
+// its other segments went down
+func climbsAboveRoot(p string) bool {
+	depth := 0
+	for _, segment := range pathSegments(p) {
+		switch segment {
+		case ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRewriteURL(t *testing.T) {
+	defer func() { stripPrefix, addPrefix = "", "" }()
+	for _, tc := range []struct{ strip, add, in, want string }{
+		{"/proxy/v1", "", "/proxy/v1/users", "/users"},
+		{"/proxy/v1", "", "/proxy/v1", "/"},
+		{"/proxy/v1", "", "/proxy/v10/x", "/proxy/v10/x"},
+		{"", "/api", "/users/", "/api/users/"},
+		{"/p", "/api", "/p/../../etc/passwd", "/api/etc/passwd"},
+		{"", "/api", "/../x", "/api/x"},
+		{"/proxy", "", "/proxy/files/a%2Fb", "/files/a%2Fb"},
+		{"", "/api", "/files/a%2Fb", "/api/files/a%2Fb"},
+		{"/proxy", "/api", "/proxy/a%20b", "/api/a%20b"},
+	} {
+		stripPrefix, addPrefix = tc.strip, tc.add
+		in, err := url.Parse(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rewriteURL(in).EscapedPath(); got != tc.want {
+			t.Errorf("strip %q add %q %s: %q, want %q", tc.strip, tc.add, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRewrittenPathIsForwardedAndCached(t *testing.T) {
+	var seen string
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.EscapedPath()
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	stripPrefix = "/proxy/v1"
+	defer func() { stripPrefix = "" }()
+	doRequest("GET", "/proxy/v1/users?id=1")
+	if seen != "/users" {
+		t.Fatalf("origin saw %q", seen)
+	}
+	if rec := doRequest("GET", "/users?id=1"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatal("cache key not built from the rewritten path")
+	}
+	doRequest("GET", "/proxy/v1/files/a%2Fb")
+	if seen != "/files/a%2Fb" {
+		t.Fatalf("origin saw %q, want the escaped slash kept", seen)
+	}
+}
+
+func TestNormalizeTrailingSlash(t *testing.T) {
+	defer func() { trailingSlash = "" }()
+	for _, tc := range []struct{ mode, in, want string }{
+		{"strip", "/a/", "/a"},
+		{"strip", "/", "/"},
+		{"add", "/b", "/b/"},
+		{"add", "/app.js", "/app.js"},
+		{"", "/c/", "/c/"},
+	} {
+		trailingSlash = tc.mode
+		if got := normalizeTrailingSlash(tc.in); got != tc.want {
+			t.Errorf("%q %s: %q, want %q", tc.mode, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestTrailingSlashesShareAnEntry(t *testing.T) {
+	var paths []string
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte("x"))
+	})
+	defer func() { trailingSlash = "" }()
+
+	trailingSlash = "strip"
+	doRequest("GET", "/a/")
+	if got := doRequest("GET", "/a").Header().Get("X-Cache"); got != "HIT" || hits.Load() != 1 || paths[0] != "/a" {
+		t.Fatalf("strip: X-Cache %q, origin saw %q", got, paths)
+	}
+	if got := doRequest("GET", "//a//").Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("duplicate slashes: X-Cache %q", got)
+	}
+
+	trailingSlash = "add"
+	doRequest("GET", "/b")
+	if got := doRequest("GET", "/b/").Header().Get("X-Cache"); got != "HIT" || paths[1] != "/b/" {
+		t.Fatalf("add: X-Cache %q, origin saw %q", got, paths)
+	}
+
+	// off by default, so strict origins see the path they were sent
+	trailingSlash = ""
+	doRequest("GET", "/c/")
+	if got := doRequest("GET", "/c").Header().Get("X-Cache"); got != "MISS" {
+		t.Fatalf("off: X-Cache %q", got)
+	}
+}
+
+func TestDirectoriesFetchTheIndexDocument(t *testing.T) {
+	var paths []string
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("page " + r.URL.Path))
+	})
+	defer func(name string) { indexDocument = name }(indexDocument)
+	indexDocument = "index.html"
+
+	if body := doRequest("GET", "/foo/").Body.String(); body != "page /foo/index.html" {
+		t.Fatalf("/foo/ answered %q, want the index document", body)
+	}
+	// the directory and its index document share one entry
+	if got := doRequest("GET", "/foo/index.html").Header().Get("X-Cache"); got != "HIT" || hits.Load() != 1 {
+		t.Fatalf("index document: X-Cache %q, origin hit %d times", got, hits.Load())
+	}
+	if e, _ := getEntry(t.Context(), keyFor("/foo/index.html")); e == nil {
+		t.Fatal("not cached under the index document")
+	}
+
+	doRequest("GET", "/")
+	doRequest("GET", "/foo/bar")
+	if paths[1] != "/index.html" || paths[2] != "/foo/bar" {
+		t.Fatalf("origin saw %q, want /index.html and /foo/bar left alone", paths)
+	}
+}
+
+func TestValidateIndexDocument(t *testing.T) {
+	for _, name := range []string{"a/b", ".."} {
+		if validateIndexDocument(name) == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+	for _, name := range []string{"", "index.htm"} {
+		if err := validateIndexDocument(name); err != nil {
+			t.Errorf("%q refused: %v", name, err)
+		}
+	}
+}
+
+// rawRequest sends target to the proxy exactly as written, without the
+// cleaning httptest.NewRequest would do
+func rawRequest(t *testing.T, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RequestURI, r.URL = target, u
+	rec := httptest.NewRecorder()
+	handleRequest(rec, r)
+	return rec
+}
+
+func TestTraversalPathsAreRejected(t *testing.T) {
+	var forwarded string
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.EscapedPath()
+		w.Write([]byte("ok"))
+	})
+	for _, bad := range []string{"/..%2Fetc/passwd", "/a/..%2F..%2Fsecret", "/%2e%2e/secret", "/a/%2E%2E/b", "/../secret", "/a/../../secret", "/%252e%252e/x", "/a/..%5Cb", "/a%00b"} {
+		forwarded = ""
+		if rec := rawRequest(t, bad); rec.Code != http.StatusBadRequest || forwarded != "" {
+			t.Errorf("%s: %d, forwarded %q", bad, rec.Code, forwarded)
+		}
+	}
+	// dot segments staying under the root are resolved
+	for target, want := range map[string]string{
+		"/a/../b":      "/b",
+		"/a/./b/../c":  "/a/c",
+		"/files/a%2Fb": "/files/a%2Fb",
+		"/x/../y%2Fz":  "/y%2Fz",
+		"/plain/path/": "/plain/path/",
+		"/dots...name": "/dots...name",
+	} {
+		forwarded = ""
+		if rec := rawRequest(t, target); rec.Code != http.StatusOK || forwarded != want {
+			t.Errorf("%s: %d, forwarded %q, want %q", target, rec.Code, forwarded, want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Router maps request path prefixes to origin servers. the longest matching
+// prefix wins and prefixes only match on path segment boundaries, so /api
+// matches /api and /api/users but not /apiv2
+type Router struct {
+	routes []route
+}
+
+type route struct {
+	prefix string
+	origin string
+}
+
+// Add registers origin for every path under prefix
+func (rt *Router) Add(prefix, origin string) {
+	rt.routes = append(rt.routes, route{prefix: prefix, origin: strings.TrimRight(origin, "/")})
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return len(rt.routes[i].prefix) > len(rt.routes[j].prefix)
+	})
+}
+
+// Origin returns the origin configured for path
+func (rt *Router) Origin(path string) (string, bool) {
+	_, origin, ok := rt.Route(path)
+	return origin, ok
+}
+
+// Route returns the prefix of the route path falls under and its origin
+func (rt *Router) Route(path string) (prefix, origin string, ok bool) {
+	for _, route := range rt.routes {
+		if matchPrefix(path, route.prefix) {
+			return route.prefix, route.origin, true
+		}
+	}
+	return "", "", false
+}
+
+// Origins returns the origin of every route
+func (rt *Router) Origins() []string {
+	var origins []string
+	for _, route := range rt.routes {
+		origins = append(origins, route.origin)
+	}
+	return origins
+}
+
+// Reports returns a routeReport naming every route and its origin
+func (rt *Router) Reports() []routeReport {
+	var reports []routeReport
+	for _, route := range rt.routes {
+		reports = append(reports, routeReport{Route: route.prefix, Origin: route.origin})
+	}
+	return reports
+}
+
+// Len returns the number of configured routes
+func (rt *Router) Len() int {
+	return len(rt.routes)
+}
+
+// String implements flag.Value
+func (rt *Router) String() string {
+	var parts []string
+	for _, route := range rt.routes {
+		parts = append(parts, route.prefix+"="+route.origin)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value, parsing one /prefix=http://origin route
+func (rt *Router) Set(value string) error {
+	prefix, origin, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || origin == "" {
+		return fmt.Errorf("route %q must look like /prefix=http://origin", value)
+	}
+	origin, err := parseOrigin(origin)
+	if err != nil {
+		return fmt.Errorf("route %q: %w", value, err)
+	}
+	rt.Add(prefix, origin)
+	return nil
+}
+
+// matchPrefix reports whether path is prefix or lies below it
+func matchPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
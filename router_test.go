@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestRouterLongestPrefix(t *testing.T) {
+	var rt Router
+	for _, value := range []string{
+		"/api=http://api:9000",
+		"/api/v2=http://api-v2:9000/",
+		"/img/=http://cdn:8000",
+	} {
+		if err := rt.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		path, origin string
+		ok           bool
+	}{
+		{"/api", "http://api:9000", true},
+		{"/api/users", "http://api:9000", true},
+		{"/api/v2", "http://api-v2:9000", true},
+		{"/api/v2/users", "http://api-v2:9000", true},
+		{"/api/v20", "http://api:9000", true},
+		{"/apiv2", "", false},
+		{"/img/logo.png", "http://cdn:8000", true},
+		{"/img", "", false},
+		{"/", "", false},
+	} {
+		origin, ok := rt.Origin(tc.path)
+		if origin != tc.origin || ok != tc.ok {
+			t.Errorf("%s: got %q %v, want %q %v", tc.path, origin, ok, tc.origin, tc.ok)
+		}
+	}
+}
+
+func TestRouterRejectsBadRoutes(t *testing.T) {
+	for _, value := range []string{"api=http://api", "/api", "/api=", "/api=ftp://api", "/api=http://"} {
+		var rt Router
+		if err := rt.Set(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+func TestRoutesHaveTheirOwnKeys(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("default")) })
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("api")) }))
+	defer api.Close()
+	router = Router{}
+	defer func() { router = Router{} }()
+	router.Add("/api", api.URL)
+
+	if rec := doRequest("GET", "/api/items"); rec.Body.String() != "api" {
+		t.Fatalf("routed request got %q", rec.Body.String())
+	}
+	if rec := doRequest("GET", "/items"); rec.Body.String() != "default" {
+		t.Fatalf("unrouted request got %q", rec.Body.String())
+	}
+	apiKey := cache.Key(http.MethodGet, api.URL+"/api/items")
+	if !mr.Exists(apiKey) || !mr.Exists(keyFor("/items")) {
+		t.Fatalf("keys %v", mr.Keys())
+	}
+}
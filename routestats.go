@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// routeStats counts hits, misses and errors for every --route prefix on
+// top of the totals in stats, keyed by prefix. requests for --origin
+// itself are counted under the empty prefix
+var routeStats = struct {
+	sync.Mutex
+	routes map[string]*cache.Stats
+}{routes: map[string]*cache.Stats{}}
+
+// statsFor returns the counters of the route r is for
+func statsFor(r *http.Request) *cache.Stats {
+	prefix, _, _ := router.Route(r.URL.Path)
+	routeStats.Lock()
+	defer routeStats.Unlock()
+	s, ok := routeStats.routes[prefix]
+	if !ok {
+		s = &cache.Stats{}
+		routeStats.routes[prefix] = s
+	}
+	return s
+}
+
+// countHit, countMiss and countError count a request in stats and in the
+// stats of its route
+func countHit(r *http.Request) {
+	stats.Hit()
+	statsFor(r).Hit()
+}
+
+func countMiss(r *http.Request) {
+	stats.Miss()
+	statsFor(r).Miss()
+}
+
+func countError(r *http.Request) {
+	stats.Error()
+	statsFor(r).Error()
+}
+
+// routeReport is one route of GET /_admin/routes. route is empty for
+// --origin and error says why the origin didn't answer when it isn't
+// reachable
+type routeReport struct {
+	Route     string  `json:"route"`
+	Origin    string  `json:"origin"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Errors    uint64  `json:"errors"`
+	HitRatio  float64 `json:"hit_ratio"`
+	Reachable bool    `json:"reachable"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// handleRoutes reports the counters of every route and of --origin, and
+// whether each origin answers a HEAD / right now, so a backend doing worse
+// than the others stands out. the origins are probed at the same time
+func handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	reports := router.Reports()
+	if originServer != "" {
+		reports = append(reports, routeReport{Origin: originServer})
+	}
+	client := &http.Client{
+		Transport: originProxy.Transport,
+		Timeout:   originTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var wg sync.WaitGroup
+	for i := range reports {
+		report := &reports[i]
+		routeStats.Lock()
+		s, ok := routeStats.routes[report.Route]
+		routeStats.Unlock()
+		if ok {
+			counts := s.Snapshot()
+			report.Hits, report.Misses, report.Errors = counts.Hits, counts.Misses, counts.Errors
+			report.HitRatio = counts.HitRatio()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := probeOrigin(client, report.Origin); err != nil {
+				report.Error = err.Error()
+				return
+			}
+			report.Reachable = true
+		}()
+	}
+	wg.Wait()
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Route < reports[j].Route })
+	writeJSON(w, http.StatusOK, reports)
+}
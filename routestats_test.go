@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// routeReports returns what /_admin/routes reports, by route
+func routeReports(t *testing.T) map[string]routeReport {
+	t.Helper()
+	rec := adminRequest(t, handleRoutes, "GET", "/_admin/routes")
+	var reports []routeReport
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &reports) != nil {
+		t.Fatalf("routes answered %d %q", rec.Code, rec.Body.String())
+	}
+	byRoute := map[string]routeReport{}
+	for _, report := range reports {
+		byRoute[report.Route] = report
+	}
+	return byRoute
+}
+
+func TestRoutesAreCountedIndependently(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("a"))
+	})
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("b"))
+	}))
+	defer b.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	defer func(r Router) { router = r }(router)
+	t.Cleanup(func() { routeStats.routes = map[string]*cache.Stats{} })
+	routeStats.routes = map[string]*cache.Stats{}
+	router = Router{}
+	router.Add("/a", originServer)
+	router.Add("/b", b.URL)
+	router.Add("/down", down.URL)
+
+	for range 3 {
+		doRequest("GET", "/a/x")
+		doRequest("GET", "/b/x")
+	}
+	doRequest("GET", "/down/x")
+
+	got := routeReports(t)
+	if a := got["/a"]; a.Hits != 2 || a.Misses != 1 || a.Errors != 0 || !a.Reachable {
+		t.Errorf("/a: %+v, want 2 hits and 1 miss", a)
+	}
+	if b := got["/b"]; b.Hits != 0 || b.Misses != 3 || !b.Reachable {
+		t.Errorf("/b: %+v, want 3 misses", b)
+	}
+	if d := got["/down"]; d.Misses != 1 || d.Errors != 1 || d.Reachable || d.Error == "" {
+		t.Errorf("/down: %+v, want an error and unreachable", d)
+	}
+	if o, ok := got[""]; !ok || o.Origin != originServer || o.Hits != 0 || o.Misses != 0 {
+		t.Errorf("--origin: %+v, want it listed without counts", o)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSetCookieResponsesAreNotStored(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: r.URL.Query().Get("u")})
+		w.Write([]byte("x"))
+	})
+	doRequest("GET", "/c?u=alice")
+	rec := doRequest("GET", "/c?u=alice")
+	if hits.Load() != 2 || rec.Header().Get("X-Cache") != "MISS" || rec.Header().Get("Set-Cookie") != "session=alice" {
+		t.Fatalf("%d origin requests, X-Cache %q, Set-Cookie %q", hits.Load(), rec.Header().Get("X-Cache"), rec.Header().Get("Set-Cookie"))
+	}
+	if mr.Exists(keyFor("/c?u=alice")) {
+		t.Fatal("a Set-Cookie response was stored")
+	}
+
+	defer func(v bool) { cacheSetCookie = v }(cacheSetCookie)
+	cacheSetCookie = true
+	doRequest("GET", "/s")
+	if rec := doRequest("GET", "/s"); hits.Load() != 3 || rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Set-Cookie") != "session=" {
+		t.Fatalf("with --cache-set-cookie: %d origin requests, X-Cache %q, Set-Cookie %q", hits.Load(), rec.Header().Get("X-Cache"), rec.Header().Get("Set-Cookie"))
+	}
+}
+
+func TestSetCookieIsNotSharedWithWaiters(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	sessions := 0
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sessions++
+		session := sessions
+		mu.Unlock()
+		if session == 1 {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: strconv.Itoa(session)})
+		w.Write([]byte("x"))
+	})
+
+	var wg sync.WaitGroup
+	var first, second *http.Response
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		first = doRequest("GET", "/login").Result()
+	}()
+	waitForWaiters(t, 1)
+	go func() {
+		defer wg.Done()
+		second = doRequest("GET", "/login").Result()
+	}()
+	waitForWaiters(t, 2)
+	close(release)
+	wg.Wait()
+
+	// the waiter fetched its own response rather than take the cookie
+	// meant for the first client
+	if hits.Load() != 2 || first.Header.Get("Set-Cookie") != "session=1" || second.Header.Get("Set-Cookie") != "session=2" {
+		t.Fatalf("%d origin requests, cookies %q and %q", hits.Load(), first.Header.Get("Set-Cookie"), second.Header.Get("Set-Cookie"))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// spoolBody reads the body of r ahead of forwarding it, with
+// --buffer-request-bodies, so a retry or a fallback origin can be sent the
+// same body again. up to --request-memory-bytes are kept in memory, a
+// larger body is written to a temporary file in --request-spill-dir and
+// read back from it for every attempt. cleanup removes that file once the
+// request is done and must always be called, err being nil
+func spoolBody(r *http.Request) (cleanup func(), err error) {
+	cleanup = func() {}
+	if r.Body == nil || r.Body == http.NoBody || r.GetBody != nil {
+		return cleanup, nil
+	}
+	defer r.Body.Close()
+	head, err := io.ReadAll(io.LimitReader(r.Body, requestMemoryBytes+1))
+	if err != nil {
+		return cleanup, err
+	}
+	if int64(len(head)) <= requestMemoryBytes {
+		r.ContentLength = int64(len(head))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(head)), nil
+		}
+		r.Body, _ = r.GetBody()
+		return cleanup, nil
+	}
+
+	f, err := os.CreateTemp(requestSpillDir, "proxy-body-*")
+	if err != nil {
+		return cleanup, err
+	}
+	name := f.Name()
+	// a copy the origin was never sent, as when the cache answered, is
+	// left open by the transport and closed here
+	var mu sync.Mutex
+	var opened []*os.File
+	cleanup = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, f := range opened {
+			f.Close()
+		}
+		os.Remove(name)
+	}
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(head), r.Body))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return func() {}, err
+	}
+	r.ContentLength = n
+	r.GetBody = func() (io.ReadCloser, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		opened = append(opened, f)
+		mu.Unlock()
+		return f, nil
+	}
+	if r.Body, err = r.GetBody(); err != nil {
+		cleanup()
+		return func() {}, err
+	}
+	return cleanup, nil
+}
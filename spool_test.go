@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// spoolOrigin fails the first attempt at every request so the body has to
+// be sent twice, noting whether a spill file was in dir while it was read
+type spoolOrigin struct {
+	dir      string
+	bodies   [][]byte
+	lengths  []int64
+	sawSpill bool
+}
+
+func (o *spoolOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	o.bodies = append(o.bodies, b)
+	o.lengths = append(o.lengths, r.ContentLength)
+	if entries, _ := os.ReadDir(o.dir); len(entries) == 1 {
+		o.sawSpill = true
+	}
+	if len(o.bodies)%2 == 1 {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// useSpooling turns on --buffer-request-bodies with 1 KiB in memory and one
+// origin retry
+func useSpooling(t *testing.T) *spoolOrigin {
+	o := &spoolOrigin{dir: t.TempDir()}
+	newTestProxy(t, o.ServeHTTP)
+	buffer, memory, dir := bufferRequestBodies, requestMemoryBytes, requestSpillDir
+	retries, backoff := originRetries, originRetryBackoff
+	t.Cleanup(func() {
+		bufferRequestBodies, requestMemoryBytes, requestSpillDir = buffer, memory, dir
+		originRetries, originRetryBackoff = retries, backoff
+	})
+	bufferRequestBodies, requestMemoryBytes, requestSpillDir = true, 1024, o.dir
+	originRetries, originRetryBackoff = 1, 0
+	return o
+}
+
+func TestLargeBodiesSpillToDiskAndAreReplayedIntact(t *testing.T) {
+	o := useSpooling(t)
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+
+	// an unknown length, so the body can only be sized by reading it
+	r := httptest.NewRequest("PUT", "/upload", io.NopCloser(bytes.NewReader(big)))
+	r.ContentLength = -1
+	rec := httptest.NewRecorder()
+	handleRequest(rec, r)
+	if rec.Code != http.StatusOK || len(o.bodies) != 2 {
+		t.Fatalf("answered %d after %d attempts, want 200 after 2", rec.Code, len(o.bodies))
+	}
+	for i, b := range o.bodies {
+		if !bytes.Equal(b, big) || o.lengths[i] != int64(len(big)) {
+			t.Fatalf("attempt %d got %d bytes with Content-Length %d, want %d", i, len(b), o.lengths[i], len(big))
+		}
+	}
+	if !o.sawSpill {
+		t.Fatal("a body over --request-memory-bytes was not spilled to disk")
+	}
+	if entries, _ := os.ReadDir(o.dir); len(entries) != 0 {
+		t.Fatalf("spill files left behind: %v", entries)
+	}
+}
+
+func TestSmallBodiesStayInMemory(t *testing.T) {
+	o := useSpooling(t)
+	// the spill directory doesn't exist, so touching the disk would fail
+	requestSpillDir = o.dir + "/missing"
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("PUT", "/upload", strings.NewReader("small")))
+	if rec.Code != http.StatusOK || len(o.bodies) != 2 || string(o.bodies[1]) != "small" {
+		t.Fatalf("answered %d, origin got %q", rec.Code, o.bodies)
+	}
+}
+
+func TestRequestMemoryBytesIsChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--request-memory-bytes=-1"); !strings.Contains(out, "Error: --request-memory-bytes must not be negative") {
+		t.Fatal(out)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEventStreamsArriveIncrementally(t *testing.T) {
+	release := make(chan struct{})
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "data: two\n\n")
+	})
+	proxy := httptest.NewServer(http.HandlerFunc(handleRequest))
+	defer proxy.Close()
+	resp, err := http.Get(proxy.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+		close(lines)
+	}()
+	// the origin holds the second event back until the first has arrived
+	select {
+	case line := <-lines:
+		if line != "data: one" {
+			t.Fatalf("first line %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first event not delivered before the stream ended")
+	}
+	close(release)
+	var rest []string
+	for line := range lines {
+		if line != "" {
+			rest = append(rest, line)
+		}
+	}
+	if len(rest) != 1 || rest[0] != "data: two" {
+		t.Fatalf("rest of the stream %q", rest)
+	}
+	if len(mr.Keys()) != 0 {
+		t.Fatalf("event stream was cached: %v", mr.Keys())
+	}
+}
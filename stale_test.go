@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaleIfError(t *testing.T) {
+	fail := false
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Write([]byte("good"))
+	})
+	staleIfError = time.Hour
+	defer func() { staleIfError = 0 }()
+	doRequest("GET", "/sie")
+	time.Sleep(1100 * time.Millisecond)
+	fail = true
+	buf := captureLog(t)
+	rec := doRequest("GET", "/sie")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "STALE-ERROR" || rec.Body.String() != "good" {
+		t.Fatalf("failing origin: %d %q %q", rec.Code, rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if !strings.Contains(buf.String(), `"level":"WARN","msg":"origin failed, serving stale entry"`) {
+		t.Fatalf("no warning logged: %s", buf)
+	}
+
+	// past the window the error goes through
+	staleIfError = time.Millisecond
+	if rec := doRequest("GET", "/sie"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("entry too stale: %d", rec.Code)
+	}
+}
+
+func TestStaleIfErrorUnreachable(t *testing.T) {
+	fail := false
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=1, stale-if-error=60")
+		w.Write([]byte("good"))
+	})
+	doRequest("GET", "/u")
+	time.Sleep(1100 * time.Millisecond)
+	fail = true
+	rec := doRequest("GET", "/u")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "STALE-ERROR" {
+		t.Fatalf("unreachable origin: %d %q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestStaleResponsesCarryWarnings(t *testing.T) {
+	fail := false
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path == "/swr" {
+			w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=30")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=1, stale-if-error=60")
+		}
+		w.Write([]byte("x"))
+	})
+	if rec := doRequest("GET", "/swr"); len(rec.Header().Values("Warning")) != 0 {
+		t.Fatalf("fresh response warns %q", rec.Header().Values("Warning"))
+	}
+	doRequest("GET", "/sie")
+	time.Sleep(1100 * time.Millisecond)
+
+	rec := doRequest("GET", "/swr")
+	if rec.Header().Get("X-Cache") != "STALE" || !slices.Equal(rec.Header().Values("Warning"), []string{`110 - "Response is Stale"`}) {
+		t.Fatalf("X-Cache %q, Warning %q", rec.Header().Get("X-Cache"), rec.Header().Values("Warning"))
+	}
+	fail = true
+	rec = doRequest("GET", "/sie")
+	if rec.Header().Get("X-Cache") != "STALE-ERROR" || !slices.Equal(rec.Header().Values("Warning"), []string{`110 - "Response is Stale"`, `111 - "Revalidation Failed"`}) {
+		t.Fatalf("X-Cache %q, Warning %q", rec.Header().Get("X-Cache"), rec.Header().Values("Warning"))
+	}
+	// let the background revalidation of /swr finish
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestMustRevalidateEntriesAreNeverServedStale(t *testing.T) {
+	fail := false
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		cc := "max-age=0, stale-if-error=600, stale-while-revalidate=600"
+		if r.URL.Path != "/loose" {
+			cc += ", must-revalidate"
+		}
+		w.Header().Set("Cache-Control", cc)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("body"))
+	})
+	defer func(fallback bool, status int) { errorPageFallback, offlineStatus = fallback, status }(errorPageFallback, offlineStatus)
+	defer offlineMode.Store(false)
+
+	doRequest("GET", "/strict")
+	doRequest("GET", "/loose")
+	if e, _ := getEntry(t.Context(), keyFor("/strict")); e == nil || !e.MustRevalidate {
+		t.Fatal("must-revalidate not recorded with the entry")
+	}
+	fail = true
+	// without it the stale entry stands in for the failing origin
+	if rec := doRequest("GET", "/loose"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") == "MISS" {
+		t.Fatalf("without must-revalidate: %d, X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	for i := 0; i < 3; i++ {
+		if rec := doRequest("GET", "/strict"); rec.Code != http.StatusBadGateway || rec.Body.String() == "body" {
+			t.Fatalf("served stale: %d, X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+		}
+	}
+	errorPageFallback = true
+	if rec := doRequest("GET", "/strict"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("--error-page-fallback served stale: %d", rec.Code)
+	}
+	offlineMode.Store(true)
+	offlineStatus = http.StatusServiceUnavailable
+	if rec := doRequest("GET", "/strict"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("--offline-mode served stale: %d", rec.Code)
+	}
+
+	offlineMode.Store(false)
+	fail = false
+	if rec := doRequest("GET", "/strict"); rec.Code != http.StatusOK || rec.Body.String() != "body" {
+		t.Fatalf("after revalidating: %d %q", rec.Code, rec.Body.String())
+	}
+}
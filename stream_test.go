@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+// countingWriter is a ResponseWriter that keeps only how much was written
+type countingWriter struct {
+	header http.Header
+	status int
+	n      int64
+}
+
+func (w *countingWriter) Header() http.Header { return w.header }
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestLargeBodiesStreamThrough(t *testing.T) {
+	const size = 64 << 20
+	chunk := bytes.Repeat([]byte("a"), 32<<10)
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		for written := 0; written < size; written += len(chunk) {
+			w.Write(chunk)
+		}
+	})
+	maxCacheableBytes = 1 << 20
+	defer func() { maxCacheableBytes = 10 << 20 }()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	w := &countingWriter{header: http.Header{}}
+	handleRequest(w, httptest.NewRequest("GET", "/big", nil))
+	runtime.ReadMemStats(&after)
+
+	if w.n != size {
+		t.Fatalf("client got %d bytes, want %d", w.n, size)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Fatalf("proxying %d bytes allocated %d", size, allocated)
+	}
+	if len(mr.Keys()) != 0 {
+		t.Fatalf("oversized response stored: %v", mr.Keys())
+	}
+}
+
+func TestBodiesUnderTheLimitAreCached(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 1000))
+	})
+	maxCacheableBytes = 1000
+	defer func() { maxCacheableBytes = 10 << 20 }()
+
+	if rec := doRequest("GET", "/small"); rec.Body.Len() != 1000 || !mr.Exists(keyFor("/small")) {
+		t.Fatalf("got %d bytes, keys %v", rec.Body.Len(), mr.Keys())
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var served atomic.Int64
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		n := served.Add(1)
+		if n > 1 {
+			// keep the refresh running while the stale hits below come in
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=30")
+		w.Write([]byte("v" + strconv.FormatInt(n, 10)))
+	})
+	doRequest("GET", "/swr")
+	time.Sleep(1100 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			rec := doRequest("GET", "/swr")
+			if rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != "v1" {
+				t.Errorf("stale hit got %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+			}
+			if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+				t.Errorf("stale hit took %s", elapsed)
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec := doRequest("GET", "/swr")
+		if rec.Body.String() == "v2" && rec.Header().Get("X-Cache") == "HIT" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cache not refreshed: %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// let the refresh finish storing before the next test
+	for inflightCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("origin hit %d times, want one refresh", hits.Load())
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// serverCerts holds the --tls-cert certificate clients are served. main
+// loads it at startup so a bad certificate stops the proxy right away
+var serverCerts *certReloader
+
+// certReloader serves a certificate and its key from disk, reading them
+// again on reload so a renewed certificate is picked up without dropping a
+// single connection
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertReloader loads the certificate in certFile and keyFile
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the certificate again. when that fails the one already
+// loaded stays in use
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+// getCertificate is the tls.Config hook handing out the current certificate
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// reloadOnHangup reloads certs on every SIGHUP, for certificate rotation
+func reloadOnHangup(certs *certReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := certs.reload(); err != nil {
+			slog.Error("TLS certificate reload failed, keeping the current one", "error", err)
+			continue
+		}
+		slog.Info("TLS certificate reloaded", "cert", certs.certFile)
+	}
+}
+
+// serveTLS accepts HTTPS connections on ln with serverCerts, loading them
+// first when main hasn't
+func serveTLS(server *http.Server, ln net.Listener) error {
+	certs := serverCerts
+	if certs == nil {
+		var err error
+		if certs, err = newCertReloader(tlsCertFile, tlsKeyFile); err != nil {
+			return err
+		}
+	}
+	server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+	return server.ServeTLS(ln, "", "")
+}
+
+// redirectToHTTPS sends plain HTTP requests arriving on --https-redirect
+// to the same URL over HTTPS on the proxy's port, httpsAddr. a 308 keeps
+// the method and body of the request
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
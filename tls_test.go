@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tlsOrigin starts an https origin and writes its certificate to a PEM
+// file, returning the file's path
+func tlsOrigin(t *testing.T) string {
+	t.Helper()
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	t.Cleanup(origin.Close)
+	originServer = origin.URL
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: origin.Certificate().Raw}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return caFile
+}
+
+// useOriginTLS sends origin requests with the TLS settings of --origin-ca-file
+// and --origin-insecure-skip-verify until the test ends
+func useOriginTLS(t *testing.T, caFile string, insecure bool) {
+	t.Helper()
+	cfg, err := originTLSConfig(caFile, insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := originProxy
+	originProxy = newOriginProxy(newOriginTransport(0, cfg))
+	t.Cleanup(func() { originProxy = previous })
+}
+
+func TestOriginCAFile(t *testing.T) {
+	caFile := tlsOrigin(t)
+	useOriginTLS(t, caFile, false)
+	if rec := doRequest("GET", "/tls"); rec.Code != http.StatusOK || rec.Body.String() != "secure" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUntrustedOriginCertificate(t *testing.T) {
+	tlsOrigin(t)
+	defer func(p *httputil.ReverseProxy) { originProxy = p }(originProxy)
+	originProxy = newOriginProxy(newOriginTransport(0, nil))
+	if rec := doRequest("GET", "/tls"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("self-signed origin got %d, want 502", rec.Code)
+	}
+}
+
+func TestOriginInsecureSkipVerify(t *testing.T) {
+	tlsOrigin(t)
+	useOriginTLS(t, "", true)
+	if rec := doRequest("GET", "/tls"); rec.Code != http.StatusOK {
+		t.Fatalf("got %d", rec.Code)
+	}
+}
+
+func TestOriginTLSConfigErrors(t *testing.T) {
+	caFile := tlsOrigin(t)
+	notPEM := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+	for _, tc := range []struct {
+		caFile   string
+		insecure bool
+	}{
+		{caFile, true},
+		{notPEM, false},
+		{filepath.Join(t.TempDir(), "missing.pem"), false},
+	} {
+		if _, err := originTLSConfig(tc.caFile, tc.insecure); err == nil {
+			t.Errorf("%s insecure=%v accepted", tc.caFile, tc.insecure)
+		}
+	}
+}
+
+// certPool returns a pool trusting the certificate in certFile
+func certPool(t *testing.T, certFile string) *x509.CertPool {
+	t.Helper()
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(data)
+	return pool
+}
+
+// servedCert returns the certificate the server at addr presents
+func servedCert(t *testing.T, addr string, pool *x509.CertPool) *x509.Certificate {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestHTTPSClientConnectsAndCertificatesReload(t *testing.T) {
+	defer func(cert, key string, certs *certReloader) { tlsCertFile, tlsKeyFile, serverCerts = cert, key, certs }(tlsCertFile, tlsKeyFile, serverCerts)
+	certFile, keyFile := writeTestCert(t)
+	tlsCertFile, tlsKeyFile = certFile, keyFile
+	var err error
+	serverCerts, err = newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go reloadOnHangup(serverCerts)
+	addr := startServer(t)
+
+	pool := certPool(t, certFile)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	first := servedCert(t, addr, pool)
+
+	// rotate the files in place and signal
+	newCert, newKey := writeTestCert(t)
+	for src, dst := range map[string]string{newCert: certFile, newKey: keyFile} {
+		data, _ := os.ReadFile(src)
+		os.WriteFile(dst, data, 0o600)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	time.Sleep(200 * time.Millisecond)
+	pool2 := certPool(t, certFile)
+	second := servedCert(t, addr, pool2)
+	if first.Equal(second) {
+		t.Fatal("certificate not reloaded on SIGHUP")
+	}
+
+	// a broken file keeps the current certificate
+	os.WriteFile(certFile, []byte("junk"), 0o600)
+	if err := serverCerts.reload(); err == nil {
+		t.Fatal("a broken certificate file was loaded")
+	}
+	if !servedCert(t, addr, pool2).Equal(second) {
+		t.Fatal("a failed reload dropped the certificate")
+	}
+}
+
+func TestHTTPSRedirectKeepsTheTarget(t *testing.T) {
+	for addr, want := range map[string]string{":8443": "https://example.com:8443/a?b=1", ":443": "https://example.com/a?b=1"} {
+		rec := httptest.NewRecorder()
+		redirectToHTTPS(addr).ServeHTTP(rec, httptest.NewRequest("POST", "http://example.com:8080/a?b=1", nil))
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != want {
+			t.Errorf("%s: %d, Location %q, want %q", addr, rec.Code, rec.Header().Get("Location"), want)
+		}
+	}
+}
+
+func TestHTTPSRedirectNeedsTLS(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--https-redirect=:8080"); !strings.Contains(out, "Error: --https-redirect needs --tls-cert") {
+		t.Fatal(out)
+	}
+}
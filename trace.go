@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// cacheTraceHeader asks for, and then carries, the list of caching
+// decisions made for a request
+const cacheTraceHeader = "X-Cache-Trace"
+
+// cacheTrace collects the caching decisions made for one request. the
+// zero value of its pointer records nothing, so untraced requests pay for
+// a nil check only
+type cacheTrace struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+type cacheTraceKey struct{}
+
+// withCacheTrace starts a trace for r when it sends X-Cache-Trace and
+// traces are allowed for everybody with --cache-trace or r is an admin
+// request
+func withCacheTrace(r *http.Request) *http.Request {
+	if r.Header.Get(cacheTraceHeader) == "" || (!allowCacheTrace && !adminAuthorized(r)) {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), cacheTraceKey{}, &cacheTrace{}))
+}
+
+// traceOf returns the trace of r, nil when it isn't traced
+func traceOf(r *http.Request) *cacheTrace {
+	trace, _ := r.Context().Value(cacheTraceKey{}).(*cacheTrace)
+	return trace
+}
+
+// add records one decision
+func (t *cacheTrace) add(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, fmt.Sprintf(format, args...))
+}
+
+// setHeader puts the decisions so far in the X-Cache-Trace header of h
+func (t *cacheTrace) setHeader(h http.Header) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h.Set(cacheTraceHeader, strings.Join(t.steps, "; "))
+}
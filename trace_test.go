@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func traceOrigin(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/secret" {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", "max-age=60")
+	}
+	w.Write([]byte("x"))
+}
+
+func TestCacheTraceExplainsNoStore(t *testing.T) {
+	newTestProxy(t, traceOrigin)
+	defer func(v bool) { allowCacheTrace = v }(allowCacheTrace)
+	allowCacheTrace = true
+
+	trace := doRequest("GET", "/secret", cacheTraceHeader, "1").Header().Get(cacheTraceHeader)
+	for _, want := range []string{"method GET cacheable", "key ", "lookup miss", `Cache-Control "no-store"`, "not stored: origin sent no-store"} {
+		if !strings.Contains(trace, want) {
+			t.Errorf("trace %q lacks %q", trace, want)
+		}
+	}
+	if w := doRequest("GET", "/secret"); w.Header().Get(cacheTraceHeader) != "" {
+		t.Fatal("traced a request that didn't ask")
+	}
+
+	doRequest("GET", "/ok")
+	if trace := doRequest("GET", "/ok", cacheTraceHeader, "1").Header().Get(cacheTraceHeader); !strings.Contains(trace, "lookup fresh") {
+		t.Errorf("hit trace %q", trace)
+	}
+	if trace := doRequest("POST", "/ok", cacheTraceHeader, "1").Header().Get(cacheTraceHeader); !strings.Contains(trace, "method POST not cacheable") {
+		t.Errorf("POST trace %q", trace)
+	}
+}
+
+func TestCacheTraceIsForAdminsByDefault(t *testing.T) {
+	newTestProxy(t, traceOrigin)
+	if w := doRequest("GET", "/secret", cacheTraceHeader, "1"); w.Header().Get(cacheTraceHeader) != "" {
+		t.Fatalf("traced for an ordinary client: %q", w.Header().Get(cacheTraceHeader))
+	}
+
+	defer func(s string) { adminSecret = s }(adminSecret)
+	adminSecret = testAdminSecret
+	w := doRequest("GET", "/secret", cacheTraceHeader, "1", adminSecretHeader, testAdminSecret)
+	if !strings.Contains(w.Header().Get(cacheTraceHeader), "not stored") {
+		t.Fatalf("admin trace %q", w.Header().Get(cacheTraceHeader))
+	}
+}
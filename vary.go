@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+// varyHeaders returns the request header names listed in the Vary response
+// header, canonicalized and sorted. ok is false for Vary: *, which must
+// never be cached
+func varyHeaders(h http.Header) (names []string, ok bool) {
+	seen := map[string]bool{}
+	for _, value := range h.Values("Vary") {
+		for _, name := range splitList(value) {
+			if name == "*" {
+				return nil, false
+			}
+			name = http.CanonicalHeaderKey(name)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// without returns names minus name
+func without(names []string, name string) []string {
+	var kept []string
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// xCacheValue returns the X-Cache of a response served from entry. with
+// --expose-variant a varying response adds ;v= and the first 8 hex digits
+// of the SHA-256 of what its variant key adds to key, so two clients can
+// tell they were served different variants
+func xCacheValue(r *http.Request, key string, entry *cache.Entry, status string) string {
+	if !exposeVariant || len(entry.Vary) == 0 {
+		return status
+	}
+	variant := strings.TrimPrefix(cache.VariantKey(key, entry.Vary, r.Header), key)
+	sum := sha256.Sum256([]byte(variant))
+	return status + ";v=" + hex.EncodeToString(sum[:4])
+}
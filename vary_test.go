@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestVaryKeepsARepresentationPerHeader(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, "hello in "+r.Header.Get("Accept-Language"))
+	})
+	doRequest("GET", "/greeting", "Accept-Language", "en")
+	doRequest("GET", "/greeting", "Accept-Language", "fr")
+	for _, lang := range []string{"en", "fr"} {
+		rec := doRequest("GET", "/greeting", "Accept-Language", lang)
+		if rec.Body.String() != "hello in "+lang || rec.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("%s: %q %q", lang, rec.Body.String(), rec.Header().Get("X-Cache"))
+		}
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("%d origin requests", hits.Load())
+	}
+}
+
+func TestVaryStarIsNotStored(t *testing.T) {
+	mr, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "*")
+		io.WriteString(w, "x")
+	})
+	doRequest("GET", "/anything")
+	if len(mr.Keys()) != 0 {
+		t.Fatalf("keys %v", mr.Keys())
+	}
+}
+
+func TestEquivalentAcceptEncodingsShareAnEntry(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write([]byte("png"))
+	})
+	for _, class := range []struct {
+		name    string
+		headers []string
+	}{
+		{"gzip", []string{"gzip, deflate", "deflate, gzip", "gzip;q=1.0, deflate;q=0.5", "deflate,gzip,"}},
+		{"br", []string{"br, gzip", "gzip, br;q=0.9"}},
+		{"identity", []string{"", "identity", "gzip;q=0, deflate"}},
+	} {
+		before := hits.Load()
+		for _, ae := range class.headers {
+			if ae == "" {
+				doRequest("GET", "/img")
+			} else {
+				doRequest("GET", "/img", "Accept-Encoding", ae)
+			}
+		}
+		if n := hits.Load() - before; n != 1 {
+			t.Errorf("%s clients fetched %d times, want 1", class.name, n)
+		}
+	}
+}
+
+func TestVaryCookiesKeepsAnEntryPerCookieValue(t *testing.T) {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		lang := "none"
+		if c, err := r.Cookie("lang"); err == nil {
+			lang = c.Value
+		}
+		w.Write([]byte(lang))
+	})
+	defer func(names []string) { varyCookies = names }(varyCookies)
+	varyCookies = []string{"lang", "theme"}
+
+	for _, tc := range []struct {
+		cookie, body string
+		hits         int64
+	}{
+		{"lang=en; session=a", "en", 1},
+		{"lang=de; session=a", "de", 2},
+		{"session=b; lang=en", "en", 2},
+		{"lang=en; theme=dark", "en", 3},
+		{"", "none", 4},
+		{"session=c", "none", 4},
+		{"lang=", "", 5},
+	} {
+		rec := doRequest("GET", "/vc", "Cookie", tc.cookie)
+		if rec.Body.String() != tc.body || hits.Load() != tc.hits {
+			t.Fatalf("Cookie %q: body %q after %d origin requests, want %q after %d", tc.cookie, rec.Body.String(), hits.Load(), tc.body, tc.hits)
+		}
+	}
+}
+
+// negotiatingOrigin answers JSON to clients accepting it and XML otherwise,
+// saying Vary: Accept unless silent
+func negotiatingOrigin(t *testing.T, silent bool) *atomic.Int64 {
+	_, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if !silent {
+			w.Header().Set("Vary", "Accept")
+		}
+		if strings.Contains(r.Header.Get("Accept"), "json") {
+			w.Write([]byte(`{"a":1}`))
+			return
+		}
+		w.Write([]byte("<a>1</a>"))
+	})
+	return hits
+}
+
+// checkAcceptVariants sends requests with Accept headers that normalize to
+// two representations, checking each gets its own entry
+func checkAcceptVariants(t *testing.T, hits *atomic.Int64) {
+	t.Helper()
+	for _, tc := range []struct {
+		accept, body string
+		hits         int64
+	}{
+		{"application/json", `{"a":1}`, 1},
+		{"application/xml", "<a>1</a>", 2},
+		{"application/json;q=0.9", `{"a":1}`, 2},
+		{"application/xml, text/html;q=0.5", "<a>1</a>", 3},
+		{"TEXT/HTML ; q=1,application/xml", "<a>1</a>", 3},
+		{"application/xml", "<a>1</a>", 3},
+	} {
+		rec := doRequest("GET", "/neg", "Accept", tc.accept)
+		if rec.Body.String() != tc.body || hits.Load() != tc.hits {
+			t.Fatalf("Accept %q: body %q after %d origin requests, want %q after %d", tc.accept, rec.Body.String(), hits.Load(), tc.body, tc.hits)
+		}
+	}
+}
+
+func TestVaryAcceptKeepsAnEntryPerRepresentation(t *testing.T) {
+	checkAcceptVariants(t, negotiatingOrigin(t, false))
+}
+
+func TestVaryAcceptFlagWithoutTheOriginsVary(t *testing.T) {
+	hits := negotiatingOrigin(t, true)
+	defer func(on bool) { varyAccept = on }(varyAccept)
+	varyAccept = true
+	checkAcceptVariants(t, hits)
+}
+
+func TestExposeVariantTellsVariantsApart(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/vl" {
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+	defer func(on bool) { exposeVariant = on }(exposeVariant)
+	exposeVariant = true
+
+	variant := func(accept string) (result, hash string) {
+		result, hash, _ = strings.Cut(doRequest("GET", "/vl", "Accept-Language", accept).Header().Get("X-Cache"), ";v=")
+		return result, hash
+	}
+	missResult, missEN := variant("en")
+	hitResult, en := variant("en")
+	_, deMiss := variant("de")
+	_, de := variant("de")
+	if missResult != "MISS" || hitResult != "HIT" || len(en) != 8 {
+		t.Fatalf("X-Cache %s;v=%s then %s;v=%s, want a MISS and a HIT with 8 hex digits", missResult, missEN, hitResult, en)
+	}
+	if missEN != en || deMiss != de {
+		t.Fatalf("one variant got %q and %q, %q and %q", missEN, en, deMiss, de)
+	}
+	if en == de {
+		t.Fatalf("en and de share the variant hash %q", en)
+	}
+
+	// without Vary there is no variant to tell
+	doRequest("GET", "/plain")
+	if got := doRequest("GET", "/plain").Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("without Vary X-Cache %q, want HIT", got)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/avii09/proxy_server/cache"
+)
+
+func TestBumpingTheVersionMisses(t *testing.T) {
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("x"))
+	})
+	defer func() { cache.Version = "" }()
+	cache.Version = "1"
+	doRequest("GET", "/v")
+	if rec := doRequest("GET", "/v"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache %q under an unchanged version", rec.Header().Get("X-Cache"))
+	}
+	cache.Version = "2"
+	if rec := doRequest("GET", "/v"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("X-Cache %q after the version changed", rec.Header().Get("X-Cache"))
+	}
+
+	rec := adminRequest(t, handleVersion, "GET", "/_admin/version")
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"version":"2"}`+"\n" {
+		t.Fatalf("version endpoint: %d %s", rec.Code, rec.Body.String())
+	}
+}
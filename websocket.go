@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isWebSocket reports whether r is a WebSocket handshake, asking to upgrade
+// its connection with Connection: Upgrade and Upgrade: websocket
+func isWebSocket(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		headerHasToken(r.Header, "Connection", "upgrade") &&
+		headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken reports whether the comma-separated values of header name
+// include token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tunnelWebSocket hands a WebSocket handshake to the origin, bypassing the
+// cache. once the origin switches protocols originProxy hijacks the client
+// connection and copies both directions until either side closes it. the
+// server's read and write timeouts are meant for requests, not for a
+// connection that may stay open for hours, so they are lifted first
+func tunnelWebSocket(w http.ResponseWriter, r *http.Request, targetURL string) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	passThrough(w, r, targetURL, "BYPASS")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebSocketEchoThroughTheProxy(t *testing.T) {
+	mr, hits := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.URL.Path != "/ws" {
+			http.Error(w, "no upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		// echo lines until told to hang up
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil || line == "bye\n" {
+				return
+			}
+			brw.WriteString(line)
+			brw.Flush()
+		}
+	})
+	proxy := httptest.NewUnstartedServer(withRequestLog(http.HandlerFunc(handleRequest)))
+	proxy.Config.WriteTimeout = 200 * time.Millisecond
+	proxy.Start()
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake got %s", resp.Status)
+	}
+
+	// past the write timeout the tunnel still works
+	time.Sleep(300 * time.Millisecond)
+	for _, msg := range []string{"hello\n", "again\n"} {
+		io.WriteString(conn, msg)
+		if line, err := br.ReadString('\n'); err != nil || line != msg {
+			t.Fatalf("echo %q, %v, want %q", line, err, msg)
+		}
+	}
+
+	// the origin hanging up closes the client's side too
+	io.WriteString(conn, "bye\n")
+	if _, err := br.ReadString('\n'); err != io.EOF {
+		t.Fatalf("after the origin closed: %v, want EOF", err)
+	}
+	if hits.Load() != 1 || len(mr.Keys()) != 0 {
+		t.Fatalf("%d origin requests, keys %v", hits.Load(), mr.Keys())
+	}
+}
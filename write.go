@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+)
+
+// writeBody writes a cached body to a client --write-chunk-bytes at a time,
+// flushing after each chunk, so a slow client drains the writer's buffer
+// as it goes rather than receiving one write of the whole body. writing
+// stops as soon as the request is cancelled or a write fails, the client
+// having gone away, without pushing the rest of the body at it
+func writeBody(w http.ResponseWriter, r *http.Request, body []byte) error {
+	flusher, _ := w.(http.Flusher)
+	for len(body) > 0 {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		n := min(len(body), writeChunkBytes)
+		if _, err := w.Write(body[:n]); err != nil {
+			return err
+		}
+		body = body[n:]
+		if flusher != nil && len(body) > 0 {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
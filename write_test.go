@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowWriter takes a while over every write, like a client reading
+// slowly, and calls cancel on its second write
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	writes, flushes int
+	cancel          func()
+}
+
+func (s *slowWriter) Write(b []byte) (int, error) {
+	s.writes++
+	time.Sleep(5 * time.Millisecond)
+	if s.writes == 2 {
+		s.cancel()
+	}
+	return s.ResponseRecorder.Write(b)
+}
+
+func (s *slowWriter) Flush() { s.flushes++ }
+
+// bigOrigin serves a 1 MiB cacheable body
+func bigOrigin(t *testing.T) []byte {
+	big := bytes.Repeat([]byte("x"), 1<<20)
+	newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(big)
+	})
+	if rec := doRequest("GET", "/big"); rec.Body.Len() != len(big) {
+		t.Fatalf("filling the cache got %d bytes", rec.Body.Len())
+	}
+	return big
+}
+
+func TestCancelledClientStopsACachedWrite(t *testing.T) {
+	bigOrigin(t)
+	defer func(n int) { writeChunkBytes = n }(writeChunkBytes)
+	writeChunkBytes = 4 << 10
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sw := &slowWriter{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+	start := time.Now()
+	handleRequest(sw, httptest.NewRequest("GET", "/big", nil).WithContext(ctx))
+	if got := sw.Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("X-Cache %q, want HIT", got)
+	}
+	// the chunk in flight when the client went away is the last one
+	if sw.writes != 2 || sw.Body.Len() != 8<<10 || sw.flushes != 2 {
+		t.Fatalf("wrote %d bytes in %d writes with %d flushes, want 8 KiB in 2", sw.Body.Len(), sw.writes, sw.flushes)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("cancelled write took %v", took)
+	}
+}
+
+func TestCachedBodiesAreWrittenInFlushedChunks(t *testing.T) {
+	big := bigOrigin(t)
+	defer func(n int) { writeChunkBytes = n }(writeChunkBytes)
+	writeChunkBytes = 256 << 10
+
+	sw := &slowWriter{ResponseRecorder: httptest.NewRecorder(), cancel: func() {}}
+	handleRequest(sw, httptest.NewRequest("GET", "/big", nil))
+	if !bytes.Equal(sw.Body.Bytes(), big) {
+		t.Fatalf("wrote %d bytes, want the %d cached", sw.Body.Len(), len(big))
+	}
+	// no flush is needed after the last chunk
+	if sw.writes != 4 || sw.flushes != 3 {
+		t.Fatalf("%d writes and %d flushes, want 4 and 3", sw.writes, sw.flushes)
+	}
+}
+
+func TestWriteChunkBytesIsChecked(t *testing.T) {
+	if out := startupError(t, "--origin=http://origin.test", "--write-chunk-bytes=0"); !strings.Contains(out, "Error: --write-chunk-bytes must be positive") {
+		t.Fatal(out)
+	}
+}